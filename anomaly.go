@@ -0,0 +1,361 @@
+/*
+	Description:
+		Keeps a rolling history of past results and flags hosts and
+		subnets whose traffic is far above their usual level
+*/
+
+package qreader
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+// number of past periods kept in the history directory
+var HistoryLen int = 14
+
+// fewest past periods needed before anything is flagged
+var MinBaselinePeriods int = 3
+
+// fewest bytes a host or subnet with no traffic in its baseline needs to
+// be flagged, so that the first few packets of a new host aren't
+var AnomalyMinBytes int64 = 1 << 20
+
+//--------------------------------------------------------------------------------
+//	rolling history of saved results
+//--------------------------------------------------------------------------------
+
+/*
+	function to list the state files in a history directory, oldest first
+*/
+func historyFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+/*
+	function to load the most recent results from a history directory
+*/
+func LoadHistory(dir string) ([]Result, error) {
+	files, err := historyFiles(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > HistoryLen {
+		files = files[len(files)-HistoryLen:]
+	}
+
+	history := make([]Result, 0, len(files))
+	for _, filename := range files {
+		result, err := LoadState(filename)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, result)
+	}
+	return history, nil
+}
+
+/*
+	function to add a result to a history directory and drop the periods
+	that have fallen out of the rolling window
+*/
+func AppendHistory(dir string, result Result) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + ".json"
+	if err := SaveState(filepath.Join(dir, name), result); err != nil {
+		return err
+	}
+
+	files, err := historyFiles(dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > HistoryLen {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+//--------------------------------------------------------------------------------
+//	Baseline class holding the usual traffic level of each host and subnet
+//--------------------------------------------------------------------------------
+
+type Stat struct {
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+}
+
+func (self Stat) Std() float64 {
+	return math.Sqrt(self.Variance)
+}
+
+type Baseline struct {
+	Periods int             `json:"periods"`
+	Hosts   map[string]Stat `json:"hosts"`
+	Subnets map[string]Stat `json:"subnets"`
+}
+
+/*
+	function to compute the mean and sample variance of each key over a
+	number of periods, counting the periods a key is missing from as zero
+*/
+func statsOf(periods []map[string]int64) map[string]Stat {
+	sums := make(map[string]float64)
+	for _, totals := range periods {
+		for k, v := range totals {
+			sums[k] += float64(v)
+		}
+	}
+
+	n := float64(len(periods))
+	stats := make(map[string]Stat, len(sums))
+	for k, sum := range sums {
+		mean := sum / n
+		var squares float64
+		for _, totals := range periods {
+			d := float64(totals[k]) - mean
+			squares += d * d
+		}
+		stats[k] = Stat{mean, squares / math.Max(n-1, 1)}
+	}
+	return stats
+}
+
+/*
+	function to build a baseline from a set of past results
+*/
+func BuildBaseline(history []Result) Baseline {
+	hosts := make([]map[string]int64, len(history))
+	subnets := make([]map[string]int64, len(history))
+	for i, result := range history {
+		hosts[i] = result.Hosts
+		subnets[i] = SubnetTotals(result.Hosts)
+	}
+	return Baseline{len(history), statsOf(hosts), statsOf(subnets)}
+}
+
+/*
+	function to save a baseline learned from a set of normal periods, so
+	that later runs can be scored against it with -baseline
+*/
+func SaveBaseline(filename string, baseline Baseline) error {
+	file, err := CreateOutput(filename)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(baseline); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
+
+/*
+	function to read a baseline back from a file written by SaveBaseline
+*/
+func LoadBaseline(filename string) (Baseline, error) {
+	var baseline Baseline
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return baseline, err
+	}
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return baseline, fmt.Errorf("invalid baseline file %v: %v", filename, err)
+	}
+	return baseline, nil
+}
+
+/*
+	function to run the baseline command with its own options, the
+	arguments following qreader baseline. Each input is one normal
+	period, such as a day, summed on its own
+*/
+func BaselineMain(args []string) {
+	flags := flag.NewFlagSet("qreader baseline", flag.ExitOnError)
+	var input_files fileList
+	flags.Var(&input_files, "f", "the file of one period, or a glob pattern, repeated for more files (which may also follow as arguments)")
+	var output = flags.String("o", "", "file the baseline is written to, for qreader -baseline")
+	var bsize = flags.Int("b", 1<<20, "specify the blocksize to be used in filereading")
+	var format = flags.String("format", "auto", "format of the inputs: tsv, zeek-json, csv, ndjson, or auto to detect it from their first lines")
+	var exclude = flags.String("exclude", "", "csv file of name,kind,value rules for expected bulk traffic left out of the baseline, as in the runs it scores")
+	var debugging = flags.Bool("d", false, "enable debug messages")
+	flags.Parse(args)
+
+	LogInit(*debugging)
+	if len(input_files) == 0 {
+		Error.Fatalln("qreader baseline requires -f")
+	}
+	if *output == "" {
+		Error.Fatalln("qreader baseline requires -o")
+	}
+	if *bsize <= 0 {
+		Error.Fatalf("Invalid block size given: %d", *bsize)
+	}
+	if err := CheckOutputs(*output); err != nil {
+		Error.Fatalln(err)
+	}
+	input_format, err := parse.ParseFormat(*format)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	filenames, err := ExpandInputs(append([]string(input_files), flags.Args()...))
+	if err != nil {
+		Error.Fatalln(err)
+	}
+
+	settings := Defaults()
+	switch input_format {
+	case parse.FormatRegex:
+		Error.Fatalln("qreader baseline can't read -format regex")
+	case parse.FormatAuto, parse.FormatCSV:
+		if settings.Schema, err = DetectSchema(filenames, ""); err != nil {
+			Error.Fatalln(err)
+		}
+	default:
+		if err := CheckInputs(filenames); err != nil {
+			Error.Fatalln(err)
+		}
+		settings.Schema = parse.Schema{Format: input_format}
+	}
+	settings.Need = parse.NeedTs | parse.NeedAddrs | parse.NeedBytes
+	if *exclude != "" {
+		if settings.Excludes, err = LoadExclusions(*exclude); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	periods := make([]Result, 0, len(filenames))
+	for _, filename := range filenames {
+		result, err := New(WithSettings(settings), WithBlockSize(*bsize)).Source(filename).Run(context.Background())
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		periods = append(periods, result)
+	}
+	if err := SaveBaseline(*output, BuildBaseline(periods)); err != nil {
+		Error.Fatalln(err)
+	}
+	fmt.Printf("Learned a baseline of %d periods into %v\n", len(periods), *output)
+	if len(periods) < MinBaselinePeriods {
+		Warning.Printf("anomalies are only flagged against %d or more periods", MinBaselinePeriods)
+	}
+}
+
+//--------------------------------------------------------------------------------
+//	anomaly detection
+//--------------------------------------------------------------------------------
+
+// a host or subnet far above its usual traffic. Sigma is infinite for
+// those that had no traffic in the baseline
+type Anomaly struct {
+	Key   string
+	Bytes int64
+	Mean  float64
+	Sigma float64
+}
+
+/*
+	function to find the keys more than sigma standard deviations above
+	their mean. The variance is taken to be at least the mean, as it is
+	for counts, so that a rise over a flat baseline is scored like any
+	other. Keys with no traffic in the stats, including those missing
+	from them, are new and flagged once they reach AnomalyMinBytes
+*/
+func anomaliesOf(totals map[string]int64, stats map[string]Stat, sigma float64) []Anomaly {
+	var found []Anomaly
+	for k, v := range totals {
+		stat := stats[k]
+		if stat.Mean == 0 {
+			if v >= AnomalyMinBytes && v > 0 {
+				found = append(found, Anomaly{k, v, 0, math.Inf(1)})
+			}
+			continue
+		}
+		variance := math.Max(stat.Variance, math.Max(stat.Mean, 1))
+		if z := (float64(v) - stat.Mean) / math.Sqrt(variance); z > sigma {
+			found = append(found, Anomaly{k, v, stat.Mean, z})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Sigma != found[j].Sigma {
+			return found[i].Sigma > found[j].Sigma
+		}
+		if found[i].Bytes != found[j].Bytes {
+			return found[i].Bytes > found[j].Bytes
+		}
+		return found[i].Key < found[j].Key
+	})
+	return found
+}
+
+/*
+	function to find the hosts and subnets of a result whose traffic is
+	more than the given number of standard deviations above the baseline
+*/
+func (self Baseline) Anomalies(result Result, sigma float64) []Anomaly {
+	if self.Periods < MinBaselinePeriods {
+		return nil
+	}
+	found := anomaliesOf(SubnetTotals(result.Hosts), self.Subnets, sigma)
+	return append(found, anomaliesOf(result.Hosts, self.Hosts, sigma)...)
+}
+
+/*
+	function to print the flagged hosts and subnets
+*/
+func AnomalyReport(w io.Writer, anomalies []Anomaly, baseline Baseline) {
+	if baseline.Periods < MinBaselinePeriods {
+		fmt.Fprintf(w, "anomalies: not enough history yet (%d of %d periods)\n", baseline.Periods, MinBaselinePeriods)
+		return
+	}
+	if len(anomalies) == 0 {
+		fmt.Fprintf(w, "anomalies: none over %d periods of history\n", baseline.Periods)
+		return
+	}
+
+	fmt.Fprintf(w, "anomalies over %d periods of history:\n", baseline.Periods)
+	for _, a := range anomalies {
+		sigma := FormatNumber(a.Sigma, 1)
+		if math.IsInf(a.Sigma, 1) {
+			sigma = "new"
+		} else if a.Sigma >= 0 {
+			sigma = "+" + sigma
+		}
+		line := fmt.Sprintf("%18v %12v  usually %12v  %6v sigma", a.Key, HumanBytes(a.Bytes), HumanBytes(int64(a.Mean)), sigma)
+		if label, ok := Labels.Lookup(strings.SplitN(a.Key, "/", 2)[0]); ok {
+			line += "  " + label.String()
+		}
+		fmt.Fprintln(w, line)
+	}
+}
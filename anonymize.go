@@ -0,0 +1,240 @@
+/*
+	Description:
+		Prefix-preserving anonymization of ip addresses (Crypto-PAn) so
+		that reports can be shared outside the organization while still
+		showing which hosts share a subnet
+*/
+
+package qreader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+//--------------------------------------------------------------------------------
+//	Anonymizer class implementing the Crypto-PAn scheme for both ipv4 and
+//	ipv6 addresses
+//--------------------------------------------------------------------------------
+
+type Anonymizer struct {
+	block cipher.Block
+	pad   [16]byte
+}
+
+/*
+	function to create an anonymizer from a 32 byte key, the first half
+	of which keys the cipher and the second half of which is encrypted
+	to produce the padding
+*/
+func NewAnonymizer(key []byte) (*Anonymizer, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("anonymization key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	a := &Anonymizer{block: block}
+	block.Encrypt(a.pad[:], key[16:])
+	return a, nil
+}
+
+/*
+	function to load an anonymization key from a file holding either 32
+	raw bytes or 64 hex characters. With no file a random key is used,
+	which keeps the mapping consistent within a single run only
+*/
+func LoadAnonymizer(filename string) (*Anonymizer, error) {
+	key := make([]byte, 32)
+	if filename == "" {
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return NewAnonymizer(key)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if text := strings.TrimSpace(string(data)); len(text) == 64 {
+		if decoded, err := hex.DecodeString(text); err == nil {
+			return NewAnonymizer(decoded)
+		}
+	}
+	return NewAnonymizer(data)
+}
+
+/*
+	function to anonymize the given address bits. Each output bit is the
+	input bit xor'd with the first bit of the encryption of the input's
+	preceding bits, so addresses sharing a prefix keep sharing it
+*/
+func (self *Anonymizer) anonymize(addr []byte) []byte {
+	nbits := len(addr) * 8
+	out := make([]byte, len(addr))
+	var input, output [16]byte
+
+	for pos := 0; pos < nbits; pos++ {
+		// the first pos bits come from the address, the rest from the pad
+		copy(input[:], self.pad[:])
+		whole := pos / 8
+		copy(input[:whole], addr[:whole])
+		if rem := pos % 8; rem != 0 {
+			mask := byte(0xff) << uint(8-rem)
+			input[whole] = (addr[whole] & mask) | (self.pad[whole] &^ mask)
+		}
+
+		self.block.Encrypt(output[:], input[:])
+		if output[0]&0x80 != 0 {
+			out[pos/8] |= 0x80 >> uint(pos%8)
+		}
+	}
+
+	for i := range out {
+		out[i] ^= addr[i]
+	}
+	return out
+}
+
+/*
+	function to anonymize an ip address string, leaving anything that is
+	not an address untouched
+*/
+func (self *Anonymizer) IP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return net.IP(self.anonymize(v4)).String()
+	}
+	return net.IP(self.anonymize(ip.To16())).String()
+}
+
+/*
+	function to anonymize a link layer address string with the same
+	scheme, so devices from one vendor keep sharing a prefix
+*/
+func (self *Anonymizer) MAC(s string) string {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return s
+	}
+	return net.HardwareAddr(self.anonymize(mac)).String()
+}
+
+/*
+	function to anonymize a report key, which is either an address or a
+	network in cidr notation. Since the scheme preserves prefixes, the
+	anonymized network is the masked anonymization of its address
+*/
+func (self *Anonymizer) Key(s string) string {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return self.IP(s)
+	}
+	anon := net.ParseIP(self.IP(network.IP.String()))
+	masked := net.IPNet{IP: anon.Mask(network.Mask), Mask: network.Mask}
+	return masked.String()
+}
+
+/*
+	function to anonymize the keys of a set of totals, which are returned
+	as they are by a nil Anonymizer
+*/
+func (self *Anonymizer) Totals(totals map[string]int64) map[string]int64 {
+	if self == nil || totals == nil {
+		return totals
+	}
+	anon := make(map[string]int64, len(totals))
+	for key, bytecount := range totals {
+		anon[self.Key(key)] += bytecount
+	}
+	return anon
+}
+
+/*
+	function to produce a copy of a result with every host anonymized
+*/
+func (self *Anonymizer) Result(result Result) Result {
+	anon := Result{Hosts: make(map[string]int64), Buckets: result.Buckets, Services: result.Services, Excluded: result.Excluded,
+		Countries: result.Countries, Segments: result.Segments, Users: result.Users, Tags: result.Tags, Directions: result.Directions, First: result.First, Last: result.Last}
+	if result.Convs != nil {
+		anon.Convs = make(map[string]int64)
+		for pair, bytecount := range result.Convs {
+			a, b := SplitConvKey(pair)
+			anon.Convs[ConvKey(self.IP(a), self.IP(b))] += bytecount
+		}
+	}
+	if result.Remotes != nil {
+		anon.Remotes = make(map[string]int64)
+		for ip, bytecount := range result.Remotes {
+			anon.Remotes[self.IP(ip)] += bytecount
+		}
+	}
+	if result.SubnetBuckets != nil {
+		anon.SubnetBuckets = make(map[string]map[int64]int64)
+		for subnet, buckets := range result.SubnetBuckets {
+			anon.SubnetBuckets[self.Key(subnet)] = buckets
+		}
+	}
+	if result.Sent != nil {
+		anon.Sent = make(map[string]int64)
+	}
+	if result.MACs != nil {
+		anon.MACs = make(map[string]int64)
+		for mac, bytecount := range result.MACs {
+			anon.MACs[self.MAC(mac)] += bytecount
+		}
+	}
+	if result.Ports != nil {
+		anon.Conns = make(map[string]int64)
+		anon.Ports = make(map[string]map[int]int64)
+	}
+
+	// the names of the external hosts are kept, their addresses aren't
+	if result.RemoteNames != nil {
+		anon.RemoteNames = make(map[string]string)
+		for ip, name := range result.RemoteNames {
+			anon.RemoteNames[self.IP(ip)] = name
+		}
+	}
+	if result.Destinations != nil {
+		anon.Destinations = make(map[string]int64)
+		for key, bytecount := range result.Destinations {
+			anon.Destinations[self.IP(key)] += bytecount
+		}
+	}
+
+	if result.Tenants != nil {
+		anon.Tenants = make(map[string]map[string]int64)
+		for name, hosts := range result.Tenants {
+			anon.Tenants[name] = make(map[string]int64)
+			for ip, bytecount := range hosts {
+				anon.Tenants[name][self.Key(ip)] += bytecount
+			}
+		}
+	}
+
+	// the hosts may be normalized to networks, see KeyNormalizer
+	for ip, bytecount := range result.Hosts {
+		key := self.Key(ip)
+		anon.Hosts[key] += bytecount
+		if result.Sent != nil {
+			anon.Sent[key] += result.Sent[ip]
+		}
+		if result.Ports != nil {
+			anon.Conns[key] = result.Conns[ip]
+			anon.Ports[key] = result.Ports[ip]
+		}
+	}
+	return anon
+}
@@ -0,0 +1,121 @@
+/*
+	Description:
+		TLS and bearer token authentication for the report server and
+		the coordinator, since their results give away the addressing
+		of the internal network, and the matching client side for the
+		workers
+*/
+
+package qreader
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// the certificate and key the servers use for https, plain http when
+// not given
+var TLSCert string = ""
+var TLSKey string = ""
+
+// the token clients must present, no authentication when empty
+var AuthToken string = ""
+
+// the client the workers talk to the coordinator with, see NewClient
+var Client = http.DefaultClient
+
+/*
+	function to read a token from a file, trimmed of surrounding space so
+	that the newline editors end files with doesn't become part of it
+*/
+func ReadToken(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%v holds no token", filename)
+	}
+	return token, nil
+}
+
+/*
+	handler wrapper turning away requests without the token, given as a
+	bearer token in the Authorization header or, for browsers and
+	EventSource clients which can't set headers, as the token query
+	parameter
+*/
+func RequireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			given = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="qreader"`)
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	function to serve requests on the server's address, over https when
+	TLSCert is set
+*/
+func ListenAndServe(server *http.Server) error {
+	if TLSCert != "" {
+		return server.ListenAndServeTLS(TLSCert, TLSKey)
+	}
+	return server.ListenAndServe()
+}
+
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (self tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+self.token)
+	return self.next.RoundTrip(r)
+}
+
+/*
+	function to make a client that presents the token, if any, and also
+	trusts the certificates in the pem file ca, if given, such as the
+	self signed certificate of a coordinator
+*/
+func NewClient(token string, ca string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if ca != "" {
+		data, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%v holds no pem certificates", ca)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	var rt http.RoundTripper = transport
+	if token != "" {
+		rt = tokenTransport{token, transport}
+	}
+	return &http.Client{Transport: rt}, nil
+}
@@ -0,0 +1,159 @@
+/*
+	Description:
+		Caches the results of runs by their inputs and options, so that
+		going back to the same analysis during an investigation doesn't
+		read all of its inputs again
+*/
+
+package qreader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// the options that only change how a result is presented, which runs
+// can differ in and still share a cached result
+var presentationOptions = map[string]bool{
+	"d": true, "top": true, "top-pct": true, "top-per-group": true, "all": true, "no-pager": true,
+	"color": true, "bars": true, "si": true, "iec": true, "locale": true,
+	"serve-report": true, "chart-top": true, "chart-time": true,
+	"cache-dir": true, "timeout": true, "cost": true, "query": true, "queries": true,
+	"throughput-log": true, "manifest": true,
+}
+
+// the options naming files the result is summed with, comma separated
+// for some, whose files are digested like the inputs so that editing one
+// doesn't leave a stale result in the cache
+var fileOptions = map[string]bool{
+	"users": true, "tenants": true, "exclude": true, "geoip": true, "tags": true,
+	"dns-log": true, "http-log": true, "public-suffix-list": true,
+}
+
+// how much of the head and the tail of an input goes into its digest
+const digestSpan = 64 * 1024
+
+type ResultCache struct {
+	dir string
+}
+
+/*
+	function to open a result cache in the given directory, creating it
+	if needed
+*/
+func OpenResultCache(dir string) (*ResultCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ResultCache{dir}, nil
+}
+
+/*
+	function to digest an input by its path, size, modification time and
+	the data at its head and tail. Hashing all of it would take as long
+	as the run the cache saves, and logs are only ever appended to or
+	replaced, which changes what is digested
+*/
+func inputDigest(filename string) ([]byte, error) {
+	if filename == StdinName {
+		return nil, fmt.Errorf("the standard input can't be cached")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\x00%d\x00%d\x00", path, info.Size(), info.ModTime().UnixNano())
+	if _, err := io.CopyN(h, file, digestSpan); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if info.Size() > 2*digestSpan {
+		if _, err := file.Seek(-digestSpan, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(h, file); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+/*
+	function to work out the key of a run over the given inputs with the
+	given command line options, those that change how the result is
+	presented left out and the files named by the fileOptions digested
+*/
+func CacheKey(inputs []string, options map[string]string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "qreader %v\x00", Version)
+	for _, filename := range inputs {
+		digest, err := inputDigest(filename)
+		if err != nil {
+			return "", err
+		}
+		h.Write(digest)
+	}
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		if !presentationOptions[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "-%v=%v\x00", name, options[name])
+		if !fileOptions[name] || options[name] == "" {
+			continue
+		}
+		for _, filename := range strings.Split(options[name], ",") {
+			digest, err := inputDigest(filename)
+			if err != nil {
+				return "", err
+			}
+			h.Write(digest)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (self *ResultCache) path(key string) string {
+	return filepath.Join(self.dir, key+".json")
+}
+
+/*
+	function to look up the cached result of a run
+*/
+func (self *ResultCache) Get(key string) (Result, bool) {
+	result, err := LoadState(self.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Warning.Printf("ignoring the cached result: %v", err)
+		}
+		return Result{}, false
+	}
+	return result, true
+}
+
+/*
+	function to keep the result of a run in the cache
+*/
+func (self *ResultCache) Put(key string, result Result) error {
+	return writeState(self.path(key), result)
+}
@@ -0,0 +1,119 @@
+/*
+	Description:
+		Expresses the traffic as a share of the capacity of the link the
+		sensor watches, for each time bucket and over the whole time
+		range of the data, the figure capacity planning works with
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the capacity of the monitored link in bits per second, 0 when unknown
+var LinkCapacity float64 = 0
+
+// multipliers for the unit prefixes accepted by ParseBitRate
+var bitRateUnits = map[string]float64{
+	"":  1,
+	"k": 1e3,
+	"m": 1e6,
+	"g": 1e9,
+	"t": 1e12,
+}
+
+/*
+	function to parse a bit rate such as "10Gbps", "100 Mbit/s" or
+	"1.5g", in bits per second with decimal prefixes
+*/
+func ParseBitRate(s string) (float64, error) {
+	text := strings.ToLower(strings.TrimSpace(s))
+	for _, suffix := range []string{"bit/s", "bits/s", "bps", "b/s", "bit", "b"} {
+		if strings.HasSuffix(text, suffix) {
+			text = strings.TrimSuffix(text, suffix)
+			break
+		}
+	}
+	split := len(text)
+	for split > 0 && (text[split-1] < '0' || text[split-1] > '9') && text[split-1] != '.' {
+		split--
+	}
+
+	unit, ok := bitRateUnits[strings.TrimSpace(text[split:])]
+	value, err := strconv.ParseFloat(strings.TrimSpace(text[:split]), 64)
+	if !ok || err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid bit rate %q", s)
+	}
+	return value * unit, nil
+}
+
+/*
+	function to work out the average use of the link by the given bytes
+	over the given time, as a percentage of its capacity
+*/
+func Utilization(bytes int64, elapsed time.Duration) float64 {
+	if LinkCapacity <= 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / elapsed.Seconds() / LinkCapacity * 100
+}
+
+/*
+	function to format a bit rate with a decimal prefix
+*/
+func HumanBitRate(bps float64) string {
+	for _, unit := range []string{"", "k", "M", "G"} {
+		if bps < 1000 {
+			return FormatNumber(bps, 1) + " " + unit + "bit/s"
+		}
+		bps /= 1000
+	}
+	return FormatNumber(bps, 1) + " Tbit/s"
+}
+
+/*
+	function to print the average utilization of the link over the time
+	range of the data, and in each time bucket when they were kept. The
+	average is of all the traffic seen, which the direction totals count
+	once per connection, or else of the local traffic in the buckets
+*/
+func UtilizationReport(w io.Writer, result Result) {
+	var tbytes int64
+	for _, v := range result.Directions {
+		tbytes += v
+	}
+	if result.Directions == nil {
+		for _, v := range result.Buckets {
+			tbytes += v
+		}
+	}
+
+	elapsed := time.Duration((result.Last - result.First) * float64(time.Second))
+	fmt.Fprintf(w, "link capacity %v\n", HumanBitRate(LinkCapacity))
+	if elapsed <= 0 {
+		fmt.Fprintln(w, "average: the data covers no time")
+	} else {
+		rate := float64(tbytes) * 8 / elapsed.Seconds()
+		fmt.Fprintf(w, "average: %v, %v%% over %v\n", HumanBitRate(rate), FormatNumber(Utilization(tbytes, elapsed), 2), elapsed.Round(time.Second))
+	}
+
+	if BucketSize <= 0 {
+		return
+	}
+	// the first and last buckets are only partly covered by the data
+	for _, window := range Windows(result) {
+		from, to := math.Max(float64(window.Start), result.First), math.Min(float64(window.End), result.Last)
+		size := time.Duration((to - from) * float64(time.Second))
+		if size <= 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%20v %12v %7v%%\n", time.Unix(window.Start, 0).UTC().Format(time.RFC3339),
+			HumanBitRate(float64(window.Bytes)*8/size.Seconds()), FormatNumber(Utilization(window.Bytes, size), 2))
+	}
+}
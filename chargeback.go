@@ -0,0 +1,101 @@
+/*
+	Description:
+		Chargeback report which sums the traffic of each department from
+		the mapping file, for monthly billing of network usage
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io"
+)
+
+// department name used for hosts the mapping file doesn't cover
+const Unassigned = "(unassigned)"
+
+/*
+	function to find the department a host is mapped to
+*/
+func DepartmentOf(ip string) string {
+	if label, ok := Labels.Lookup(ip); ok && label.Department != "" {
+		return label.Department
+	}
+	return Unassigned
+}
+
+/*
+	function to sum the host totals of a result by the department each
+	host is mapped to
+*/
+func Departments(result Result) map[string]int64 {
+	totals := make(map[string]int64)
+	for ip, bytecount := range result.Hosts {
+		totals[DepartmentOf(ip)] += bytecount
+	}
+	return totals
+}
+
+// the chargeback report as a section, measured on the real addresses of
+// the result, see ChargebackReport
+type ChargebackSection struct {
+	Anon *Anonymizer
+}
+
+func (self ChargebackSection) Name() string { return "chargeback" }
+
+func (self ChargebackSection) Render(w io.Writer, result Result) {
+	ChargebackReport(w, result, self.Anon)
+}
+
+/*
+	function to print the per-department totals and their share of all
+	traffic. The departments are found from the real addresses of the
+	result, and its hosts are printed anonymized when anon isn't nil
+*/
+func ChargebackReport(w io.Writer, result Result, anon *Anonymizer) {
+	totals := Departments(result)
+	var tbytes int64
+	for _, v := range totals {
+		tbytes += v
+	}
+
+	// the cost column is only there when rates are given
+	var tcost float64
+	cost := func(bytes int64) string {
+		if Rates == nil {
+			return ""
+		}
+		tcost += Rates.Cost(bytes)
+		return fmt.Sprintf(" %12v", FormatCost(Rates.Cost(bytes)))
+	}
+	head := ""
+	if Rates != nil {
+		head = fmt.Sprintf(" %12v", "cost")
+	}
+
+	var groups map[string]map[string]int64
+	if TopPerGroup > 0 {
+		groups = GroupHosts(result.Hosts, DepartmentOf)
+		for department, hosts := range groups {
+			groups[department] = anon.Totals(hosts)
+		}
+	}
+
+	fmt.Fprintf(w, "%-30v %18v %10v%v\n", "department", "bytes", "share", head)
+	for _, t := range Rank(totals) {
+		var share float64
+		if tbytes > 0 {
+			share = float64(t.Bytes) / float64(tbytes) * 100
+		}
+		fmt.Fprintf(w, "%-30v %18v %10v%v\n", t.Key, FormatCount(t.Bytes), FormatNumber(share, 4)+"%", cost(t.Bytes))
+		if groups != nil {
+			printGroupTop(w, groups[t.Key], 2)
+		}
+	}
+	total := ""
+	if Rates != nil {
+		total = fmt.Sprintf(" %12v", FormatCost(tcost))
+	}
+	fmt.Fprintf(w, "%-30v %18v %10v%v\n", "total", FormatCount(tbytes), FormatNumber(100, 4)+"%", total)
+}
@@ -0,0 +1,356 @@
+/*
+	Description:
+		Renders a bar chart of the top talkers and a traffic-over-time
+		line chart to png or svg images for inclusion in reports
+*/
+
+package qreader
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// number of hosts drawn in the top talker chart
+var ChartTopN int = 10
+
+// size of the chart images
+var ChartWidth int = 800
+var ChartHeight int = 400
+
+var (
+	chartBackground = color.RGBA{255, 255, 255, 255}
+	chartInk        = color.RGBA{34, 34, 34, 255}
+	chartGrid       = color.RGBA{221, 221, 221, 255}
+	chartBar        = color.RGBA{74, 122, 181, 255}
+)
+
+//--------------------------------------------------------------------------------
+//	Canvas interface which lets the same drawing code produce both
+//	raster and vector images
+//--------------------------------------------------------------------------------
+
+type Canvas interface {
+	Rect(x, y, w, h int, c color.RGBA)
+	Line(x1, y1, x2, y2 int, c color.RGBA)
+
+	// draw text with its top edge at y, either starting or ending at x
+	Text(x, y int, s string, right bool)
+	Encode() ([]byte, error)
+}
+
+// a chart is a function that draws itself onto a canvas
+type Chart func(Canvas)
+
+/*
+	function to render a chart to a file, choosing the image format from
+	the file's extension
+*/
+func WriteChart(filename string, chart Chart) error {
+	var canvas Canvas
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png":
+		canvas = newPNGCanvas(ChartWidth, ChartHeight)
+	case ".svg":
+		canvas = newSVGCanvas(ChartWidth, ChartHeight)
+	default:
+		return fmt.Errorf("unsupported chart format for %v, use .png or .svg", filename)
+	}
+
+	chart(canvas)
+	data, err := canvas.Encode()
+	if err != nil {
+		return err
+	}
+	return WriteOutput(filename, data)
+}
+
+//--------------------------------------------------------------------------------
+//	the charts themselves
+//--------------------------------------------------------------------------------
+
+/*
+	function to build a horizontal bar chart of the top talkers
+*/
+func TopChart(result Result) Chart {
+	var total int64
+	for _, v := range result.Hosts {
+		total += v
+	}
+	ranked := Rank(result.Hosts)
+	if len(ranked) > ChartTopN {
+		ranked = ranked[:ChartTopN]
+	}
+
+	return func(c Canvas) {
+		c.Rect(0, 0, ChartWidth, ChartHeight, chartBackground)
+		c.Text(10, 10, fmt.Sprintf("top %d talkers, %v total", len(ranked), HumanBytes(total)), false)
+		if len(ranked) == 0 || ranked[0].Bytes <= 0 {
+			c.Text(10, 30, "no data", false)
+			return
+		}
+
+		left, right, top := 180, ChartWidth-100, 40
+		slot := (ChartHeight - top - 10) / len(ranked)
+		for i, t := range ranked {
+			y := top + i*slot
+			width := int(float64(right-left) * float64(t.Bytes) / float64(ranked[0].Bytes))
+			c.Text(left-10, y+slot/4, t.Key, true)
+			c.Rect(left, y+slot/8, width, slot*3/4, chartBar)
+			c.Text(left+width+6, y+slot/4, fmt.Sprintf("%.2f%%", float64(t.Bytes)/float64(total)*100), false)
+		}
+	}
+}
+
+/*
+	function to build a line chart of the traffic in each time bucket
+*/
+func TimeChart(result Result) Chart {
+	starts := make([]int64, 0, len(result.Buckets))
+	var peak int64
+	for start, v := range result.Buckets {
+		starts = append(starts, start)
+		if v > peak {
+			peak = v
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	return func(c Canvas) {
+		c.Rect(0, 0, ChartWidth, ChartHeight, chartBackground)
+		c.Text(10, 10, fmt.Sprintf("traffic per %v", BucketSize), false)
+		if len(starts) == 0 || peak == 0 {
+			c.Text(10, 30, "no data", false)
+			return
+		}
+
+		left, right, top, bottom := 130, ChartWidth-20, 40, ChartHeight-40
+		for i := 0; i <= 4; i++ {
+			y := bottom - (bottom-top)*i/4
+			c.Line(left, y, right, y, chartGrid)
+			c.Text(left-6, y-7, HumanBytes(peak*int64(i)/4), true)
+		}
+		c.Line(left, top, left, bottom, chartInk)
+		c.Line(left, bottom, right, bottom, chartInk)
+
+		first, last := starts[0], starts[len(starts)-1]
+		x_of := func(start int64) int {
+			if last == first {
+				return left
+			}
+			return left + int(float64(right-left)*float64(start-first)/float64(last-first))
+		}
+		y_of := func(v int64) int {
+			return bottom - int(float64(bottom-top)*float64(v)/float64(peak))
+		}
+
+		for i := 1; i < len(starts); i++ {
+			c.Line(x_of(starts[i-1]), y_of(result.Buckets[starts[i-1]]), x_of(starts[i]), y_of(result.Buckets[starts[i]]), chartBar)
+		}
+		if len(starts) == 1 {
+			c.Rect(left-2, y_of(result.Buckets[first])-2, 5, 5, chartBar)
+		}
+
+		layout := "01-02 15:04"
+		c.Text(left, bottom+10, time.Unix(first, 0).Format(layout), false)
+		c.Text(right, bottom+10, time.Unix(last, 0).Format(layout), true)
+	}
+}
+
+//--------------------------------------------------------------------------------
+//	svg canvas
+//--------------------------------------------------------------------------------
+
+type svgCanvas struct {
+	buf bytes.Buffer
+}
+
+func newSVGCanvas(width, height int) *svgCanvas {
+	c := &svgCanvas{}
+	fmt.Fprintf(&c.buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", width, height, width, height)
+	return c
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (self *svgCanvas) Rect(x, y, w, h int, c color.RGBA) {
+	fmt.Fprintf(&self.buf, `<rect x="%d" y="%d" width="%d" height="%d" fill="%v"/>`+"\n", x, y, w, h, svgColor(c))
+}
+
+func (self *svgCanvas) Line(x1, y1, x2, y2 int, c color.RGBA) {
+	fmt.Fprintf(&self.buf, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%v" stroke-width="2"/>`+"\n", x1, y1, x2, y2, svgColor(c))
+}
+
+func (self *svgCanvas) Text(x, y int, s string, right bool) {
+	anchor := "start"
+	if right {
+		anchor = "end"
+	}
+	var escaped bytes.Buffer
+	for _, r := range s {
+		switch r {
+		case '<':
+			escaped.WriteString("&lt;")
+		case '>':
+			escaped.WriteString("&gt;")
+		case '&':
+			escaped.WriteString("&amp;")
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	fmt.Fprintf(&self.buf, `<text x="%d" y="%d" font-family="monospace" font-size="13" fill="%v" text-anchor="%v" dominant-baseline="hanging">%v</text>`+"\n",
+		x, y, svgColor(chartInk), anchor, escaped.String())
+}
+
+func (self *svgCanvas) Encode() ([]byte, error) {
+	self.buf.WriteString("</svg>\n")
+	return self.buf.Bytes(), nil
+}
+
+//--------------------------------------------------------------------------------
+//	png canvas, using a small built-in bitmap font for the labels
+//--------------------------------------------------------------------------------
+
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func newPNGCanvas(width, height int) *pngCanvas {
+	return &pngCanvas{image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+func (self *pngCanvas) Rect(x, y, w, h int, c color.RGBA) {
+	draw.Draw(self.img, image.Rect(x, y, x+w, y+h), &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+func (self *pngCanvas) Line(x1, y1, x2, y2 int, c color.RGBA) {
+	// bresenham, drawn two pixels wide to match the svg stroke
+	dx, dy := abs(x2-x1), -abs(y2-y1)
+	sx, sy := 1, 1
+	if x1 > x2 {
+		sx = -1
+	}
+	if y1 > y2 {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		self.img.SetRGBA(x1, y1, c)
+		self.img.SetRGBA(x1, y1+1, c)
+		if x1 == x2 && y1 == y2 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x1 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y1 += sy
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// glyphs are drawn at twice their size, with a pixel of spacing
+const glyphScale = 2
+const glyphAdvance = 6 * glyphScale
+
+func (self *pngCanvas) Text(x, y int, s string, right bool) {
+	if right {
+		x -= len(s) * glyphAdvance
+	}
+	for _, r := range s {
+		glyph, ok := font5x7[r]
+		if !ok {
+			glyph = font5x7['?']
+		}
+		for row, bits := range glyph {
+			for col, bit := range bits {
+				if bit == '#' {
+					self.Rect(x+col*glyphScale, y+row*glyphScale, glyphScale, glyphScale, chartInk)
+				}
+			}
+		}
+		x += glyphAdvance
+	}
+}
+
+func (self *pngCanvas) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, self.img)
+	return buf.Bytes(), err
+}
+
+var font5x7 = map[rune][7]string{
+	' ': {".....", ".....", ".....", ".....", ".....", ".....", "....."},
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"#####", "...#.", "..#..", "...#.", "....#", "#...#", ".###."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "...#.", ".##.."},
+	'a': {".....", ".....", ".###.", "....#", ".####", "#...#", ".####"},
+	'b': {"#....", "#....", "#.##.", "##..#", "#...#", "#...#", "####."},
+	'c': {".....", ".....", ".###.", "#....", "#....", "#...#", ".###."},
+	'd': {"....#", "....#", ".##.#", "#..##", "#...#", "#...#", ".####"},
+	'e': {".....", ".....", ".###.", "#...#", "#####", "#....", ".###."},
+	'f': {"..##.", ".#..#", ".#...", "###..", ".#...", ".#...", ".#..."},
+	'g': {".....", ".####", "#...#", "#...#", ".####", "....#", ".###."},
+	'h': {"#....", "#....", "#.##.", "##..#", "#...#", "#...#", "#...#"},
+	'i': {"..#..", ".....", ".##..", "..#..", "..#..", "..#..", ".###."},
+	'j': {"...#.", ".....", "..##.", "...#.", "...#.", "#..#.", ".##.."},
+	'k': {"#....", "#....", "#..#.", "#.#..", "##...", "#.#..", "#..#."},
+	'l': {".##..", "..#..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'm': {".....", ".....", "##.#.", "#.#.#", "#.#.#", "#...#", "#...#"},
+	'n': {".....", ".....", "#.##.", "##..#", "#...#", "#...#", "#...#"},
+	'o': {".....", ".....", ".###.", "#...#", "#...#", "#...#", ".###."},
+	'p': {".....", ".....", "####.", "#...#", "####.", "#....", "#...."},
+	'q': {".....", ".....", ".##.#", "#..##", ".####", "....#", "....#"},
+	'r': {".....", ".....", "#.##.", "##..#", "#....", "#....", "#...."},
+	's': {".....", ".....", ".###.", "#....", ".###.", "....#", "####."},
+	't': {".#...", ".#...", "###..", ".#...", ".#...", ".#..#", "..##."},
+	'u': {".....", ".....", "#...#", "#...#", "#...#", "#..##", ".##.#"},
+	'v': {".....", ".....", "#...#", "#...#", "#...#", ".#.#.", "..#.."},
+	'w': {".....", ".....", "#...#", "#...#", "#.#.#", "#.#.#", ".#.#."},
+	'x': {".....", ".....", "#...#", ".#.#.", "..#..", ".#.#.", "#...#"},
+	'y': {".....", ".....", "#...#", "#...#", ".####", "....#", ".###."},
+	'z': {".....", ".....", "#####", "...#.", "..#..", ".#...", "#####"},
+	'B': {"####.", "#...#", "#...#", "####.", "#...#", "#...#", "####."},
+	'G': {".###.", "#...#", "#....", "#.###", "#...#", "#...#", ".####"},
+	'K': {"#...#", "#..#.", "#.#..", "##...", "#.#..", "#..#.", "#...#"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'T': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "..#.."},
+	'.': {".....", ".....", ".....", ".....", ".....", ".##..", ".##.."},
+	',': {".....", ".....", ".....", ".....", ".##..", "..#..", ".#..."},
+	':': {".....", ".##..", ".##..", ".....", ".##..", ".##..", "....."},
+	'-': {".....", ".....", ".....", "#####", ".....", ".....", "....."},
+	'/': {".....", "....#", "...#.", "..#..", ".#...", "#....", "....."},
+	'%': {"##...", "##..#", "...#.", "..#..", ".#...", "#..##", "...##"},
+	'(': {"...#.", "..#..", ".#...", ".#...", ".#...", "..#..", "...#."},
+	')': {".#...", "..#..", "...#.", "...#.", "...#.", "..#..", ".#..."},
+	'?': {".###.", "#...#", "....#", "...#.", "..#..", ".....", "..#.."},
+}
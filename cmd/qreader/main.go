@@ -0,0 +1,17 @@
+/*
+	Description:
+		The qreader command, a thin wrapper around the qreader package
+		that the stages and the command line options live in. Build it
+		with
+			go build ./cmd/qreader
+*/
+
+package main
+
+import (
+	"github.com/kings-gambit/qreader"
+)
+
+func main() {
+	qreader.Main()
+}
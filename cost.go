@@ -0,0 +1,93 @@
+/*
+	Description:
+		Estimated cost of the traffic at a billing rate per GB, flat or
+		in tiers like cloud egress pricing, for teams that charge the
+		traffic of their subnets and tenants back internally
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the bytes in the GB the rates are given per, decimal like the cloud
+// providers' price lists
+const CostUnit = 1000 * 1000 * 1000
+
+// a rate per GB that applies to the bytes from From on
+type CostTier struct {
+	From  int64
+	PerGB float64
+}
+
+// the tiers of a billing rate, by ascending From and starting at 0
+type CostRates []CostTier
+
+// the rates of the cost column, nil for no cost column
+var Rates CostRates
+
+/*
+	function to parse a billing rate, either one price per GB such as
+	"0.09", or tiers such as "0.09,10TB:0.085,50TB:0.07" where each tier
+	after the first gives the volume its price starts at
+*/
+func ParseCostRates(s string) (CostRates, error) {
+	var rates CostRates
+	for i, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		tier := CostTier{}
+		price := part
+		if i > 0 {
+			from, rest, ok := strings.Cut(part, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid rate tier %q, expected volume:price", part)
+			}
+			var err error
+			if tier.From, err = ParseBytes(from); err != nil {
+				return nil, err
+			}
+			price = rest
+		}
+		var err error
+		tier.PerGB, err = strconv.ParseFloat(strings.TrimSpace(price), 64)
+		if err != nil || tier.PerGB < 0 {
+			return nil, fmt.Errorf("invalid price %q", price)
+		}
+		rates = append(rates, tier)
+	}
+	if !sort.SliceIsSorted(rates, func(i, j int) bool { return rates[i].From < rates[j].From }) {
+		return nil, fmt.Errorf("the tiers of %q are not in ascending order", s)
+	}
+	return rates, nil
+}
+
+/*
+	function to work out the cost of a volume, billing the bytes in each
+	tier at its price. Each subnet or tenant is billed through the tiers
+	on its own, as if it were an account of its own
+*/
+func (self CostRates) Cost(bytes int64) float64 {
+	var cost float64
+	for i, tier := range self {
+		if bytes <= tier.From {
+			break
+		}
+		upto := bytes
+		if i+1 < len(self) && self[i+1].From < bytes {
+			upto = self[i+1].From
+		}
+		cost += float64(upto-tier.From) / CostUnit * tier.PerGB
+	}
+	return cost
+}
+
+/*
+	function to format a cost with two decimals
+*/
+func FormatCost(cost float64) string {
+	return FormatNumber(cost, 2)
+}
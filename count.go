@@ -0,0 +1,155 @@
+/*
+	Description:
+		A counting mode for taking inventory of an archive, run as
+			qreader count -f conn.log.gz
+		It reads the inputs through the whole pipeline but only counts
+		their records, their bytes of traffic and the time they span,
+		without summing anything per host
+*/
+
+package qreader
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+// what a count of some inputs found. Size is of the inputs as they are
+// on disk, Bytes the traffic of their records
+type Inventory struct {
+	Inputs  int
+	Size    int64
+	Records int64
+	Bytes   int64
+	First   float64
+	Last    float64
+}
+
+/*
+	function to count the records of the given inputs, their traffic and
+	the time they span with the given settings
+*/
+func CountInputs(ctx context.Context, settings Settings, filenames []string, opts ...Option) (Inventory, error) {
+	inventory := Inventory{Inputs: len(filenames)}
+	for _, filename := range filenames {
+		if info, err := os.Stat(filename); err == nil {
+			inventory.Size += info.Size()
+		}
+	}
+
+	// each batch is reduced to its time span alone, so the combiner has
+	// no hosts to merge
+	count := func(batch []Conn) *Partial {
+		partial := &Partial{settings: &settings}
+		var bytes int64
+		for _, c := range batch {
+			partial.AddTime(c.Ts)
+			bytes += int64(c.Bytes)
+		}
+		atomic.AddInt64(&inventory.Records, int64(len(batch)))
+		atomic.AddInt64(&inventory.Bytes, bytes)
+		return partial
+	}
+	result, err := New(append(opts, WithSettings(settings))...).Source(filenames...).Reducer(count).Run(ctx)
+	inventory.First, inventory.Last = result.First, result.Last
+	return inventory, err
+}
+
+/*
+	function to print an inventory, with the lines that were rejected and
+	how long it took to count
+*/
+func (self Inventory) Print(w io.Writer, rejected int64, elapsed time.Duration) {
+	fmt.Fprintf(w, "inputs    %v (%v)\n", FormatCount(int64(self.Inputs)), HumanBytes(self.Size))
+	fmt.Fprintf(w, "records   %v\n", FormatCount(self.Records))
+	fmt.Fprintf(w, "rejected  %v\n", FormatCount(rejected))
+	fmt.Fprintf(w, "bytes     %v\n", HumanBytes(self.Bytes))
+	if self.First != 0 {
+		span := time.Duration((self.Last - self.First) * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "first     %v\n", epochString(self.First))
+		fmt.Fprintf(w, "last      %v\n", epochString(self.Last))
+		fmt.Fprintf(w, "span      %v\n", span)
+	}
+	rate := ""
+	if elapsed > 0 {
+		rate = fmt.Sprintf(" (%v/s)", HumanBytes(int64(float64(self.Size)/elapsed.Seconds())))
+	}
+	fmt.Fprintf(w, "elapsed   %v%v\n", elapsed.Round(time.Millisecond), rate)
+}
+
+/*
+	function to run the count command with its own options, the arguments
+	following qreader count
+*/
+func CountMain(args []string) {
+	flags := flag.NewFlagSet("qreader count", flag.ExitOnError)
+	var input_files fileList
+	flags.Var(&input_files, "f", "the file to be counted, or a glob pattern, repeated for more files (which may also follow as arguments)")
+	var bsize = flags.Int("b", 1<<20, "specify the blocksize to be used in filereading")
+	var format = flags.String("format", "auto", "format of the inputs: tsv, zeek-json, csv, ndjson, or auto to detect it from their first lines")
+	var unzip_bench = flags.Bool("unzip-bench", false, "time the installed gzip decompressors on the first .gz input and use the fastest")
+	var debugging = flags.Bool("d", false, "enable debug messages")
+	flags.Parse(args)
+
+	LogInit(*debugging)
+	if len(input_files) == 0 {
+		Error.Fatalln("qreader count requires -f")
+	}
+	if *bsize <= 0 {
+		Error.Fatalf("Invalid block size given: %d", *bsize)
+	}
+	input_format, err := parse.ParseFormat(*format)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	filenames, err := ExpandInputs(append([]string(input_files), flags.Args()...))
+	if err != nil {
+		Error.Fatalln(err)
+	}
+
+	settings := Defaults()
+	settings.Lines = &LineCounts{}
+	if *unzip_bench {
+		for _, filename := range filenames {
+			if !strings.HasSuffix(filename, ".gz") {
+				continue
+			}
+			if settings.Unzipper, _, err = BenchmarkUnzippers(filename); err != nil {
+				Error.Fatalln(err)
+			}
+			Debug.Printf("using %v to decompress the inputs", settings.Unzipper)
+			break
+		}
+	}
+
+	switch input_format {
+	case parse.FormatRegex:
+		Error.Fatalln("qreader count can't read -format regex, run qreader -regex instead")
+	case parse.FormatAuto, parse.FormatCSV:
+		if settings.Schema, err = DetectSchema(filenames, ""); err != nil {
+			Error.Fatalln(err)
+		}
+	default:
+		if err := CheckInputs(filenames); err != nil {
+			Error.Fatalln(err)
+		}
+		settings.Schema = parse.Schema{Format: input_format}
+	}
+	settings.Need = parse.NeedTs | parse.NeedAddrs | parse.NeedBytes
+
+	began := time.Now()
+	inventory, err := CountInputs(context.Background(), settings, filenames, WithBlockSize(*bsize))
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	_, rejected := settings.Lines.Load()
+	inventory.Print(os.Stdout, rejected, time.Since(began))
+}
@@ -0,0 +1,76 @@
+/*
+	Description:
+		Works out how many cpus the process may actually use, taking the
+		cpu quota of a container's cgroup into account
+*/
+
+package qreader
+
+import (
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// where the cgroup v2 and v1 cpu controllers are mounted
+var CgroupRoot string = "/sys/fs/cgroup"
+
+func readCgroupFile(name string) (string, bool) {
+	data, err := ioutil.ReadFile(CgroupRoot + "/" + name)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+/*
+	function to read the cpu quota of the cgroup, as a number of cpus.
+	Returns 0 when there is no quota or it can't be determined
+*/
+func CgroupCPUs() float64 {
+	var quota, period float64
+
+	// cgroup v2 holds "<quota> <period>", with a quota of max for none
+	if line, ok := readCgroupFile("cpu.max"); ok {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0
+		}
+		quota, _ = strconv.ParseFloat(fields[0], 64)
+		period, _ = strconv.ParseFloat(fields[1], 64)
+	} else {
+		// cgroup v1 keeps them in separate files, with -1 for none
+		q, ok1 := readCgroupFile("cpu/cpu.cfs_quota_us")
+		p, ok2 := readCgroupFile("cpu/cpu.cfs_period_us")
+		if !ok1 || !ok2 {
+			return 0
+		}
+		quota, _ = strconv.ParseFloat(q, 64)
+		period, _ = strconv.ParseFloat(p, 64)
+	}
+
+	if quota <= 0 || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+/*
+	function to decide how many cpus to use: the requested number if one
+	was given, otherwise the cgroup quota rounded up, capped by the cpus
+	of the machine
+*/
+func UsableCPUs(requested int) int {
+	if requested > 0 {
+		return requested
+	}
+	cpus := runtime.NumCPU()
+	if quota := CgroupCPUs(); quota > 0 {
+		if limit := int(math.Ceil(quota)); limit < cpus {
+			cpus = limit
+		}
+	}
+	return cpus
+}
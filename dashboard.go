@@ -0,0 +1,278 @@
+/*
+	Description:
+		Small embedded web server that presents the results as an html
+		page with sortable tables and a chart of the top talkers, so
+		they can be shared with a link
+*/
+
+package qreader
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// number of hosts shown in the dashboard table and chart
+var DashboardRows int = 500
+var DashboardBars int = 10
+
+type dashboardRow struct {
+	Rank  int
+	Host  string
+	Bytes int64
+	Share float64
+	Conns int64
+	Width float64
+	Label string
+}
+
+type dashboardPage struct {
+	Total  int64
+	Hosts  int
+	Detail bool
+	Labels bool
+	Rows   []dashboardRow
+	Bars   []dashboardRow
+}
+
+func newDashboardPage(result Result) dashboardPage {
+	page := dashboardPage{Hosts: len(result.Hosts), Detail: result.Conns != nil, Labels: Labels != nil}
+	for _, v := range result.Hosts {
+		page.Total += v
+	}
+
+	ranked := Rank(result.Hosts)
+	for i, t := range ranked {
+		if i >= DashboardRows {
+			break
+		}
+		row := dashboardRow{Rank: i + 1, Host: t.Key, Bytes: t.Bytes, Conns: result.Conns[t.Key]}
+		if label, ok := Labels.Lookup(t.Key); ok {
+			row.Label = label.String()
+		}
+		if page.Total > 0 {
+			row.Share = float64(t.Bytes) / float64(page.Total) * 100
+		}
+		if ranked[0].Bytes > 0 {
+			row.Width = float64(t.Bytes) / float64(ranked[0].Bytes) * 100
+		}
+		page.Rows = append(page.Rows, row)
+		if i < DashboardBars {
+			page.Bars = append(page.Bars, row)
+		}
+	}
+	return page
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"human": HumanBytes,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>qreader report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { padding: 0.25em 0.75em; text-align: right; border-bottom: 1px solid #ddd; }
+th { cursor: pointer; background: #f4f4f4; }
+td.host, th.host { text-align: left; font-family: monospace; }
+.bar { fill: #4a7ab5; }
+.label { font: 12px monospace; }
+</style>
+</head>
+<body>
+<h1>qreader report</h1>
+<p>{{.Hosts}} hosts, {{human .Total}} total</p>
+
+<h2>Top talkers</h2>
+<div>
+{{range .Bars}}<div style="display: flex; align-items: center; margin: 2px 0">
+<span class="label" style="width: 12em">{{.Host}}</span>
+<svg width="480" height="14"><rect class="bar" width="{{printf "%.2f" .Width}}%" height="14"></rect></svg>
+<span class="label" style="margin-left: 0.5em">{{printf "%.2f" .Share}}%</span>
+</div>
+{{end}}</div>
+
+<h2>All hosts</h2>
+<table id="hosts">
+<thead><tr>
+<th data-type="num">#</th>
+<th class="host" data-type="str">host</th>
+<th data-type="num">bytes</th>
+<th data-type="num">share</th>
+{{if .Detail}}<th data-type="num">conns</th>{{end}}
+{{if .Labels}}<th class="host" data-type="str">label</th>{{end}}
+</tr></thead>
+<tbody>
+{{range .Rows}}<tr>
+<td data-value="{{.Rank}}">{{.Rank}}</td>
+<td class="host" data-value="{{.Host}}">{{.Host}}</td>
+<td data-value="{{.Bytes}}">{{human .Bytes}}</td>
+<td data-value="{{.Share}}">{{printf "%.4f" .Share}}%</td>
+{{if $.Detail}}<td data-value="{{.Conns}}">{{.Conns}}</td>{{end}}
+{{if $.Labels}}<td class="host" data-value="{{.Label}}">{{.Label}}</td>{{end}}
+</tr>
+{{end}}</tbody>
+</table>
+
+<script>
+document.querySelectorAll("#hosts th").forEach(function (th, col) {
+	var descending = false;
+	th.addEventListener("click", function () {
+		var body = document.querySelector("#hosts tbody");
+		var rows = Array.prototype.slice.call(body.rows);
+		var numeric = th.dataset.type === "num";
+		descending = !descending;
+		rows.sort(function (a, b) {
+			var x = a.cells[col].dataset.value, y = b.cells[col].dataset.value;
+			var cmp = numeric ? parseFloat(x) - parseFloat(y) : x.localeCompare(y);
+			return descending ? -cmp : cmp;
+		});
+		rows.forEach(function (row) { body.appendChild(row); });
+	});
+});
+</script>
+</body>
+</html>
+`))
+
+/*
+	function to serve the report page, a json copy of the results and
+	the run metadata on the given address, blocking until the server
+	fails. On SIGHUP the reload function is called, if given, and the
+	page is rendered again from the same results, or from the next ones
+	received from updates. Results received from updates, if given,
+	replace the ones served and are pushed to the clients of
+	/results/stream, and the windows of the store, if given, can be
+	queried under /windows/
+*/
+func ServeReport(addr string, result Result, reload func() error, store *WindowStore, updates <-chan WindowEvent) error {
+	var mu sync.RWMutex
+	page := newDashboardPage(result)
+	stream := NewStream()
+
+	if updates != nil {
+		go func() {
+			for update := range updates {
+				mu.Lock()
+				result, page = update.Result, newDashboardPage(update.Result)
+				mu.Unlock()
+				if err := stream.Publish(update); err != nil {
+					Warning.Printf("could not stream window: %v", err)
+				}
+			}
+		}()
+	}
+
+	if reload != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reload(); err != nil {
+					Warning.Printf("could not reload the configuration, keeping the previous one: %v", err)
+					continue
+				}
+				// a replay shows the configuration from its next window
+				if updates == nil {
+					mu.Lock()
+					page = newDashboardPage(result)
+					mu.Unlock()
+				}
+				Info.Println("reloaded the configuration")
+			}
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.RLock()
+		defer mu.RUnlock()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, page); err != nil {
+			Warning.Printf("could not render report: %v", err)
+		}
+	})
+	mux.HandleFunc("/results.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		defer mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Rank(result.Hosts))
+	})
+	mux.HandleFunc("/metadata.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Run)
+	})
+	if updates != nil {
+		mux.Handle("/results/stream", stream)
+	}
+
+	if store != nil {
+		mux.HandleFunc("/windows.json", func(w http.ResponseWriter, r *http.Request) {
+			serveWindows(w, r, store)
+		})
+		mux.HandleFunc("/windows/", func(w http.ResponseWriter, r *http.Request) {
+			serveWindow(w, r, store)
+		})
+	}
+
+	Info.Printf("serving the report on %v", addr)
+	return ListenAndServe(&http.Server{Addr: addr, Handler: Throttle(RequireToken(AuthToken, mux))})
+}
+
+/*
+	handler listing the stored windows, optionally limited to the unix
+	times given by the from and to query parameters
+*/
+func serveWindows(w http.ResponseWriter, r *http.Request, store *WindowStore) {
+	var bounds [2]int64
+	for i, name := range []string{"from", "to"} {
+		if v := r.URL.Query().Get(name); v != "" {
+			var err error
+			if bounds[i], err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %v time %q", name, v), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	windows, err := store.List(bounds[0], bounds[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(windows)
+}
+
+/*
+	handler serving the ranked hosts of the window named by the path,
+	/windows/<start>.json
+*/
+func serveWindow(w http.ResponseWriter, r *http.Request, store *WindowStore) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/windows/"), ".json")
+	start, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	result, err := store.Get(start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Rank(result.Hosts))
+}
@@ -0,0 +1,64 @@
+/*
+	Description:
+		Splits the traffic by which side of the local network each end
+		of a connection is on, the summary asked for before the top
+		talkers: how much came in, went out, stayed inside or merely
+		passed the sensor
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io"
+)
+
+// whether the reducers also total the traffic by direction
+var TrackDirections bool = false
+
+// the directions of a connection, by where its originator and its
+// responder are
+const (
+	Inbound  = "inbound"
+	Outbound = "outbound"
+	Internal = "internal"
+	External = "external"
+)
+
+// the directions in the order they are reported
+var Directions = []string{Inbound, Outbound, Internal, External}
+
+/*
+	function to classify a connection by whether its originator and its
+	responder are local
+*/
+func Direction(orig_local, resp_local bool) string {
+	switch {
+	case orig_local && resp_local:
+		return Internal
+	case orig_local:
+		return Outbound
+	case resp_local:
+		return Inbound
+	}
+	return External
+}
+
+/*
+	function to print the bytes of each direction, including the ones
+	without any traffic
+*/
+func DirectionReport(w io.Writer, result Result) {
+	var tbytes int64
+	for _, v := range result.Directions {
+		tbytes += v
+	}
+	for _, direction := range Directions {
+		bytecount := result.Directions[direction]
+		share := "-"
+		if tbytes > 0 {
+			share = Percent(bytecount, tbytes)
+		}
+		fmt.Fprintf(w, "%9v %10v %v\n", direction, HumanBytes(bytecount), share)
+	}
+}
@@ -0,0 +1,417 @@
+/*
+	Description:
+		Spreads the inputs of a run over several machines. A coordinator
+		hands the files out to worker instances over http, one lease at a
+		time, and merges the result each worker sends back. A file whose
+		lease ran out is handed out again under a new lease, and only the
+		result sent under the current lease of a file is merged, so a
+		worker that was cut off and carries on can't get a file counted
+		twice. Instead of files, the coordinator can hand out partitions
+		of the keys, see partition.go
+*/
+
+package qreader
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often idle workers ask for work again, and how long the
+// coordinator stays up after the last file so they learn it's done
+var WorkerPoll = time.Second
+
+// how many times a file is handed out before the run fails on it
+var MaxAttempts int = 3
+
+// a file, or a partition of the keys of all the inputs, handed to a
+// worker
+type Assignment struct {
+	File      string        `json:"file,omitempty"`
+	Partition string        `json:"partition,omitempty"`
+	Lease     string        `json:"lease"`
+	TTL       time.Duration `json:"ttl"`
+}
+
+type assignment struct {
+	lease    string
+	worker   string
+	expires  time.Time
+	attempts int
+	done     bool
+}
+
+//--------------------------------------------------------------------------------
+//	Coordinator class which hands out the inputs and merges the results
+//--------------------------------------------------------------------------------
+
+type Coordinator struct {
+	mu    sync.Mutex
+	files []string
+	state map[string]*assignment
+	ttl   time.Duration
+
+	// whether the files are the names of key partitions instead
+	partitioned bool
+
+	// prefix of this coordinator's leases, so that a worker left over
+	// from an earlier run can't complete a file of this one
+	token string
+	next  int
+
+	result  Result
+	pending int
+	err     error
+	done    chan struct{}
+}
+
+func NewCoordinator(files []string, ttl time.Duration) (*Coordinator, error) {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	self := &Coordinator{
+		files:   files,
+		state:   make(map[string]*assignment),
+		ttl:     ttl,
+		token:   hex.EncodeToString(token),
+		result:  Result{Hosts: make(map[string]int64)},
+		pending: len(files),
+		done:    make(chan struct{}),
+	}
+	for _, file := range files {
+		self.state[file] = &assignment{}
+	}
+	if self.pending == 0 {
+		close(self.done)
+	}
+	return self, nil
+}
+
+/*
+	function to make a coordinator handing out count partitions of the
+	keys instead of files. Since the partitions are disjoint, merging
+	their results only ever adds keys that aren't there yet
+*/
+func NewPartitionedCoordinator(count int, ttl time.Duration) (*Coordinator, error) {
+	var partitions []string
+	for i := 0; i < count; i++ {
+		partitions = append(partitions, (&Partition{i, count}).String())
+	}
+	self, err := NewCoordinator(partitions, ttl)
+	if err != nil {
+		return nil, err
+	}
+	self.partitioned = true
+	return self, nil
+}
+
+/*
+	function to finish the run, successfully when err is nil. The lock
+	must be held
+*/
+func (self *Coordinator) finish(err error) {
+	if self.pending == 0 || self.err != nil {
+		return
+	}
+	if err != nil {
+		self.err = err
+	} else {
+		self.pending--
+		if self.pending > 0 {
+			return
+		}
+	}
+	close(self.done)
+}
+
+/*
+	function to hand the next file without a live lease to a worker.
+	It returns false once nothing is left to hand out
+*/
+func (self *Coordinator) Claim(worker string) (Assignment, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	now := time.Now()
+	for _, file := range self.files {
+		state := self.state[file]
+		if state.done || (state.lease != "" && now.Before(state.expires)) {
+			continue
+		}
+		if state.lease != "" {
+			Warning.Printf("%v let the lease on %v run out, handing it out again", state.worker, file)
+		}
+		if state.attempts >= MaxAttempts {
+			self.finish(fmt.Errorf("%v failed %d times", file, state.attempts))
+			return Assignment{}, false
+		}
+		self.next++
+		state.lease = self.token + "-" + strconv.Itoa(self.next)
+		state.worker = worker
+		state.expires = now.Add(self.ttl)
+		state.attempts++
+		Debug.Printf("%v is processing %v", worker, file)
+		if self.partitioned {
+			return Assignment{Partition: file, Lease: state.lease, TTL: self.ttl}, true
+		}
+		return Assignment{File: file, Lease: state.lease, TTL: self.ttl}, true
+	}
+	return Assignment{}, false
+}
+
+/*
+	function to find the file a lease is current for, which the lock
+	must be held for
+*/
+func (self *Coordinator) leased(lease string) (string, *assignment) {
+	for file, state := range self.state {
+		if state.lease == lease && !state.done {
+			return file, state
+		}
+	}
+	return "", nil
+}
+
+/*
+	function to extend a lease, failing if it is no longer current
+*/
+func (self *Coordinator) Renew(lease string) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	_, state := self.leased(lease)
+	if state == nil {
+		return false
+	}
+	state.expires = time.Now().Add(self.ttl)
+	return true
+}
+
+/*
+	function to merge the result of a file, if it was sent under the
+	current lease of that file. A lease that ran out but wasn't handed
+	out again is still current
+*/
+func (self *Coordinator) Complete(lease string, result Result) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	file, state := self.leased(lease)
+	if state == nil {
+		return false
+	}
+	state.done = true
+	self.result.Merge(result)
+	Debug.Printf("%v finished %v", state.worker, file)
+	self.finish(nil)
+	return true
+}
+
+/*
+	function to give up a lease after the worker failed on the file, so
+	that it is handed out again
+*/
+func (self *Coordinator) Fail(lease string, reason string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	file, state := self.leased(lease)
+	if state == nil {
+		return
+	}
+	Warning.Printf("%v failed on %v: %v", state.worker, file, reason)
+	state.lease = ""
+}
+
+func (self *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/claim", func(w http.ResponseWriter, r *http.Request) {
+		assignment, ok := self.Claim(r.FormValue("worker"))
+		if !ok {
+			select {
+			case <-self.done:
+				w.WriteHeader(http.StatusGone)
+			default:
+				w.WriteHeader(http.StatusAccepted)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assignment)
+	})
+	mux.HandleFunc("/renew", func(w http.ResponseWriter, r *http.Request) {
+		if !self.Renew(r.FormValue("lease")) {
+			w.WriteHeader(http.StatusConflict)
+		}
+	})
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		var result Result
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !self.Complete(r.FormValue("lease"), result) {
+			w.WriteHeader(http.StatusConflict)
+		}
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		self.Fail(r.FormValue("lease"), r.FormValue("error"))
+	})
+	return mux
+}
+
+/*
+	function to hand the files out to workers from the given address and
+	return their merged results once every file is done. With partitions
+	above 0, each worker processes all the files for one partition of
+	the keys instead
+*/
+func Coordinate(addr string, files []string, partitions int, ttl time.Duration) (Result, error) {
+	var coordinator *Coordinator
+	var err error
+	if partitions > 0 {
+		coordinator, err = NewPartitionedCoordinator(partitions, ttl)
+	} else {
+		coordinator, err = NewCoordinator(files, ttl)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	server := &http.Server{Addr: addr, Handler: Throttle(RequireToken(AuthToken, coordinator.Handler()))}
+	failed := make(chan error, 1)
+	go func() { failed <- ListenAndServe(server) }()
+	fmt.Printf("Coordinating %d inputs on %v\n", len(files), addr)
+
+	select {
+	case err := <-failed:
+		return Result{}, err
+	case <-coordinator.done:
+	}
+
+	// idle workers are told there is nothing left before the server goes
+	time.Sleep(2 * WorkerPoll)
+	server.Close()
+
+	coordinator.mu.Lock()
+	defer coordinator.mu.Unlock()
+	return coordinator.result, coordinator.err
+}
+
+//--------------------------------------------------------------------------------
+//	workers
+//--------------------------------------------------------------------------------
+
+func post(coordinator string, path string, form url.Values, body []byte) (*http.Response, error) {
+	resp, err := Client.Post(coordinator+path+"?"+form.Encode(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+/*
+	function to keep a lease alive until the context is done, cancelling
+	the work if the coordinator says the lease is lost
+*/
+func renewLease(ctx context.Context, cancel func(), coordinator string, assignment Assignment) {
+	ticker := time.NewTicker(assignment.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		resp, err := post(coordinator, "/renew", url.Values{"lease": {assignment.Lease}}, nil)
+		if err != nil {
+			Warning.Printf("could not renew the lease on %v%v: %v", assignment.File, assignment.Partition, err)
+			continue
+		}
+		if resp.StatusCode == http.StatusConflict {
+			Warning.Printf("lost the lease on %v%v, stopping", assignment.File, assignment.Partition)
+			cancel()
+			return
+		}
+	}
+}
+
+/*
+	function to process assignments from the coordinator at the given url
+	until it has none left. Each is passed to process, which must stop
+	when its context is cancelled, and only the files in inputs are
+	accepted since the worker must see them where the coordinator does
+*/
+func RunWorker(coordinator string, name string, inputs []string, process func(ctx context.Context, assignment Assignment) (Result, error)) error {
+	known := make(map[string]bool, len(inputs))
+	for _, filename := range inputs {
+		known[filename] = true
+	}
+
+	for {
+		resp, err := Client.Post(coordinator+"/claim?"+url.Values{"worker": {name}}.Encode(), "", nil)
+		if err != nil {
+			return err
+		}
+		var assignment Assignment
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&assignment)
+		}
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			return err
+		case resp.StatusCode == http.StatusGone:
+			return nil
+		case resp.StatusCode == http.StatusAccepted:
+			time.Sleep(WorkerPoll)
+			continue
+		case resp.StatusCode != http.StatusOK:
+			return fmt.Errorf("%v: %v", coordinator, resp.Status)
+		}
+
+		lease := url.Values{"lease": {assignment.Lease}}
+		if assignment.File != "" && !known[assignment.File] {
+			post(coordinator, "/fail", url.Values{"lease": {assignment.Lease}, "error": {"not among the worker's inputs"}}, nil)
+			return fmt.Errorf("was handed %v, which isn't among the inputs", assignment.File)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go renewLease(ctx, cancel, coordinator, assignment)
+		result, err := process(ctx, assignment)
+		lost := ctx.Err() != nil
+		cancel()
+		if lost {
+			continue
+		}
+		if err != nil {
+			lease.Set("error", err.Error())
+			post(coordinator, "/fail", lease, nil)
+			continue
+		}
+
+		body, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		resp, err = post(coordinator, "/done", lease, body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusConflict {
+			Warning.Printf("%v%v was handed to another worker, discarding this result", assignment.File, assignment.Partition)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+	Description:
+		Names the external hosts of the remotes report after the domains
+		they were resolved from, by stitching the connections to zeek's
+		dns.log: a connection from a local host is named after the query
+		that host most recently had answered with the address it then
+		connected to
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// the loaded resolutions, nil when -dns-log isn't given
+var DNSNames *DNSMap
+
+// a name resolved to an address at a time
+type dnsAnswer struct {
+	name string
+	ts   float64
+}
+
+type DNSMap struct {
+	// the answers each client got for each address, sorted by time
+	answers map[[2]netip.Addr][]dnsAnswer
+}
+
+/*
+	function to remember that a client had name resolved to an address
+*/
+func (self *DNSMap) add(client netip.Addr, address netip.Addr, name string, ts float64) {
+	key := [2]netip.Addr{client.Unmap(), address.Unmap()}
+	self.answers[key] = append(self.answers[key], dnsAnswer{name, ts})
+}
+
+/*
+	function to find the name a client most recently had resolved to an
+	address at or before the given time, and the time it was resolved
+*/
+func (self *DNSMap) Lookup(client netip.Addr, address netip.Addr, ts float64) (string, float64, bool) {
+	if self == nil {
+		return "", 0, false
+	}
+	answers := self.answers[[2]netip.Addr{client.Unmap(), address.Unmap()}]
+	i := sort.Search(len(answers), func(i int) bool { return answers[i].ts > ts })
+	if i == 0 {
+		return "", 0, false
+	}
+	return answers[i-1].name, answers[i-1].ts, true
+}
+
+/*
+	function to load the answers of zeek dns logs, either tab separated
+	with a #fields header or json, and gzipped or not. Answers that
+	aren't addresses, such as the names of CNAME records, are left out
+*/
+func LoadDNS(filenames []string) (*DNSMap, error) {
+	dns := &DNSMap{answers: make(map[[2]netip.Addr][]dnsAnswer)}
+	for _, filename := range filenames {
+		reader, err := Reader{}.OpenFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		err = dns.load(bufio.NewReader(reader))
+		if closed := reader.Close(); err == nil {
+			err = closed
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+	}
+	for _, answers := range dns.answers {
+		sort.SliceStable(answers, func(i, j int) bool { return answers[i].ts < answers[j].ts })
+	}
+	return dns, nil
+}
+
+/*
+	function to load the answers of one dns log
+*/
+func (self *DNSMap) load(r *bufio.Reader) error {
+	return readZeekLog(r, []string{"ts", "id.orig_h", "query", "answers"}, func(values []string) error {
+		ts, err := zeekTime(values[0])
+		if err != nil {
+			return err
+		}
+		if values[2] != "" && values[3] != "" {
+			self.addAnswers(values[1], values[2], strings.Split(values[3], ","), ts)
+		}
+		return nil
+	})
+}
+
+/*
+	function to add the answers of one query, skipping those that aren't
+	addresses
+*/
+func (self *DNSMap) addAnswers(client string, query string, answers []string, ts float64) {
+	ip, err := netip.ParseAddr(client)
+	if err != nil || query == "" {
+		return
+	}
+	for _, answer := range answers {
+		if address, err := netip.ParseAddr(answer); err == nil {
+			self.add(ip, address, query, ts)
+		}
+	}
+}
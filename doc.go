@@ -0,0 +1,23 @@
+/*
+Package qreader sums the traffic of zeek conn logs by host with a
+pipeline of stages, read -> parse -> batch -> reduce -> combine, that
+run concurrently over a shared pool of workers.
+
+A pipeline is assembled with New and its options and run over files or
+streams:
+
+	settings := qreader.Defaults()
+	settings.Local = netip.MustParsePrefix("10.0.0.0/8")
+	result, err := qreader.New(qreader.WithSettings(settings), qreader.WithWorkers(4)).
+		Source("conn.log.gz").
+		Run(ctx)
+
+The parse and reduce stages can be replaced with Parser and Reducer,
+the parsed records copied to channels of the caller's with Tap, and the
+problems found in the inputs and the final result received through
+Warnings and Sink. A pipeline given its Settings with WithSettings
+doesn't read the package level variables the command line options set.
+
+The qreader command in cmd/qreader is a thin wrapper around Main.
+*/
+package qreader
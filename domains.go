@@ -0,0 +1,207 @@
+/*
+	Description:
+		Rolls the names of the destinations report up to their registered
+		domains, the public suffix and one label more, so that the many
+		edge hosts of a service such as rr3.sn-4g5e6nsz.googlevideo.com
+		show up as the one googlevideo.com
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// the public suffixes the domains are found with, see LoadPublicSuffixes
+var PublicSuffixes *SuffixList = ParsePublicSuffixes(strings.NewReader(builtinSuffixes))
+
+// a short list of the suffixes under which names are registered at the
+// second level or deeper, in the format of the public suffix list. Names
+// under other top level domains are registered directly below them
+const builtinSuffixes = `
+// ICANN
+ac.uk
+co.uk
+gov.uk
+ltd.uk
+me.uk
+net.uk
+nhs.uk
+org.uk
+plc.uk
+sch.uk
+com.au
+edu.au
+gov.au
+net.au
+org.au
+co.nz
+net.nz
+org.nz
+ac.jp
+co.jp
+ne.jp
+or.jp
+go.jp
+co.kr
+or.kr
+com.br
+net.br
+org.br
+gov.br
+com.cn
+net.cn
+org.cn
+gov.cn
+edu.cn
+co.in
+net.in
+org.in
+gov.in
+ac.in
+com.mx
+org.mx
+gob.mx
+co.za
+org.za
+gov.za
+com.tr
+gov.tr
+com.sg
+edu.sg
+gov.sg
+com.hk
+edu.hk
+gov.hk
+com.tw
+edu.tw
+gov.tw
+com.ar
+com.co
+com.my
+com.ph
+com.pk
+com.sa
+com.ua
+co.id
+co.il
+co.th
+ac.th
+edu.pl
+com.pl
+
+// private
+amazonaws.com
+cloudfront.net
+azurewebsites.net
+blob.core.windows.net
+appspot.com
+herokuapp.com
+github.io
+netlify.app
+vercel.app
+pages.dev
+workers.dev
+`
+
+// a set of public suffix rules, see https://publicsuffix.org/list/
+type SuffixList struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+/*
+	function to parse a list of public suffixes in the format of the
+	public suffix list: a rule per line, // comments, *. wildcards and !
+	exceptions
+*/
+func ParsePublicSuffixes(r io.Reader) *SuffixList {
+	list := &SuffixList{rules: make(map[string]bool), wildcards: make(map[string]bool), exceptions: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(fields[0])
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			list.exceptions[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			list.wildcards[rule[2:]] = true
+		default:
+			list.rules[rule] = true
+		}
+	}
+	return list
+}
+
+/*
+	function to load the public suffix list from a file, such as
+	public_suffix_list.dat from publicsuffix.org
+*/
+func LoadPublicSuffixes(filename string) (*SuffixList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParsePublicSuffixes(file), nil
+}
+
+/*
+	function to find the public suffix of a name, the longest rule that
+	matches it, or its top level domain when none does
+*/
+func (self *SuffixList) suffix(labels []string) int {
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+		switch {
+		case self.exceptions[name]:
+			return i + 1
+		case self.rules[name]:
+			return i
+		case i > 0 && self.wildcards[name]:
+			return i - 1
+		}
+	}
+	return len(labels) - 1
+}
+
+/*
+	function to find the registered domain of a host name, its public
+	suffix and the label before it. Ports, trailing dots and case are
+	dropped, and addresses and public suffixes are returned as they are
+*/
+func (self *SuffixList) Domain(name string) string {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, err := netip.ParseAddr(name); err == nil {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	i := self.suffix(labels)
+	if i == 0 {
+		return name
+	}
+	return strings.Join(labels[i-1:], ".")
+}
+
+/*
+	function to total the destinations by their registered domains
+*/
+func (self *SuffixList) Rollup(destinations map[string]int64) map[string]int64 {
+	domains := make(map[string]int64, len(destinations))
+	for name, bytecount := range destinations {
+		domains[self.Domain(name)] += bytecount
+	}
+	return domains
+}
@@ -0,0 +1,241 @@
+/*
+	Description:
+		Exports the full aggregation, and optionally every parsed record,
+		to a duckdb database so analysts can keep exploring the data
+		without parsing the logs again
+*/
+
+package qreader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// which command to use for building duckdb databases
+var DuckDB string = "duckdb"
+
+//--------------------------------------------------------------------------------
+//	RecordWriter class which writes the parsed records passing through the
+//	reducers to a csv file
+//--------------------------------------------------------------------------------
+
+type RecordWriter struct {
+	inq  chan []Conn
+	done chan error
+	file io.WriteCloser
+	anon *Anonymizer
+
+	// decides which records are written, nil to write them all
+	keep func(Conn) bool
+}
+
+func NewRecordWriter(filename string, anon *Anonymizer) (*RecordWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordWriter{inq: make(chan []Conn, 100), done: make(chan error, 1), file: file, anon: anon}, nil
+}
+
+func (self *RecordWriter) Start() {
+	w := csv.NewWriter(self.file)
+	w.Write([]string{"ts", "uid", "orig", "orig_port", "resp", "port", "proto", "service",
+		"duration", "state", "history", "orig_pkts", "resp_pkts", "orig_bytes", "resp_bytes", "bytes"})
+
+	// anonymizing is expensive, so each address is only done once
+	seen := make(map[string]string)
+	mask := func(addr netip.Addr) string {
+		ip := addr.String()
+		if self.anon == nil {
+			return ip
+		}
+		anon, ok := seen[ip]
+		if !ok {
+			anon = self.anon.IP(ip)
+			seen[ip] = anon
+		}
+		return anon
+	}
+
+	for data_slice := range self.inq {
+		for _, c := range data_slice {
+			if self.keep != nil && !self.keep(c) {
+				continue
+			}
+			w.Write([]string{
+				strconv.FormatFloat(c.Ts, 'f', 6, 64),
+				c.UID,
+				mask(c.Orig),
+				strconv.Itoa(c.OrigPort),
+				mask(c.Resp),
+				strconv.Itoa(c.Port),
+				c.Proto,
+				c.Service,
+				strconv.FormatFloat(c.Duration, 'f', 6, 64),
+				c.State,
+				c.History,
+				strconv.Itoa(c.OrigPkts),
+				strconv.Itoa(c.RespPkts),
+				strconv.Itoa(c.OrigBytes),
+				strconv.Itoa(c.RespBytes),
+				strconv.Itoa(c.Bytes),
+			})
+		}
+	}
+
+	w.Flush()
+	err := w.Error()
+	if cerr := self.file.Close(); err == nil {
+		err = cerr
+	}
+	self.done <- err
+}
+
+/*
+	function to stop accepting records and wait for them to be written
+*/
+func (self *RecordWriter) Close() error {
+	close(self.inq)
+	return <-self.done
+}
+
+//--------------------------------------------------------------------------------
+//	database export
+//--------------------------------------------------------------------------------
+
+func writeTotals(filename string, header []string, rows [][]string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	w.Write(header)
+	w.WriteAll(rows)
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func talkerRows(tt map[string]int64) [][]string {
+	rows := make([][]string, 0, len(tt))
+	for _, t := range Rank(tt) {
+		if t.Bytes < MinBytes {
+			break
+		}
+		rows = append(rows, []string{t.Key, strconv.FormatInt(t.Bytes, 10)})
+	}
+	return rows
+}
+
+func sqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+/*
+	function to write the aggregation to tables of a duckdb database,
+	along with the raw records from the given csv file if it isn't empty.
+	Hosts and remotes below MinBytes are left out.
+	The tables are staged as csv files and loaded by the duckdb command
+*/
+func ExportDuckDB(filename string, result Result, records string) error {
+	staging, err := ioutil.TempDir("", "qreader-duckdb")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	var sql []string
+	load := func(table string, header []string, columns string, rows [][]string) error {
+		path := filepath.Join(staging, table+".csv")
+		if err := writeTotals(path, header, rows); err != nil {
+			return err
+		}
+		sql = append(sql, fmt.Sprintf("CREATE OR REPLACE TABLE %v AS SELECT * FROM read_csv(%v, header=true, columns={%v});",
+			table, sqlString(path), columns))
+		return nil
+	}
+
+	hosts := make([][]string, 0, len(result.Hosts))
+	for _, t := range Rank(result.Hosts) {
+		if t.Bytes < MinBytes {
+			break
+		}
+		row := []string{t.Key, strconv.FormatInt(t.Bytes, 10), ""}
+		if result.Conns != nil {
+			row[2] = strconv.FormatInt(result.Conns[t.Key], 10)
+		}
+		hosts = append(hosts, row)
+	}
+	if err := load("hosts", []string{"host", "bytes", "conns"}, "'host': 'VARCHAR', 'bytes': 'BIGINT', 'conns': 'BIGINT'", hosts); err != nil {
+		return err
+	}
+
+	if result.Ports != nil {
+		var ports [][]string
+		for host, breakdown := range result.Ports {
+			if result.Hosts[host] < MinBytes {
+				continue
+			}
+			for port, bytecount := range breakdown {
+				ports = append(ports, []string{host, strconv.Itoa(port), strconv.FormatInt(bytecount, 10)})
+			}
+		}
+		if err := load("host_ports", []string{"host", "port", "bytes"}, "'host': 'VARCHAR', 'port': 'INTEGER', 'bytes': 'BIGINT'", ports); err != nil {
+			return err
+		}
+	}
+
+	if result.Remotes != nil {
+		if err := load("remotes", []string{"host", "bytes"}, "'host': 'VARCHAR', 'bytes': 'BIGINT'", talkerRows(result.Remotes)); err != nil {
+			return err
+		}
+	}
+
+	if result.Buckets != nil {
+		var buckets [][]string
+		for start, bytecount := range result.Buckets {
+			buckets = append(buckets, []string{strconv.FormatInt(start, 10), strconv.FormatInt(bytecount, 10)})
+		}
+		if err := load("buckets", []string{"start", "bytes"}, "'start': 'BIGINT', 'bytes': 'BIGINT'", buckets); err != nil {
+			return err
+		}
+	}
+
+	if Run != nil {
+		if err := load("metadata", []string{"key", "value"}, "'key': 'VARCHAR', 'value': 'VARCHAR'", Run.Rows()); err != nil {
+			return err
+		}
+	}
+
+	if records != "" {
+		sql = append(sql, fmt.Sprintf("CREATE OR REPLACE TABLE conns AS SELECT * FROM read_csv(%v, header=true, columns={%v});",
+			sqlString(records), "'ts': 'DOUBLE', 'uid': 'VARCHAR', 'orig': 'VARCHAR', 'orig_port': 'INTEGER', 'resp': 'VARCHAR', 'port': 'INTEGER', "+
+			"'proto': 'VARCHAR', 'service': 'VARCHAR', 'duration': 'DOUBLE', 'state': 'VARCHAR', 'history': 'VARCHAR', "+
+			"'orig_pkts': 'BIGINT', 'resp_pkts': 'BIGINT', 'orig_bytes': 'BIGINT', 'resp_bytes': 'BIGINT', 'bytes': 'BIGINT'"))
+	}
+
+	// the database is built under a temporary name, so an interrupted
+	// export never leaves a half-written one
+	output, err := CreateOutputPath(filename)
+	if err != nil {
+		return err
+	}
+	c := exec.Command(DuckDB, output.Name)
+	c.Stdin = strings.NewReader(strings.Join(sql, "\n") + "\n")
+	if out, err := c.CombinedOutput(); err != nil {
+		output.Abort()
+		return fmt.Errorf("%v failed: %v: %v", DuckDB, err, strings.TrimSpace(string(out)))
+	}
+	return output.Commit()
+}
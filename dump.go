@@ -0,0 +1,113 @@
+/*
+	Description:
+		Writes every aggregated key and its totals to a csv file, so that
+		nothing is lost to the top-N cutoff of the printed report
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// keys with fewer bytes than this are left out of the dump and the
+// database export, 0 keeps them all
+var MinBytes int64 = 0
+
+/*
+	function to write every total of a result to a csv file with the
+	columns
+		kind,key,bytes,conns
+	where conns is only filled in for hosts when per-host detail was
+	kept. Keys below MinBytes are left out, except for the time buckets.
+	The run metadata leads the file as #qreader comment lines. The file
+	is gzip compressed when its name ends in .gz, and otherwise zstd
+	compressed unless CompressOutputs is off, see DumpName
+*/
+func DumpAll(filename string, result Result) error {
+	file, err := CreateOutput(filename)
+	if err != nil {
+		return err
+	}
+	var zw io.WriteCloser
+	if strings.HasSuffix(filename, ".gz") {
+		zw = gzip.NewWriter(file)
+	} else if zw, err = compressOutput(file); err != nil {
+		file.Abort()
+		return err
+	}
+
+	bw := bufio.NewWriter(zw)
+	if Run != nil {
+		for _, row := range Run.Rows() {
+			fmt.Fprintf(bw, "#qreader %v: %v\n", row[0], strings.ReplaceAll(row[1], "\n", " "))
+		}
+	}
+	w := csv.NewWriter(bw)
+	w.Write([]string{"kind", "key", "bytes", "conns"})
+	dump := func(kind string, tt map[string]int64) {
+		for _, t := range Rank(tt) {
+			if t.Bytes < MinBytes && kind != "bucket" {
+				break
+			}
+			w.Write([]string{kind, t.Key, strconv.FormatInt(t.Bytes, 10), ""})
+		}
+	}
+
+	for _, t := range Rank(result.Hosts) {
+		if t.Bytes < MinBytes {
+			break
+		}
+		conns := ""
+		if result.Conns != nil {
+			conns = strconv.FormatInt(result.Conns[t.Key], 10)
+		}
+		w.Write([]string{"host", t.Key, strconv.FormatInt(t.Bytes, 10), conns})
+	}
+	dump("subnet", SubnetTotals(result.Hosts))
+	dump("remote", result.Remotes)
+	dump("conv", result.Convs)
+
+	ports := make(map[string]int64, len(result.Services))
+	for port, bytecount := range result.Services {
+		ports[strconv.Itoa(port)] = bytecount
+	}
+	dump("port", ports)
+
+	buckets := make(map[string]int64, len(result.Buckets))
+	for start, bytecount := range result.Buckets {
+		buckets[strconv.FormatInt(start, 10)] = bytecount
+	}
+	dump("bucket", buckets)
+
+	w.Flush()
+	err = w.Error()
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	if zerr := zw.Close(); err == nil {
+		err = zerr
+	}
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
+
+/*
+	function to find the name a dump is written under, which gains .zst
+	when it is going to be zstd compressed and doesn't say so already
+*/
+func DumpName(filename string) string {
+	if strings.HasSuffix(filename, ".gz") || strings.HasSuffix(filename, ".zst") || !CompressOutputs || !ZstdInstalled() {
+		return filename
+	}
+	return filename + ".zst"
+}
@@ -0,0 +1,102 @@
+/*
+	Description:
+		Lets sites add what they know about their hosts to the parsed
+		records, such as their asset tags in a CMDB, the names DHCP
+		handed them or the ids of their EDR agents, so that the traffic
+		can be grouped and reported by it
+*/
+
+package qreader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// the enrichers of every run, see Enricher
+var Enrichers []Enricher
+
+/*
+	Enricher adds to the records of each batch as they are parsed, before
+	they are sent to the taps and summed. The tags it gives the hosts,
+	Conn.OrigTag and Conn.RespTag, are what the tags report is totalled
+	by. Batches are enriched by several workers at once
+*/
+type Enricher interface {
+	Enrich(batch []Conn)
+}
+
+// a function used as an Enricher
+type EnricherFunc func(batch []Conn)
+
+func (self EnricherFunc) Enrich(batch []Conn) {
+	self(batch)
+}
+
+// the tags of the hosts loaded with -tags, an Enricher
+type TagMap struct {
+	tags map[netip.Addr]string
+}
+
+/*
+	function to load a tags file with the columns
+		address,tag
+	such as an export of a CMDB, of DHCP leases or of the inventory of
+	an EDR. Lines starting with # and a header row are ignored
+*/
+func LoadTags(filename string) (*TagMap, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	tags := &TagMap{tags: make(map[netip.Addr]string)}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) < 2 || strings.TrimSpace(record[1]) == "" {
+			return nil, fmt.Errorf("%v:%d: expected address,tag", filename, line)
+		}
+		ip, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			if row == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		tags.tags[ip.Unmap()] = strings.TrimSpace(record[1])
+	}
+	return tags, nil
+}
+
+/*
+	function to tag the hosts of a batch of records, leaving the tags
+	earlier enrichers gave them
+*/
+func (self *TagMap) Enrich(batch []Conn) {
+	for i := range batch {
+		c := &batch[i]
+		if tag, ok := self.tags[c.Orig.Unmap()]; ok && c.OrigTag == "" {
+			c.OrigTag = tag
+		}
+		if tag, ok := self.tags[c.Resp.Unmap()]; ok && c.RespTag == "" {
+			c.RespTag = tag
+		}
+	}
+}
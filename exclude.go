@@ -0,0 +1,175 @@
+/*
+	Description:
+		Rules for expected bulk traffic, such as backups and internal
+		mirrors, which is left out of the rankings or accounted for on its
+		own so that it doesn't drown out the interesting traffic
+*/
+
+package qreader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+//--------------------------------------------------------------------------------
+//	ExcludeRule matches the connections of one kind of expected traffic
+//--------------------------------------------------------------------------------
+
+type ExcludeRule struct {
+	Name string
+	Kind string
+
+	port    int
+	service string
+	network netip.Prefix
+
+	// hours of the day in utc, from inclusive to exclusive, wrapping
+	// around midnight when from is after to
+	from int
+	to   int
+}
+
+/*
+	function to check whether a connection matches the rule
+*/
+func (self ExcludeRule) Match(c Conn) bool {
+	switch self.Kind {
+	case "port":
+		return c.Port == self.port
+	case "service":
+		return strings.Contains(","+c.Service+",", ","+self.service+",")
+	case "cidr":
+		return self.network.Contains(c.Orig) || self.network.Contains(c.Resp)
+	case "hours":
+		hour := time.Unix(int64(c.Ts), 0).UTC().Hour()
+		if self.from <= self.to {
+			return hour >= self.from && hour < self.to
+		}
+		return hour >= self.from || hour < self.to
+	}
+	return false
+}
+
+// the loaded rules, in the order of the file
+type Exclusions []ExcludeRule
+
+// the rules connections are checked against, nil for none
+var Excludes Exclusions
+
+// whether excluded traffic is totalled by rule rather than dropped
+var TrackExcluded bool = false
+
+/*
+	function to load an exclusion file with the columns
+		name,kind,value
+	where kind is one of
+		port     a responder port, e.g. 873
+		service  a service zeek detected, e.g. rsync
+		cidr     a network either end of the connection is in
+		hours    a range of hours of the day in utc, e.g. 01-05
+	Rows sharing a name add up to one rule that matches if any of them
+	do. Lines starting with # are ignored
+*/
+func LoadExclusions(filename string) (Exclusions, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	var rules Exclusions
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != 3 {
+			return nil, fmt.Errorf("%v:%d: expected name,kind,value", filename, line)
+		}
+
+		rule, err := parseExcludeRule(record[0], record[1], strings.TrimSpace(record[2]))
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseExcludeRule(name, kind, value string) (ExcludeRule, error) {
+	rule := ExcludeRule{Name: name, Kind: kind}
+	var err error
+	switch kind {
+	case "port":
+		if rule.port, err = strconv.Atoi(value); err != nil || rule.port < 0 || rule.port > 65535 {
+			return rule, fmt.Errorf("invalid port %q", value)
+		}
+	case "service":
+		rule.service = value
+	case "cidr":
+		if rule.network, err = parseNetwork(value); err != nil {
+			return rule, err
+		}
+	case "hours":
+		hours := strings.SplitN(value, "-", 2)
+		if len(hours) != 2 {
+			return rule, fmt.Errorf("invalid hours %q, expected from-to", value)
+		}
+		from, err1 := strconv.Atoi(hours[0])
+		to, err2 := strconv.Atoi(hours[1])
+		if err1 != nil || err2 != nil || from < 0 || from > 23 || to < 0 || to > 24 {
+			return rule, fmt.Errorf("invalid hours %q, expected from-to", value)
+		}
+		rule.from, rule.to = from, to
+	default:
+		return rule, fmt.Errorf("unknown rule kind %q, expected port, service, cidr or hours", kind)
+	}
+	return rule, nil
+}
+
+/*
+	function to find the first rule a connection matches
+*/
+func (self Exclusions) Match(c Conn) (string, bool) {
+	for _, rule := range self {
+		if rule.Match(c) {
+			return rule.Name, true
+		}
+	}
+	return "", false
+}
+
+/*
+	function to find the record fields the rules need
+*/
+func (self Exclusions) Need() parse.Need {
+	var need parse.Need
+	for _, rule := range self {
+		switch rule.Kind {
+		case "port":
+			need |= parse.NeedPort
+		case "service":
+			need |= parse.NeedService
+		case "hours":
+			need |= parse.NeedTs
+		}
+	}
+	return need
+}
@@ -0,0 +1,53 @@
+/*
+	Description:
+		Streams the parsed records of an input to a callback, for callers
+		that want the fast parsing without any of the aggregation
+*/
+
+package qreader
+
+import (
+	"context"
+)
+
+/*
+	function to call fn with every record parsed from the source file.
+	The parsing runs in parallel, but fn is only ever called from one
+	goroutine at a time, with the records in no particular order. An
+	error from fn, or the context being cancelled, stops the reading and
+	is returned
+*/
+func ForEachConn(ctx context.Context, source string, fn func(c Conn) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tap := make(chan []Conn, 100)
+	done := make(chan error, 1)
+	go func() {
+		var failed error
+		for data_slice := range tap {
+			if failed != nil {
+				continue
+			}
+			for _, c := range data_slice {
+				if err := fn(c); err != nil {
+					failed = err
+					cancel()
+					break
+				}
+			}
+		}
+		done <- failed
+	}()
+
+	// the records only pass through the tap, so nothing is summed
+	_, err := New().Source(source).Tap(tap).Reducer(func([]Conn) *Partial {
+		return &Partial{}
+	}).Run(ctx)
+	close(tap)
+
+	if failed := <-done; failed != nil {
+		return failed
+	}
+	return err
+}
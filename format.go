@@ -0,0 +1,74 @@
+/*
+	Description:
+		Works out the format of the inputs from their heads, so that
+		-format only needs to be given when the detection can't tell
+*/
+
+package qreader
+
+import (
+	"fmt"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+/*
+	function to read the head of an input, failing if it is clearly not
+	a connection log
+*/
+func probe(filename string) ([]byte, error) {
+	head, err := Reader{}.readHead(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	if err := parse.Sniff(head); err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	return head, nil
+}
+
+/*
+	function to check that none of the inputs is clearly something other
+	than a connection log, for when their format is given rather than
+	detected
+*/
+func CheckInputs(filenames []string) error {
+	for _, filename := range filenames {
+		if _, err := probe(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	function to detect the format of each input, failing when it can't be
+	told or when the inputs don't all share one layout. The segment of
+	each connection is read from the named column, if one is given
+*/
+func DetectSchema(filenames []string, segment string) (parse.Schema, error) {
+	var schema parse.Schema
+	for i, filename := range filenames {
+		head, err := probe(filename)
+		if err != nil {
+			return schema, err
+		}
+
+		found, err := parse.Detect(head)
+		if err != nil {
+			return schema, fmt.Errorf("%v: %v, give the format with -format", filename, err)
+		}
+		if segment != "" {
+			if found, err = found.WithSegment(segment); err != nil {
+				return schema, fmt.Errorf("%v: %v", filename, err)
+			}
+		}
+		Debug.Printf("\t%v is %v", filename, found.Format)
+		if i > 0 && !found.Same(schema) {
+			return schema, fmt.Errorf("%v and %v are laid out differently (%v and %v), the inputs must share one format",
+				filenames[0], filename, schema.Format, found.Format)
+		}
+		schema = found
+	}
+	return schema, nil
+}
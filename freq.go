@@ -0,0 +1,62 @@
+/*
+	Description:
+		A frequency table of the values of one column of the inputs, for
+		quick questions such as which services appear in a capture. It is
+		run as
+			qreader -f conn.log -freq service
+		and counts the records through the parallel pipeline, reading the
+		column the way a segment column is read
+*/
+
+package qreader
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+/*
+	function to count the records of the given inputs by their value of a
+	column, which the schema of the settings must read as the segment,
+	see parse.Schema.WithSegment. Records without a value are counted as
+	-, as zeek writes them
+*/
+func CountValues(ctx context.Context, settings Settings, filenames []string, opts ...Option) (map[string]int64, error) {
+	settings.TrackSegments = true
+	count := func(batch []Conn) *Partial {
+		partial := &Partial{segments: make(map[string]int64), settings: &settings}
+		for _, c := range batch {
+			value := c.Segment
+			if value == "" {
+				value = "-"
+			}
+			partial.segments[value]++
+		}
+		return partial
+	}
+	result, err := New(append(opts, WithSettings(settings))...).Source(filenames...).Reducer(count).Run(ctx)
+	return result.Segments, err
+}
+
+/*
+	function to print a frequency table of the values of a column, the
+	most frequent first, with the number of records of each value and
+	their share of all of them
+*/
+func PrintFrequencies(w io.Writer, column string, counts map[string]int64) {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	ranked := topRows(Rank(counts))
+	width := len(column)
+	for _, t := range ranked {
+		width = max(width, len(t.Key))
+	}
+	fmt.Fprintln(w, Heading(fmt.Sprintf("%-*v %12v %9v", width, column, "records", "share")))
+	for _, t := range ranked {
+		fmt.Fprintf(w, "%-*v %12v %9v\n", width, t.Key, FormatCount(t.Bytes), Percent(t.Bytes, total))
+	}
+	fmt.Fprintf(w, "\n%v distinct values in %v records\n", FormatCount(int64(len(counts))), FormatCount(total))
+}
@@ -0,0 +1,122 @@
+/*
+	Description:
+		Looks up the country of external hosts in a geoip table, so that
+		the traffic leaving the network can be totalled per destination
+		country for data sovereignty reviews
+*/
+
+package qreader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// key of the hosts the geoip table has no country for
+const UnknownCountry = "??"
+
+// the loaded geoip table, nil when -geoip isn't given
+var Geo *GeoDB
+
+type GeoDB struct {
+	countries map[netip.Prefix]string
+
+	// the distinct prefix lengths in the table, longest first
+	bits []int
+}
+
+/*
+	function to load a geoip table with the columns
+		network,country
+	where the network is in cidr notation and the country is a code such
+	as NL. Tables in this form can be made from the csv editions of the
+	common geoip databases. Lines starting with # and a header row are
+	ignored
+*/
+func LoadGeoIP(filename string) (*GeoDB, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	db := &GeoDB{countries: make(map[netip.Prefix]string)}
+	seen := make(map[int]bool)
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != 2 {
+			return nil, fmt.Errorf("%v:%d: expected network,country", filename, line)
+		}
+
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			if row == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		prefix = prefix.Masked()
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		db.countries[prefix] = strings.ToUpper(strings.TrimSpace(record[1]))
+		if !seen[prefix.Bits()] {
+			seen[prefix.Bits()] = true
+			db.bits = append(db.bits, prefix.Bits())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(db.bits)))
+	return db, nil
+}
+
+/*
+	function to find the country of the most specific network in the
+	table containing the given address
+*/
+func (self *GeoDB) Lookup(ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	for _, bits := range self.bits {
+		if bits > ip.BitLen() {
+			continue
+		}
+		prefix, _ := ip.Prefix(bits)
+		if country, ok := self.countries[prefix]; ok {
+			return country, true
+		}
+	}
+	return "", false
+}
+
+/*
+	function to total the bytes of external hosts per country, with the
+	hosts that aren't in the table under UnknownCountry
+*/
+func (self *GeoDB) Totals(remotes map[string]int64) map[string]int64 {
+	totals := make(map[string]int64)
+	for s, bytecount := range remotes {
+		country := UnknownCountry
+		if ip, err := netip.ParseAddr(s); err == nil {
+			if c, ok := self.Lookup(ip); ok {
+				country = c
+			}
+		}
+		totals[country] += bytecount
+	}
+	return totals
+}
@@ -0,0 +1,82 @@
+/*
+	Description:
+		Expansion of glob patterns in the names of the inputs, so that a
+		day of rotated logs can be selected with -f 'conn.*.log.gz' where
+		the shell running qreader doesn't expand patterns, as from cron,
+		and the walking of the directory trees of log archives given with
+		-dir
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	function to replace each input name that is a glob pattern with the
+	files it matches, in the order of their names. A name that is an
+	existing file is kept as it is even if it holds pattern characters,
+	and a pattern matching nothing is an error
+*/
+func ExpandInputs(filenames []string) ([]string, error) {
+	var expanded []string
+	for _, filename := range filenames {
+		if !strings.ContainsAny(filename, "*?[") {
+			expanded = append(expanded, filename)
+			continue
+		}
+		if _, err := os.Stat(filename); err == nil {
+			expanded = append(expanded, filename)
+			continue
+		}
+		matches, err := filepath.Glob(filename)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %v: %v", filename, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no inputs match %v", filename)
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+/*
+	function to list the files under a directory tree whose names end in
+	one of the given extensions, such as .gz or .log, or all the files
+	when none are given, in the order of their paths. A tree holding no
+	such files is an error
+*/
+func WalkInputs(dir string, exts []string) ([]string, error) {
+	var found []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		for _, ext := range exts {
+			if strings.HasSuffix(entry.Name(), ext) {
+				found = append(found, path)
+				return nil
+			}
+		}
+		if len(exts) == 0 {
+			found = append(found, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no inputs found under %v", dir)
+	}
+	return found, nil
+}
@@ -0,0 +1,3 @@
+module github.com/kings-gambit/qreader
+
+go 1.21
@@ -0,0 +1,71 @@
+/*
+	Description:
+		Attributes the traffic of the local hosts to the names of the
+		services they reached, from the Host header of zeek's http.log
+		and the SNI of its ssl.log, joined to the connections by their
+		uid. Services hosted behind a CDN share its addresses, so their
+		names tell them apart where the addresses can't
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+)
+
+// the loaded names, nil when -http-log isn't given
+var HostNames *HostNameMap
+
+type HostNameMap struct {
+	// the name of the service each connection reached, by uid
+	names map[string]string
+}
+
+/*
+	function to load the Host headers of zeek http logs and the server
+	names of ssl logs, either tab separated with a #fields header or
+	json, and gzipped or not. The first name seen for a connection is
+	kept, as its later requests may be redirects elsewhere
+*/
+func LoadHostNames(filenames []string) (*HostNameMap, error) {
+	hosts := &HostNameMap{names: make(map[string]string)}
+	for _, filename := range filenames {
+		reader, err := Reader{}.OpenFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		err = readZeekLog(bufio.NewReader(reader), []string{"uid", "host|server_name"}, func(values []string) error {
+			if _, ok := hosts.names[values[0]]; !ok && values[0] != "" && values[1] != "" {
+				hosts.names[values[0]] = values[1]
+			}
+			return nil
+		})
+		if closed := reader.Close(); err == nil {
+			err = closed
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+	}
+	return hosts, nil
+}
+
+/*
+	function to find the name of the service a connection reached
+*/
+func (self *HostNameMap) Lookup(uid string) (string, bool) {
+	if self == nil {
+		return "", false
+	}
+	name, ok := self.names[uid]
+	return name, ok
+}
+
+// what the traffic with an external host is totalled under, the name of
+// the service it was for when it is known, else the address of the host
+type destination struct {
+	name string
+	ip   netip.Addr
+}
@@ -0,0 +1,132 @@
+/*
+	Description:
+		Inputs that are still being written, such as a log that rotation
+		renamed but its writer hasn't closed yet. A scheduled run racing
+		the rotation would otherwise read a different amount of the file
+		each time and end on half a line, so what it does with them is
+		set by a policy: wait for the file to settle, read it up to its
+		last complete line, or skip it
+*/
+
+package qreader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// what is done with an input that is still being written: wait,
+// complete or skip
+var InProgress string = "complete"
+
+// how long an input has to go unmodified to be taken as finished
+var SettleTime time.Duration = 10 * time.Second
+
+/*
+	function to tell whether a file looks like it is still being written,
+	from it having been modified within the settle time
+*/
+func StillWritten(info os.FileInfo, settle time.Duration, now time.Time) bool {
+	return info.Mode().IsRegular() && settle > 0 && now.Sub(info.ModTime()) < settle
+}
+
+/*
+	function to wait for a file to go unmodified for the settle time, or
+	for the run to be cancelled
+*/
+func (self Reader) settle(filename string, settle time.Duration) error {
+	poll := min(settle, time.Second)
+	for {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if !StillWritten(info, settle, time.Now()) {
+			return nil
+		}
+		select {
+		case <-time.After(poll):
+		case <-self.ctx.Done():
+			return self.ctx.Err()
+		}
+	}
+}
+
+// an input read up to its last complete line, leaving out what follows
+// the last newline when the input ends. Dropped is how many bytes that was.
+// A line longer than MaxLine is passed on as it is, for the reader to fail
+// on, rather than held back
+type wholeLines struct {
+	io.ReadCloser
+	MaxLine int
+	buf     []byte
+	ready   []byte
+	pending []byte
+	err     error
+	Dropped int
+}
+
+func (self *wholeLines) Read(p []byte) (int, error) {
+	for len(self.ready) == 0 {
+		if self.err != nil {
+			self.Dropped = len(self.pending)
+			return 0, self.err
+		}
+		if self.buf == nil {
+			self.buf = make([]byte, 64*1024)
+		}
+		n, err := self.ReadCloser.Read(self.buf)
+		self.pending = append(self.pending, self.buf[:n]...)
+		self.err = err
+		if i := bytes.LastIndexByte(self.pending, '\n'); i >= 0 {
+			self.ready = self.pending[:i+1]
+			self.pending = append([]byte(nil), self.pending[i+1:]...)
+		} else if self.MaxLine > 0 && len(self.pending) > self.MaxLine {
+			self.ready, self.pending = self.pending, nil
+		}
+	}
+	n := copy(p, self.ready)
+	self.ready = self.ready[n:]
+	return n, nil
+}
+
+/*
+	function to read an input that is still being written as the
+	InProgress policy of the settings says, returning the end time of its
+	data
+*/
+func (self Reader) readInProgress(filename string) float64 {
+	settings := self.config()
+	switch settings.InProgress {
+	case "skip":
+		self.Warn(InputWarning{Kind: InProgressInput, File: filename, Err: fmt.Errorf("skipping it")})
+		return 0
+	case "wait":
+		self.Warn(InputWarning{Kind: InProgressInput, File: filename, Err: fmt.Errorf("waiting for it to go unmodified for %v", settings.SettleTime)})
+		if err := self.settle(filename, settings.SettleTime); err != nil {
+			if err != self.ctx.Err() {
+				self.fail(err)
+			}
+			return 0
+		}
+	}
+
+	reader, err := self.OpenFile(filename)
+	if err != nil {
+		self.fail(err)
+		return 0
+	}
+	if settings.InProgress == "wait" {
+		return self.read(filename, reader)
+	}
+	lines := &wholeLines{ReadCloser: reader, MaxLine: settings.MaxLineLength}
+	end := self.read(filename, lines)
+	if lines.Dropped > 0 {
+		self.Warn(InputWarning{Kind: InProgressInput, File: filename,
+			Err: fmt.Errorf("left out the %d bytes of its incomplete last line", lines.Dropped)})
+	}
+	return end
+}
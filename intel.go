@@ -0,0 +1,51 @@
+/*
+	Description:
+		Exports the top external talkers in the zeek intelligence
+		framework file format, so they can be loaded back into zeek
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+)
+
+// value of the meta.source column of exported indicators
+var IntelSource string = "qreader"
+
+/*
+	function to write the top n external hosts to a zeek intel file
+*/
+func WriteIntel(filename string, result Result, n int) error {
+	file, err := CreateOutput(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+
+	// zeek skips comment lines, so the run metadata can lead the file
+	if Run != nil {
+		for _, row := range Run.Rows() {
+			fmt.Fprintf(w, "#qreader %v: %v\n", row[0], row[1])
+		}
+	}
+	fmt.Fprintln(w, "#fields\tindicator\tindicator_type\tmeta.source\tmeta.desc")
+	for i, t := range Rank(result.Remotes) {
+		if i >= n {
+			break
+		}
+		if net.ParseIP(t.Key) == nil {
+			continue
+		}
+		desc := fmt.Sprintf("top external talker #%d, %v exchanged with the local network", i+1, HumanBytes(t.Bytes))
+		fmt.Fprintf(w, "%v\tIntel::ADDR\t%v\t%v\n", t.Key, IntelSource, desc)
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
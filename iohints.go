@@ -0,0 +1,126 @@
+/*
+	Description:
+		Optional hints for reading local inputs without disturbing the
+		page cache, so that large batch runs don't evict the cached data
+		of other programs on the same machine
+*/
+
+package qreader
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// whether local inputs bypass the page cache with O_DIRECT
+var DirectIO bool = false
+
+// whether the kernel is told that local inputs are read sequentially
+// and that the pages already read won't be needed again
+var DropCache bool = false
+
+// how much is read between requests to drop the cached pages
+var DropCacheEvery int64 = 32 << 20
+
+/*
+	function to open a local input with the configured hints, falling
+	back to a plain open where they are not supported
+*/
+func OpenInput(filename string) (io.ReadCloser, error) {
+	var file *os.File
+	var err error
+	if DirectIO {
+		file, err = openDirect(filename)
+		if err != nil {
+			Warning.Printf("direct io not available for %v, reading through the page cache: %v", filename, err)
+		} else {
+			return &alignedReader{file: file, buf: alignedBuffer(1 << 20)}, nil
+		}
+	}
+
+	if file, err = os.Open(filename); err != nil {
+		return nil, err
+	}
+	if DropCache {
+		fadvise(file, 0, 0, fadvSequential)
+		return &cacheDropper{file: file}, nil
+	}
+	return file, nil
+}
+
+//--------------------------------------------------------------------------------
+//	alignedReader class which reads a file opened with O_DIRECT, which
+//	only allows reads into block aligned buffers
+//--------------------------------------------------------------------------------
+
+// alignment that satisfies the block size of common devices
+const directAlign = 4096
+
+type alignedReader struct {
+	file *os.File
+	buf  []byte
+	r, w int
+	err  error
+}
+
+/*
+	function to allocate a buffer whose start is aligned for direct io
+*/
+func alignedBuffer(size int) []byte {
+	raw := make([]byte, size+directAlign)
+	offset := directAlign - int(addressOf(raw)%directAlign)
+	if offset == directAlign {
+		offset = 0
+	}
+	return raw[offset : offset+size]
+}
+
+func addressOf(b []byte) uintptr {
+	return uintptr(unsafe.Pointer(&b[0]))
+}
+
+func (self *alignedReader) Read(p []byte) (int, error) {
+	if self.r == self.w {
+		if self.err != nil {
+			return 0, self.err
+		}
+		self.r = 0
+		self.w, self.err = self.file.Read(self.buf)
+		if self.w == 0 {
+			return 0, self.err
+		}
+	}
+	n := copy(p, self.buf[self.r:self.w])
+	self.r += n
+	return n, nil
+}
+
+func (self *alignedReader) Close() error {
+	return self.file.Close()
+}
+
+//--------------------------------------------------------------------------------
+//	cacheDropper class which asks the kernel to drop the pages of a file
+//	behind the reader as it goes
+//--------------------------------------------------------------------------------
+
+type cacheDropper struct {
+	file    *os.File
+	offset  int64
+	dropped int64
+}
+
+func (self *cacheDropper) Read(p []byte) (int, error) {
+	n, err := self.file.Read(p)
+	self.offset += int64(n)
+	if self.offset-self.dropped >= DropCacheEvery || (err != nil && self.offset > self.dropped) {
+		fadvise(self.file, self.dropped, self.offset-self.dropped, fadvDontNeed)
+		self.dropped = self.offset
+	}
+	return n, err
+}
+
+func (self *cacheDropper) Close() error {
+	return self.file.Close()
+}
@@ -0,0 +1,26 @@
+//go:build linux && (amd64 || arm64)
+
+package qreader
+
+import (
+	"os"
+	"syscall"
+)
+
+// advice values of posix_fadvise
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+func openDirect(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_RDONLY|syscall.O_DIRECT, 0)
+}
+
+func fadvise(file *os.File, offset, length int64, advice int) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), uintptr(offset), uintptr(length), uintptr(advice), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !(linux && (amd64 || arm64))
+
+package qreader
+
+import (
+	"errors"
+	"os"
+)
+
+const (
+	fadvSequential = 0
+	fadvDontNeed   = 0
+)
+
+func openDirect(filename string) (*os.File, error) {
+	return nil, errors.New("direct io is only supported on linux")
+}
+
+func fadvise(file *os.File, offset, length int64, advice int) error {
+	return nil
+}
@@ -0,0 +1,259 @@
+/*
+	Description:
+		Writes kubernetes manifests that spread a large backfill over a
+		cluster: an indexed job whose pods each save the state of one
+		share of the inputs, and a job that rolls those states up into
+		the final report once the shares are done
+*/
+
+package qreader
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// a description of the jobs to write
+type K8sPlan struct {
+	Name     string
+	Image    string
+	Claim    string
+	Shards   [][]string
+	Args     []string
+	StateDir string
+
+	// the options of Args the merge job's qreader rollup takes too
+	MergeArgs []string
+}
+
+// flags that are set by the plan itself or make no sense in a job
+var k8sSkipFlags = map[string]bool{
+	"f": true, "save-state": true, "tui": true, "serve-report": true,
+	"coordinate": true, "worker-of": true, "replay-speed": true,
+	"dir": true, "ext": true,
+}
+
+// flags of the shards that the merge job's qreader rollup takes as well
+var k8sMergeFlags = map[string]bool{
+	"report": true, "top": true, "anonymize": true, "anonymize-key": true, "d": true,
+}
+
+/*
+	function to run the k8s-plan command with its own options, the
+	arguments following qreader k8s-plan. The options the jobs run with
+	follow a "--", e.g. qreader k8s-plan -pods 8 -f '/logs/*.gz' -- -report hosts
+*/
+func K8sPlanMain(args []string) {
+	flags := flag.NewFlagSet("qreader k8s-plan", flag.ExitOnError)
+	var input_files fileList
+	flags.Var(&input_files, "f", "a file to process, or a glob pattern, repeated for more files (which may also follow as arguments)")
+	var input_dir = flags.String("dir", "", "a directory whose tree is walked for more files to process (see <-ext>)")
+	var input_exts = flags.String("ext", ".gz,.log", "comma separated extensions of the files processed under <-dir>, or \"\" for all of them")
+	var pods = flags.Int("pods", 1, "number of pods the inputs are spread over")
+	var image = flags.String("image", "qreader:"+Version, "container image the jobs run")
+	var claim = flags.String("claim", "qreader-data", "persistent volume claim holding the inputs, mounted at "+K8sMount+" in the jobs")
+	var name = flags.String("name", "qreader", "name the jobs are prefixed with")
+	var debugging = flags.Bool("d", false, "enable debug messages")
+	var run_args []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, run_args = args[:i], args[i+1:]
+			break
+		}
+	}
+	flags.Parse(args)
+
+	LogInit(*debugging)
+	// the options of the jobs are those of a run, so k8sArgs finds them
+	flag.CommandLine.Parse(run_args)
+	if flag.NArg() > 0 {
+		Error.Fatalf("Invalid run option given: %v", flag.Arg(0))
+	}
+	if *pods <= 0 {
+		Error.Fatalf("Invalid number of pods given: %d", *pods)
+	}
+
+	filenames, err := ExpandInputs(append([]string(input_files), flags.Args()...))
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	if *input_dir != "" {
+		var exts []string
+		if *input_exts != "" {
+			exts = strings.Split(*input_exts, ",")
+		}
+		found, err := WalkInputs(*input_dir, exts)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		filenames = append(filenames, found...)
+	}
+	if len(filenames) == 0 {
+		Error.Fatalln("qreader k8s-plan requires -f or -dir")
+	}
+
+	plan := NewK8sPlan(*name, *image, *claim, filenames, *pods)
+	if err := plan.Write(os.Stdout); err != nil {
+		Error.Fatalln(err)
+	}
+}
+
+/*
+	function to collect the flags given on the command line that the
+	jobs should run with too, those of the shards and those of the merge
+*/
+func k8sArgs() ([]string, []string) {
+	var args, merge []string
+	flag.Visit(func(f *flag.Flag) {
+		if !k8sSkipFlags[f.Name] {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+		if k8sMergeFlags[f.Name] {
+			merge = append(merge, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args, merge
+}
+
+/*
+	function to plan jobs processing the given inputs in at most shards
+	pods, each taking a run of consecutive inputs so that the inputs of
+	a pod stay in time order
+*/
+func NewK8sPlan(name string, image string, claim string, filenames []string, shards int) K8sPlan {
+	if shards > len(filenames) {
+		shards = len(filenames)
+	}
+	plan := K8sPlan{
+		Name:     name,
+		Image:    image,
+		Claim:    claim,
+		StateDir: path.Join(K8sMount, "qreader-plan", name),
+	}
+	plan.Args, plan.MergeArgs = k8sArgs()
+	for i := 0; i < shards; i++ {
+		plan.Shards = append(plan.Shards, filenames[i*len(filenames)/shards:(i+1)*len(filenames)/shards])
+	}
+	return plan
+}
+
+// where the claim holding the inputs and the states is mounted
+const K8sMount = "/data"
+
+/*
+	function to quote a string for yaml, which accepts json strings
+*/
+func yamlQuote(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+/*
+	function to quote a list of words for the shell
+*/
+func shellQuote(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+var k8sTemplate = template.Must(template.New("k8s").Funcs(template.FuncMap{
+	"quote": yamlQuote,
+	"shell": shellQuote,
+	"word":  func(s string) string { return shellQuote([]string{s}) },
+	"states": func(dir string, n int) []string {
+		var states []string
+		for i := 0; i < n; i++ {
+			states = append(states, path.Join(dir, fmt.Sprintf("part-%d.json", i)))
+		}
+		return states
+	},
+}).Parse(`# generated by qreader {{.Version}}
+# apply the shards first, and the merge once they have completed:
+#   kubectl wait --for=condition=complete --timeout=-1s job/{{.Name}}-shards
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{quote (printf "%v-shards" .Name)}}
+spec:
+  completionMode: Indexed
+  completions: {{len .Shards}}
+  parallelism: {{len .Shards}}
+  backoffLimit: {{len .Shards}}
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: qreader
+        image: {{quote .Image}}
+        command: ["/bin/sh", "-c"]
+        args:
+        - |
+          mkdir -p {{word .StateDir}}
+          case "$JOB_COMPLETION_INDEX" in
+{{- range $i, $files := .Shards}}
+          {{$i}}) set -- {{shell $files}} ;;
+{{- end}}
+          esac
+          first="$1"; shift
+          exec qreader {{shell .Args}} -save-state={{word .StateDir}}/part-"$JOB_COMPLETION_INDEX".json -force -f "$first" "$@"
+        volumeMounts:
+        - name: data
+          mountPath: {{quote .Mount}}
+      volumes:
+      - name: data
+        persistentVolumeClaim:
+          claimName: {{quote .Claim}}
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{quote (printf "%v-merge" .Name)}}
+spec:
+  backoffLimit: 2
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: qreader
+        image: {{quote .Image}}
+        command: ["qreader"]
+        args:
+        - "rollup"
+        - "-period=total"
+{{- range .MergeArgs}}
+        - {{quote .}}
+{{- end}}
+{{- range $i, $state := states .StateDir (len .Shards)}}
+{{- if eq $i 0}}
+        - "-f"
+{{- end}}
+        - {{quote $state}}
+{{- end}}
+        volumeMounts:
+        - name: data
+          mountPath: {{quote .Mount}}
+      volumes:
+      - name: data
+        persistentVolumeClaim:
+          claimName: {{quote .Claim}}
+`))
+
+/*
+	function to write the manifests of the plan as one yaml stream
+*/
+func (self K8sPlan) Write(w io.Writer) error {
+	return k8sTemplate.Execute(w, struct {
+		K8sPlan
+		Version string
+		Mount   string
+	}{self, Version, K8sMount})
+}
@@ -0,0 +1,85 @@
+/*
+	Description:
+		Guards that stop a run which reads far more than expected, so that
+		an automated invocation pointed at the wrong input, such as a
+		packet capture, fails quickly instead of running for hours
+*/
+
+package qreader
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// the most lines and bytes of data a run reads, 0 for no limit. The
+// bytes are counted after decompression
+var MaxLines int64 = 0
+var MaxInputBytes int64 = 0
+
+// the longest line an input may have, 0 for no limit. Past it the input
+// is taken to be binary or not a log at all
+var MaxLineLength int = 1 << 20
+
+// the error a run stops with when it reaches one of its limits
+type LimitError struct {
+	Limit string
+	Max   int64
+	File  string
+}
+
+func (self *LimitError) Error() string {
+	return fmt.Sprintf("stopped in %v after reading more than the %d %v allowed", self.File, self.Max, self.Limit)
+}
+
+// the error a run stops with when an input has a line longer than
+// MaxLineLength
+type LineTooLongError struct {
+	File string
+	Line int
+	Max  int
+}
+
+func (self *LineTooLongError) Error() string {
+	return fmt.Sprintf("line %d of %v is longer than the %d bytes allowed, it may be binary or have no newlines (see -max-line)", self.Line, self.File, self.Max)
+}
+
+/*
+	function to find the first line of a chunk longer than max bytes,
+	counting from 1, or 0 when there is none
+*/
+func longestLine(chunk []byte, max int) int {
+	for n := 1; len(chunk) > 0; n++ {
+		end := bytes.IndexByte(chunk, '\n')
+		if end < 0 {
+			end = len(chunk)
+		}
+		if end > max {
+			return n
+		}
+		chunk = chunk[min(end+1, len(chunk)):]
+	}
+	return 0
+}
+
+// the lines and bytes a run has read, checked against its limits
+type usage struct {
+	lines int64
+	bytes int64
+}
+
+/*
+	function to count a chunk of an input against the limits, returning
+	an error once one of them is exceeded
+*/
+func (self *usage) add(settings *Settings, filename string, chunk []byte, lines int) error {
+	self.lines += int64(lines)
+	self.bytes += int64(len(chunk))
+	if settings.MaxLines > 0 && self.lines > settings.MaxLines {
+		return &LimitError{"lines", settings.MaxLines, filename}
+	}
+	if settings.MaxInputBytes > 0 && self.bytes > settings.MaxInputBytes {
+		return &LimitError{"bytes", settings.MaxInputBytes, filename}
+	}
+	return nil
+}
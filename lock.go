@@ -0,0 +1,79 @@
+/*
+	Description:
+		Advisory locking of state files and history directories, so that
+		overlapping runs can't interleave their reads and writes of the
+		same state
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// how often a waiting run retries a held lock
+var LockPoll time.Duration = 500 * time.Millisecond
+
+type Lock struct {
+	file *os.File
+}
+
+/*
+	function to name the lock file guarding a state file or, for a
+	directory, the lock file inside it
+*/
+func lockFile(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, ".lock")
+	}
+	return path + ".lock"
+}
+
+/*
+	function to take the lock guarding the given state, waiting up to the
+	given time for another run to release it. The lock is released when
+	the process exits, so a crashed run never leaves a stale lock behind
+*/
+func AcquireLock(path string, wait time.Duration) (*Lock, error) {
+	filename := lockFile(path)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		locked, err := tryLock(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			if wait == 0 {
+				return nil, fmt.Errorf("%v is in use by another run (locked through %v), see <-lock-wait>", path, filename)
+			}
+			return nil, fmt.Errorf("%v is still in use by another run after waiting %v (locked through %v)", path, wait, filename)
+		}
+		time.Sleep(LockPoll)
+	}
+
+	// leave a note for whoever finds the lock held
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	return &Lock{file}, nil
+}
+
+/*
+	function to release a lock taken by AcquireLock
+*/
+func (self *Lock) Release() error {
+	unlock(self.file)
+	return self.file.Close()
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package qreader
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+	function to take an exclusive lock of the file without waiting,
+	telling whether another process holds it
+*/
+func tryLock(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(file *os.File) {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,163 @@
+/*
+	Description:
+		A manifest of each run for data-governance tooling: the inputs it
+		read with their digests, how it was configured, the versions of
+		what it ran with, what it counted and the files it wrote, so the
+		lineage of published numbers can be traced back to the logs
+*/
+
+package qreader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// the files written by the run so far, see noteOutput
+var written struct {
+	sync.Mutex
+	paths map[string]bool
+}
+
+/*
+	function to remember a file or directory the run wrote, for the
+	manifest
+*/
+func noteOutput(path string) {
+	written.Lock()
+	defer written.Unlock()
+	if written.paths == nil {
+		written.paths = make(map[string]bool)
+	}
+	written.paths[path] = true
+}
+
+/*
+	function to list the files and directories the run wrote
+*/
+func WrittenOutputs() []string {
+	written.Lock()
+	defer written.Unlock()
+	paths := make([]string, 0, len(written.paths))
+	for path := range written.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// a file a run read or wrote. Directories have no digest
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type ManifestCounts struct {
+	Lines    int64 `json:"lines"`
+	Rejected int64 `json:"rejected_lines"`
+	Hosts    int   `json:"hosts"`
+	Cached   bool  `json:"cached,omitempty"`
+}
+
+type RunManifest struct {
+	*RunMetadata
+
+	GoVersion string `json:"go_version"`
+	Unzipper  string `json:"unzipper"`
+
+	InputFiles []ManifestFile `json:"input_files"`
+	Counts     ManifestCounts `json:"counts"`
+	Outputs    []ManifestFile `json:"outputs"`
+}
+
+/*
+	function to describe a file by its size and the sha256 of its data
+*/
+func digestFile(path string) (ManifestFile, error) {
+	entry := ManifestFile{Path: path}
+	if path == StdinName {
+		// what was read from the standard input is gone
+		return entry, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return entry, err
+	}
+	if info.IsDir() {
+		return entry, nil
+	}
+	entry.Size = info.Size()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return entry, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return entry, err
+	}
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return entry, nil
+}
+
+/*
+	function to make the manifest of a run from its metadata, the
+	settings it ran with and its result, digesting its inputs and the
+	outputs it wrote
+*/
+func NewRunManifest(metadata *RunMetadata, settings *Settings, result Result, cached bool) (*RunManifest, error) {
+	parsed, rejected := settings.Lines.Load()
+	manifest := &RunManifest{
+		RunMetadata: metadata,
+		GoVersion:   runtime.Version(),
+		Unzipper:    settings.Unzipper,
+		Counts: ManifestCounts{
+			Lines:    parsed,
+			Rejected: rejected,
+			Hosts:    len(result.Hosts),
+			Cached:   cached,
+		},
+		InputFiles: []ManifestFile{},
+		Outputs:    []ManifestFile{},
+	}
+	for _, filename := range metadata.Inputs {
+		entry, err := digestFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		manifest.InputFiles = append(manifest.InputFiles, entry)
+	}
+
+	// outputs can be gone by the end of the run, such as samples pruned
+	// by their retention
+	for _, path := range WrittenOutputs() {
+		entry, err := digestFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Outputs = append(manifest.Outputs, entry)
+	}
+	return manifest, nil
+}
+
+/*
+	function to write the manifest of a run as json
+*/
+func WriteManifest(filename string, manifest *RunManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteOutput(filename, append(data, '\n'))
+}
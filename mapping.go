@@ -0,0 +1,198 @@
+/*
+	Description:
+		Loads a csv mapping of ip addresses and networks to hostnames,
+		owners and departments, used to label the rows of the report
+*/
+
+package qreader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// the loaded mapping used to label report rows, nil when not in use
+var Labels *Mapping
+
+//--------------------------------------------------------------------------------
+//	Label describes who a network or host belongs to
+//--------------------------------------------------------------------------------
+
+type Label struct {
+	Hostname   string
+	Owner      string
+	Department string
+}
+
+func (self Label) String() string {
+	var extra []string
+	for _, s := range []string{self.Owner, self.Department} {
+		if s != "" {
+			extra = append(extra, s)
+		}
+	}
+	if len(extra) == 0 {
+		return self.Hostname
+	}
+	if self.Hostname == "" {
+		return "[" + strings.Join(extra, ", ") + "]"
+	}
+	return self.Hostname + " [" + strings.Join(extra, ", ") + "]"
+}
+
+//--------------------------------------------------------------------------------
+//	Mapping class which finds the most specific label for an address
+//--------------------------------------------------------------------------------
+
+type mappingEntry struct {
+	network netip.Prefix
+	label   Label
+}
+
+type Mapping struct {
+	entries []mappingEntry
+}
+
+/*
+	function to parse an ip address or cidr network, an address being
+	the network of just itself
+*/
+func parseNetwork(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		network, err := netip.ParsePrefix(s)
+		if err != nil {
+			return network, fmt.Errorf("invalid network %q", s)
+		}
+		return network.Masked(), nil
+	}
+	ip, err := parseHost(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+/*
+	function to parse an address to be matched against the networks of
+	parseNetwork, with ipv4 addresses in their 4 byte form
+*/
+func parseHost(s string) (netip.Addr, error) {
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return ip, fmt.Errorf("invalid address %q", s)
+	}
+	return ip.Unmap(), nil
+}
+
+// prefix lengths used when summing hosts into subnets
+var SubnetBits4 int = 24
+var SubnetBits6 int = 64
+
+/*
+	function to find the subnet an address belongs to, in cidr notation
+*/
+func Subnet(s string) string {
+	ip, err := parseHost(s)
+	if err != nil {
+		return s
+	}
+	return SubnetOf(ip).String()
+}
+
+/*
+	function to find the subnet a parsed address belongs to
+*/
+func SubnetOf(ip netip.Addr) netip.Prefix {
+	if ip.Is4() {
+		return netip.PrefixFrom(ip, SubnetBits4).Masked()
+	}
+	return netip.PrefixFrom(ip, SubnetBits6).Masked()
+}
+
+/*
+	function to sum host totals into their subnets
+*/
+func SubnetTotals(hosts map[string]int64) map[string]int64 {
+	totals := make(map[string]int64)
+	for ip, bytecount := range hosts {
+		totals[Subnet(ip)] += bytecount
+	}
+	return totals
+}
+
+/*
+	function to load a mapping file with the columns
+		network,hostname,owner,department
+	where the network is an address or cidr and the trailing columns may
+	be left out. Lines starting with # and a header row are ignored
+*/
+func LoadMapping(filename string) (*Mapping, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	m := &Mapping{}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		network, err := parseNetwork(record[0])
+		if err != nil {
+			if row == 1 {
+				continue
+			}
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+
+		var fields [3]string
+		for i := 1; i < len(record) && i <= 3; i++ {
+			fields[i-1] = strings.TrimSpace(record[i])
+		}
+		m.entries = append(m.entries, mappingEntry{network, Label{fields[0], fields[1], fields[2]}})
+	}
+
+	// most specific networks first so that the first match wins
+	sort.SliceStable(m.entries, func(i, j int) bool {
+		return m.entries[i].network.Bits() > m.entries[j].network.Bits()
+	})
+	return m, nil
+}
+
+/*
+	function to find the label of the most specific network containing
+	the given address
+*/
+func (self *Mapping) Lookup(s string) (Label, bool) {
+	if self == nil {
+		return Label{}, false
+	}
+	ip, err := parseHost(s)
+	if err != nil {
+		return Label{}, false
+	}
+	for _, entry := range self.entries {
+		if entry.network.Contains(ip) {
+			return entry.label, true
+		}
+	}
+	return Label{}, false
+}
@@ -0,0 +1,85 @@
+/*
+	Description:
+		Describes how a run was made, so that its saved results and
+		exports can be audited and reproduced long after the fact
+*/
+
+package qreader
+
+import (
+	"flag"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the metadata of the current run, nil until the results are final
+var Run *RunMetadata
+
+type RunMetadata struct {
+	Version string   `json:"version"`
+	Created string   `json:"created"`
+	Inputs  []string `json:"inputs"`
+
+	// time range of the data that was read
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+
+	// every command line option that was given, by flag name
+	Options map[string]string `json:"options,omitempty"`
+
+	LocalNetworks []string `json:"local_networks"`
+}
+
+func epochString(ts float64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(0, int64(ts*1e9)).UTC().Format(time.RFC3339)
+}
+
+/*
+	function to collect the metadata of a run over the given inputs
+	from its results and the command line options it was given
+*/
+func NewRunMetadata(inputs []string, result Result) *RunMetadata {
+	options := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		options[f.Name] = f.Value.String()
+	})
+
+	return &RunMetadata{
+		Version:       Version,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+		Inputs:        inputs,
+		Start:         epochString(result.First),
+		End:           epochString(result.Last),
+		Options:       options,
+		LocalNetworks: []string{LocalCIDR},
+	}
+}
+
+/*
+	function to list the metadata as key,value rows for tabular outputs,
+	with the options flattened into one row each
+*/
+func (self *RunMetadata) Rows() [][]string {
+	rows := [][]string{
+		{"version", self.Version},
+		{"created", self.Created},
+		{"inputs", strings.Join(self.Inputs, " ")},
+		{"start", self.Start},
+		{"end", self.End},
+		{"local_networks", strings.Join(self.LocalNetworks, " ")},
+	}
+
+	names := make([]string, 0, len(self.Options))
+	for name := range self.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rows = append(rows, []string{"option." + name, self.Options[name]})
+	}
+	return rows
+}
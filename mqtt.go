@@ -0,0 +1,74 @@
+/*
+	Description:
+		Publishes a summary of each time bucket to an mqtt topic, so
+		lightweight dashboards can subscribe to the traffic totals
+*/
+
+package qreader
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// which command to use for publishing mqtt messages
+var MosquittoPub string = "mosquitto_pub"
+
+// the summary published for each time bucket
+type WindowSummary struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Bytes int64 `json:"bytes"`
+}
+
+/*
+	function to list the summaries of the time buckets of a result, oldest
+	first
+*/
+func Windows(result Result) []WindowSummary {
+	size := int64(BucketSize / time.Second)
+	windows := make([]WindowSummary, 0, len(result.Buckets))
+	for start, bytecount := range result.Buckets {
+		windows = append(windows, WindowSummary{start, start + size, bytecount})
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start < windows[j].Start
+	})
+	return windows
+}
+
+/*
+	function to publish the summary of every time bucket to a topic on
+	the given broker, one message per bucket. The messages are handed to
+	the mosquitto_pub command, which sends each line of its input
+*/
+func PublishWindows(broker string, topic string, result Result) error {
+	host, port := broker, "1883"
+	if h, p, err := net.SplitHostPort(broker); err == nil {
+		host, port = h, p
+	}
+
+	var lines []string
+	for _, w := range Windows(result) {
+		msg, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(msg))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	c := exec.Command(MosquittoPub, "-h", host, "-p", port, "-t", topic, "-l")
+	c.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v failed: %v: %v", MosquittoPub, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
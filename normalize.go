@@ -0,0 +1,76 @@
+/*
+	Description:
+		Key normalizers rewrite the address a host total is kept under,
+		such as into its subnet, its owner or an anonymized token, so
+		that programs using the pipeline can group the traffic with
+		logic of their own instead of one of the built in groupings
+*/
+
+package qreader
+
+import (
+	"net/netip"
+)
+
+// a function giving the key a host's traffic is totalled under, hosts
+// with the same key are summed together
+type KeyNormalizer func(netip.Addr) string
+
+// the normalizer of the host keys, nil to keep each address on its own
+var NormalizeKeys KeyNormalizer
+
+/*
+	function to normalize the host keys of a result by the address
+	strings, summing the hosts that end up with the same key. The keys
+	are normalized as the partial sums are turned into a result rather
+	than for each record, which gives the same totals at a fraction of
+	the cost
+*/
+func (self KeyNormalizer) totals(tt map[netip.Addr]int64) map[string]int64 {
+	if tt == nil {
+		return nil
+	}
+	totals := make(map[string]int64, len(tt))
+	for ip, bytecount := range tt {
+		totals[self.key(ip)] += bytecount
+	}
+	return totals
+}
+
+func (self KeyNormalizer) key(ip netip.Addr) string {
+	if self == nil {
+		return ip.String()
+	}
+	return self(ip)
+}
+
+/*
+	function to key the hosts by their subnet, see SubnetBits4
+*/
+func SubnetKeys(settings *Settings) KeyNormalizer {
+	return func(ip netip.Addr) string {
+		return settings.SubnetOf(ip).String()
+	}
+}
+
+/*
+	function to key the hosts by the owner the mapping labels them with,
+	keeping the address of the hosts without one
+*/
+func OwnerKeys(labels *Mapping) KeyNormalizer {
+	return func(ip netip.Addr) string {
+		if label, ok := labels.Lookup(ip.String()); ok && label.Owner != "" {
+			return label.Owner
+		}
+		return ip.String()
+	}
+}
+
+/*
+	function to key the hosts by their anonymized address
+*/
+func AnonymizedKeys(anonymizer *Anonymizer) KeyNormalizer {
+	return func(ip netip.Addr) string {
+		return anonymizer.IP(ip.String())
+	}
+}
@@ -0,0 +1,176 @@
+/*
+	Description:
+		Writing of output files. Outputs are written to a temporary file
+		beside their destination and renamed into place once complete, so
+		an interrupted run never leaves a half-written file for the jobs
+		that consume it. Existing files are only replaced with -force
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// whether existing output files may be replaced
+var Force bool = false
+
+// an output file being written, which only appears under its name once
+// it is committed
+type OutputFile struct {
+	*os.File
+	path string
+}
+
+/*
+	function to check that none of the given outputs exist yet, unless
+	they may be replaced. Empty names are skipped
+*/
+func CheckOutputs(filenames ...string) error {
+	if Force {
+		return nil
+	}
+	for _, filename := range filenames {
+		if filename == "" {
+			continue
+		}
+		if _, err := os.Stat(filename); err == nil {
+			return fmt.Errorf("%v already exists, use -force to replace it", filename)
+		}
+	}
+	return nil
+}
+
+/*
+	function to check that the given output directories, which runs add
+	to, are directories if they exist. Empty names are skipped
+*/
+func CheckOutputDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			return fmt.Errorf("%v is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+/*
+	function to start writing an output file
+*/
+func CreateOutput(filename string) (*OutputFile, error) {
+	if err := CheckOutputs(filename); err != nil {
+		return nil, err
+	}
+	return replaceOutput(filename)
+}
+
+/*
+	function to start writing a file that replaces whatever is there,
+	for files that qreader manages itself
+*/
+func replaceOutput(filename string) (*OutputFile, error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := ioutil.TempFile(dir, "."+base+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &OutputFile{file, filename}, nil
+}
+
+/*
+	function to finish writing the file and move it into place
+*/
+func (self *OutputFile) Commit() error {
+	if err := self.Sync(); err != nil {
+		self.Abort()
+		return err
+	}
+	if err := self.File.Close(); err != nil {
+		os.Remove(self.Name())
+		return err
+	}
+	if err := os.Chmod(self.Name(), 0644); err != nil {
+		os.Remove(self.Name())
+		return err
+	}
+	if err := os.Rename(self.Name(), self.path); err != nil {
+		os.Remove(self.Name())
+		return err
+	}
+	noteOutput(self.path)
+	return nil
+}
+
+/*
+	function to throw away a file that won't be completed
+*/
+func (self *OutputFile) Abort() {
+	self.File.Close()
+	os.Remove(self.Name())
+}
+
+/*
+	function to write a whole output file at once
+*/
+func WriteOutput(filename string, data []byte) error {
+	file, err := CreateOutput(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
+
+// an output written under a temporary name by another program, such as
+// the duckdb command, and moved into place once it is complete
+type OutputPath struct {
+	Name string
+	path string
+}
+
+/*
+	function to pick the temporary name an output is written under by
+	another program. Nothing is created there
+*/
+func CreateOutputPath(filename string) (*OutputPath, error) {
+	if err := CheckOutputs(filename); err != nil {
+		return nil, err
+	}
+	dir, base := filepath.Split(filename)
+	name := filepath.Join(dir, fmt.Sprintf(".%v.tmp-%d-%d", base, os.Getpid(), time.Now().UnixNano()))
+	return &OutputPath{name, filename}, nil
+}
+
+/*
+	function to move the finished output into place
+*/
+func (self *OutputPath) Commit() error {
+	if err := os.Rename(self.Name, self.path); err != nil {
+		self.Abort()
+		return err
+	}
+	noteOutput(self.path)
+	return nil
+}
+
+/*
+	function to throw away an output that won't be completed, with the
+	write-ahead log duckdb may have left beside it
+*/
+func (self *OutputPath) Abort() {
+	os.Remove(self.Name)
+	os.Remove(self.Name + ".wal")
+}
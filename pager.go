@@ -0,0 +1,75 @@
+/*
+	Description:
+		Pipes long reports through the user's pager when they are printed
+		to a terminal, so that a full dump can be scrolled and searched
+		instead of running off the screen
+*/
+
+package qreader
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// how many rows a section may show before the report is paged
+var PagerRows int = 50
+
+// the pager used when $PAGER isn't set
+var DefaultPager = "less"
+
+type pagerWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+/*
+	function to wait for the user to quit the pager once the report has
+	been written
+*/
+func (self pagerWriter) Close() error {
+	self.WriteCloser.Close()
+	return self.cmd.Wait()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+/*
+	function to open a writer for a report with the given number of rows
+	per section, 0 for all of them. Long reports printed to a terminal go
+	through $PAGER, anything else is written to out directly. Closing the
+	writer waits for the pager to exit
+*/
+func OpenPager(out *os.File, rows int) (io.WriteCloser, error) {
+	if (rows > 0 && rows <= PagerRows) || !IsTerminal(out) {
+		return nopWriteCloser{out}, nil
+	}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = DefaultPager
+	}
+	if pager == "cat" {
+		return nopWriteCloser{out}, nil
+	}
+
+	c := exec.Command("/bin/sh", "-c", pager)
+	c.Stdout = out
+	c.Stderr = os.Stderr
+	// like git, have less quit on a screenful and keep the colors
+	if os.Getenv("LESS") == "" {
+		c.Env = append(os.Environ(), "LESS=FRX")
+	}
+	pipe, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return pagerWriter{pipe, c}, nil
+}
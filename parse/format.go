@@ -0,0 +1,652 @@
+/*
+	Description:
+		Input formats other than zeek's tab separated logs: zeek's json
+		logs, csv with a header row and plain ndjson using the column
+		names of qreader's own record export. The format is detected from
+		the head of an input, and a Schema parses lines in that format.
+		Semi-structured logs such as firewall syslog lines are parsed
+		with a regular expression instead, see RegexSchema
+*/
+
+package parse
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format int
+
+const (
+	FormatAuto Format = iota
+	FormatTSV
+	FormatZeekJSON
+	FormatCSV
+	FormatNDJSON
+	FormatRegex
+)
+
+var formatNames = []string{"auto", "tsv", "zeek-json", "csv", "ndjson", "regex"}
+
+func (self Format) String() string {
+	if int(self) < len(formatNames) {
+		return formatNames[self]
+	}
+	return fmt.Sprintf("format(%d)", int(self))
+}
+
+/*
+	function to parse the name of a format
+*/
+func ParseFormat(s string) (Format, error) {
+	for i, name := range formatNames {
+		if s == name {
+			return Format(i), nil
+		}
+	}
+	return FormatAuto, fmt.Errorf("unknown format %q, expected one of %v", s, strings.Join(formatNames, ", "))
+}
+
+// the names zeek gives the columns, and the names used for them here.
+// zeek's orig_bytes and resp_bytes count payload bytes, so they are
+// not used
+var zeekNames = map[string]string{
+	"ts":            "ts",
+	"uid":           "uid",
+	"id.orig_h":     "orig",
+	"id.orig_p":     "orig_port",
+	"id.resp_h":     "resp",
+	"id.resp_p":     "port",
+	"proto":         "proto",
+	"service":       "service",
+	"duration":      "duration",
+	"conn_state":    "state",
+	"history":       "history",
+	"orig_pkts":     "orig_pkts",
+	"resp_pkts":     "resp_pkts",
+	"orig_ip_bytes": "orig_bytes",
+	"resp_ip_bytes": "resp_bytes",
+	"orig_l2_addr":  "orig_mac",
+	"resp_l2_addr":  "resp_mac",
+}
+
+// the names of the columns of qreader's record export
+var plainNames = map[string]string{
+	"ts":         "ts",
+	"uid":        "uid",
+	"orig":       "orig",
+	"orig_port":  "orig_port",
+	"resp":       "resp",
+	"port":       "port",
+	"proto":      "proto",
+	"service":    "service",
+	"duration":   "duration",
+	"state":      "state",
+	"history":    "history",
+	"orig_pkts":  "orig_pkts",
+	"resp_pkts":  "resp_pkts",
+	"orig_bytes": "orig_bytes",
+	"resp_bytes": "resp_bytes",
+	"bytes":      "bytes",
+	"orig_mac":   "orig_mac",
+	"resp_mac":   "resp_mac",
+}
+
+// the names of the groups of a regular expression that aren't column
+// names of qreader's record export, see RegexSchema
+var regexNames = map[string]string{
+	"src":   "orig",
+	"dst":   "resp",
+	"sport": "orig_port",
+	"dport": "port",
+}
+
+// how the lines of an input are laid out
+type Schema struct {
+	Format Format
+
+	// the header row of a csv input and the name used here for each of
+	// its columns, empty for columns that aren't used
+	header  []byte
+	columns []string
+
+	// the column names of a csv header or a zeek #fields line
+	fields []string
+
+	// the column the segment of a connection is read from, by name and,
+	// for tab separated logs, by position
+	segment    string
+	segmentCol int
+
+	// the columns of the link layer addresses in a tab separated log
+	macCols [2]int
+
+	// the expression the lines are matched with, whose groups take the
+	// place of the columns
+	pattern *regexp.Regexp
+
+	// whether the lines are framed by syslog, see Unframe
+	syslog bool
+}
+
+// the schema of zeek's tab separated logs
+var TSV = Schema{Format: FormatTSV}
+
+/*
+	function to work out the format of an input from a block read from
+	its head. An error is returned when the block doesn't clearly match
+	one of the formats. Lines relayed through syslog are detected by the
+	format of their messages
+*/
+func Detect(head []byte) (Schema, error) {
+	if unframed, ok := unframeHead(head); ok {
+		schema, err := detect(unframed)
+		schema.syslog = true
+		return schema, err
+	}
+	return detect(head)
+}
+
+func detect(head []byte) (Schema, error) {
+	tsv := false
+	for len(head) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(head, '\n'); i >= 0 {
+			line, head = head[:i], head[i+1:]
+		} else {
+			line, head = head, nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			// zeek's tab separated logs start with a #separator header,
+			// and name their columns in a #fields header
+			if bytes.HasPrefix(line, []byte("#fields\t")) {
+				schema := TSV
+				schema.fields = strings.Split(string(line[len("#fields\t"):]), "\t")
+				schema.macCols = [2]int{-1, -1}
+				for i, field := range schema.fields {
+					switch field {
+					case "orig_l2_addr":
+						schema.macCols[0] = i
+					case "resp_l2_addr":
+						schema.macCols[1] = i
+					}
+				}
+				return schema, nil
+			}
+			tsv = tsv || bytes.HasPrefix(line, []byte("#separator"))
+			continue
+		}
+		if tsv {
+			return TSV, nil
+		}
+		return detectLine(line)
+	}
+	if tsv {
+		return TSV, nil
+	}
+	return Schema{}, fmt.Errorf("no data to detect the format from")
+}
+
+func detectLine(line []byte) (Schema, error) {
+	if line[0] == '{' {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(line, &object); err != nil {
+			return Schema{}, fmt.Errorf("first record looks like json but isn't: %v", err)
+		}
+		_, zeek := object["id.orig_h"]
+		_, plain := object["orig"]
+		switch {
+		case zeek && !plain:
+			return Schema{Format: FormatZeekJSON}, nil
+		case plain && !zeek:
+			return Schema{Format: FormatNDJSON}, nil
+		}
+		return Schema{}, fmt.Errorf("json records have neither zeek's id.orig_h nor an orig field, or both")
+	}
+
+	tabs := bytes.Count(line, []byte("\t"))
+	commas := bytes.Count(line, []byte(","))
+	if tabs > 0 && commas == 0 {
+		return TSV, nil
+	}
+	if commas > 0 && tabs == 0 {
+		return csvSchema(line)
+	}
+	return Schema{}, fmt.Errorf("can't tell whether the input is tab or comma separated")
+}
+
+/*
+	function to build the schema of a csv input from its header row,
+	which may use either zeek's column names or the plain ones
+*/
+func csvSchema(header []byte) (Schema, error) {
+	fields, err := csv.NewReader(bytes.NewReader(header)).Read()
+	if err != nil {
+		return Schema{}, fmt.Errorf("invalid csv header: %v", err)
+	}
+	names := plainNames
+	for _, field := range fields {
+		if field == "id.orig_h" {
+			names = zeekNames
+		}
+	}
+
+	schema := Schema{Format: FormatCSV, header: append([]byte(nil), header...)}
+	known := map[string]bool{}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		schema.fields = append(schema.fields, field)
+		name := names[field]
+		schema.columns = append(schema.columns, name)
+		known[name] = true
+	}
+	if !known["ts"] || !known["orig"] || !known["resp"] {
+		return Schema{}, fmt.Errorf("first line of csv input is not a header naming the ts, orig and resp columns")
+	}
+	return schema, nil
+}
+
+/*
+	function to build the schema of lines matched by a regular expression,
+	whose named groups hold the fields of each connection: src, dst and
+	bytes, and optionally ts, sport, dport and proto. The column names of
+	qreader's record export may be used for the groups too. A ts may be
+	in epoch seconds, RFC3339 or syslog's Jan _2 15:04:05, which is taken
+	to be in the last year
+*/
+func RegexSchema(expr string) (Schema, error) {
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return Schema{}, err
+	}
+	schema := Schema{Format: FormatRegex, header: []byte(expr), pattern: pattern}
+	known := map[string]bool{}
+	for _, group := range pattern.SubexpNames() {
+		name, ok := regexNames[group]
+		if !ok {
+			name = plainNames[group]
+		}
+		schema.fields = append(schema.fields, group)
+		schema.columns = append(schema.columns, name)
+		known[name] = true
+	}
+
+	// the whole match is the first group, which has no name
+	schema.fields, schema.columns = schema.fields[1:], schema.columns[1:]
+	if !known["orig"] || !known["resp"] {
+		return Schema{}, fmt.Errorf("the expression has no src and dst groups, e.g. SRC=(?P<src>\\S+)")
+	}
+	return schema, nil
+}
+
+/*
+	function to choose the column the segment of each connection is read
+	from, such as vlan or zeek's _node_name. Tab separated and csv inputs
+	must name the column in their header
+*/
+func (self Schema) WithSegment(name string) (Schema, error) {
+	self.segment, self.segmentCol = name, -1
+	switch self.Format {
+	case FormatZeekJSON, FormatNDJSON:
+		return self, nil
+	case FormatCSV, FormatRegex:
+		columns := append([]string(nil), self.columns...)
+		for i, field := range self.fields {
+			if field == name {
+				columns[i] = "segment"
+				self.columns = columns
+				return self, nil
+			}
+		}
+	default:
+		for i, field := range self.fields {
+			if field == name {
+				self.segmentCol = i
+				return self, nil
+			}
+		}
+	}
+	return self, fmt.Errorf("the input has no %v column", name)
+}
+
+/*
+	function to list the columns of a csv header or the groups of a
+	regular expression that aren't read, since they have names that
+	aren't known
+*/
+func (self Schema) Unknown() []string {
+	var unknown []string
+	for i, name := range self.columns {
+		if name == "" {
+			unknown = append(unknown, self.fields[i])
+		}
+	}
+	return unknown
+}
+
+/*
+	function to check whether the input has the link layer addresses of
+	the hosts. Json inputs may have them on some records only, so they
+	are assumed to
+*/
+func (self Schema) HasMACs() bool {
+	switch self.Format {
+	case FormatZeekJSON, FormatNDJSON:
+		return true
+	case FormatCSV, FormatRegex:
+		found := 0
+		for _, name := range self.columns {
+			if name == "orig_mac" || name == "resp_mac" {
+				found++
+			}
+		}
+		return found == 2
+	}
+	return len(self.fields) > 0 && self.macCols[0] >= 0 && self.macCols[1] >= 0
+}
+
+/*
+	function to strip the syslog framing of lines the schema is for, see
+	WithSyslog. Lines without it are taken as they are
+*/
+func (self Schema) WithSyslog() Schema {
+	self.syslog = true
+	return self
+}
+
+/*
+	function to tell whether the lines are framed by syslog
+*/
+func (self Schema) Syslog() bool {
+	return self.syslog
+}
+
+/*
+	function to parse a line of the schema's format into a record,
+	filling in only the given fields
+*/
+func (self Schema) LineWith(line []byte, need Need) (Conn, error) {
+	if self.syslog {
+		line, _ = Unframe(line)
+	}
+	return self.lineWith(line, need)
+}
+
+func (self Schema) lineWith(line []byte, need Need) (Conn, error) {
+	switch self.Format {
+	case FormatZeekJSON, FormatNDJSON:
+		return self.jsonLine(line, need)
+	case FormatCSV:
+		return self.csvLine(line, need)
+	case FormatRegex:
+		return self.regexLine(line, need)
+	}
+	return self.tsvLine(line, need, 0, nil)
+}
+
+/*
+	function to parse a line of the schema's format into a record that
+	keep, if given, decides whether to keep, returning ErrFiltered for
+	the records it turns away. Where lists the fields keep looks at, 0
+	for any of the ones in need. For zeek's tab separated logs keep is
+	pushed down to be checked on just those fields, so that the lines it
+	turns away are skipped before the rest of their fields are converted.
+	The other formats, and filters on the segment or the macs, which
+	come after the standard columns, are parsed in full first
+*/
+func (self Schema) LineWhere(line []byte, need Need, where Need, keep func(Conn) bool) (Conn, error) {
+	if self.syslog {
+		line, _ = Unframe(line)
+	}
+	pushdown := where != 0 && where&(NeedSegment|NeedMACs) == 0
+	switch {
+	case keep == nil:
+		return self.lineWith(line, need)
+	case pushdown && (self.Format == FormatAuto || self.Format == FormatTSV):
+		return self.tsvLine(line, need, where, keep)
+	}
+
+	c, err := self.lineWith(line, need|where)
+	if err == nil && !keep(c) {
+		return Conn{}, ErrFiltered
+	}
+	return c, err
+}
+
+func (self Schema) tsvLine(line []byte, need Need, where Need, keep func(Conn) bool) (Conn, error) {
+	c, err := lineWhere(line, need, where, keep)
+	if err != nil || need&(NeedSegment|NeedMACs) == 0 {
+		return c, err
+	}
+
+	// the optional columns come after the standard ones, at positions
+	// only known from the #fields header
+	last := -1
+	if need&NeedSegment != 0 && self.segment != "" && self.segmentCol > last {
+		last = self.segmentCol
+	}
+	if need&NeedMACs != 0 && self.HasMACs() {
+		for _, col := range self.macCols {
+			if col > last {
+				last = col
+			}
+		}
+	}
+	if last < 0 {
+		return c, nil
+	}
+	fields := make([][]byte, last+1)
+	if !Fields(line, fields) {
+		return c, nil
+	}
+	if need&NeedSegment != 0 && self.segment != "" && self.segmentCol >= 0 {
+		c.Segment = text(fields[self.segmentCol])
+	}
+	if need&NeedMACs != 0 && self.HasMACs() {
+		c.OrigMAC = text(fields[self.macCols[0]])
+		c.RespMAC = text(fields[self.macCols[1]])
+	}
+	return c, nil
+}
+
+func (self Schema) jsonLine(line []byte, need Need) (Conn, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return Conn{}, ErrComment
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(line, &object); err != nil {
+		return Conn{}, err
+	}
+
+	names := plainNames
+	if self.Format == FormatZeekJSON {
+		names = zeekNames
+	}
+	values := make(map[string]string, len(object))
+	for key, raw := range object {
+		if name, ok := names[key]; ok {
+			var s string
+			if json.Unmarshal(raw, &s) != nil {
+				s = string(raw)
+			}
+			values[name] = s
+		}
+	}
+	if raw, ok := object[self.segment]; ok && self.segment != "" {
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			s = string(raw)
+		}
+		values["segment"] = s
+	}
+	return fill(values, need)
+}
+
+func (self Schema) csvLine(line []byte, need Need) (Conn, error) {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 || line[0] == '#' || bytes.Equal(line, self.header) {
+		return Conn{}, ErrComment
+	}
+
+	var fields []string
+	if bytes.IndexByte(line, '"') >= 0 {
+		var err error
+		if fields, err = csv.NewReader(bytes.NewReader(line)).Read(); err != nil {
+			return Conn{}, err
+		}
+	} else {
+		fields = strings.Split(string(line), ",")
+	}
+	if len(fields) != len(self.columns) {
+		return Conn{}, fmt.Errorf("expected %d fields, got %d", len(self.columns), len(fields))
+	}
+
+	values := make(map[string]string, len(fields))
+	for i, name := range self.columns {
+		if name != "" {
+			values[name] = fields[i]
+		}
+	}
+	return fill(values, need)
+}
+
+func (self Schema) regexLine(line []byte, need Need) (Conn, error) {
+	line = bytes.TrimRight(line, "\r")
+	if len(bytes.TrimSpace(line)) == 0 {
+		return Conn{}, ErrComment
+	}
+	match := self.pattern.FindSubmatch(line)
+	if match == nil {
+		return Conn{}, fmt.Errorf("line doesn't match the expression")
+	}
+
+	values := make(map[string]string, len(self.columns))
+	for i, name := range self.columns {
+		if name != "" && match[i+1] != nil {
+			values[name] = string(match[i+1])
+		}
+	}
+	if need&NeedTs != 0 {
+		ts, ok := values["ts"]
+		if !ok {
+			values["ts"] = "0"
+		} else if t, err := time.ParseInLocation(time.Stamp, ts, time.Local); err == nil {
+			values["ts"] = strconv.FormatInt(syslogYear(t, time.Now()).Unix(), 10)
+		}
+	}
+	return fill(values, need)
+}
+
+/*
+	function to place a syslog timestamp, which has no year, in the year
+	that puts it within the last twelve months of now. A day ahead is
+	allowed for clocks that are off
+*/
+func syslogYear(t time.Time, now time.Time) time.Time {
+	t = t.AddDate(now.Year()-t.Year(), 0, 0)
+	if t.After(now.AddDate(0, 0, 1)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+/*
+	function to fill in a record from the values of its named columns.
+	Timestamps may be epoch seconds or RFC3339, as zeek writes them in
+	json logs either way
+*/
+func fill(values map[string]string, need Need) (Conn, error) {
+	number := func(name string) int { return Atoi([]byte(values[name])) }
+
+	var c Conn
+	if need&NeedTs != 0 {
+		ts, err := strconv.ParseFloat(values["ts"], 64)
+		if err != nil {
+			t, err := time.Parse(time.RFC3339Nano, values["ts"])
+			if err != nil {
+				return Conn{}, fmt.Errorf("invalid ts %q", values["ts"])
+			}
+			ts = float64(t.Unix()) + float64(t.Nanosecond())/1e9
+		}
+		c.Ts = ts
+	}
+	if need&NeedAddrs != 0 {
+		orig, err := netip.ParseAddr(values["orig"])
+		if err != nil {
+			return Conn{}, fmt.Errorf("invalid originator %q", values["orig"])
+		}
+		resp, err := netip.ParseAddr(values["resp"])
+		if err != nil {
+			return Conn{}, fmt.Errorf("invalid responder %q", values["resp"])
+		}
+		c.Orig, c.Resp = orig.Unmap(), resp.Unmap()
+	}
+	if need&NeedPort != 0 {
+		c.Port = number("port")
+	}
+	if need&NeedBytes != 0 {
+		if _, ok := values["orig_bytes"]; ok {
+			c.Bytes = number("orig_bytes") + number("resp_bytes")
+		} else {
+			c.Bytes = number("bytes")
+		}
+	}
+	if need&NeedUID != 0 {
+		c.UID = text([]byte(values["uid"]))
+	}
+	if need&NeedOrigPort != 0 {
+		c.OrigPort = number("orig_port")
+	}
+	if need&NeedProto != 0 {
+		c.Proto = text([]byte(values["proto"]))
+	}
+	if need&NeedService != 0 {
+		c.Service = text([]byte(values["service"]))
+	}
+	if need&NeedDuration != 0 {
+		c.Duration, _ = strconv.ParseFloat(values["duration"], 64)
+	}
+	if need&NeedState != 0 {
+		c.State = text([]byte(values["state"]))
+	}
+	if need&NeedHistory != 0 {
+		c.History = text([]byte(values["history"]))
+	}
+	if need&NeedPackets != 0 {
+		c.OrigPkts = number("orig_pkts")
+		c.RespPkts = number("resp_pkts")
+	}
+	if need&NeedDirBytes != 0 {
+		c.OrigBytes = number("orig_bytes")
+		c.RespBytes = number("resp_bytes")
+	}
+	if need&NeedSegment != 0 {
+		c.Segment = text([]byte(values["segment"]))
+	}
+	if need&NeedMACs != 0 {
+		c.OrigMAC = text([]byte(values["orig_mac"]))
+		c.RespMAC = text([]byte(values["resp_mac"]))
+	}
+	return c, nil
+}
+
+/*
+	function to check whether two schemas lay out their lines the same
+	way
+*/
+func (self Schema) Same(other Schema) bool {
+	return self.Format == other.Format && bytes.Equal(self.header, other.header) && self.segmentCol == other.segmentCol &&
+		self.syslog == other.syslog
+}
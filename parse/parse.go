@@ -0,0 +1,303 @@
+/*
+	Description:
+		Parsing of single zeek conn.log lines into records. Everything
+		here is a pure function of its input, so it can be fuzzed and
+		reused outside of the qreader pipeline
+*/
+
+package parse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+)
+
+// returned by Line for blank and comment lines, which hold no record
+var ErrComment = errors.New("not a record")
+
+// returned by the filtering parsers for records their filter turns away
+var ErrFiltered = errors.New("filtered out")
+
+// a parsed conn.log record. Bytes is the sum of the ip bytes of both
+// directions. Only the fields that were asked for are filled in, see
+// Need
+type Conn struct {
+	Ts    float64
+	Orig  netip.Addr
+	Resp  netip.Addr
+	Port  int
+	Bytes int
+
+	UID       string
+	OrigPort  int
+	Proto     string
+	Service   string
+	Duration  float64
+	State     string
+	History   string
+	OrigPkts  int
+	RespPkts  int
+	OrigBytes int
+	RespBytes int
+
+	// the network segment of the connection, such as its vlan or the
+	// sensor that saw it, from the column chosen with Schema.WithSegment
+	Segment string
+
+	// the link layer addresses of the hosts, from the orig_l2_addr and
+	// resp_l2_addr columns zeek adds when logging them is enabled
+	OrigMAC string
+	RespMAC string
+
+	// what an enricher labelled the hosts with, such as their asset tags
+	OrigTag string
+	RespTag string
+}
+
+// set of the fields of a Conn to fill in. Lines are only scanned as far
+// as the last column the set needs, and only those columns are converted
+type Need uint
+
+const (
+	NeedTs Need = 1 << iota
+	NeedAddrs
+	NeedPort
+	NeedBytes
+	NeedUID
+	NeedOrigPort
+	NeedProto
+	NeedService
+	NeedDuration
+	NeedState
+	NeedHistory
+	NeedPackets
+	NeedDirBytes
+	NeedSegment
+	NeedMACs
+
+	NeedAll Need = 1<<iota - 1
+
+	// the fields filled in by Line
+	NeedCore = NeedTs | NeedAddrs | NeedPort | NeedBytes
+)
+
+// the conn.log columns
+const (
+	colTs          = 0
+	colUID         = 1
+	colOrig        = 2
+	colOrigPort    = 3
+	colResp        = 4
+	colRespPort    = 5
+	colProto       = 6
+	colService     = 7
+	colDuration    = 8
+	colState       = 11
+	colHistory     = 14
+	colOrigPkts    = 15
+	colOrigIPBytes = 16
+	colRespPkts    = 17
+	colRespIPBytes = 18
+	numCols        = 19
+)
+
+// the last column each field is read from
+var needCols = []struct {
+	need Need
+	col  int
+}{
+	{NeedTs, colTs},
+	{NeedUID, colUID},
+	{NeedOrigPort, colOrigPort},
+	{NeedAddrs, colResp},
+	{NeedPort, colRespPort},
+	{NeedProto, colProto},
+	{NeedService, colService},
+	{NeedDuration, colDuration},
+	{NeedState, colState},
+	{NeedHistory, colHistory},
+	{NeedPackets, colRespPkts},
+	{NeedBytes, colRespIPBytes},
+	{NeedDirBytes, colRespIPBytes},
+}
+
+/*
+	function to find how many leading columns must be scanned to fill in
+	the given fields
+*/
+func (self Need) Columns() int {
+	n := 0
+	for _, nc := range needCols {
+		if self&nc.need != 0 && nc.col+1 > n {
+			n = nc.col + 1
+		}
+	}
+	return n
+}
+
+/*
+	function to parse a conn.log line, without its newline, into a
+	record with the fields every record has. Unset numeric fields count
+	as 0
+*/
+func Line(line []byte) (Conn, error) {
+	return LineWith(line, NeedCore)
+}
+
+/*
+	function to parse a conn.log line into a record, filling in only the
+	given fields
+*/
+func LineWith(line []byte, need Need) (Conn, error) {
+	return lineWhere(line, need, 0, nil)
+}
+
+/*
+	function to parse a conn.log line like LineWith, but when keep is
+	given, converting only the fields in where first and giving up with
+	ErrFiltered if keep turns the record away
+*/
+func lineWhere(line []byte, need Need, where Need, keep func(Conn) bool) (Conn, error) {
+	if len(line) == 0 || line[0] == '#' {
+		return Conn{}, ErrComment
+	}
+
+	var data [numCols][]byte
+	if cols := (need | where).Columns(); !Fields(line, data[:cols]) {
+		return Conn{}, fmt.Errorf("expected at least %d fields", cols)
+	}
+
+	var c Conn
+	if keep != nil {
+		if err := c.fillColumns(&data, where); err != nil {
+			return Conn{}, err
+		}
+		if !keep(c) {
+			return Conn{}, ErrFiltered
+		}
+		need &^= where
+	}
+	if err := c.fillColumns(&data, need); err != nil {
+		return Conn{}, err
+	}
+	return c, nil
+}
+
+/*
+	function to convert the given fields of a record from the columns of
+	its line
+*/
+func (self *Conn) fillColumns(data *[numCols][]byte, need Need) error {
+	var err error
+	if need&NeedTs != 0 {
+		if self.Ts, err = strconv.ParseFloat(string(data[colTs]), 64); err != nil {
+			return fmt.Errorf("invalid ts %q", data[colTs])
+		}
+	}
+	if need&NeedAddrs != 0 {
+		orig, err := netip.ParseAddr(string(data[colOrig]))
+		if err != nil {
+			return fmt.Errorf("invalid originator %q", data[colOrig])
+		}
+		resp, err := netip.ParseAddr(string(data[colResp]))
+		if err != nil {
+			return fmt.Errorf("invalid responder %q", data[colResp])
+		}
+		self.Orig, self.Resp = orig.Unmap(), resp.Unmap()
+	}
+	if need&NeedPort != 0 {
+		self.Port = Atoi(data[colRespPort])
+	}
+	if need&NeedBytes != 0 {
+		self.Bytes = Atoi(data[colOrigIPBytes]) + Atoi(data[colRespIPBytes])
+	}
+	if need&^NeedCore == 0 {
+		return nil
+	}
+
+	if need&NeedUID != 0 {
+		self.UID = text(data[colUID])
+	}
+	if need&NeedOrigPort != 0 {
+		self.OrigPort = Atoi(data[colOrigPort])
+	}
+	if need&NeedProto != 0 {
+		self.Proto = text(data[colProto])
+	}
+	if need&NeedService != 0 {
+		self.Service = text(data[colService])
+	}
+	if need&NeedDuration != 0 {
+		self.Duration, _ = strconv.ParseFloat(string(data[colDuration]), 64)
+	}
+	if need&NeedState != 0 {
+		self.State = text(data[colState])
+	}
+	if need&NeedHistory != 0 {
+		self.History = text(data[colHistory])
+	}
+	if need&NeedPackets != 0 {
+		self.OrigPkts = Atoi(data[colOrigPkts])
+		self.RespPkts = Atoi(data[colRespPkts])
+	}
+	if need&NeedDirBytes != 0 {
+		self.OrigBytes = Atoi(data[colOrigIPBytes])
+		self.RespBytes = Atoi(data[colRespIPBytes])
+	}
+	return nil
+}
+
+/*
+	function to copy a text field, with zeek's "-" for unset values
+	becoming empty
+*/
+func text(field []byte) string {
+	if len(field) == 1 && field[0] == '-' {
+		return ""
+	}
+	return string(field)
+}
+
+/*
+	function to fill fields with the leading tab separated fields of a
+	line, stopping once it is full. Returns false if the line has fewer
+	fields than that. The fields are found with bytes.IndexByte, which
+	the go runtime implements with vector instructions, and they slice
+	the line in place
+*/
+func Fields(line []byte, fields [][]byte) bool {
+	for i := range fields {
+		if line == nil {
+			return false
+		}
+		if tab := bytes.IndexByte(line, '\t'); tab >= 0 {
+			fields[i] = line[:tab]
+			line = line[tab+1:]
+		} else {
+			fields[i] = line
+			line = nil
+		}
+	}
+	return true
+}
+
+/*
+	function to parse a non-negative decimal field, giving 0 for anything
+	else such as zeek's "-" for unset values
+*/
+func Atoi(field []byte) int {
+	if len(field) == 0 || len(field) > 18 {
+		return 0
+	}
+	n := 0
+	for _, c := range field {
+		if c < '0' || c > '9' {
+			return 0
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n
+}
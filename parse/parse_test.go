@@ -0,0 +1,337 @@
+package parse
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func record(fields map[int]string) []byte {
+	cols := make([]string, numCols+1)
+	for i := range cols {
+		cols[i] = "-"
+	}
+	for i, v := range fields {
+		cols[i] = v
+	}
+	return []byte(strings.Join(cols, "\t"))
+}
+
+func TestLine(t *testing.T) {
+	c, err := Line(record(map[int]string{0: "1600000000.25", 2: "128.252.0.1", 4: "::ffff:8.8.8.8", 5: "443", 16: "100", 18: "50"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Conn{Ts: 1600000000.25, Orig: netip.MustParseAddr("128.252.0.1"), Resp: netip.MustParseAddr("8.8.8.8"), Port: 443, Bytes: 150}
+	if c != want {
+		t.Errorf("got %+v, expected %+v", c, want)
+	}
+
+	// unset byte counts are zero
+	c, err = Line(record(map[int]string{0: "1", 2: "10.0.0.1", 4: "10.0.0.2"}))
+	if err != nil || c.Bytes != 0 || c.Port != 0 {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
+
+func TestLineWith(t *testing.T) {
+	line := record(map[int]string{0: "1", 1: "CAbc", 2: "10.0.0.1", 3: "5353", 4: "10.0.0.2", 5: "53", 6: "udp", 7: "dns",
+		8: "0.5", 11: "SF", 14: "Dd", 15: "2", 16: "120", 17: "3", 18: "300"})
+
+	c, err := LineWith(line, NeedAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UID != "CAbc" || c.OrigPort != 5353 || c.Proto != "udp" || c.Service != "dns" || c.Duration != 0.5 ||
+		c.State != "SF" || c.History != "Dd" || c.OrigPkts != 2 || c.RespPkts != 3 || c.OrigBytes != 120 || c.RespBytes != 300 {
+		t.Errorf("unexpected record %+v", c)
+	}
+
+	// only what was asked for is filled in
+	c, _ = LineWith(line, NeedProto)
+	if c.Proto != "udp" || c.UID != "" || c.OrigPkts != 0 || c.Orig.IsValid() {
+		t.Errorf("unexpected record %+v", c)
+	}
+
+	// and the line only has to be as long as the columns that are needed
+	if _, err := LineWith([]byte("1	CAbc	10.0.0.1	5353	10.0.0.2	53	udp"), NeedTs|NeedAddrs|NeedProto); err != nil {
+		t.Errorf("short line rejected: %v", err)
+	}
+	if _, err := LineWith([]byte("1	CAbc	10.0.0.1	5353	10.0.0.2	53	udp"), NeedBytes); err == nil {
+		t.Error("expected a line without the byte columns to be rejected")
+	}
+}
+
+func TestLineRejects(t *testing.T) {
+	for _, line := range []string{"", "#fields\tts", "1\tC\t10.0.0.1", string(record(map[int]string{0: "1", 2: "bad", 4: "10.0.0.2"}))} {
+		if _, err := Line([]byte(line)); err == nil {
+			t.Errorf("expected %q to be rejected", line)
+		}
+	}
+	if _, err := Line([]byte("#close\t2020")); err != ErrComment {
+		t.Errorf("expected ErrComment for a comment, got %v", err)
+	}
+}
+
+func TestFields(t *testing.T) {
+	var fields [3][]byte
+	if !Fields([]byte("a\t\tc\td"), fields[:]) {
+		t.Fatal("expected the line to have enough fields")
+	}
+	if string(fields[0]) != "a" || string(fields[1]) != "" || string(fields[2]) != "c" {
+		t.Errorf("unexpected fields %q", fields)
+	}
+	if !Fields([]byte("a\tb\t"), fields[:]) || string(fields[2]) != "" {
+		t.Errorf("expected an empty trailing field, got %q", fields)
+	}
+	if Fields([]byte("a\tb"), fields[:]) {
+		t.Error("expected a short line to be rejected")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	cases := map[string]Format{
+		"#separator \\x09\n#fields\tts\n":                               FormatTSV,
+		"1\tC1\t10.0.0.1\t1\t10.0.0.2\t53\n":                            FormatTSV,
+		`{"ts":1,"id.orig_h":"10.0.0.1","id.resp_h":"10.0.0.2"}` + "\n": FormatZeekJSON,
+		"\n" + `{"ts":1,"orig":"10.0.0.1","resp":"10.0.0.2","bytes":5}`: FormatNDJSON,
+		"ts,id.orig_h,id.resp_h,orig_ip_bytes\n1,10.0.0.1,10.0.0.2,5\n": FormatCSV,
+	}
+	for head, want := range cases {
+		schema, err := Detect([]byte(head))
+		if err != nil || schema.Format != want {
+			t.Errorf("%q: got %v, %v, expected %v", head, schema.Format, err, want)
+		}
+	}
+
+	for _, head := range []string{"", "#comment\n", "1\t2,3\n", "a,b,c\n", `{"ts":1}`, "{not json"} {
+		if schema, err := Detect([]byte(head)); err == nil {
+			t.Errorf("%q: expected an error, got %v", head, schema.Format)
+		}
+	}
+}
+
+func TestSchemaLine(t *testing.T) {
+	want := Conn{Ts: 1600000000.25, Orig: netip.MustParseAddr("10.0.0.1"), Resp: netip.MustParseAddr("10.0.0.2"), Port: 53, Bytes: 150}
+	inputs := []string{
+		`{"ts":1600000000.25,"id.orig_h":"10.0.0.1","id.resp_h":"10.0.0.2","id.resp_p":53,"orig_bytes":1,"orig_ip_bytes":100,"resp_ip_bytes":50}`,
+		`{"ts":"2020-09-13T12:26:40.25Z","id.orig_h":"10.0.0.1","id.resp_h":"10.0.0.2","id.resp_p":53,"orig_ip_bytes":100,"resp_ip_bytes":50}`,
+		`{"ts":1600000000.25,"orig":"10.0.0.1","resp":"10.0.0.2","port":53,"bytes":150}`,
+		"ts,id.orig_h,id.resp_h,id.resp_p,orig_ip_bytes,resp_ip_bytes\n1600000000.25,10.0.0.1,10.0.0.2,53,100,50",
+		"ts,orig,resp,port,extra,bytes\n1600000000.25,10.0.0.1,10.0.0.2,53,\"a,b\",150",
+	}
+	for _, input := range inputs {
+		schema, err := Detect([]byte(input))
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		lines := strings.Split(input, "\n")
+		if schema.Format == FormatCSV {
+			if _, err := schema.LineWith([]byte(lines[0]), NeedCore); err != ErrComment {
+				t.Errorf("%q: header row not skipped: %v", input, err)
+			}
+		}
+		c, err := schema.LineWith([]byte(lines[len(lines)-1]), NeedCore)
+		if err != nil || c != want {
+			t.Errorf("%v: got %+v, %v, expected %+v", schema.Format, c, err, want)
+		}
+	}
+}
+
+func TestWithSegment(t *testing.T) {
+	columns := strings.Repeat("\tx", numCols) + "\tvlan"
+	inputs := []string{
+		"#separator \\x09\n#fields" + columns + "\n" + string(record(map[int]string{0: "1", 2: "10.0.0.1", 4: "10.0.0.2", numCols: "20"})),
+		`{"ts":1,"id.orig_h":"10.0.0.1","id.resp_h":"10.0.0.2","vlan":20}`,
+		"ts,orig,resp,vlan\n1,10.0.0.1,10.0.0.2,20",
+	}
+	for _, input := range inputs {
+		schema, err := Detect([]byte(input))
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if _, err := schema.WithSegment("sensor"); err == nil && schema.Format != FormatZeekJSON {
+			t.Errorf("%v: expected an error for a missing column", schema.Format)
+		}
+		if schema, err = schema.WithSegment("vlan"); err != nil {
+			t.Fatalf("%v: %v", schema.Format, err)
+		}
+		lines := strings.Split(input, "\n")
+		c, err := schema.LineWith([]byte(lines[len(lines)-1]), NeedTs|NeedAddrs|NeedSegment)
+		if err != nil || c.Segment != "20" {
+			t.Errorf("%v: got segment %q, %v", schema.Format, c.Segment, err)
+		}
+	}
+}
+
+func TestMACs(t *testing.T) {
+	columns := strings.Repeat("\tx", numCols) + "\torig_l2_addr\tresp_l2_addr"
+	inputs := []string{
+		"#separator \\x09\n#fields" + columns + "\n" + string(record(map[int]string{0: "1", 2: "10.0.0.1", 4: "10.0.0.2", numCols: "00:11:22:33:44:55"})) + "\t66:77:88:99:aa:bb",
+		`{"ts":1,"id.orig_h":"10.0.0.1","id.resp_h":"10.0.0.2","orig_l2_addr":"00:11:22:33:44:55","resp_l2_addr":"66:77:88:99:aa:bb"}`,
+		"ts,orig,resp,orig_mac,resp_mac\n1,10.0.0.1,10.0.0.2,00:11:22:33:44:55,66:77:88:99:aa:bb",
+	}
+	for _, input := range inputs {
+		schema, err := Detect([]byte(input))
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if !schema.HasMACs() {
+			t.Fatalf("%v: expected mac columns", schema.Format)
+		}
+		lines := strings.Split(input, "\n")
+		c, err := schema.LineWith([]byte(lines[len(lines)-1]), NeedTs|NeedAddrs|NeedMACs)
+		if err != nil || c.OrigMAC != "00:11:22:33:44:55" || c.RespMAC != "66:77:88:99:aa:bb" {
+			t.Errorf("%v: got %q %q, %v", schema.Format, c.OrigMAC, c.RespMAC, err)
+		}
+	}
+	if schema, _ := Detect([]byte("ts,orig,resp\n1,10.0.0.1,10.0.0.2")); schema.HasMACs() {
+		t.Errorf("expected no mac columns")
+	}
+}
+
+func FuzzLine(f *testing.F) {
+	f.Add(record(map[int]string{0: "1600000000.25", 2: "128.252.0.1", 4: "8.8.8.8", 5: "443", 16: "100", 18: "50"}))
+	f.Add([]byte("#fields\tts"))
+	f.Add([]byte(""))
+	f.Fuzz(func(t *testing.T, line []byte) {
+		c, err := Line(line)
+		if err != nil {
+			return
+		}
+		if !c.Orig.IsValid() || !c.Resp.IsValid() {
+			t.Errorf("accepted a record without addresses: %+v", c)
+		}
+		if c.Port < 0 || c.Bytes < 0 {
+			t.Errorf("accepted negative counts: %+v", c)
+		}
+	})
+}
+
+func TestSniff(t *testing.T) {
+	wrong := map[string]string{
+		"\xd4\xc3\xb2\xa1\x02\x00\x04\x00": "pcap",
+		"\x1f\x8b\x08\x00":                 "gzip",
+		"\x00\x01\x02\x03 some text":       "binary",
+		"\n<!DOCTYPE html>\n<html>":        "html",
+		"#separator \\x09\n#path\tdns\n":   "zeek dns log",
+		`{"_path":"http","ts":1}` + "\n":   "zeek http log",
+	}
+	for head, want := range wrong {
+		err := Sniff([]byte(head))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, expected it to be taken for %v", head, err, want)
+		}
+	}
+
+	for _, head := range []string{
+		"",
+		"#separator \\x09\n#path\tconn\n#fields\tts\n1\tC1\t10.0.0.1\n",
+		`{"_path":"conn","ts":1}`,
+		`{"ts":1,"orig":"10.0.0.1","resp":"10.0.0.2","bytes":5}`,
+		"ts,orig,resp\n1,10.0.0.1,10.0.0.2 caf\xc3",
+	} {
+		if err := Sniff([]byte(head)); err != nil {
+			t.Errorf("%q: %v", head, err)
+		}
+	}
+}
+
+func TestLineWhere(t *testing.T) {
+	https := func(c Conn) bool { return c.Port == 443 }
+	kept := record(map[int]string{0: "1", 2: "10.0.0.1", 4: "10.0.0.2", 5: "443", 16: "100", 18: "50"})
+	c, err := TSV.LineWhere(kept, NeedCore, NeedPort, https)
+	if err != nil || c.Ts != 1 || c.Orig != netip.MustParseAddr("10.0.0.1") || c.Bytes != 150 {
+		t.Errorf("got %+v, %v", c, err)
+	}
+
+	// a line the filter turns away isn't converted any further, so its
+	// invalid timestamp goes unnoticed
+	other := record(map[int]string{0: "never", 2: "10.0.0.1", 4: "10.0.0.2", 5: "80"})
+	if _, err := TSV.LineWhere(other, NeedCore, NeedPort, https); err != ErrFiltered {
+		t.Errorf("got %v, expected ErrFiltered", err)
+	}
+	if _, err := TSV.LineWhere(other, NeedCore, 0, https); err == nil || err == ErrFiltered {
+		t.Errorf("got %v for a filter on unknown fields", err)
+	}
+
+	schema, err := Detect([]byte("ts,orig,resp,port,bytes\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schema.LineWhere([]byte("1,10.0.0.1,10.0.0.2,80,5"), NeedCore, NeedPort, https); err != ErrFiltered {
+		t.Errorf("got %v from csv, expected ErrFiltered", err)
+	}
+}
+
+func TestRegexSchema(t *testing.T) {
+	schema, err := RegexSchema(`^(?P<ts>\w{3} [ \d]\d \d\d:\d\d:\d\d) \S+ kernel: .*SRC=(?P<src>\S+) DST=(?P<dst>\S+) LEN=(?P<bytes>\d+) .*PROTO=(?P<proto>\w+)(?: SPT=(?P<sport>\d+) DPT=(?P<dport>\d+))?(?: IN=(?P<iface>\S+))?`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown := schema.Unknown(); len(unknown) != 1 || unknown[0] != "iface" {
+		t.Errorf("got unknown groups %v", unknown)
+	}
+
+	line := "Mar  4 10:20:30 fw kernel: DROP IN=eth0 SRC=10.0.0.1 DST=192.0.2.7 LEN=60 TTL=64 PROTO=TCP SPT=51000 DPT=443"
+	c, err := schema.LineWith([]byte(line), NeedAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(int64(c.Ts), 0).Local()
+	if c.Orig != netip.MustParseAddr("10.0.0.1") || c.Resp != netip.MustParseAddr("192.0.2.7") || c.Bytes != 60 ||
+		c.Port != 443 || c.OrigPort != 51000 || c.Proto != "TCP" || ts.Month() != time.March || ts.Hour() != 10 {
+		t.Errorf("got %+v at %v", c, ts)
+	}
+
+	// lines that don't match are malformed, the optional groups may be missing
+	if _, err := schema.LineWith([]byte("Mar  4 10:20:30 fw sshd: session opened"), NeedAll); err == nil {
+		t.Errorf("parsed a line that doesn't match")
+	}
+	if c, err := schema.LineWith([]byte("Mar  4 10:20:30 fw kernel: SRC=10.0.0.1 DST=10.0.0.2 LEN=84 PROTO=ICMP"), NeedAll); err != nil || c.Port != 0 {
+		t.Errorf("got %+v, %v", c, err)
+	}
+
+	if _, err := RegexSchema(`(?P<src>\S+) (?P<bytes>\d+)`); err == nil {
+		t.Errorf("accepted an expression without a dst group")
+	}
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	if got := syslogYear(time.Date(0, 12, 31, 23, 0, 0, 0, time.UTC), now); got.Year() != 2023 {
+		t.Errorf("placed december in %v", got.Year())
+	}
+}
+
+func TestUnframe(t *testing.T) {
+	record := "1600000000.1\tC1\t10.0.0.1\t1\t10.0.0.2\t53"
+	escaped := strings.ReplaceAll(record, "\t", "#011")
+	for _, test := range []struct {
+		line   string
+		msg    string
+		framed bool
+	}{
+		{"<134>Mar  4 10:20:30 sensor zeek: " + escaped, record, true},
+		{"<134>Mar 14 10:20:30 sensor zeek[42]: " + record, record, true},
+		{"Mar  4 10:20:30 sensor " + record, record, true},
+		{"<134>1 2024-03-04T10:20:30.1Z sensor zeek 42 conn - " + record, record, true},
+		{`<134>1 2024-03-04T10:20:30Z sensor zeek - - [origin ip="10.0.0.9" x="a\]b"][meta seq="1"] ` + "\xef\xbb\xbf" + record, record, true},
+		{record, record, false},
+		{`{"ts":1}`, `{"ts":1}`, false},
+		{"<html>", "<html>", false},
+	} {
+		msg, framed := Unframe([]byte(test.line))
+		if string(msg) != test.msg || framed != test.framed {
+			t.Errorf("%q: got %q, %v", test.line, msg, framed)
+		}
+	}
+
+	head := "<134>Mar  4 10:20:30 sensor zeek: #separator \\x09\n<134>Mar  4 10:20:30 sensor zeek: " + escaped + "\n"
+	schema, err := Detect([]byte(head))
+	if err != nil || !schema.Syslog() || schema.Format != FormatTSV {
+		t.Fatalf("got %v, %v", schema.Format, err)
+	}
+	c, err := schema.LineWith([]byte("<134>Mar  4 10:20:30 sensor zeek: "+escaped), NeedAddrs)
+	if err != nil || c.Resp != netip.MustParseAddr("10.0.0.2") {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+	Description:
+		Recognizes inputs that are clearly not connection logs from their
+		head, such as packet captures, compressed files without a .gz
+		name, other zeek logs and web pages saved from a bad url, so that
+		they can be turned away with a message saying what they are
+		instead of being parsed into an empty report
+*/
+
+package parse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// the leading bytes of binary formats inputs are mistaken for
+var magics = []struct {
+	magic []byte
+	what  string
+}{
+	{[]byte{0xd4, 0xc3, 0xb2, 0xa1}, "a pcap packet capture"},
+	{[]byte{0xa1, 0xb2, 0xc3, 0xd4}, "a pcap packet capture"},
+	{[]byte{0x4d, 0x3c, 0xb2, 0xa1}, "a pcap packet capture"},
+	{[]byte{0xa1, 0xb2, 0x3c, 0x4d}, "a pcap packet capture"},
+	{[]byte{0x0a, 0x0d, 0x0d, 0x0a}, "a pcapng packet capture"},
+	{[]byte{0x1f, 0x8b}, "gzip compressed data, which is only decompressed when the name ends in .gz"},
+	{[]byte("BZh"), "bzip2 compressed data"},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, "xz compressed data"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "zstd compressed data"},
+	{[]byte("PK\x03\x04"), "a zip archive"},
+	{[]byte("SQLite format 3\x00"), "an sqlite database"},
+}
+
+// the share of a head that may be control bytes before it is taken for
+// binary data
+const binaryShare = 0.05
+
+/*
+	function to check the head of an input for signs that it isn't a
+	connection log at all, returning an error that says what it looks
+	like instead
+*/
+func Sniff(head []byte) error {
+	if len(head) == 0 {
+		return nil
+	}
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m.magic) {
+			return fmt.Errorf("input is %v, not a connection log", m.what)
+		}
+	}
+	if binary(head) {
+		return fmt.Errorf("input is binary data, not a connection log")
+	}
+
+	first := bytes.TrimLeft(head, " \t\r\n\ufeff")
+	lower := bytes.ToLower(first[:min(len(first), 64)])
+	for _, prefix := range []string{"<!doctype html", "<html", "<?xml", "<head", "<body"} {
+		if bytes.HasPrefix(lower, []byte(prefix)) {
+			return fmt.Errorf("input is an html or xml page, such as the error page of a bad url, not a connection log")
+		}
+	}
+
+	// zeek names the log type in the #path header of its tab separated
+	// logs, and optionally in a _path field of its json logs
+	for len(first) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(first, '\n'); i >= 0 {
+			line, first = first[:i], first[i+1:]
+		} else {
+			line, first = first, nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		line, _ = Unframe(line)
+		if bytes.HasPrefix(line, []byte("#path\t")) {
+			return checkPath(string(line[len("#path\t"):]))
+		}
+		if len(line) > 0 && line[0] == '{' {
+			var record struct {
+				Path *string `json:"_path"`
+			}
+			if json.Unmarshal(line, &record) == nil && record.Path != nil {
+				return checkPath(*record.Path)
+			}
+			return nil
+		}
+		if len(line) > 0 && line[0] != '#' {
+			return nil
+		}
+	}
+	return nil
+}
+
+func checkPath(path string) error {
+	if path == "conn" || path == "" {
+		return nil
+	}
+	return fmt.Errorf("input is a zeek %v log, not a conn log", path)
+}
+
+/*
+	function to tell whether a head holds binary data: a NUL byte, or
+	more than binaryShare of control characters or invalid utf-8
+*/
+func binary(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return true
+	}
+	// a multibyte character cut off at the end of the head is no sign
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+
+	total, odd := len(head), 0
+	for len(head) > 0 {
+		r, size := utf8.DecodeRune(head)
+		head = head[size:]
+		if r == utf8.RuneError && size == 1 {
+			odd++
+		} else if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			odd++
+		}
+	}
+	return float64(odd) > binaryShare*float64(total)
+}
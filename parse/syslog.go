@@ -0,0 +1,172 @@
+/*
+	Description:
+		Syslog framing of lines relayed through rsyslog or another syslog
+		daemon, in the RFC3164 or the RFC5424 layout. The priority,
+		timestamp, host and tag are stripped so that the message can be
+		parsed like a line of the log it was relayed from
+*/
+
+package parse
+
+import (
+	"bytes"
+	"time"
+)
+
+// the escape rsyslog writes the tabs of messages as by default
+var escapedTab = []byte("#011")
+
+// the byte order mark RFC5424 allows at the start of a message
+var bom = []byte("\xef\xbb\xbf")
+
+func digits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+/*
+	function to strip the syslog framing from a line, returning its
+	message and whether the line was framed. RFC3164 lines may come
+	without a priority, as syslog daemons write them to files, and tabs
+	escaped as #011 are turned back into tabs
+*/
+func Unframe(line []byte) ([]byte, bool) {
+	rest := line
+	pri := false
+	if len(rest) > 2 && rest[0] == '<' {
+		i := bytes.IndexByte(rest[:min(len(rest), 5)], '>')
+		if i < 0 || !digits(rest[1:i]) {
+			return line, false
+		}
+		rest, pri = rest[i+1:], true
+	}
+
+	var msg []byte
+	var ok bool
+	if pri && len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		msg, ok = unframe5424(rest[2:])
+	} else {
+		msg, ok = unframe3164(rest)
+	}
+	if !ok {
+		return line, false
+	}
+	if bytes.Contains(msg, escapedTab) {
+		msg = bytes.ReplaceAll(msg, escapedTab, []byte("\t"))
+	}
+	return msg, true
+}
+
+/*
+	function to strip the timestamp, host and tag of an RFC3164 line,
+	Mmm dd hh:mm:ss host tag: message. The tag is optional
+*/
+func unframe3164(rest []byte) ([]byte, bool) {
+	if len(rest) < len(time.Stamp)+1 || rest[len(time.Stamp)] != ' ' {
+		return nil, false
+	}
+	if _, err := time.Parse(time.Stamp, string(rest[:len(time.Stamp)])); err != nil {
+		return nil, false
+	}
+	rest = rest[len(time.Stamp)+1:]
+	i := bytes.IndexByte(rest, ' ')
+	if i <= 0 {
+		return nil, false
+	}
+	rest = rest[i+1:]
+
+	// a tag is a word ending in a colon, such as zeek: or zeek[42]:
+	if i := bytes.IndexByte(rest, ' '); i > 0 && rest[i-1] == ':' && bytes.IndexByte(rest[:i], '\t') < 0 {
+		rest = rest[i+1:]
+	}
+	return rest, true
+}
+
+/*
+	function to strip the header and structured data of an RFC5424 line,
+	from the timestamp after the version:
+		timestamp host app procid msgid structured-data message
+*/
+func unframe5424(rest []byte) ([]byte, bool) {
+	for field := 0; field < 5; field++ {
+		i := bytes.IndexByte(rest, ' ')
+		if i <= 0 {
+			return nil, false
+		}
+		rest = rest[i+1:]
+	}
+
+	// structured data is - or elements in brackets, whose values are
+	// quoted and may hold escaped quotes and brackets
+	switch {
+	case len(rest) > 0 && rest[0] == '-':
+		rest = rest[1:]
+	case len(rest) > 0 && rest[0] == '[':
+		end := structuredEnd(rest)
+		if end < 0 {
+			return nil, false
+		}
+		rest = rest[end:]
+	default:
+		return nil, false
+	}
+
+	if len(rest) > 0 {
+		if rest[0] != ' ' {
+			return nil, false
+		}
+		rest = rest[1:]
+	}
+	return bytes.TrimPrefix(rest, bom), true
+}
+
+/*
+	function to find the end of the structured data elements at the start
+	of a line, -1 if they aren't closed
+*/
+func structuredEnd(rest []byte) int {
+	quoted := false
+	for i := 0; i < len(rest); i++ {
+		switch c := rest[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == ']' && !quoted && (i+1 == len(rest) || rest[i+1] != '['):
+			return i + 1
+		}
+	}
+	return -1
+}
+
+/*
+	function to strip the framing from each line of the head of an input
+	whose first line is framed, for detecting the format of the messages
+*/
+func unframeHead(head []byte) ([]byte, bool) {
+	var out []byte
+	first := true
+	for len(head) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(head, '\n'); i >= 0 {
+			line, head = head[:i], head[i+1:]
+		} else {
+			line, head = head, nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		msg, ok := Unframe(line)
+		if first && !ok {
+			return nil, false
+		}
+		first = false
+		out = append(append(out, msg...), '\n')
+	}
+	return out, !first
+}
@@ -0,0 +1,113 @@
+/*
+	Description:
+		Splits the aggregation keys between the workers of a distributed
+		run, so that each worker reads all the inputs but only keeps its
+		own share of the keys. The shares are disjoint, which turns the
+		final merge into a concatenation and bounds the memory of each
+		worker by its share rather than by the whole key space
+*/
+
+package qreader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// one of Count shares of the key space
+type Partition struct {
+	Index int
+	Count int
+}
+
+// the share of the keys this process aggregates, nil for all of them
+var KeyPartition *Partition
+
+/*
+	function to parse a partition such as "2/8", counting from 0
+*/
+func ParsePartition(s string) (*Partition, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid partition %q, expected index/count", s)
+	}
+	index, err1 := strconv.Atoi(parts[0])
+	count, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || count <= 0 || index < 0 || index >= count {
+		return nil, fmt.Errorf("invalid partition %q, expected index/count with 0 <= index < count", s)
+	}
+	return &Partition{index, count}, nil
+}
+
+func (self *Partition) String() string {
+	return fmt.Sprintf("%d/%d", self.Index, self.Count)
+}
+
+/*
+	function to map a hash onto one of the buckets with the jump
+	consistent hash of Lamping and Veach, which moves only 1/n of the
+	keys when going from n-1 to n buckets
+*/
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (self *Partition) owns(key []byte) bool {
+	h := fnv.New64a()
+	h.Write(key)
+	return jumpHash(h.Sum64(), self.Count) == self.Index
+}
+
+/*
+	functions to decide whether a key is in the partition. They are safe
+	to call on a nil partition, which owns every key
+*/
+func (self *Partition) OwnsAddr(ip netip.Addr) bool {
+	if self == nil {
+		return true
+	}
+	key := ip.As16()
+	return self.owns(key[:])
+}
+
+func (self *Partition) OwnsPair(pair [2]netip.Addr) bool {
+	if self == nil {
+		return true
+	}
+	a, b := pair[0].As16(), pair[1].As16()
+	return self.owns(append(a[:], b[:]...))
+}
+
+func (self *Partition) OwnsString(s string) bool {
+	if self == nil {
+		return true
+	}
+	return self.owns([]byte(s))
+}
+
+func (self *Partition) OwnsInt(n int64) bool {
+	if self == nil {
+		return true
+	}
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], uint64(n))
+	return self.owns(key[:])
+}
+
+func (self *Partition) OwnsPrefix(prefix netip.Prefix) bool {
+	if self == nil {
+		return true
+	}
+	key := prefix.Addr().As16()
+	return self.owns(append(key[:], byte(prefix.Bits())))
+}
@@ -0,0 +1,272 @@
+/*
+	Description:
+		Builder for assembling and running the reader, parser, batcher,
+		reducer and combiner stages, so that callers can swap out stages
+		and tune the pool and buffer sizes without wiring up channels
+*/
+
+package qreader
+
+import (
+	"context"
+)
+
+// queue lengths between the stages, reported while a pipeline runs
+type Status struct {
+	Read    int
+	Parsed  int
+	Batched int
+	Reduced int
+
+	// number of hosts in the partial results combined so far
+	Done int
+}
+
+type Pipeline struct {
+	workers int
+	bsize   int
+	buffer  int
+	overlap string
+
+	// the settings of every run, nil for the Defaults at the time
+	settings *Settings
+
+	inputs   []string
+	streams  []streamSource
+	parse    func(Block) []Conn
+	reduce   func([]Conn) *Partial
+	taps     []chan []Conn
+	enrich   []Enricher
+	warn     func(InputWarning)
+	sinks    []func(Result) error
+	progress func(Status)
+}
+
+// functional options of New
+type Option func(*Pipeline)
+
+/*
+	option to set the number of workers shared by the parse and reduce
+	stages
+*/
+func WithWorkers(n int) Option {
+	return func(p *Pipeline) { p.workers = n }
+}
+
+/*
+	option to set the size of the blocks the inputs are read in
+*/
+func WithBlockSize(n int) Option {
+	return func(p *Pipeline) { p.bsize = n }
+}
+
+/*
+	option to set how many items each queue between the stages holds
+*/
+func WithBuffer(n int) Option {
+	return func(p *Pipeline) { p.buffer = n }
+}
+
+/*
+	option to set what happens to inputs whose data overlaps an earlier
+	input, either warn or skip
+*/
+func WithOverlap(policy string) Option {
+	return func(p *Pipeline) { p.overlap = policy }
+}
+
+/*
+	option to run with the given settings rather than the package level
+	ones, which makes the pipeline independent of them
+*/
+func WithSettings(settings Settings) Option {
+	return func(p *Pipeline) { p.settings = &settings }
+}
+
+/*
+	function to create a pipeline with the default conn.log parser and
+	reducer
+*/
+func New(opts ...Option) *Pipeline {
+	p := &Pipeline{
+		workers: Workers,
+		bsize:   1 << 20,
+		buffer:  10000,
+		overlap: "warn",
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+/*
+	function to add input files, or glob patterns the files they match
+	are read for, see ExpandInputs. With more than one input they are
+	read in the order of the time range of their data
+*/
+func (self *Pipeline) Source(filenames ...string) *Pipeline {
+	self.inputs = append(self.inputs, filenames...)
+	return self
+}
+
+/*
+	function to replace the function that parses a block of lines
+*/
+func (self *Pipeline) Parser(parse func(Block) []Conn) *Pipeline {
+	self.parse = parse
+	return self
+}
+
+/*
+	function to replace the function that sums a batch of records
+*/
+func (self *Pipeline) Reducer(reduce func([]Conn) *Partial) *Pipeline {
+	self.reduce = reduce
+	return self
+}
+
+/*
+	function to add an enricher of the parsed records, called after those
+	of the settings in the order they were added
+*/
+func (self *Pipeline) Enrich(enricher Enricher) *Pipeline {
+	self.enrich = append(self.enrich, enricher)
+	return self
+}
+
+/*
+	function to have every batch of parsed records sent to a channel as
+	well, which must be read until the pipeline is done. Each added
+	channel receives every batch
+*/
+func (self *Pipeline) Tap(tap chan []Conn) *Pipeline {
+	self.taps = append(self.taps, tap)
+	return self
+}
+
+/*
+	function to have the problems found in the inputs sent to a channel
+	instead of being logged, which must be read until the pipeline is
+	done
+*/
+func (self *Pipeline) Warnings(warnings chan InputWarning) *Pipeline {
+	self.warn = func(warning InputWarning) { warnings <- warning }
+	return self
+}
+
+/*
+	function to add a function that receives the final result. Sinks are
+	called in the order they were added, stopping at the first error
+*/
+func (self *Pipeline) Sink(sink func(Result) error) *Pipeline {
+	self.sinks = append(self.sinks, sink)
+	return self
+}
+
+/*
+	function to have the queue lengths reported now and then while the
+	pipeline runs
+*/
+func (self *Pipeline) Progress(progress func(Status)) *Pipeline {
+	self.progress = progress
+	return self
+}
+
+/*
+	function to run the pipeline over its inputs and pass the result to
+	the sinks. When the context is cancelled reading stops, and the
+	result of the data read so far is returned with the context's error.
+	A pipeline can be run again, and by several goroutines at once,
+	since each run has stages and a copy of the settings of its own.
+	Only its streams can't be read twice
+*/
+func (self *Pipeline) Run(ctx context.Context) (Result, error) {
+	// the reader stops the run with the limit it reached as the cause
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+
+	settings := Defaults()
+	if self.settings != nil {
+		settings = *self.settings
+	}
+	inputs, err := ExpandInputs(self.inputs)
+	if err != nil {
+		return Result{}, err
+	}
+	parse, reduce := self.parse, self.reduce
+	if parse == nil {
+		parse = settings.ParseBlock
+	}
+	if reduce == nil {
+		reduce = settings.ReduceBatch
+	}
+
+	// create the necessary channels
+	chan1 := make(chan Block, self.buffer)
+	chan2 := make(chan []Conn, self.buffer)
+	chan2b := make(chan []Conn, self.buffer)
+	chan3 := make(chan *Partial, self.buffer)
+	chan4 := make(chan int, self.buffer)
+	chan5 := make(chan Result, 1)
+
+	// the parse and reduce stages share one pool of workers
+	pool := NewPool(self.workers)
+	defer pool.Close()
+
+	// intialize the various worker objects
+	// without a warnings channel the warnings are logged, and the
+	// malformed lines recorded in the reject log of the settings
+	warn := self.warn
+	if warn == nil {
+		warn = settings.Warn
+	}
+	r := Reader{ctx, nil, self.bsize, self.overlap, chan1, self.streams, &settings, warn, &usage{}, stop}
+	for _, field := range settings.Schema.Unknown() {
+		r.Warn(InputWarning{Kind: UnknownField, Text: field})
+	}
+	if len(inputs) > 1 {
+		Debug.Printf("Ordering inputs by time range:")
+		if r.inputs, err = r.OrderInputs(inputs); err != nil {
+			return Result{}, err
+		}
+	} else {
+		for _, filename := range inputs {
+			r.inputs = append(r.inputs, FileSpan{Filename: filename})
+		}
+	}
+	p := Parser{pool, parse, chan1, chan2}
+	b := Batcher{settings.BatchSize, chan2, chan2b}
+	enrich := append(append([]Enricher{}, settings.Enrichers...), self.enrich...)
+	rd := Reducer{pool, reduce, chan2b, chan3, self.taps, enrich}
+	c := Combiner{&settings, chan3, chan4, chan5}
+
+	// start each of the worker functions on its own goroutine
+	go r.Start()
+	go p.Start()
+	go b.Start()
+	go rd.Start()
+	go c.Start()
+
+	// loop and monitor status of workers
+	sampler := 0
+	total_done := 0
+	for my_done := range chan4 {
+		total_done += my_done
+		if self.progress != nil && sampler%10000 == 0 {
+			self.progress(Status{len(chan1), len(chan2), len(chan2b), len(chan3), total_done})
+		}
+		sampler += 1
+	}
+
+	final := <-chan5
+	if err := context.Cause(ctx); err != nil {
+		return final, err
+	}
+	for _, sink := range self.sinks {
+		if err := sink(final); err != nil {
+			return final, err
+		}
+	}
+	return final, nil
+}
@@ -0,0 +1,277 @@
+/*
+	Description:
+		Planning of back-fills over an archive of logs: which files a run
+		over a range of dates would read, how much data that is and about
+		how long it would take, so a run of several hours can be checked
+		before it is started. It is run as
+			qreader plan -dir archive/ -since 2024-01-01
+*/
+
+package qreader
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how much of an input is read through the pipeline to measure the
+// throughput a plan is estimated at
+var PlanSampleBytes int64 = 8 << 20
+
+// layout of the dates a plan is given
+const planDate = "2006-01-02"
+
+// an input of a back-fill and the time its reading is estimated to take
+type PlanEntry struct {
+	Filename string
+	Size     int64
+	Start    time.Time
+	Estimate time.Duration
+}
+
+type BackfillPlan struct {
+	Entries  []PlanEntry
+	Bytes    int64
+	Estimate time.Duration
+
+	// the bytes per second of compressed and of plain inputs the
+	// estimates were made at, 0 when unknown
+	GzipRate  float64
+	PlainRate float64
+}
+
+/*
+	function to find the files under a directory whose names match a
+	glob pattern, in the order of their paths
+*/
+func FindInputs(dir, pattern string) ([]string, error) {
+	var filenames []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if ok, err := filepath.Match(pattern, entry.Name()); err != nil || !ok {
+			return err
+		}
+		filenames = append(filenames, path)
+		return nil
+	})
+	return filenames, err
+}
+
+/*
+	function to plan a back-fill over the matching files under a
+	directory whose data starts within [since, until), a zero until for
+	no end. The start of a file is probed from its data, or taken from
+	its modification time when that can't be told
+*/
+func MakePlan(dir, pattern string, since, until time.Time) (*BackfillPlan, error) {
+	filenames, err := FindInputs(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	spans, err := (Reader{}).OrderInputs(filenames)
+	if err != nil {
+		return nil, err
+	}
+	plan := &BackfillPlan{}
+	for _, span := range spans {
+		info, err := os.Stat(span.Filename)
+		if err != nil {
+			return nil, err
+		}
+		start := info.ModTime()
+		if span.Start != 0 {
+			start = time.Unix(0, int64(span.Start*1e9))
+		}
+		if start.Before(since) || (!until.IsZero() && !start.Before(until)) {
+			continue
+		}
+		plan.Entries = append(plan.Entries, PlanEntry{Filename: span.Filename, Size: info.Size(), Start: start})
+		plan.Bytes += info.Size()
+	}
+	sort.SliceStable(plan.Entries, func(i, j int) bool { return plan.Entries[i].Start.Before(plan.Entries[j].Start) })
+	return plan, nil
+}
+
+/*
+	function to time the pipeline over the head of an input, returning
+	the bytes per second it read of the file as it is on disk
+*/
+func MeasureThroughput(filename string) (float64, error) {
+	schema, err := DetectSchema([]string{filename}, "")
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// the sample cuts a compressed input short, which is expected
+	warnings := make(chan InputWarning)
+	go func() {
+		for range warnings {
+		}
+	}()
+	defer close(warnings)
+
+	settings := Defaults()
+	settings.Schema = schema
+	sample := &io.LimitedReader{R: file, N: PlanSampleBytes}
+	began := time.Now()
+	if _, err := New(WithSettings(settings)).SourceReader(filename, sample, DetectCompression).Warnings(warnings).Run(context.Background()); err != nil {
+		return 0, err
+	}
+	read := PlanSampleBytes - sample.N
+	elapsed := time.Since(began)
+	if read == 0 || elapsed <= 0 {
+		return 0, nil
+	}
+	return float64(read) / elapsed.Seconds(), nil
+}
+
+/*
+	function to estimate how long each input takes at the given rates of
+	compressed and plain inputs, measuring the rates on the largest input
+	of each kind where they are 0
+*/
+func (self *BackfillPlan) EstimateAt(gzip_rate, plain_rate float64) error {
+	largest := map[bool]PlanEntry{}
+	for _, entry := range self.Entries {
+		compressed := strings.HasSuffix(entry.Filename, ".gz")
+		if entry.Size > largest[compressed].Size {
+			largest[compressed] = entry
+		}
+	}
+	for compressed, rate := range map[bool]*float64{true: &gzip_rate, false: &plain_rate} {
+		if entry, ok := largest[compressed]; ok && *rate == 0 {
+			var err error
+			if *rate, err = MeasureThroughput(entry.Filename); err != nil {
+				return err
+			}
+			Debug.Printf("\tread %v at %v/s", entry.Filename, HumanBytes(int64(*rate)))
+		}
+	}
+	self.GzipRate, self.PlainRate = gzip_rate, plain_rate
+
+	self.Estimate = 0
+	for i, entry := range self.Entries {
+		rate := plain_rate
+		if strings.HasSuffix(entry.Filename, ".gz") {
+			rate = gzip_rate
+		}
+		if rate > 0 {
+			self.Entries[i].Estimate = time.Duration(float64(entry.Size) / rate * float64(time.Second))
+		}
+		self.Estimate += self.Entries[i].Estimate
+	}
+	return nil
+}
+
+/*
+	function to print the plan, a row per input and a line of totals
+*/
+func (self *BackfillPlan) Print(w io.Writer) {
+	width := len("file")
+	for _, entry := range self.Entries {
+		width = max(width, len(entry.Filename))
+	}
+	fmt.Fprintln(w, Heading(fmt.Sprintf("%-*v %-16v %10v %10v", width, "file", "start", "size", "estimate")))
+	for _, entry := range self.Entries {
+		fmt.Fprintf(w, "%-*v %-16v %10v %10v\n", width, entry.Filename, entry.Start.Format("2006-01-02 15:04"),
+			HumanBytes(entry.Size), entry.Estimate.Round(time.Second))
+	}
+
+	var rates []string
+	if self.GzipRate > 0 {
+		rates = append(rates, fmt.Sprintf("%v/s compressed", HumanBytes(int64(self.GzipRate))))
+	}
+	if self.PlainRate > 0 {
+		rates = append(rates, fmt.Sprintf("%v/s plain", HumanBytes(int64(self.PlainRate))))
+	}
+	fmt.Fprintf(w, "\n%v files, %v, estimated %v", FormatCount(int64(len(self.Entries))), HumanBytes(self.Bytes), self.Estimate.Round(time.Second))
+	if len(rates) > 0 {
+		fmt.Fprintf(w, " at %v", strings.Join(rates, " and "))
+	}
+	fmt.Fprintln(w)
+}
+
+/*
+	function to run the plan command with its own options, the arguments
+	following qreader plan
+*/
+func PlanMain(args []string) {
+	flags := flag.NewFlagSet("qreader plan", flag.ExitOnError)
+	var dir = flags.String("dir", "", "directory of the archive to plan a back-fill of, searched recursively")
+	var pattern = flags.String("pattern", "conn*", "glob the names of the inputs under <-dir> match")
+	var since = flags.String("since", "", "plan for the inputs whose data starts on or after this date (YYYY-MM-DD)")
+	var until = flags.String("until", "", "plan for the inputs whose data starts before this date (YYYY-MM-DD)")
+	var gzip_rate = flags.String("gzip-rate", "", "bytes per second compressed inputs are read at (default: that of the past runs in <-throughput-log>, else measured on the largest one)")
+	var plain_rate = flags.String("plain-rate", "", "bytes per second plain inputs are read at (default: that of the past runs in <-throughput-log>, else measured on the largest one)")
+	var log = flags.String("throughput-log", ThroughputLog, "the log of past runs the rates are taken from")
+	var debugging = flags.Bool("d", false, "enable debug messages")
+	flags.Parse(args)
+
+	LogInit(*debugging)
+	if *dir == "" {
+		Error.Fatalln("qreader plan requires -dir")
+	}
+	if _, err := filepath.Match(*pattern, ""); err != nil {
+		Error.Fatalf("Invalid pattern given: %v", *pattern)
+	}
+	var from, to time.Time
+	if *since != "" {
+		var err error
+		if from, err = time.ParseInLocation(planDate, *since, time.Local); err != nil {
+			Error.Fatalf("Invalid date given: %v", *since)
+		}
+	}
+	if *until != "" {
+		var err error
+		if to, err = time.ParseInLocation(planDate, *until, time.Local); err != nil {
+			Error.Fatalf("Invalid date given: %v", *until)
+		}
+	}
+
+	// the rates not given are those of the past runs, if there were any
+	var rates [2]float64
+	if *log != "" {
+		records, err := LoadThroughput(*log)
+		if err != nil {
+			Warning.Printf("not using the throughput of past runs: %v", err)
+		}
+		rates[0], rates[1] = ThroughputRates(records)
+	}
+	for i, rate := range []string{*gzip_rate, *plain_rate} {
+		if rate == "" {
+			continue
+		}
+		given, err := ParseBytes(rate)
+		if err != nil || given <= 0 {
+			Error.Fatalf("Invalid rate given: %v", rate)
+		}
+		rates[i] = float64(given)
+	}
+
+	plan, err := MakePlan(*dir, *pattern, from, to)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	if err := plan.EstimateAt(rates[0], rates[1]); err != nil {
+		Error.Fatalln(err)
+	}
+	plan.Print(os.Stdout)
+}
@@ -0,0 +1,169 @@
+/*
+	Description:
+		Work-stealing pool shared by the parse and reduce stages, so that
+		the workers go wherever there is work instead of idling in a
+		stage that is waiting on its input. Each worker has a deque of
+		its own, taking its newest task first and stealing the oldest
+		ones of the others when it runs out
+*/
+
+package qreader
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// the tasks queued for one worker
+type workQueue struct {
+	mu    sync.Mutex
+	tasks []func()
+}
+
+/*
+	function to add a task at the back of the deque
+*/
+func (self *workQueue) push(task func()) {
+	self.mu.Lock()
+	self.tasks = append(self.tasks, task)
+	self.mu.Unlock()
+}
+
+/*
+	function to take the newest task, for the worker the deque belongs to
+*/
+func (self *workQueue) pop() func() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	n := len(self.tasks)
+	if n == 0 {
+		return nil
+	}
+	task := self.tasks[n-1]
+	self.tasks[n-1] = nil
+	self.tasks = self.tasks[:n-1]
+	return task
+}
+
+/*
+	function to take the oldest task, for a worker stealing from the deque
+*/
+func (self *workQueue) steal() func() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.tasks) == 0 {
+		return nil
+	}
+	task := self.tasks[0]
+	self.tasks[0] = nil
+	self.tasks = self.tasks[1:]
+	return task
+}
+
+type Pool struct {
+	queues []*workQueue
+	next   uint32
+
+	// tasks queued and not yet taken, and how many may be
+	pending int64
+	limit   int64
+
+	// idle workers wait on cond until a task is queued or the pool closes
+	mu     sync.Mutex
+	cond   *sync.Cond
+	closed bool
+	wg     sync.WaitGroup
+}
+
+/*
+	function to start a pool of the given number of workers
+*/
+func NewPool(workers int) *Pool {
+	pool := &Pool{limit: int64(workers * 2)}
+	pool.cond = sync.NewCond(&pool.mu)
+	for i := 0; i < workers; i++ {
+		pool.queues = append(pool.queues, &workQueue{})
+	}
+	pool.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work(i)
+	}
+	return pool
+}
+
+/*
+	function to queue a task for the workers, on the deques in turn. When
+	as many tasks are queued as the pool has room for, the task is run
+	by the caller instead, which throttles the stage that is ahead and
+	keeps stages that feed each other from deadlocking on queues full of
+	tasks waiting on them
+*/
+func (self *Pool) Submit(task func()) {
+	if atomic.AddInt64(&self.pending, 1) > self.limit {
+		atomic.AddInt64(&self.pending, -1)
+		task()
+		return
+	}
+	i := atomic.AddUint32(&self.next, 1) % uint32(len(self.queues))
+	self.queues[i].push(task)
+
+	// taking the lock orders the wakeup after a worker's check of the
+	// pending tasks, so that it can't be lost
+	self.mu.Lock()
+	self.cond.Signal()
+	self.mu.Unlock()
+}
+
+/*
+	function to take a task for the given worker, its own newest or
+	else the oldest of another's, or nil when there is none
+*/
+func (self *Pool) take(worker int) func() {
+	task := self.queues[worker].pop()
+	for i := 1; task == nil && i < len(self.queues); i++ {
+		task = self.queues[(worker+i)%len(self.queues)].steal()
+	}
+	if task != nil {
+		atomic.AddInt64(&self.pending, -1)
+	}
+	return task
+}
+
+/*
+	function to run the tasks of a worker until the pool is closed and
+	every queued task is done
+*/
+func (self *Pool) work(worker int) {
+	defer self.wg.Done()
+	for {
+		if task := self.take(worker); task != nil {
+			task()
+			continue
+		}
+
+		self.mu.Lock()
+		for atomic.LoadInt64(&self.pending) == 0 && !self.closed {
+			self.cond.Wait()
+		}
+		done := atomic.LoadInt64(&self.pending) == 0
+		self.mu.Unlock()
+		if done {
+			return
+		}
+
+		// a task counted as pending may still be on its way to a deque
+		runtime.Gosched()
+	}
+}
+
+/*
+	function to stop the workers once the queued tasks are done
+*/
+func (self *Pool) Close() {
+	self.mu.Lock()
+	self.closed = true
+	self.cond.Broadcast()
+	self.mu.Unlock()
+	self.wg.Wait()
+}
@@ -0,0 +1,86 @@
+/*
+	Description:
+		Self-limiting of scheduled runs, so that they don't compete with
+		the sensor's own processes for the cpu and the disk
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the most bytes per second read from the inputs, or 0 for no limit
+var ReadRate int64 = 0
+
+/*
+	function to parse an io scheduling class of the form
+		idle
+		best-effort[:level]
+	returning the linux class number and level
+*/
+func parseIOClass(s string) (int, int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	switch parts[0] {
+	case "idle":
+		if len(parts) == 2 {
+			return 0, 0, fmt.Errorf("the idle class has no levels")
+		}
+		return ioprioClassIdle, 0, nil
+	case "best-effort":
+		level := 4
+		if len(parts) == 2 {
+			var err error
+			level, err = strconv.Atoi(parts[1])
+			if err != nil || level < 0 || level > 7 {
+				return 0, 0, fmt.Errorf("invalid level %q, expected 0-7", parts[1])
+			}
+		}
+		return ioprioClassBestEffort, level, nil
+	}
+	return 0, 0, fmt.Errorf("unknown io class %q, expected idle or best-effort", parts[0])
+}
+
+//--------------------------------------------------------------------------------
+//	RateLimiter class which slows down reads to a number of bytes per
+//	second
+//--------------------------------------------------------------------------------
+
+type RateLimiter struct {
+	reader io.ReadCloser
+	rate   int64
+	start  time.Time
+	total  int64
+}
+
+func NewRateLimiter(reader io.ReadCloser, rate int64) *RateLimiter {
+	return &RateLimiter{reader: reader, rate: rate}
+}
+
+func (self *RateLimiter) Read(p []byte) (int, error) {
+	if self.start.IsZero() {
+		self.start = time.Now()
+	}
+
+	// no read is larger than a quarter second's worth, so the pace
+	// stays smooth even with large blocksizes
+	if max := int(self.rate / 4); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := self.reader.Read(p)
+	self.total += int64(n)
+
+	due := self.start.Add(time.Duration(float64(self.total) / float64(self.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+func (self *RateLimiter) Close() error {
+	return self.reader.Close()
+}
@@ -0,0 +1,39 @@
+//go:build linux
+
+package qreader
+
+import (
+	"syscall"
+)
+
+// io scheduling classes of ioprio_set
+const (
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+)
+
+/*
+	function to lower the cpu priority of the process. Threads started
+	afterwards, and child processes, inherit it
+*/
+func SetNice(n int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, n)
+}
+
+/*
+	function to set the io scheduling class of the process, see
+	parseIOClass for the accepted values
+*/
+func SetIOPriority(s string) error {
+	class, level, err := parseIOClass(s)
+	if err != nil {
+		return err
+	}
+	const ioprioWhoProcess = 1
+	const ioprioClassShift = 13
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(class<<ioprioClassShift|level))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !windows
+
+package qreader
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+)
+
+func SetNice(n int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, n)
+}
+
+func SetIOPriority(s string) error {
+	if _, _, err := parseIOClass(s); err != nil {
+		return err
+	}
+	return errors.New("io priorities are only supported on linux")
+}
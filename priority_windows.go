@@ -0,0 +1,23 @@
+//go:build windows
+
+package qreader
+
+import (
+	"errors"
+)
+
+const (
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+)
+
+func SetNice(n int) error {
+	return errors.New("niceness is only supported on unix")
+}
+
+func SetIOPriority(s string) error {
+	if _, _, err := parseIOClass(s); err != nil {
+		return err
+	}
+	return errors.New("io priorities are only supported on linux")
+}
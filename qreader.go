@@ -7,59 +7,183 @@
 		eliminate bottlenecks in filereading
 */
 
-package main
+package qreader
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/netip"
 	"os"
 	"os/exec"
 	"runtime"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/kings-gambit/qreader/parse"
 )
 
 //--------------------------------------------------------------------------------
 //	program setup
 //--------------------------------------------------------------------------------
 
-// which command to use for reading gzip files
+// version recorded in the outputs, set when building with
+// -ldflags "-X github.com/kings-gambit/qreader.Version=..."
+var Version string = "dev"
+
+// which command to use for reading gzip files, or InternalUnzipper
 var Unzipper string = "gzcat"
 
-// semaphore throttling constants
-var ParserPool int = 6
-var ReducerPool int = 2
+// whether the reducers keep per-host connection counts and port
+// breakdowns in addition to the byte totals
+var TrackDetail bool = false
+
+// width of the time buckets traffic is summed into, or 0 to disable
+var BucketSize time.Duration = 0
+
+// whether the reducers also total the external hosts talking to the
+// local network
+var TrackRemote bool = false
+
+// whether the reducers also sum each local subnet into the time buckets
+var TrackSubnetBuckets bool = false
+
+// whether the reducers also total the local traffic by port and by pair
+// of hosts
+var TrackPorts bool = false
+var TrackConvs bool = false
+
+// whether the reducers also total the bytes each local host sent, and
+// the upload/download ratio at or above which a host is flagged in the
+// hosts report (0 to flag none)
+var TrackSent bool = false
+var RatioFlag float64 = 0
+
+// whether the reducers also total the local traffic by network segment,
+// and the key of the traffic whose segment isn't known
+var TrackSegments bool = false
+
+const NoSegment = "-"
+
+// whether the reducers also total the local traffic by link layer
+// address, which stays the same when dhcp hands a host a new ip
+var TrackMACs bool = false
+var TrackTags bool = false
+
+// whether the reducers also total the local traffic by the user holding
+// the address at the time, see Users
+var TrackUsers bool = false
+
+// whether the reducers also total the traffic with external hosts by the
+// name of the service it was for, see HostNames
+var TrackDestinations bool = false
+
+// the record fields the parser fills in, see parse.Need
+var ParseNeed parse.Need = parse.NeedCore
+
+// how the input lines are laid out
+var InputSchema parse.Schema = parse.TSV
+
+// decides which parsed records are kept, or nil to keep them all
+var RecordFilter func(Conn) bool
+
+// the record fields RecordFilter looks at, so that it can be checked
+// before the others are parsed, or 0 when they aren't known
+var FilterNeed parse.Need
 
-// logging objects
+/*
+	function to add a condition records must meet to be kept, on top of
+	any that were added before. Need lists the fields it looks at, 0 if
+	it may look at any
+*/
+func AddRecordFilter(need parse.Need, keep func(Conn) bool) {
+	if previous := RecordFilter; previous != nil {
+		RecordFilter = func(c Conn) bool { return previous(c) && keep(c) }
+		if need == 0 {
+			FilterNeed = 0
+		} else if FilterNeed != 0 {
+			FilterNeed |= need
+		}
+	} else {
+		RecordFilter, FilterNeed = keep, need
+	}
+}
+
+// number of records handed to a reducer at a time
+var BatchSize int = 10000
+
+// number of goroutines shared by the parse and reduce stages
+var Workers int = 8
+
+// logging objects, set up as LogInit does without debugging until it is
+// called, so that the package can be used without calling it
 var (
-	Debugging_on bool
-	Debug        *log.Logger
-	Warning      *log.Logger
-	Error        *log.Logger
+	Debug   *log.Logger = log.New(ioutil.Discard, "[DEBUG] ", 0)
+	Info    *log.Logger = log.New(os.Stderr, "[INFO] ", 0)
+	Warning *log.Logger = log.New(os.Stderr, "[WARNING] ", 0)
+	Error   *log.Logger = log.New(os.Stderr, "[ERROR] ", 0)
 )
 
 //--------------------------------------------------------------------------------
 //	program utility and helper functions
 //--------------------------------------------------------------------------------
 
+// the inputs given with repeated -f options
+type fileList []string
+
+func (self *fileList) String() string {
+	if self == nil {
+		return ""
+	}
+	return strings.Join(*self, ",")
+}
+
+func (self *fileList) Set(filename string) error {
+	if filename == "" {
+		return fmt.Errorf("empty file name")
+	}
+	*self = append(*self, filename)
+	return nil
+}
+
 /*
-	function to initialize the logging objects
+	function to initialize the logging objects, with the debug messages
+	shown if debugging is on
 */
-func LogInit() {
-	if Debugging_on {
+func LogInit(debugging bool) {
+	if debugging {
 		Debug = log.New(os.Stdout, "[DEBUG] ", 0)
-		Warning = log.New(os.Stdout, "[WARNING] ", 0)
-		Error = log.New(os.Stdout, "[ERROR] ", 0)
 	} else {
 		Debug = log.New(ioutil.Discard, "[DEBUG] ", 0)
-		Warning = log.New(ioutil.Discard, "[WARNING] ", 0)
-		Error = log.New(ioutil.Discard, "[ERROR] ", 0)
 	}
+
+	// notes on choices made for the run go to stderr with the warnings,
+	// keeping stdout for the report
+	Info = log.New(os.Stderr, "[INFO] ", 0)
+
+	// warnings and errors are always shown since they affect the results
+	Warning = log.New(os.Stderr, "[WARNING] ", 0)
+	Error = log.New(os.Stderr, "[ERROR] ", 0)
+}
+
+// the local network
+var LocalCIDR string = "128.252.0.0/16"
+var LocalNetwork netip.Prefix = netip.MustParsePrefix(LocalCIDR)
+
+/*
+	function to decide whether an address belongs to the local network
+*/
+func IsLocal(ip netip.Addr) bool {
+	return LocalNetwork.Contains(ip)
 }
 
 //--------------------------------------------------------------------------------
@@ -68,312 +192,2614 @@ func LogInit() {
 //--------------------------------------------------------------------------------
 
 type Reader struct {
-	filename string
-	bsize    int
-	outq     chan []byte
+	ctx     context.Context
+	inputs  []FileSpan
+	bsize   int
+	overlap string
+	outq    chan Block
+
+	// inputs that aren't files, read after them
+	streams []streamSource
+
+	// the settings of the run, nil for Defaults
+	settings *Settings
+
+	// where problems with the inputs are reported, nil for LogWarning
+	warn func(InputWarning)
+
+	// what the run has read so far, and how to stop it when that is
+	// more than its limits allow
+	used *usage
+	stop func(error)
+}
+
+// a block of whole lines read from an input, along with the file it
+// came from and the line number of its first line
+type Block struct {
+	Filename string
+	Line     int
+	Data     []byte
+
+	warn func(InputWarning)
+}
+
+// wraps the output of an external decompressor so that closing the
+// stream also reaps the process
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+
+	// the file fed to the decompressor, if it doesn't read it itself
+	input io.Closer
+}
+
+func (self cmdReader) Close() error {
+	self.ReadCloser.Close()
+	err := self.cmd.Wait()
+	if self.input != nil {
+		self.input.Close()
+	}
+	return err
+}
+
+// a gzip stream decompressed in process, closing the file under it
+type gzipReader struct {
+	*gzip.Reader
+	input io.Closer
+}
+
+// returned when a gzip stream decompressed in process is cut off,
+// which would otherwise look like the normal end of the last chunk
+var ErrTruncated = errors.New("compressed data ends early")
+
+func (self gzipReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return n, err
+}
+
+func (self gzipReader) Close() error {
+	self.Reader.Close()
+	return self.input.Close()
+}
+
+/*
+	function to get the settings the reader was made with
+*/
+func (self Reader) config() *Settings {
+	if self.settings == nil {
+		settings := Defaults()
+		return &settings
+	}
+	return self.settings
+}
+
+/*
+	function to open an input for reading, exiting when it can't be
+	opened. Pipelines use OpenFile, which returns the error instead
+*/
+func (self Reader) GetReader(filename string) io.ReadCloser {
+	reader, err := self.OpenFile(filename)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	return reader
 }
 
-func (self Reader) GetReader() io.Reader {
-	if strings.HasSuffix(self.filename, ".gz") {
-		c := exec.Command(Unzipper, "-c", self.filename)
+// the name of the input read from the standard input, for qreader at
+// the end of a pipeline such as ssh host zcat conn.log.gz | qreader -f -
+const StdinName = "-"
+
+// the standard input, buffered so that its head can be peeked at for the
+// format and start of its data, see readHead
+var stdin = bufio.NewReaderSize(os.Stdin, ProbeSize)
+
+/*
+	function to open an input for reading, decompressing it when it is
+	gzipped. The standard input is read as it is, and isn't closed
+*/
+func (self Reader) OpenFile(filename string) (io.ReadCloser, error) {
+	settings := self.config()
+	if filename == StdinName {
+		if settings.ReadRate > 0 {
+			return NewRateLimiter(io.NopCloser(stdin), settings.ReadRate), nil
+		}
+		return io.NopCloser(stdin), nil
+	} else if strings.HasSuffix(filename, ".gz") && settings.Unzipper == InternalUnzipper {
+		file, err := OpenInput(filename)
+		if err != nil {
+			return nil, err
+		}
+		var input io.Reader = file
+		if settings.ReadRate > 0 {
+			input = NewRateLimiter(file, settings.ReadRate)
+		}
+		zr, err := gzip.NewReader(input)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+		return gzipReader{zr, file}, nil
+	} else if strings.HasSuffix(filename, ".gz") {
+		c := exec.Command(settings.Unzipper, "-c", "-d", filename)
+
+		// a rate limited file is fed through the decompressor's stdin so
+		// that the limit applies to what is read from the disk
+		var input io.ReadCloser
+		if settings.ReadRate > 0 {
+			var err error
+			if input, err = OpenInput(filename); err != nil {
+				return nil, err
+			}
+			c = exec.Command(settings.Unzipper, "-c", "-d")
+			c.Stdin = NewRateLimiter(input, settings.ReadRate)
+		}
+
 		pipe, err := c.StdoutPipe()
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		c.Start()
-		return pipe
+		if err := c.Start(); err != nil {
+			if input != nil {
+				input.Close()
+			}
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+		return cmdReader{pipe, c, input}, nil
 	} else {
 		// open the file in read-only mode
-		file, err := os.Open(self.filename)
+		file, err := OpenInput(filename)
 		if err != nil {
-			Error.Fatalln(err)
+			return nil, err
+		}
+		if settings.ReadRate > 0 {
+			return NewRateLimiter(file, settings.ReadRate), nil
 		}
 
 		// create and return reader object
-		return io.Reader(file)
+		return file, nil
 	}
 }
 
-func (self Reader) Start() {
-	reader := self.GetReader()
+/*
+	function to stop the run with an error, or to exit with it when the
+	reader isn't part of a pipeline
+*/
+func (self Reader) fail(err error) {
+	if self.stop == nil {
+		Error.Fatalln(err)
+	}
+	self.stop(err)
+}
 
-	// wrap that with a bufio reader
-	bsize := self.bsize
-	var leftovers []byte
-	for {
-		// read in the next chunk
-		buffer := make([]byte, bsize)
-		length, err := reader.Read(buffer)
-		if err != nil && err != io.EOF {
-			Error.Fatalln(err)
+func (self Reader) Start() {
+	// the latest data end time seen so far, used to detect inputs whose
+	// data overlaps something that has already been read
+	var seen_end float64
+	for _, span := range self.inputs {
+		if span.Start != 0 && span.Start < seen_end {
+			if self.overlap == "skip" {
+				self.Warn(InputWarning{Kind: OverlappingInput, File: span.Filename, Err: fmt.Errorf("skipping it")})
+				continue
+			}
+			self.Warn(InputWarning{Kind: OverlappingInput, File: span.Filename, Err: fmt.Errorf("totals may be inflated")})
 		}
 
-		// break if reading is done
-		if length == 0 {
+		if self.ctx.Err() != nil {
 			break
 		}
-
-		// truncate newlines at end
-		end_it := length - 1
-		for {
-			if end_it == 0 {
-				leftovers = append(leftovers, buffer...)
-				break
-			}
-			if buffer[end_it] == '\n' {
-				leftovers = append(leftovers, buffer[:end_it]...)
-				self.outq <- leftovers
-				leftovers = buffer[end_it+1:]
-				break
-			} else {
-				end_it -= 1
-			}
+		if end := self.ReadFile(span.Filename); end > seen_end {
+			seen_end = end
+		}
+	}
+	for _, stream := range self.streams {
+		if self.ctx.Err() != nil {
+			break
+		}
+		reader, err := stream.Open()
+		if err != nil {
+			self.fail(fmt.Errorf("%v: %v", stream.name, err))
+			break
 		}
+		self.read(stream.name, reader)
 	}
 
 	// close channel to let next worker know that you're done
 	close(self.outq)
 }
 
-//--------------------------------------------------------------------------------
-//	Parser class which handles splitting data at newlines and separating
-//	into key->value map
-//--------------------------------------------------------------------------------
-
-type conn struct {
-	orig  string
-	resp  string
-	bytes int
-}
-
-type Parser struct {
-	limiter chan int
-	inq     chan []byte
-	outq    chan []conn
+/*
+	function to read a single file into the output queue, returning the
+	end time of its data
+*/
+func (self Reader) ReadFile(filename string) float64 {
+	settings := self.config()
+	if info, err := os.Stat(filename); err == nil && filename != StdinName && StillWritten(info, settings.SettleTime, time.Now()) {
+		return self.readInProgress(filename)
+	}
+	reader, err := self.OpenFile(filename)
+	if err != nil {
+		self.fail(err)
+		return 0
+	}
+	return self.read(filename, reader)
 }
 
-func (self Parser) Parse(fileslice []byte) {
-	lines := strings.Split(string(fileslice), "\n")
-
-	data_slice := make([]conn, len(lines))
-	for _, line := range lines {
-		if line[0] == '#' {
-			continue
+/*
+	function to read an opened input into the output queue and close it,
+	returning the end time of its data
+*/
+func (self Reader) read(filename string, reader io.ReadCloser) float64 {
+	var last []byte
+	err := splitChunks(reader, self.bsize, self.config().MaxLineLength, func(chunk []byte, line int) error {
+		last = chunk
+		if self.used != nil {
+			if err := self.used.add(self.settings, filename, chunk, bytes.Count(chunk, []byte("\n"))+1); err != nil {
+				return err
+			}
+		}
+		select {
+		case self.outq <- Block{filename, line, chunk, self.warn}:
+			return nil
+		case <-self.ctx.Done():
+			return self.ctx.Err()
 		}
-		data := strings.Split(line, "\t")
-		orig := data[2]
-		resp := data[4]
-		bytes1, _ := strconv.Atoi(data[16])
-		bytes2, _ := strconv.Atoi(data[18])
-		data_slice = append(data_slice, conn{orig, resp, bytes1 + bytes2})
+	})
+	closed := reader.Close()
+
+	// what was read of a cut off input is still counted, a decompressor
+	// run as a command only tells by failing
+	_, limited := err.(*LimitError)
+	if long, ok := err.(*LineTooLongError); ok {
+		long.File, limited = filename, true
+	}
+	switch {
+	case err == ErrTruncated:
+		self.Warn(InputWarning{Kind: TruncatedInput, File: filename, Err: err})
+	case limited:
+		self.fail(err)
+	case err != nil && err != self.ctx.Err():
+		self.fail(err)
+	case err == nil && closed != nil && strings.HasSuffix(filename, ".gz"):
+		self.Warn(InputWarning{Kind: TruncatedInput, File: filename, Err: closed})
 	}
 
-	self.outq <- data_slice
-	<-self.limiter
+	return SpanEnd(last, self.config().Schema)
 }
 
-func (self Parser) Start() {
-	for fileslice := range self.inq {
-		self.limiter <- 1
-		go self.Parse(fileslice)
+/*
+	function to report a problem with an input
+*/
+func (self Reader) Warn(warning InputWarning) {
+	Block{warn: self.warn}.Warn(warning)
+}
+
+/*
+	function to cut a stream into chunks of at least size bytes that end
+	on a line boundary, passing each one to emit without its trailing
+	newline. A final line without a newline is still emitted, and lines
+	longer than the chunk size are kept whole. An error from emit stops
+	the split and is returned
+*/
+func SplitChunks(r io.Reader, size int, emit func([]byte) error) error {
+	return splitChunks(r, size, MaxLineLength, func(chunk []byte, line int) error {
+		return emit(chunk)
+	})
+}
+
+/*
+	function to split a stream like SplitChunks, also passing emit the
+	line number of the first line of each chunk
+*/
+func splitChunks(r io.Reader, size, max_line int, emit func([]byte, int) error) error {
+	br := bufio.NewReaderSize(r, size)
+	line := 1
+	flush := func(chunk []byte) error {
+		first := line
+		if max_line > 0 && len(chunk) > max_line {
+			if n := longestLine(chunk, max_line); n > 0 {
+				return &LineTooLongError{Line: first + n - 1, Max: max_line}
+			}
+		}
+		line += bytes.Count(chunk, []byte("\n"))
+		chunk = bytes.TrimRight(chunk, "\n")
+		if len(chunk) > 0 {
+			return emit(chunk, first)
+		}
+		return nil
 	}
 
 	for {
-		if len(self.limiter) == 0 {
-			close(self.outq)
-			break
-		} else {
-			time.Sleep(500 * time.Millisecond)
+		// ReadFull keeps going through short reads, so every chunk but
+		// the last is full before it is extended to the end of its line
+		chunk := make([]byte, size)
+		length, err := io.ReadFull(br, chunk)
+		chunk = chunk[:length]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return flush(chunk)
+		}
+		if err == ErrTruncated {
+			if err := flush(chunk); err != nil {
+				return err
+			}
+			return ErrTruncated
+		}
+		if err != nil {
+			return err
+		}
+
+		// the line the chunk ends in is read up to the limit, so that an
+		// input without newlines fails instead of being held in memory
+		start := bytes.LastIndexByte(chunk, '\n') + 1
+		for chunk[len(chunk)-1] != '\n' {
+			if max_line > 0 && len(chunk)-start > max_line {
+				return &LineTooLongError{Line: line + bytes.Count(chunk[:start], []byte("\n")), Max: max_line}
+			}
+			rest, err := br.ReadSlice('\n')
+			chunk = append(chunk, rest...)
+			if err == io.EOF {
+				return flush(chunk)
+			}
+			if err != nil && err != bufio.ErrBufferFull {
+				return err
+			}
+		}
+		if err := flush(chunk); err != nil {
+			return err
 		}
 	}
 }
 
 //--------------------------------------------------------------------------------
-//	Reducer class which performs some data reduction over the data
+//	Parser class which handles splitting data at newlines and separating
+//	into key->value map
 //--------------------------------------------------------------------------------
 
-type Reducer struct {
-	limiter chan int
-	inq     chan []conn
-	outq    chan map[string]int64
+// a parsed conn.log record
+type Conn = parse.Conn
+
+type Parser struct {
+	pool  *Pool
+	parse func(Block) []Conn
+	inq   chan Block
+	outq  chan []Conn
 }
 
-func (self Reducer) Reduce(data_slice []conn) {
-	tt := make(map[string]int64)
+func (self Parser) Parse(block Block) {
+	self.outq <- self.parse(block)
+}
 
-	for _, c := range data_slice {
-		orig := c.orig
-		resp := c.resp
-		b := c.bytes
+/*
+	function to parse a block of conn.log lines into records with the
+	package level settings
+*/
+func ParseBlock(block Block) []Conn {
+	settings := Defaults()
+	return settings.ParseBlock(block)
+}
 
-		if strings.HasPrefix(orig, "128.252.") {
-			tt[orig] += int64(b)
+/*
+	function to parse a block of conn.log lines into records, skipping
+	comments and lines that can't be parsed. Rejected lines are reported
+	as warnings of the block, and kept with the filtered ones when there
+	are DeadLetters
+*/
+func (self *Settings) ParseBlock(block Block) []Conn {
+	fileslice := block.Data
+	data_slice := make([]Conn, 0, bytes.Count(fileslice, []byte("\n"))+1)
+	parsed, rejected := 0, 0
+	for lineno := block.Line; len(fileslice) > 0; lineno++ {
+		var line []byte
+		line, fileslice = NextLine(fileslice)
+		c, err := self.Schema.LineWhere(line, self.Need, self.FilterNeed, self.Filter)
+		if errors.Is(err, parse.ErrComment) {
+			continue
 		}
-
-		if strings.HasPrefix(resp, "128.252.") {
-			tt[resp] += int64(b)
+		if err != nil && self.DeadLetters != nil {
+			self.DeadLetters.Add(block.Filename, lineno, line, err)
 		}
+		if errors.Is(err, parse.ErrFiltered) {
+			parsed++
+			continue
+		}
+		if err != nil {
+			rejected++
+			block.Warn(InputWarning{Kind: MalformedLine, File: block.Filename, Line: lineno, Text: string(line), Err: err})
+			continue
+		}
+		parsed++
+		data_slice = append(data_slice, c)
 	}
-
-	self.outq <- tt
-	<-self.limiter
+	self.Lines.Add(parsed, rejected)
+	return data_slice
 }
 
-func (self Reducer) Start() {
-	for data_slice := range self.inq {
-		self.limiter <- 1
-		go self.Reduce(data_slice)
+func (self Parser) Start() {
+	var wg sync.WaitGroup
+	for block := range self.inq {
+		block := block
+		wg.Add(1)
+		self.pool.Submit(func() {
+			self.Parse(block)
+			wg.Done()
+		})
 	}
 
-	for {
-		if len(self.limiter) == 0 {
-			close(self.outq)
-			break
-		} else {
-			time.Sleep(500 * time.Millisecond)
-		}
-	}
+	wg.Wait()
+	close(self.outq)
 }
 
 //--------------------------------------------------------------------------------
-//	Combiner class that sums the partiai results created by the reducer
+//	Batcher class which regroups the parsed records into batches of the
+//	same size, so the reducers get even amounts of work whatever the
+//	blocksize
 //--------------------------------------------------------------------------------
 
-type Combiner struct {
-	inq  chan map[string]int64
-	outq chan int
+type Batcher struct {
+	size int
+	inq  chan []Conn
+	outq chan []Conn
 }
 
-func (self Combiner) Start() {
-	final := make(map[string]int64)
+func (self Batcher) Start() {
+	batch := make([]Conn, 0, self.size)
+	for data_slice := range self.inq {
+		for len(data_slice) > 0 {
+			n := self.size - len(batch)
+			if n > len(data_slice) {
+				n = len(data_slice)
+			}
+			batch = append(batch, data_slice[:n]...)
+			data_slice = data_slice[n:]
 
-	for subresult := range self.inq {
-		for ip, bytecount := range subresult {
-			final[ip] += bytecount
+			if len(batch) == self.size {
+				self.outq <- batch
+				batch = make([]Conn, 0, self.size)
+			}
 		}
-
-		self.outq <- len(subresult)
 	}
 
-	self.Report(final)
+	if len(batch) > 0 {
+		self.outq <- batch
+	}
 	close(self.outq)
 }
 
-// define custom interface for sorting int64
-type int64arr []int64
+//--------------------------------------------------------------------------------
+//	Reducer class which performs some data reduction over the data
+//--------------------------------------------------------------------------------
+
+// the final aggregation of a run, as summed by the combiner
+type Result struct {
+	Hosts map[string]int64         `json:"hosts"`
+	Conns map[string]int64         `json:"conns,omitempty"`
+	Ports map[string]map[int]int64 `json:"ports,omitempty"`
 
-func (a int64arr) Len() int           { return len(a) }
-func (a int64arr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a int64arr) Less(i, j int) bool { return a[i] < a[j] }
+	// bytes of local traffic by the unix time of the start of each bucket
+	Buckets map[int64]int64 `json:"buckets,omitempty"`
 
-func (self Combiner) Report(tt map[string]int64) {
-	keys := make([]int64, len(tt))
-	swapped := make(map[int64][]string)
+	// bytes exchanged with the local network by each external host
+	Remotes map[string]int64 `json:"remotes,omitempty"`
 
-	var tbytes int64
-	for k, v := range tt {
-		list, ok := swapped[v]
-		if ok {
-			list = append(list, k)
-		} else {
-			swapped[v] = []string{k}
-		}
-
-		keys = append(keys, v)
-		tbytes += int64(v)
-	}
-
-	// sort the keys in descending order
-	var sortable_keys int64arr
-	sortable_keys = keys
-	sort.Sort(sort.Reverse(sortable_keys))
-
-	num_printed := 0
-	for _, k := range keys {
-		ips := swapped[k]
-		keepgoing := true
-		for _, ip := range ips {
-			if num_printed < 10 {
-				fmt.Printf("%15v %.4f%%\n", ip, float64(k)/float64(tbytes)*100)
-				num_printed += 1
-			} else {
-				keepgoing = false
-				break
-			}
-		}
+	// bytes of each local subnet by the start of each bucket
+	SubnetBuckets map[string]map[int64]int64 `json:"subnet_buckets,omitempty"`
 
-		if !keepgoing {
-			break
-		}
-	}
+	// bytes of local traffic by responder port
+	Services map[int]int64 `json:"services,omitempty"`
+
+	// bytes of local traffic by pair of hosts, see ConvKey
+	Convs map[string]int64 `json:"convs,omitempty"`
+
+	// bytes sent by each local host, the rest of its total was received
+	Sent map[string]int64 `json:"sent,omitempty"`
+
+	// bytes of the traffic matched by each exclusion rule
+	Excluded map[string]int64 `json:"excluded,omitempty"`
+
+	// bytes exchanged with external hosts by their country, filled in
+	// from Remotes when a geoip table is loaded
+	Countries map[string]int64 `json:"countries,omitempty"`
+
+	// the host totals split by tenant, filled in from Hosts when a
+	// tenants file is loaded
+	Tenants map[string]map[string]int64 `json:"tenants,omitempty"`
+
+	// bytes of local traffic by network segment, see Conn.Segment
+	Segments map[string]int64 `json:"segments,omitempty"`
+
+	// bytes of local traffic by the link layer address of the local host
+	MACs map[string]int64 `json:"macs,omitempty"`
+
+	// bytes of local traffic by the user holding the local address
+	Users map[string]int64 `json:"users,omitempty"`
+
+	// bytes of local traffic by the tag an enricher gave the local host,
+	// see Enricher
+	Tags map[string]int64 `json:"tags,omitempty"`
+
+	// bytes of all the traffic by direction, see Direction
+	Directions map[string]int64 `json:"directions,omitempty"`
+
+	// the domain each external host was last resolved from by the local
+	// hosts it talked to, filled in when dns logs are given
+	RemoteNames map[string]string `json:"remote_names,omitempty"`
+
+	// bytes exchanged with external hosts by the name of the service they
+	// were for, or by the host where that isn't known, see HostNames
+	Destinations map[string]int64 `json:"destinations,omitempty"`
+
+	// times of the earliest and latest records, as unix epoch seconds
+	First float64 `json:"first,omitempty"`
+	Last  float64 `json:"last,omitempty"`
 }
 
 //--------------------------------------------------------------------------------
-//	main program body
+//	Partial class holding the aggregation of the reducers and combiner,
+//	keyed by parsed addresses rather than strings since hashing the
+//	strings dominated both stages. It is turned into a Result once all
+//	the data has been summed
 //--------------------------------------------------------------------------------
 
-func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
+type Partial struct {
+	hosts    map[netip.Addr]int64
+	conns    map[netip.Addr]int64
+	ports    map[netip.Addr]map[int]int64
+	buckets  map[int64]int64
+	remotes  map[netip.Addr]int64
+	subnets  map[netip.Prefix]map[int64]int64
+	services map[int]int64
+	convs    map[[2]netip.Addr]int64
+	sent     map[netip.Addr]int64
+	excluded map[string]int64
+	segments map[string]int64
+	macs     map[string]int64
+	tags     map[string]int64
+	users    map[string]int64
+	dirs     map[string]int64
+	names    map[netip.Addr]dnsAnswer
+	dests    map[destination]int64
+	first    float64
+	last     float64
 
-	// parse cmd-line flags
-	var filename = flag.String("f", "", "the gzip file to be parsed")
-	var bsize = flag.Int("b", -1, "specify the blocksize to be used in filereading")
-	var debugging = flag.Bool("d", false, "turn on program debugging")
-	flag.Parse()
+	// the settings the records are summed with
+	settings *Settings
+}
 
-	// use options to initalize loggers
-	Debugging_on = *debugging
-	LogInit()
+/*
+	function to make an empty partial result with the package level
+	settings
+*/
+func NewPartial() *Partial {
+	settings := Defaults()
+	return settings.NewPartial()
+}
 
-	// make sure given options are valid
-	if *filename == "" {
-		Error.Fatalln("Please specify a file to process with the <-f> flag.")
+func (self *Settings) NewPartial() *Partial {
+	r := &Partial{hosts: make(map[netip.Addr]int64), settings: self}
+	if self.TrackDetail {
+		r.conns = make(map[netip.Addr]int64)
+		r.ports = make(map[netip.Addr]map[int]int64)
 	}
-
-	if *bsize <= 0 {
-		Error.Fatalf("Invalid blocksize given: %d", *bsize)
+	if self.BucketSize > 0 {
+		r.buckets = make(map[int64]int64)
+	}
+	if self.TrackRemote {
+		r.remotes = make(map[netip.Addr]int64)
+	}
+	if self.TrackRemote && self.DNS != nil {
+		r.names = make(map[netip.Addr]dnsAnswer)
+	}
+	if self.TrackDestinations {
+		r.dests = make(map[destination]int64)
+	}
+	if self.TrackPorts {
+		r.services = make(map[int]int64)
+	}
+	if self.TrackConvs {
+		r.convs = make(map[[2]netip.Addr]int64)
+	}
+	if self.TrackSent {
+		r.sent = make(map[netip.Addr]int64)
+	}
+	if self.TrackExcluded {
+		r.excluded = make(map[string]int64)
+	}
+	if self.TrackSegments {
+		r.segments = make(map[string]int64)
+	}
+	if self.TrackMACs {
+		r.macs = make(map[string]int64)
+	}
+	if self.TrackTags {
+		r.tags = make(map[string]int64)
 	}
+	if self.TrackUsers {
+		r.users = make(map[string]int64)
+	}
+	if self.TrackDirections {
+		r.dirs = make(map[string]int64)
+	}
+	if self.BucketSize > 0 && self.TrackSubnetBuckets {
+		r.subnets = make(map[netip.Prefix]map[int64]int64)
+	}
+	return r
+}
 
-	// print some debugging information
-	Debug.Printf("Received cmdline arguments:")
-	Debug.Printf("\tfilename: %v", *filename)
-	Debug.Printf("\tbsize: %v", *bsize)
-	Debug.Printf("\tdebugging: %v", *debugging)
+/*
+	function to find the start of the time bucket a timestamp falls in
+*/
+func bucketOf(ts float64) int64 {
+	settings := Defaults()
+	return settings.BucketOf(ts)
+}
 
-	// create the necessary channels
-	chansize := 10000
-	chan1 := make(chan []byte, chansize)
-	chan2 := make(chan []conn, chansize)
-	chan3 := make(chan map[string]int64, chansize)
-	chan4 := make(chan int, chansize)
-
-	// create buffered controller channels that can act as semaphores
-	// to limit overall throughput
-	limiter1 := make(chan int, ParserPool)
-	limiter2 := make(chan int, ReducerPool)
-
-	// intialize the various worker objects
-	r := Reader{*filename, *bsize, chan1}
-	p := Parser{limiter1, chan1, chan2}
-	rd := Reducer{limiter2, chan2, chan3}
-	c := Combiner{chan3, chan4}
-
-	// start each of the worker functions on its own goroutine
-	go r.Start()
-	go p.Start()
-	go rd.Start()
-	go c.Start()
-
-	// loop and monitor status of workers
-	fmtstring := "\rReader -> (%d) -> Parser -> (%d) -> Reducer -> (%d) -> Combiner -> (%d done)"
-	fmtstring = fmt.Sprintf("%70s", fmtstring)
-	sampler := 0
-	total_done := 0
-	for my_done := range chan4 {
-		total_done += my_done
-		if sampler%10000 == 0 {
-			fmt.Printf(fmtstring, len(chan1), len(chan2), len(chan3), total_done)
-		}
-		sampler += 1
+/*
+	function to account a connection's bytes to the user holding a local
+	host's address at the time, or to UnknownUser if no session covers it
+*/
+func (self *Partial) AddUser(host netip.Addr, ts float64, bytes int64) {
+	user, ok := self.settings.Users.Lookup(host, ts)
+	if !ok {
+		user = UnknownUser
+	}
+	if self.settings.Partition.OwnsString(user) {
+		self.users[user] += bytes
+	}
+}
+
+/*
+	function to account a connection's bytes to the time bucket of the
+	subnet a local host belongs to
+*/
+func (self *Partial) AddSubnetBucket(host netip.Addr, ts float64, bytes int64) {
+	subnet := self.settings.SubnetOf(host)
+	if !self.settings.Partition.OwnsPrefix(subnet) {
+		return
+	}
+	buckets, ok := self.subnets[subnet]
+	if !ok {
+		buckets = make(map[int64]int64)
+		self.subnets[subnet] = buckets
+	}
+	buckets[self.settings.BucketOf(ts)] += bytes
+}
+
+/*
+	function to account a connection's bytes to one of its hosts
+*/
+func (self *Partial) Add(host netip.Addr, port int, bytes int64) {
+	if !self.settings.Partition.OwnsAddr(host) {
+		return
+	}
+	self.hosts[host] += bytes
+	if self.ports == nil {
+		return
+	}
+
+	self.conns[host] += 1
+	ports, ok := self.ports[host]
+	if !ok {
+		ports = make(map[int]int64)
+		self.ports[host] = ports
+	}
+	ports[port] += bytes
+}
+
+/*
+	function to widen the data time range to include a record
+*/
+func (self *Partial) AddTime(ts float64) {
+	if ts == 0 {
+		return
+	}
+	if self.first == 0 || ts < self.first {
+		self.first = ts
+	}
+	if ts > self.last {
+		self.last = ts
+	}
+}
+
+/*
+	function to sum another partial result into this one
+*/
+func (self *Partial) Merge(other *Partial) {
+	self.AddTime(other.first)
+	self.AddTime(other.last)
+	for ip, bytecount := range other.hosts {
+		self.hosts[ip] += bytecount
+	}
+	for start, bytecount := range other.buckets {
+		self.buckets[start] += bytecount
+	}
+	for ip, bytecount := range other.remotes {
+		self.remotes[ip] += bytecount
+	}
+	for ip, answer := range other.names {
+		self.AddName(ip, answer)
+	}
+	for dest, bytecount := range other.dests {
+		self.dests[dest] += bytecount
+	}
+	for port, bytecount := range other.services {
+		self.services[port] += bytecount
+	}
+	for pair, bytecount := range other.convs {
+		self.convs[pair] += bytecount
+	}
+	for ip, bytecount := range other.sent {
+		self.sent[ip] += bytecount
+	}
+	for name, bytecount := range other.excluded {
+		self.excluded[name] += bytecount
+	}
+	for segment, bytecount := range other.segments {
+		self.segments[segment] += bytecount
+	}
+	for mac, bytecount := range other.macs {
+		self.macs[mac] += bytecount
+	}
+	for tag, bytecount := range other.tags {
+		self.tags[tag] += bytecount
+	}
+	for user, bytecount := range other.users {
+		self.users[user] += bytecount
+	}
+	for direction, bytecount := range other.dirs {
+		self.dirs[direction] += bytecount
+	}
+	for subnet, buckets := range other.subnets {
+		mine, ok := self.subnets[subnet]
+		if !ok {
+			self.subnets[subnet] = buckets
+			continue
+		}
+		for start, bytecount := range buckets {
+			mine[start] += bytecount
+		}
+	}
+	if self.ports == nil {
+		return
+	}
+
+	for ip, count := range other.conns {
+		self.conns[ip] += count
+	}
+	for ip, ports := range other.ports {
+		mine, ok := self.ports[ip]
+		if !ok {
+			self.ports[ip] = ports
+			continue
+		}
+		for port, bytecount := range ports {
+			mine[port] += bytecount
+		}
+	}
+}
+
+/*
+	function to name an external host after a domain resolved to it,
+	keeping the name that was resolved last
+*/
+func (self *Partial) AddName(remote netip.Addr, answer dnsAnswer) {
+	if answer.ts >= self.names[remote].ts {
+		self.names[remote] = answer
+	}
+}
+
+/*
+	function to convert the summed aggregation into a result keyed by
+	address strings
+*/
+func (self *Partial) Result() Result {
+	var normalize KeyNormalizer
+	if self.settings != nil {
+		normalize = self.settings.Normalize
+	}
+	r := Result{
+		Hosts:      normalize.totals(self.hosts),
+		Conns:      normalize.totals(self.conns),
+		Buckets:    self.buckets,
+		Remotes:    normalize.totals(self.remotes),
+		Services:   self.services,
+		Sent:       normalize.totals(self.sent),
+		Excluded:   self.excluded,
+		Segments:   self.segments,
+		MACs:       self.macs,
+		Tags:       self.tags,
+		Users:      self.users,
+		Directions: self.dirs,
+		First:      self.first,
+		Last:       self.last,
+	}
+	if self.ports != nil {
+		r.Ports = make(map[string]map[int]int64, len(self.ports))
+		for ip, ports := range self.ports {
+			if normalize == nil {
+				r.Ports[ip.String()] = ports
+				continue
+			}
+			key := normalize.key(ip)
+			mine, ok := r.Ports[key]
+			if !ok {
+				mine = make(map[int]int64, len(ports))
+				r.Ports[key] = mine
+			}
+			for port, bytecount := range ports {
+				mine[port] += bytecount
+			}
+		}
+	}
+	if self.subnets != nil {
+		r.SubnetBuckets = make(map[string]map[int64]int64, len(self.subnets))
+		for subnet, buckets := range self.subnets {
+			r.SubnetBuckets[subnet.String()] = buckets
+		}
+	}
+	if self.convs != nil {
+		r.Convs = make(map[string]int64, len(self.convs))
+		for pair, bytecount := range self.convs {
+			r.Convs[ConvKey(normalize.key(pair[0]), normalize.key(pair[1]))] += bytecount
+		}
+	}
+	if self.names != nil {
+		latest := make(map[string]dnsAnswer, len(self.names))
+		for ip, answer := range self.names {
+			if key := normalize.key(ip); answer.ts >= latest[key].ts {
+				latest[key] = answer
+			}
+		}
+		r.RemoteNames = make(map[string]string, len(latest))
+		for key, answer := range latest {
+			r.RemoteNames[key] = answer.name
+		}
+	}
+	if self.dests != nil {
+		r.Destinations = make(map[string]int64, len(self.dests))
+		for dest, bytecount := range self.dests {
+			key := dest.name
+			if key == "" {
+				key = normalize.key(dest.ip)
+			}
+			r.Destinations[key] += bytecount
+		}
+	}
+	return r
+}
+
+type Reducer struct {
+	pool   *Pool
+	reduce func([]Conn) *Partial
+	inq    chan []Conn
+	outq   chan *Partial
+
+	// optional channels that each receive every parsed record
+	taps []chan []Conn
+
+	// what the records are enriched with before they are tapped and summed
+	enrich []Enricher
+}
+
+func (self Reducer) Reduce(data_slice []Conn) {
+	for _, enricher := range self.enrich {
+		enricher.Enrich(data_slice)
+	}
+	for _, tap := range self.taps {
+		tap <- data_slice
+	}
+	self.outq <- self.reduce(data_slice)
+}
+
+/*
+	function to sum a batch of records into a partial result with the
+	package level settings
+*/
+func ReduceBatch(data_slice []Conn) *Partial {
+	settings := Defaults()
+	return settings.ReduceBatch(data_slice)
+}
+
+/*
+	function to sum a batch of records into a partial result
+*/
+func (self *Settings) ReduceBatch(data_slice []Conn) *Partial {
+	tt := self.NewPartial()
+	partition := self.Partition
+
+	for _, c := range data_slice {
+		orig := c.Orig
+		resp := c.Resp
+		b := c.Bytes
+		tt.AddTime(c.Ts)
+
+		// expected bulk traffic is left out of everything else
+		if self.Excludes != nil {
+			if name, ok := self.Excludes.Match(c); ok {
+				if tt.excluded != nil && partition.OwnsString(name) {
+					tt.excluded[name] += int64(b)
+				}
+				continue
+			}
+		}
+
+		orig_local := self.IsLocal(orig)
+		resp_local := self.IsLocal(resp)
+
+		if tt.dirs != nil {
+			if direction := Direction(orig_local, resp_local); partition.OwnsString(direction) {
+				tt.dirs[direction] += int64(b)
+			}
+		}
+
+		if orig_local {
+			tt.Add(orig, c.Port, int64(b))
+		}
+
+		if resp_local {
+			tt.Add(resp, c.Port, int64(b))
+		}
+
+		if tt.buckets != nil && (orig_local || resp_local) {
+			if bucket := self.BucketOf(c.Ts); partition.OwnsInt(bucket) {
+				tt.buckets[bucket] += int64(b)
+			}
+		}
+
+		if tt.segments != nil && (orig_local || resp_local) {
+			segment := c.Segment
+			if segment == "" {
+				segment = NoSegment
+			}
+			if partition.OwnsString(segment) {
+				tt.segments[segment] += int64(b)
+			}
+		}
+
+		if tt.macs != nil {
+			if orig_local && c.OrigMAC != "" && partition.OwnsString(c.OrigMAC) {
+				tt.macs[c.OrigMAC] += int64(b)
+			}
+			if resp_local && c.RespMAC != "" && partition.OwnsString(c.RespMAC) {
+				tt.macs[c.RespMAC] += int64(b)
+			}
+		}
+
+		if tt.tags != nil {
+			if orig_local && c.OrigTag != "" && partition.OwnsString(c.OrigTag) {
+				tt.tags[c.OrigTag] += int64(b)
+			}
+			if resp_local && c.RespTag != "" && partition.OwnsString(c.RespTag) {
+				tt.tags[c.RespTag] += int64(b)
+			}
+		}
+
+		if tt.users != nil {
+			if orig_local {
+				tt.AddUser(orig, c.Ts, int64(b))
+			}
+			if resp_local {
+				tt.AddUser(resp, c.Ts, int64(b))
+			}
+		}
+
+		if tt.services != nil && (orig_local || resp_local) && partition.OwnsInt(int64(c.Port)) {
+			tt.services[c.Port] += int64(b)
+		}
+
+		if tt.convs != nil && (orig_local || resp_local) {
+			pair := [2]netip.Addr{orig, resp}
+			if resp.Less(orig) {
+				pair = [2]netip.Addr{resp, orig}
+			}
+			if partition.OwnsPair(pair) {
+				tt.convs[pair] += int64(b)
+			}
+		}
+
+		if tt.sent != nil {
+			if orig_local && partition.OwnsAddr(orig) {
+				tt.sent[orig] += int64(c.OrigBytes)
+			}
+			if resp_local && partition.OwnsAddr(resp) {
+				tt.sent[resp] += int64(c.RespBytes)
+			}
+		}
+
+		if tt.subnets != nil {
+			if orig_local {
+				tt.AddSubnetBucket(orig, c.Ts, int64(b))
+			}
+			if resp_local {
+				tt.AddSubnetBucket(resp, c.Ts, int64(b))
+			}
+		}
+
+		if tt.remotes != nil && orig_local != resp_local {
+			remote := resp
+			if resp_local {
+				remote = orig
+			}
+			if partition.OwnsAddr(remote) {
+				tt.remotes[remote] += int64(b)
+			}
+
+			// the name the local host resolved the remote one from
+			if tt.names != nil && partition.OwnsAddr(remote) {
+				local := orig
+				if resp_local {
+					local = resp
+				}
+				if name, ts, ok := self.DNS.Lookup(local, remote, c.Ts); ok {
+					tt.AddName(remote, dnsAnswer{name, ts})
+				}
+			}
+		}
+
+		if tt.dests != nil && orig_local != resp_local {
+			dest := destination{ip: resp}
+			if resp_local {
+				dest.ip = orig
+			}
+			owned := partition.OwnsAddr(dest.ip)
+			if name, ok := self.HostNames.Lookup(c.UID); ok {
+				dest, owned = destination{name: name}, partition.OwnsString(name)
+			}
+			if owned {
+				tt.dests[dest] += int64(b)
+			}
+		}
+	}
+
+	return tt
+}
+
+func (self Reducer) Start() {
+	var wg sync.WaitGroup
+	for data_slice := range self.inq {
+		data_slice := data_slice
+		wg.Add(1)
+		self.pool.Submit(func() {
+			self.Reduce(data_slice)
+			wg.Done()
+		})
+	}
+
+	wg.Wait()
+	close(self.outq)
+}
+
+//--------------------------------------------------------------------------------
+//	Combiner class that sums the partiai results created by the reducer
+//--------------------------------------------------------------------------------
+
+type Combiner struct {
+	settings *Settings
+	inq      chan *Partial
+	outq     chan int
+	final    chan Result
+}
+
+func (self Combiner) Start() {
+	final := self.settings.NewPartial()
+
+	for subresult := range self.inq {
+		final.Merge(subresult)
+
+		self.outq <- len(subresult.hosts)
+	}
+
+	self.final <- final.Result()
+	close(self.outq)
+}
+
+/*
+	function to print the hosts report, presented as the settings of the
+	combiner say, or the Defaults when it has none
+*/
+func (self Combiner) Report(w io.Writer, result Result) {
+	settings := self.settings
+	if settings == nil {
+		defaults := Defaults()
+		settings = &defaults
+	}
+	var tbytes int64
+	for _, v := range result.Hosts {
+		tbytes += v
+	}
+
+	ranked := topRows(Rank(result.Hosts))
+	width := keyWidth(15, ranked)
+	for _, t := range ranked {
+		line := fmt.Sprintf("%*v %v", width, t.Key, Percent(t.Bytes, tbytes))
+		if settings.Bars {
+			line = fmt.Sprintf("%*v %9v", width, t.Key, Percent(t.Bytes, tbytes))
+		}
+		if result.Sent != nil {
+			line += "  " + RatioColumn(result.Sent[t.Key], t.Bytes)
+		}
+		if settings.Previous != nil {
+			line += "  " + Compare(settings.Previous, t.Key, t.Bytes)
+		}
+		if label, ok := settings.Labels.Lookup(t.Key); ok {
+			line += "  " + label.String()
+		}
+		// the bar goes last since its width on screen isn't its length
+		if bar := ShareBar(t.Bytes, tbytes); settings.Bars && bar != "" {
+			line += " " + bar
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// a single aggregated key and its byte total
+type Talker struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`
+}
+
+/*
+	function to rank the entries of an aggregation by bytes, largest
+	first, with ties broken by key so the order is stable between runs
+*/
+func Rank(tt map[string]int64) []Talker {
+	ranked := make([]Talker, 0, len(tt))
+	for k, v := range tt {
+		ranked = append(ranked, Talker{k, v})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Bytes != ranked[j].Bytes {
+			return ranked[i].Bytes > ranked[j].Bytes
+		}
+		return ranked[i].Key < ranked[j].Key
+	})
+	return ranked
+}
+
+//--------------------------------------------------------------------------------
+//	main program body
+//--------------------------------------------------------------------------------
+
+/*
+	function to run qreader as a command with the arguments in os.Args,
+	see cmd/qreader
+*/
+func Main() {
+	// parse cmd-line flags
+	var input_files fileList
+	flag.Var(&input_files, "f", "the gzip file to be parsed, a glob pattern such as 'conn.*.log.gz' or - for the standard input, repeated for more files (which may also follow as arguments), all summed into one report")
+	var input_dir = flag.String("dir", "", "a directory whose tree is walked for more files to parse, such as a day of a log archive (see <-ext>)")
+	var input_exts = flag.String("ext", ".gz,.log", "comma separated extensions of the files parsed under <-dir>, or \"\" for all of them")
+	var bsize = flag.Int("b", -1, "specify the blocksize to be used in filereading")
+	var debugging = flag.Bool("d", false, "turn on program debugging")
+	var cpus = flag.Int("cpus", 0, "number of cpus to use (default: all, or the container's cpu quota)")
+	var tui = flag.Bool("tui", false, "browse the results in an interactive terminal ui")
+	var report = flag.String("report", "", "comma separated report sections to print, built in are directions,hosts,ports,subnets,convs,remotes,destinations,domains,excluded,countries,segments,macs,tags,users,tenants,utilization,chargeback,quotas (default: hosts)")
+	var serve = flag.String("serve-report", "", "after processing, or while replaying, serve an html report on the given address (e.g. :8080), streaming each replayed window as server-sent events from /results/stream; SIGHUP reloads the <-map>, <-users>, <-tenants>, <-exclude> and <-tags> files, a replay summing its next window with them")
+	var bucket = flag.Duration("bucket", 0, "sum traffic into time buckets of the given width (e.g. 1h)")
+	var chart_top = flag.String("chart-top", "", "write a bar chart of the top talkers to the given .png or .svg file")
+	var chart_time = flag.String("chart-time", "", "write a traffic-over-time chart to the given .png or .svg file (requires -bucket)")
+	var anonymize = flag.Bool("anonymize", false, "anonymize all ip addresses in the output (prefix-preserving); the outputs that keep real addresses, such as <-save-state> and <-history>, are refused with it")
+	var anon_key = flag.String("anonymize-key", "", "file holding the 32 byte anonymization key (default: random per run)")
+	var mapfile = flag.String("map", "", "csv file mapping addresses/cidrs to hostname,owner,department labels")
+	var stats_columns = flag.String("stats-columns", "", "comma separated numeric columns to report the range, mean and histogram of over all the records, from "+strings.Join(StatsColumnNames(), ", "))
+	var chargeback = flag.Bool("chargeback", false, "report traffic totals per department from the mapping file")
+	var quotafile = flag.String("quota", "", "csv file of network,budget pairs to report usage against")
+	var save_state = flag.String("save-state", "", "save the aggregation state to the given file for later comparison")
+	var compare = flag.String("compare", "", "compare the results against a state file saved by a previous run")
+	var history = flag.String("history", "", "directory of past results used to flag anomalies; this run is added to it")
+	var history_len = flag.Int("history-len", HistoryLen, "number of past periods kept in the history directory")
+	var freq = flag.String("freq", "", "instead of reporting, count the records by their value of the given column, e.g. service or proto, and print the frequency table")
+	var baseline_file = flag.String("baseline", "", "flag anomalies against a baseline written by qreader baseline rather than a <-history> directory")
+	var sigma = flag.Float64("anomaly-sigma", 3, "flag hosts and subnets this many standard deviations above their baseline")
+	var anomaly_min = flag.String("anomaly-min-bytes", "1MiB", "flag hosts and subnets with no traffic in their baseline once they reach this many bytes")
+	var intel_out = flag.String("intel-out", "", "write the top external talkers to the given zeek intel file")
+	var intel_top = flag.Int("intel-top", 100, "number of external talkers written by <-intel-out>")
+	var duckdb = flag.String("duckdb", "", "export the full aggregation to the given duckdb database")
+	var duckdb_raw = flag.Bool("duckdb-raw", false, "also export every parsed record to the <-duckdb> database")
+	var mqtt = flag.String("mqtt", "", "publish a summary of each time bucket to the given mqtt broker (host[:port], requires -bucket)")
+	var mqtt_topic = flag.String("mqtt-topic", "qreader/windows", "topic the <-mqtt> summaries are published to")
+	var rrd_dir = flag.String("rrd-dir", "", "update a database per subnet in the given directory with its byte rate in each time bucket (requires -bucket)")
+	var rrd_format = flag.String("rrd-format", "rrd", "format of the <-rrd-dir> databases: rrd or wsp (whisper)")
+	var dump_all = flag.String("dump-all", "", "write every aggregated key and its totals to the given csv file, led by the run metadata as #qreader comment lines (gzipped if it ends in .gz, else zstd compressed with .zst added to the name)")
+	var lock_wait = flag.Duration("lock-wait", 0, "how long to wait for another run holding the <-save-state> or <-history> lock (default: fail at once)")
+	var direct_io = flag.Bool("direct-io", false, "read uncompressed inputs with O_DIRECT, bypassing the page cache")
+	var drop_cache = flag.Bool("drop-cache", false, "tell the kernel uncompressed inputs are read once, so their pages are dropped behind the reader")
+	var nice = flag.Int("nice", 0, "lower the cpu priority of the run by the given niceness (1-19)")
+	var ionice = flag.String("ionice", "", "io scheduling class of the run: idle, or best-effort with an optional level (e.g. best-effort:7)")
+	var timeout = flag.Duration("timeout", 0, "give up on a run that takes longer than this (default: no limit)")
+	var max_lines = flag.Int64("max-lines", 0, "give up on a run once it has read more than this many lines (default: no limit)")
+	var max_input_bytes = flag.String("max-input-bytes", "", "give up on a run once it has read more than this much data, after decompression (e.g. 50GB)")
+	var max_line = flag.String("max-line", "1MiB", "stop with an error at a line longer than this, as when given a binary file (0 for no limit)")
+	var read_rate = flag.String("read-rate", "", "limit how fast inputs are read from disk, in bytes per second (e.g. 50MB)")
+	var replay = flag.String("replay-speed", "", "replay the inputs at the given multiple of their original pace (e.g. 1x, 10x), reporting each time bucket as it closes (requires -bucket)")
+	var sample_by = flag.String("sample-by", "", "sample the connections by a hash of the given field (uid), see <-sample-rate>")
+	var sample_rate = flag.String("sample-rate", "1/16", "fraction N/D of the connections kept by <-sample-by>")
+	var format = flag.String("format", "auto", "format of the inputs: tsv, zeek-json, csv, ndjson, regex (see <-regex>), or auto to detect it from their first lines")
+	var syslog = flag.Bool("syslog", false, "strip the syslog framing (priority, timestamp, host and tag) of lines relayed through rsyslog before parsing them, which is detected unless <-format> or <-regex> is given")
+	var regex = flag.String("regex", "", "parse the inputs with the given regular expression, whose named groups src, dst and bytes, and optionally ts, sport, dport and proto, hold the fields of each line, e.g. for firewall syslog lines")
+	var errors_out = flag.String("errors-out", "", "record every line that can't be parsed, with its file, line number and the reason, in the given file")
+	var dead_letter = flag.String("dead-letter", "", "keep every line dropped by <-segments> or <-sample-by> or that can't be parsed, with its file, line number and the reason, in the given file")
+	var max_error_rate = flag.Float64("max-error-rate", 1, "fail the run if more than this fraction of the data lines can't be parsed (e.g. 0.01)")
+	var no_compress = flag.Bool("no-compress", false, "write state files, <-dump-all> files, <-errors-out> and <-dead-letter> logs uncompressed instead of compressing them with zstd")
+	var force = flag.Bool("force", false, "replace output files that already exist")
+	var window_store = flag.String("window-store", "", "keep the result of every <-replay-speed> window in the given directory, queryable through <-serve-report>")
+	var window_retention = flag.Duration("window-retention", 0, "how far back from the newest window the <-window-store> keeps windows (default: forever)")
+	var ratio = flag.Bool("ratio", false, "add each host's upload/download ratio to the hosts report")
+	var flag_ratio = flag.Float64("flag-ratio", 0, "flag hosts whose upload/download ratio is at least the given value, e.g. 10 (implies -ratio)")
+	var min_bytes = flag.String("min-bytes", "", "leave keys with fewer bytes than this (e.g. 1GB) out of <-dump-all> and <-duckdb>")
+	var exclude = flag.String("exclude", "", "csv file of name,kind,value rules for expected bulk traffic left out of the rankings (see exclude.go)")
+	var exclude_mode = flag.String("exclude-mode", "drop", "what happens to <-exclude> traffic: drop, or separate to total it by rule in the excluded report section")
+	var geoip = flag.String("geoip", "", "csv file of network,country rows used to find the country of external hosts")
+	var group_by = flag.String("group-by", "host", "what the default report totals traffic by: host, mac, user (requires -users), tenant (requires -tenants), country (requires -geoip), domain (requires -http-log), tag (requires -tags) or segment (see <-segment-field>)")
+	var tags = flag.String("tags", "", "csv file of address,tag rows labelling the local hosts, such as an export of a CMDB, DHCP leases or EDR inventory, for the tags report")
+	var tenants = flag.String("tenants", "", "csv file of name,network rows assigning local networks to the tenants of a shared sensor")
+	var http_log = flag.String("http-log", "", "comma separated zeek http and ssl logs, used to total the destinations report by the Host header or SNI of each connection")
+	var suffix_list = flag.String("public-suffix-list", "", "public suffix list the domains report finds registered domains with, such as public_suffix_list.dat from publicsuffix.org (default: a short built in list)")
+	var dns_log = flag.String("dns-log", "", "comma separated zeek dns logs, used to name the hosts of the remotes report after the domains the local hosts resolved them from")
+	var users = flag.String("users", "", "csv file of ip,user,start,end sessions, e.g. from radius or vpn logs, used to attribute local traffic to users")
+	var records_dir = flag.String("records-dir", "", "keep a sample of the raw parsed records of each run in the given directory, as gzipped csv")
+	var records_rate = flag.String("records-rate", "1/100", "fraction N/D of the records kept by <-records-dir>")
+	var records_retention = flag.Duration("records-retention", 0, "remove <-records-dir> files older than this at the end of each run (default: keep them all)")
+	var unzip_bench = flag.Bool("unzip-bench", false, "time the installed gzip decompressors on the first .gz input and use the fastest")
+	var coordinate = flag.String("coordinate", "", "hand the inputs out to <-worker-of> instances from the given address (e.g. :9000) and report their merged results")
+	var worker_of = flag.String("worker-of", "", "process inputs handed out by the coordinator at the given url (e.g. http://host:9000), which must be given the same inputs")
+	var partitions = flag.Int("partitions", 0, "have each <-coordinate> worker read all the inputs for one of this many disjoint partitions of the keys, instead of handing out files")
+	var lease = flag.Duration("lease", 5*time.Minute, "how long a <-coordinate> worker may go silent before its file is handed to another")
+	var locale = flag.String("locale", "C", "locale the numbers of the text report are written in, e.g. en, de or fr_CH, or auto to take it from LC_ALL, LC_NUMERIC or LANG")
+	var si = flag.Bool("si", false, "show byte counts in decimal units (kB, MB, GB) in the text report")
+	var iec = flag.Bool("iec", false, "show byte counts in binary units (KiB, MiB, GiB) in the text report (the default)")
+	var top = flag.Int("top", 10, "number of rows in each section of the text report, 0 for all")
+	var top_pct = flag.Float64("top-pct", 0, "instead of a fixed number of rows, show the top rows of each section that together make up this percentage of its total, e.g. 95")
+	var top_per_group = flag.Int("top-per-group", 0, "list the given number of top hosts under each subnet of the subnets section and each department of <-chargeback>")
+	var all = flag.Bool("all", false, "show every row of the text report, the same as -top 0")
+	var no_pager = flag.Bool("no-pager", false, "don't page long text reports on a terminal through $PAGER")
+	var tls_cert = flag.String("tls-cert", "", "pem certificate for <-serve-report> and <-coordinate> to serve https with, requires <-tls-key>")
+	var tls_key = flag.String("tls-key", "", "pem private key of <-tls-cert>")
+	var tls_ca = flag.String("tls-ca", "", "pem certificates a <-worker-of> trusts besides the system ones, e.g. the coordinator's self signed certificate")
+	var token_file = flag.String("auth-token-file", "", "file holding the token <-serve-report> and <-coordinate> require as a bearer token or token query parameter, and <-worker-of> presents")
+	var request_rate = flag.Float64("request-rate", 0, "requests per second each client of <-serve-report> and <-coordinate> may send, 0 for no limit")
+	var request_burst = flag.Int("request-burst", 20, "requests a client may send at once within <-request-rate>")
+	var max_upload = flag.String("max-upload", "1GiB", "largest request body <-serve-report> and <-coordinate> accept, such as a worker's result")
+	var max_concurrent = flag.Int("max-concurrent", 0, "most requests <-serve-report> and <-coordinate> work on at once, including open result streams, 0 for no limit")
+	var rates = flag.String("cost", "", "price per GB to estimate the cost of each subnet, tenant and department at, e.g. 0.09, or tiers such as 0.09,10TB:0.085,50TB:0.07")
+	var link_capacity = flag.String("link-capacity", "", "capacity of the monitored link (e.g. 10Gbps), reported as the utilization of each <-bucket> and of the whole run")
+	var color = flag.String("color", "auto", "color the text report: auto (only on a terminal), always or never")
+	var bars = flag.Bool("bars", false, "add a bar showing each row's share of the total to the text report")
+	var segment_field = flag.String("segment-field", "vlan", "column holding the network segment of a connection, e.g. vlan, inner_vlan or _node_name")
+	var segments = flag.String("segments", "", "comma separated segments to keep, see <-segment-field>")
+	var overlap = flag.String("overlap", "warn", "what to do with inputs whose data overlaps another input: warn or skip")
+	var in_progress = flag.String("in-progress", "complete", "what to do with inputs modified within <-settle-time>, taken as still being written: wait for them to settle, read them up to their last complete line, or skip them")
+	var settle_time = flag.Duration("settle-time", 10*time.Second, "how long an input has to go unmodified to be taken as finished, 0 to read every input as it is")
+	var cache_dir = flag.String("cache-dir", "", "keep the result of each run in the given directory, and reuse it when the same inputs are read with the same options again")
+	var manifest = flag.String("manifest", "", "write a json manifest of the run to the given file: its inputs and their sha256, options, versions, counts and the files it wrote")
+	var throughput_log = flag.String("throughput-log", ThroughputLog, "file the throughput of each run is logged to, shown by qreader history, \"\" to log none")
+	var query = flag.String("query", "", "run with the options of the given saved query, which those on the command line override; also run as: qreader run <name> ...")
+	var queries = flag.String("queries", DefaultQueriesFile(), "file of the saved queries <-query> runs")
+
+	// qreader plan lists what a back-fill would read instead of running it
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		PlanMain(os.Args[2:])
+		return
+	}
+
+	// qreader selftest checks that the deployment works
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		SelfTestMain(os.Args[2:])
+		return
+	}
+
+	// qreader count takes inventory of the inputs without summing them
+	if len(os.Args) > 1 && os.Args[1] == "count" {
+		CountMain(os.Args[2:])
+		return
+	}
+
+	// qreader rollup totals the state of past runs by week or month
+	if len(os.Args) > 1 && os.Args[1] == "rollup" {
+		RollupMain(os.Args[2:])
+		return
+	}
+
+	// qreader k8s-plan writes kubernetes jobs that process the inputs
+	if len(os.Args) > 1 && os.Args[1] == "k8s-plan" {
+		K8sPlanMain(os.Args[2:])
+		return
+	}
+
+	// qreader baseline learns the usual traffic to flag anomalies against
+	if len(os.Args) > 1 && os.Args[1] == "baseline" {
+		BaselineMain(os.Args[2:])
+		return
+	}
+
+	// qreader history shows the throughput of the past runs
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		HistoryMain(os.Args[2:])
+		return
+	}
+
+	// qreader run <name> is short for qreader -query <name>
+	if len(os.Args) > 2 && os.Args[1] == "run" {
+		os.Args = append([]string{os.Args[0], "-query", os.Args[2]}, os.Args[3:]...)
+	}
+	flag.Parse()
+
+	// use options to initalize loggers
+	LogInit(*debugging)
+
+	if *query != "" {
+		saved, err := LoadQueries(*queries)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		q, ok := saved[*query]
+		if !ok {
+			Error.Fatalf("Invalid query given: %v is not in %v", *query, *queries)
+		}
+		if err := q.Apply(flag.CommandLine); err != nil {
+			Error.Fatalf("Invalid query %v: %v", *query, err)
+		}
+		LogInit(*debugging)
+	}
+
+	// make sure given options are valid
+	if len(input_files) == 0 && *input_dir == "" {
+		Error.Fatalln("Please specify a file to process with the <-f> flag, or a directory with <-dir>.")
+	}
+
+	if *bsize <= 0 {
+		Error.Fatalf("Invalid blocksize given: %d", *bsize)
+	}
+
+	if *cpus < 0 {
+		Error.Fatalf("Invalid number of cpus given: %d", *cpus)
+	}
+	runtime.GOMAXPROCS(UsableCPUs(*cpus))
+
+	if *bucket < 0 || *bucket%time.Second != 0 {
+		Error.Fatalf("Invalid bucket width given: %v", *bucket)
+	}
+
+	if *chart_time != "" && *bucket == 0 {
+		Error.Fatalln("The <-chart-time> flag requires time buckets, see <-bucket>.")
+	}
+
+	if *mqtt != "" && *bucket == 0 {
+		Error.Fatalln("The <-mqtt> flag requires time buckets, see <-bucket>.")
+	}
+
+	if *rrd_dir != "" && *bucket == 0 {
+		Error.Fatalln("The <-rrd-dir> flag requires time buckets, see <-bucket>.")
+	}
+
+	if *rrd_format != "rrd" && *rrd_format != "wsp" {
+		Error.Fatalf("Invalid database format given: %v", *rrd_format)
+	}
+
+	if *replay != "" && *bucket == 0 {
+		Error.Fatalln("The <-replay-speed> flag requires time buckets, see <-bucket>.")
+	}
+
+	// a replay only reports, publishes, stores and graphs each window,
+	// the outputs of a whole run have no place in it
+	if *replay != "" {
+		for _, output := range []struct{ name, value string }{
+			{"save-state", *save_state}, {"history", *history}, {"dump-all", *dump_all},
+			{"duckdb", *duckdb}, {"intel-out", *intel_out}, {"chart-top", *chart_top},
+			{"chart-time", *chart_time}, {"manifest", *manifest},
+		} {
+			if output.value != "" {
+				Error.Fatalf("The <-%v> flag can't be used with <-replay-speed>, which only reports each window.", output.name)
+			}
+		}
+	}
+
+	if *duckdb_raw && *duckdb == "" {
+		Error.Fatalln("The <-duckdb-raw> flag requires a database, see <-duckdb>.")
+	}
+
+	if *intel_out != "" && *anonymize {
+		Error.Fatalln("The <-intel-out> file must hold real addresses and cannot be combined with <-anonymize>.")
+	}
+
+	// the state, history and cache are kept with the real addresses, for
+	// later runs to compare against and learn from, and the reject logs
+	// hold the lines as they were read, so none of them can be written
+	// by an anonymized run
+	if *anonymize {
+		for _, output := range []struct{ name, value string }{
+			{"save-state", *save_state}, {"history", *history}, {"cache-dir", *cache_dir},
+			{"errors-out", *errors_out}, {"dead-letter", *dead_letter},
+		} {
+			if output.value != "" {
+				Error.Fatalf("The <-%v> flag keeps real addresses and cannot be combined with <-anonymize>.", output.name)
+			}
+		}
+	}
+
+	// the top hosts are shown unless some other report was asked for
+	var sections []string
+	if *report != "" {
+		var err error
+		if sections, err = ParseSections(*report); err != nil {
+			Error.Fatalln(err)
+		}
+
+		// the chargeback and quotas are measured on the real addresses,
+		// so they are printed on their own before the result is
+		// anonymized, as -chargeback and -quota print them
+		var kept []string
+		for _, name := range sections {
+			switch name {
+			case "chargeback":
+				*chargeback = true
+			case "quotas":
+				if *quotafile == "" {
+					Error.Fatalln("The quotas report requires -quota")
+				}
+			default:
+				kept = append(kept, name)
+			}
+		}
+		sections = kept
+	} else if !*chargeback && *quotafile == "" {
+		sections = []string{"hosts"}
+	}
+
+	if *overlap != "warn" && *overlap != "skip" {
+		Error.Fatalf("Invalid overlap policy given: %v", *overlap)
+	}
+	switch *in_progress {
+	case "wait", "complete", "skip":
+	default:
+		Error.Fatalf("Invalid in-progress policy given: %v", *in_progress)
+	}
+	if *settle_time < 0 {
+		Error.Fatalf("Invalid settle time given: %v", *settle_time)
+	}
+	InProgress, SettleTime = *in_progress, *settle_time
+	ThroughputLog = *throughput_log
+	var err error
+	if *min_bytes != "" {
+		if MinBytes, err = ParseBytes(*min_bytes); err != nil || MinBytes < 0 {
+			Error.Fatalf("Invalid byte threshold given: %v", *min_bytes)
+		}
+	}
+	if AnomalyMinBytes, err = ParseBytes(*anomaly_min); err != nil || AnomalyMinBytes < 0 {
+		Error.Fatalf("Invalid anomaly threshold given: %v", *anomaly_min)
+	}
+	switch *group_by {
+	case "host":
+	case "country":
+		if *geoip == "" {
+			Error.Fatalln("-group-by country requires -geoip")
+		}
+		if *report == "" {
+			sections = []string{"countries"}
+		}
+	case "segment":
+		if *report == "" {
+			sections = []string{"segments"}
+		}
+	case "mac":
+		if *report == "" {
+			sections = []string{"macs"}
+		}
+	case "tenant":
+		if *tenants == "" {
+			Error.Fatalln("-group-by tenant requires -tenants")
+		}
+		if *report == "" {
+			sections = []string{"tenants"}
+		}
+	case "tag":
+		if *tags == "" {
+			Error.Fatalln("-group-by tag requires -tags")
+		}
+		if *report == "" {
+			sections = []string{"tags"}
+		}
+	case "user":
+		if *users == "" {
+			Error.Fatalln("-group-by user requires -users")
+		}
+		if *report == "" {
+			sections = []string{"users"}
+		}
+	case "domain":
+		if *http_log == "" {
+			Error.Fatalln("-group-by domain requires -http-log")
+		}
+		if *report == "" {
+			sections = []string{"domains"}
+		}
+	default:
+		Error.Fatalf("Invalid grouping given: %v", *group_by)
+	}
+	var records_sample Sample
+	if *records_dir != "" {
+		var err error
+		if records_sample, err = ParseSample(*records_rate); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *records_retention < 0 {
+		Error.Fatalf("Invalid records retention given: %v", *records_retention)
+	}
+	if *coordinate != "" && *worker_of != "" {
+		Error.Fatalln("An instance is either the coordinator or a worker, not both.")
+	}
+	if *coordinate != "" && (*duckdb_raw || *records_dir != "") {
+		Error.Fatalln("The raw records stay on the workers, <-duckdb-raw> and <-records-dir> can't be used with <-coordinate>.")
+	}
+	if *partitions < 0 || (*partitions > 0 && *coordinate == "") {
+		Error.Fatalf("Invalid number of partitions given: %d, which requires <-coordinate>", *partitions)
+	}
+	if *lease <= 0 {
+		Error.Fatalf("Invalid lease given: %v", *lease)
+	}
+	if *top < 0 {
+		Error.Fatalf("Invalid number of rows given: %v", *top)
+	}
+	TopN = *top
+	if *all {
+		TopN = 0
+	}
+	if *top_per_group < 0 {
+		Error.Fatalf("Invalid number of hosts per group given: %d", *top_per_group)
+	}
+	TopPerGroup = *top_per_group
+	if *top_pct < 0 || *top_pct > 100 {
+		Error.Fatalf("Invalid percentage given: %v", *top_pct)
+	}
+	if TopShare = *top_pct; TopShare > 0 {
+		TopN = 0
+	}
+	if *color != "auto" && *color != "always" && *color != "never" {
+		Error.Fatalf("Invalid color setting given: %v", *color)
+	}
+	Styled = UseColor(*color, os.Stdout)
+	Bars = *bars
+	if *si && *iec {
+		Error.Fatalln("Only one of <-si> and <-iec> can be given.")
+	}
+	SIUnits = *si
+	if *locale == "auto" {
+		*locale = "C"
+		for _, name := range []string{"LC_ALL", "LC_NUMERIC", "LANG"} {
+			if value := os.Getenv(name); value != "" {
+				*locale = value
+				break
+			}
+		}
+	}
+	if *locale != "" {
+		var err error
+		if Numbers, err = ParseNumberLocale(*locale); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *exclude_mode != "drop" && *exclude_mode != "separate" {
+		Error.Fatalf("Invalid exclusion mode given: %v", *exclude_mode)
+	}
+	if *flag_ratio < 0 {
+		Error.Fatalf("Invalid ratio given: %v", *flag_ratio)
+	}
+	if *max_error_rate < 0 || *max_error_rate > 1 {
+		Error.Fatalf("Invalid error rate given: %v", *max_error_rate)
+	}
+	// outputs are checked up front so a collision doesn't waste the run
+	Force = *force
+	CompressOutputs = !*no_compress
+	if CompressOutputs && !ZstdInstalled() {
+		if *save_state != "" || *dump_all != "" || *errors_out != "" || *history != "" || *cache_dir != "" || *window_store != "" {
+			Info.Printf("%v is not installed, writing the outputs uncompressed", Zstd)
+		}
+	}
+	if *dump_all != "" && DumpName(*dump_all) != *dump_all {
+		*dump_all = DumpName(*dump_all)
+		Info.Printf("writing the compressed dump to %v", *dump_all)
+	}
+	if err := CheckOutputs(*save_state, *dump_all, *intel_out, *chart_top, *chart_time, *errors_out, *dead_letter, *duckdb, *manifest); err != nil {
+		Error.Fatalln(err)
+	}
+	if err := CheckOutputDirs(*rrd_dir, *records_dir, *history, *window_store, *cache_dir); err != nil {
+		Error.Fatalln(err)
+	}
+	input_format, err := parse.ParseFormat(*format)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+
+	filenames, err := ExpandInputs(append([]string(input_files), flag.Args()...))
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	if *input_dir != "" {
+		var exts []string
+		if *input_exts != "" {
+			exts = strings.Split(*input_exts, ",")
+		}
+		found, err := WalkInputs(*input_dir, exts)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		filenames = append(filenames, found...)
+	}
+
+	// print some debugging information
+	Debug.Printf("Received cmdline arguments:")
+	Debug.Printf("\tfilenames: %v", filenames)
+	Debug.Printf("\tdir: %v", *input_dir)
+	Debug.Printf("\text: %v", *input_exts)
+	Debug.Printf("\tbsize: %v", *bsize)
+	Debug.Printf("\tdebugging: %v", *debugging)
+	Debug.Printf("\tcpus: %v", runtime.GOMAXPROCS(0))
+	Debug.Printf("\toverlap: %v", *overlap)
+	Debug.Printf("\tin-progress: %v", *in_progress)
+	Debug.Printf("\tsettle-time: %v", *settle_time)
+	Debug.Printf("\ttui: %v", *tui)
+	Debug.Printf("\treport: %v", *report)
+	Debug.Printf("\tserve-report: %v", *serve)
+	Debug.Printf("\tbucket: %v", *bucket)
+	Debug.Printf("\tchart-top: %v", *chart_top)
+	Debug.Printf("\tchart-time: %v", *chart_time)
+	Debug.Printf("\tanonymize: %v", *anonymize)
+	Debug.Printf("\tanonymize-key: %v", *anon_key)
+	Debug.Printf("\tmap: %v", *mapfile)
+	Debug.Printf("\tchargeback: %v", *chargeback)
+	Debug.Printf("\tstats-columns: %v", *stats_columns)
+	Debug.Printf("\tquota: %v", *quotafile)
+	Debug.Printf("\tsave-state: %v", *save_state)
+	Debug.Printf("\tcompare: %v", *compare)
+	Debug.Printf("\thistory: %v", *history)
+	Debug.Printf("\thistory-len: %v", *history_len)
+	Debug.Printf("\tno-compress: %v", *no_compress)
+	Debug.Printf("\tcache-dir: %v", *cache_dir)
+	Debug.Printf("\tmanifest: %v", *manifest)
+	Debug.Printf("\tthroughput-log: %v", *throughput_log)
+	Debug.Printf("\tquery: %v", *query)
+	Debug.Printf("\tqueries: %v", *queries)
+	Debug.Printf("\tfreq: %v", *freq)
+	Debug.Printf("\tbaseline: %v", *baseline_file)
+	Debug.Printf("\tanomaly-sigma: %v", *sigma)
+	Debug.Printf("\tanomaly-min-bytes: %v", *anomaly_min)
+	Debug.Printf("\tintel-out: %v", *intel_out)
+	Debug.Printf("\tintel-top: %v", *intel_top)
+	Debug.Printf("\tduckdb: %v", *duckdb)
+	Debug.Printf("\tduckdb-raw: %v", *duckdb_raw)
+	Debug.Printf("\tmqtt: %v", *mqtt)
+	Debug.Printf("\tmqtt-topic: %v", *mqtt_topic)
+	Debug.Printf("\trrd-dir: %v", *rrd_dir)
+	Debug.Printf("\trrd-format: %v", *rrd_format)
+	Debug.Printf("\tdump-all: %v", *dump_all)
+	Debug.Printf("\tlock-wait: %v", *lock_wait)
+	Debug.Printf("\tdirect-io: %v", *direct_io)
+	Debug.Printf("\tdrop-cache: %v", *drop_cache)
+	Debug.Printf("\tnice: %v", *nice)
+	Debug.Printf("\tionice: %v", *ionice)
+	Debug.Printf("\ttimeout: %v", *timeout)
+	Debug.Printf("\tmax-lines: %v", *max_lines)
+	Debug.Printf("\tmax-input-bytes: %v", *max_input_bytes)
+	Debug.Printf("\tmax-line: %v", *max_line)
+	Debug.Printf("\tread-rate: %v", *read_rate)
+	Debug.Printf("\treplay-speed: %v", *replay)
+	Debug.Printf("\tsample-by: %v", *sample_by)
+	Debug.Printf("\tsample-rate: %v", *sample_rate)
+	Debug.Printf("\tformat: %v", *format)
+	Debug.Printf("\tregex: %v", *regex)
+	Debug.Printf("\tsyslog: %v", *syslog)
+	Debug.Printf("\terrors-out: %v", *errors_out)
+	Debug.Printf("\tdead-letter: %v", *dead_letter)
+	Debug.Printf("\tmax-error-rate: %v", *max_error_rate)
+	Debug.Printf("\tforce: %v", *force)
+	Debug.Printf("\twindow-store: %v", *window_store)
+	Debug.Printf("\twindow-retention: %v", *window_retention)
+	Debug.Printf("\tratio: %v", *ratio)
+	Debug.Printf("\tflag-ratio: %v", *flag_ratio)
+	Debug.Printf("\tmin-bytes: %v", *min_bytes)
+	Debug.Printf("\texclude: %v", *exclude)
+	Debug.Printf("\texclude-mode: %v", *exclude_mode)
+	Debug.Printf("\tgeoip: %v", *geoip)
+	Debug.Printf("\tgroup-by: %v", *group_by)
+	Debug.Printf("\thttp-log: %v", *http_log)
+	Debug.Printf("\tpublic-suffix-list: %v", *suffix_list)
+	Debug.Printf("\tdns-log: %v", *dns_log)
+	Debug.Printf("\tusers: %v", *users)
+	Debug.Printf("\ttags: %v", *tags)
+	Debug.Printf("\ttenants: %v", *tenants)
+	Debug.Printf("\trecords-dir: %v", *records_dir)
+	Debug.Printf("\trecords-rate: %v", *records_rate)
+	Debug.Printf("\trecords-retention: %v", *records_retention)
+	Debug.Printf("\tunzip-bench: %v", *unzip_bench)
+	Debug.Printf("\tcoordinate: %v", *coordinate)
+	Debug.Printf("\tworker-of: %v", *worker_of)
+	Debug.Printf("\tpartitions: %v", *partitions)
+	Debug.Printf("\tlease: %v", *lease)
+	Debug.Printf("\ttop: %v", *top)
+	Debug.Printf("\ttop-pct: %v", *top_pct)
+	Debug.Printf("\ttop-per-group: %v", *top_per_group)
+	Debug.Printf("\tall: %v", *all)
+	Debug.Printf("\tno-pager: %v", *no_pager)
+	Debug.Printf("\tcost: %v", *rates)
+	Debug.Printf("\ttls-cert: %v", *tls_cert)
+	Debug.Printf("\ttls-key: %v", *tls_key)
+	Debug.Printf("\ttls-ca: %v", *tls_ca)
+	Debug.Printf("\tauth-token-file: %v", *token_file)
+	Debug.Printf("\trequest-rate: %v", *request_rate)
+	Debug.Printf("\trequest-burst: %v", *request_burst)
+	Debug.Printf("\tmax-upload: %v", *max_upload)
+	Debug.Printf("\tmax-concurrent: %v", *max_concurrent)
+	Debug.Printf("\tlink-capacity: %v", *link_capacity)
+	Debug.Printf("\tcolor: %v", *color)
+	Debug.Printf("\tbars: %v", *bars)
+	Debug.Printf("\tlocale: %v", *locale)
+	Debug.Printf("\tsi: %v", *si)
+	Debug.Printf("\tiec: %v", *iec)
+	Debug.Printf("\tsegment-field: %v", *segment_field)
+	Debug.Printf("\tsegments: %v", *segments)
+
+	if *chargeback && *mapfile == "" {
+		Error.Fatalln("The <-chargeback> flag requires a mapping file, see <-map>.")
+	}
+
+	if *mapfile != "" {
+		if *anonymize {
+			Warning.Println("labels from the mapping file are not shown for anonymized hosts")
+		}
+		var err error
+		if Labels, err = LoadMapping(*mapfile); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	if *quotafile != "" {
+		var err error
+		if Quotas, err = LoadQuotas(*quotafile); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	// the state written by this run is locked until it has been saved, so
+	// overlapping runs can't corrupt it or count the same period twice
+	var locks []*Lock
+	if *save_state != "" {
+		lock, err := AcquireLock(*save_state, *lock_wait)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		locks = append(locks, lock)
+	}
+	if *history != "" {
+		if err := os.MkdirAll(*history, 0755); err != nil {
+			Error.Fatalln(err)
+		}
+		lock, err := AcquireLock(*history, *lock_wait)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		locks = append(locks, lock)
+	}
+
+	if *compare != "" {
+		previous, err := LoadState(*compare)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		Previous = &previous
+	}
+
+	var anon *Anonymizer
+	if *anonymize {
+		var err error
+		if anon, err = LoadAnonymizer(*anon_key); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	var baseline *Baseline
+	if *history != "" {
+		if *history_len <= 0 {
+			Error.Fatalf("Invalid history length given: %d", *history_len)
+		}
+		HistoryLen = *history_len
+
+		past, err := LoadHistory(*history)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		built := BuildBaseline(past)
+		baseline = &built
+	}
+	if *baseline_file != "" {
+		if *history != "" {
+			Error.Fatalln("Only one of <-baseline> and <-history> can be given.")
+		}
+		loaded, err := LoadBaseline(*baseline_file)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		baseline = &loaded
+	}
+
+	// the browser needs per-host detail for drilling down, and the
+	// database export and full dump hold everything that can be aggregated
+	TrackDetail = *tui || *duckdb != "" || *dump_all != ""
+	BucketSize = *bucket
+	DirectIO = *direct_io
+	DropCache = *drop_cache
+	if *timeout < 0 {
+		Error.Fatalf("Invalid timeout given: %v", *timeout)
+	}
+	if *max_lines < 0 {
+		Error.Fatalf("Invalid line limit given: %v", *max_lines)
+	}
+	MaxLines = *max_lines
+	if *max_input_bytes != "" {
+		var err error
+		if MaxInputBytes, err = ParseBytes(*max_input_bytes); err != nil || MaxInputBytes <= 0 {
+			Error.Fatalf("Invalid input limit given: %v", *max_input_bytes)
+		}
+	}
+	if length, err := ParseBytes(*max_line); err != nil {
+		Error.Fatalf("Invalid line length given: %v", *max_line)
+	} else {
+		MaxLineLength = int(length)
+	}
+	// the timeout covers the reading and summing, not what is done with
+	// the result
+	withTimeout := func(ctx context.Context) (context.Context, context.CancelFunc) {
+		if *timeout == 0 {
+			return context.WithCancel(ctx)
+		}
+		return context.WithTimeoutCause(ctx, *timeout, fmt.Errorf("gave up after the -timeout of %v", *timeout))
+	}
+	if *read_rate != "" {
+		var err error
+		if ReadRate, err = ParseBytes(*read_rate); err != nil || ReadRate <= 0 {
+			Error.Fatalf("Invalid read rate given: %v", *read_rate)
+		}
+	}
+
+	// lowered priorities are set before the workers start, so that their
+	// threads and the decompressors inherit them
+	if *nice != 0 {
+		if err := SetNice(*nice); err != nil {
+			Error.Fatalf("Could not set the niceness to %d: %v", *nice, err)
+		}
+	}
+	if *ionice != "" {
+		if err := SetIOPriority(*ionice); err != nil {
+			Error.Fatalf("Could not set the io priority to %v: %v", *ionice, err)
+		}
+	}
+	TrackRemote = *intel_out != "" || *duckdb != "" || *dump_all != ""
+	TrackSubnetBuckets = *rrd_dir != ""
+	TrackSent = *ratio || *flag_ratio > 0
+	if *geoip != "" {
+		if Geo, err = LoadGeoIP(*geoip); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *users != "" {
+		if Users, err = LoadUsers(*users); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *dns_log != "" {
+		if DNSNames, err = LoadDNS(strings.Split(*dns_log, ",")); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *http_log != "" {
+		if HostNames, err = LoadHostNames(strings.Split(*http_log, ",")); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *suffix_list != "" {
+		if PublicSuffixes, err = LoadPublicSuffixes(*suffix_list); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	tag_index := -1
+	if *tags != "" {
+		tag_map, err := LoadTags(*tags)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		tag_index = len(Enrichers)
+		Enrichers = append(Enrichers, tag_map)
+	}
+	if *tenants != "" {
+		if Tenants, err = LoadTenants(*tenants); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *exclude != "" {
+		if Excludes, err = LoadExclusions(*exclude); err != nil {
+			Error.Fatalln(err)
+		}
+		TrackExcluded = *exclude_mode == "separate"
+		if TrackExcluded && *report == "" {
+			sections = append(sections, "excluded")
+		}
+	}
+	if *rates != "" {
+		if Rates, err = ParseCostRates(*rates); err != nil {
+			Error.Fatalf("Invalid cost given: %v", err)
+		}
+	}
+	if (*tls_cert == "") != (*tls_key == "") {
+		Error.Fatalln("<-tls-cert> and <-tls-key> must be given together.")
+	}
+	TLSCert, TLSKey = *tls_cert, *tls_key
+	if *token_file != "" {
+		if AuthToken, err = ReadToken(*token_file); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *request_rate < 0 {
+		Error.Fatalf("Invalid request rate given: %v", *request_rate)
+	}
+	if *request_burst < 1 {
+		Error.Fatalf("Invalid request burst given: %v", *request_burst)
+	}
+	if *max_concurrent < 0 {
+		Error.Fatalf("Invalid number of concurrent requests given: %v", *max_concurrent)
+	}
+	RequestRate, RequestBurst, MaxConcurrent = *request_rate, *request_burst, *max_concurrent
+	if MaxUploadBytes, err = ParseBytes(*max_upload); err != nil || MaxUploadBytes <= 0 {
+		Error.Fatalf("Invalid upload limit given: %v", *max_upload)
+	}
+	if *worker_of != "" {
+		if Client, err = NewClient(AuthToken, *tls_ca); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *link_capacity != "" {
+		if LinkCapacity, err = ParseBitRate(*link_capacity); err != nil {
+			Error.Fatalf("Invalid link capacity given: %v", *link_capacity)
+		}
+		if *report == "" {
+			sections = append(sections, "utilization")
+		}
+	}
+	RatioFlag = *flag_ratio
+	for _, name := range sections {
+		TrackPorts = TrackPorts || name == "ports"
+		TrackConvs = TrackConvs || name == "convs"
+		TrackRemote = TrackRemote || name == "remotes" || name == "countries"
+		if name == "countries" && Geo == nil {
+			Error.Fatalln("The countries report requires -geoip")
+		}
+		TrackSegments = TrackSegments || name == "segments"
+		TrackMACs = TrackMACs || name == "macs"
+		if name == "tags" && len(Enrichers) == 0 {
+			Error.Fatalln("The tags report requires -tags")
+		}
+		TrackTags = TrackTags || name == "tags"
+		if name == "users" && Users == nil {
+			Error.Fatalln("The users report requires -users")
+		}
+		TrackUsers = TrackUsers || name == "users"
+		TrackDirections = TrackDirections || name == "directions" || name == "utilization"
+		if name == "utilization" && LinkCapacity == 0 {
+			Error.Fatalln("The utilization report requires -link-capacity")
+		}
+		if name == "tenants" && Tenants == nil {
+			Error.Fatalln("The tenants report requires -tenants")
+		}
+		if (name == "destinations" || name == "domains") && HostNames == nil {
+			Error.Fatalf("The %v report requires -http-log", name)
+		}
+		TrackDestinations = TrackDestinations || name == "destinations" || name == "domains"
+	}
+	if DNSNames != nil && !TrackRemote {
+		Warning.Println("-dns-log only names the hosts of the remotes report, which isn't printed")
+	}
+	segment := ""
+	if TrackSegments || *segments != "" {
+		segment = *segment_field
+	}
+
+	// the column of -freq is read in place of the segment
+	if *freq != "" {
+		if segment != "" {
+			Error.Fatalln("-freq can't be used with -segments or the segments report")
+		}
+		segment = *freq
+	}
+
+	unzipper := Unzipper
+	if *unzip_bench {
+		for _, filename := range filenames {
+			if !strings.HasSuffix(filename, ".gz") {
+				continue
+			}
+			best, timings, err := BenchmarkUnzippers(filename)
+			if err != nil {
+				Error.Fatalln(err)
+			}
+			for _, timing := range timings {
+				Debug.Printf("\t%v: %v %v", timing.Unzipper, timing.Elapsed, timing.Err)
+			}
+			unzipper = best
+			Info.Printf("using %v to decompress the inputs", unzipper)
+			break
+		}
+	}
+
+	// csv inputs are always read from their header row, and the segment
+	// column is found from the header too
+	switch {
+	case *regex != "":
+		if input_format != parse.FormatAuto && input_format != parse.FormatRegex {
+			Error.Fatalf("-regex can't be used with -format %v", input_format)
+		}
+		if InputSchema, err = parse.RegexSchema(*regex); err != nil {
+			Error.Fatalf("Invalid regular expression given: %v", err)
+		}
+		if segment != "" {
+			if InputSchema, err = InputSchema.WithSegment(segment); err != nil {
+				Error.Fatalln(err)
+			}
+		}
+		if err := CheckInputs(filenames); err != nil {
+			Error.Fatalln(err)
+		}
+	case input_format == parse.FormatRegex:
+		Error.Fatalln("-format regex requires -regex")
+	case input_format == parse.FormatAuto || input_format == parse.FormatCSV || segment != "" || TrackMACs:
+		Debug.Printf("Detecting the input format:")
+		if InputSchema, err = DetectSchema(filenames, segment); err != nil {
+			Error.Fatalln(err)
+		}
+		if input_format != parse.FormatAuto && InputSchema.Format != input_format {
+			Error.Fatalf("Inputs are %v, not %v", InputSchema.Format, input_format)
+		}
+	default:
+		if err := CheckInputs(filenames); err != nil {
+			Error.Fatalln(err)
+		}
+		InputSchema = parse.Schema{Format: input_format}
+	}
+	if *syslog {
+		InputSchema = InputSchema.WithSyslog()
+	}
+
+	// only the columns the aggregation uses are extracted
+	ParseNeed = parse.NeedTs | parse.NeedAddrs | parse.NeedBytes
+	if TrackDetail || TrackPorts {
+		ParseNeed |= parse.NeedPort
+	}
+	if TrackSent {
+		ParseNeed |= parse.NeedDirBytes
+	}
+	if TrackDestinations {
+		ParseNeed |= parse.NeedUID
+	}
+	ParseNeed |= Excludes.Need()
+	if segment != "" {
+		ParseNeed |= parse.NeedSegment
+	}
+	if TrackMACs {
+		if !InputSchema.HasMACs() {
+			Error.Fatalln("The inputs have no orig_l2_addr and resp_l2_addr columns to total by mac")
+		}
+		ParseNeed |= parse.NeedMACs
+	}
+	if *segments != "" {
+		keep := make(map[string]bool)
+		for _, s := range strings.Split(*segments, ",") {
+			keep[strings.TrimSpace(s)] = true
+		}
+		AddRecordFilter(parse.NeedSegment, func(c Conn) bool { return keep[c.Segment] })
+	}
+
+	if *sample_by != "" {
+		if *sample_by != "uid" {
+			Error.Fatalf("Invalid sampling field given: %v", *sample_by)
+		}
+		sample, err := ParseSample(*sample_rate)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		ParseNeed |= parse.NeedUID
+		AddRecordFilter(parse.NeedUID, func(c Conn) bool { return sample.Keep(c.UID) })
+	}
+
+	// the lines that can't be parsed are recorded while the inputs are read
+	var rejects, dead_letters *RejectLog
+	if *errors_out != "" {
+		if rejects, err = NewRejectLog(*errors_out); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *dead_letter != "" {
+		if dead_letters, err = NewRejectLog(*dead_letter); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	closeRejects := func() {
+		if dead_letters != nil {
+			if err := dead_letters.Close(); err != nil {
+				Error.Fatalln(err)
+			}
+			if dead_letters.Count > 0 {
+				Info.Printf("%d lines were dropped, see %v", dead_letters.Count, *dead_letter)
+			}
+		}
+		if rejects == nil {
+			return
+		}
+		if err := rejects.Close(); err != nil {
+			Error.Fatalln(err)
+		}
+		if rejects.Count > 0 {
+			Warning.Printf("%d lines could not be parsed, see %v", rejects.Count, *errors_out)
+		}
+	}
+
+	// the runs of the command count their lines together and record them
+	// in the same logs, with the settings taken from the options when
+	// the run starts
+	lines := &LineCounts{}
+	runSettings := func() Settings {
+		settings := Defaults()
+		settings.Unzipper, settings.Lines = unzipper, lines
+		settings.Rejects, settings.DeadLetters = rejects, dead_letters
+		return settings
+	}
+
+	// a run over inputs too corrupted to trust fails before any output
+	// is written
+	checkErrorRate := func() {
+		if rate := lines.ErrorRate(); rate > *max_error_rate {
+			parsed, rejected := lines.Load()
+			Error.Fatalf("%d of %d data lines could not be parsed (%.4f%%), more than -max-error-rate allows",
+				rejected, parsed+rejected, rate*100)
+		}
+	}
+
+	// SIGHUP reloads the files the report is labelled and summed with.
+	// The new configuration is loaded whole before any of it is applied,
+	// so that a broken file leaves the previous one in place
+	loadConfig := func() (func(), error) {
+		var labels *Mapping
+		var user_map *UserMap
+		var tenancy *Tenancy
+		var exclusions Exclusions
+		var tag_map *TagMap
+		var err error
+		if *mapfile != "" && anon == nil {
+			if labels, err = LoadMapping(*mapfile); err != nil {
+				return nil, err
+			}
+		}
+		if *users != "" {
+			if user_map, err = LoadUsers(*users); err != nil {
+				return nil, err
+			}
+		}
+		if *tenants != "" {
+			if tenancy, err = LoadTenants(*tenants); err != nil {
+				return nil, err
+			}
+		}
+		if *exclude != "" {
+			if exclusions, err = LoadExclusions(*exclude); err != nil {
+				return nil, err
+			}
+		}
+		if *tags != "" {
+			if tag_map, err = LoadTags(*tags); err != nil {
+				return nil, err
+			}
+		}
+		return func() {
+			Labels, Users, Tenants, Excludes = labels, user_map, tenancy, exclusions
+			if tag_index >= 0 {
+				Enrichers[tag_index] = tag_map
+			}
+		}, nil
+	}
+
+	var store *WindowStore
+	if *window_store != "" {
+		if store, err = OpenWindowStore(*window_store, *window_retention); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	if *replay != "" {
+		speed, err := ParseSpeed(*replay)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		if sections == nil {
+			sections = []string{"hosts"}
+		}
+
+		// the mapping refers to real addresses, so it must not be used
+		// to label anonymized ones
+		if anon != nil {
+			Labels = nil
+		}
+
+		// the report server shows each window as it closes. A reloaded
+		// configuration is applied between two windows, by the replay
+		// itself, so that no window is summed with a mix of the two
+		var updates chan WindowEvent
+		reloaded := make(chan func(), 1)
+		if *serve != "" {
+			updates = make(chan WindowEvent)
+			reload := func() error {
+				apply, err := loadConfig()
+				if err != nil {
+					return err
+				}
+				select {
+				case <-reloaded:
+				default:
+				}
+				reloaded <- apply
+				return nil
+			}
+			go func() {
+				if err := ServeReport(*serve, Result{}, reload, store, updates); err != nil {
+					Error.Fatalln(err)
+				}
+			}()
+		}
+
+		err = Replay(runSettings(), filenames, speed, func(start int64, window Result) {
+			defer func() {
+				select {
+				case apply := <-reloaded:
+					apply()
+				default:
+				}
+			}()
+			if Geo != nil && window.Remotes != nil {
+				window.Countries = Geo.Totals(window.Remotes)
+			}
+			if Tenants != nil {
+				window.Tenants = Tenants.Split(window.Hosts)
+			}
+			if anon != nil {
+				window = anon.Result(window)
+			}
+			fmt.Printf("\nwindow %v:\n", time.Unix(start, 0).UTC().Format(time.RFC3339))
+			PrintSections(os.Stdout, sections, window)
+			if *mqtt != "" {
+				if err := PublishWindows(*mqtt, *mqtt_topic, window); err != nil {
+					Warning.Println(err)
+				}
+			}
+			if store != nil {
+				if err := store.Put(start, window); err != nil {
+					Warning.Println(err)
+				}
+			}
+			if *rrd_dir != "" {
+				if err := UpdateRRDWindow(*rrd_dir, *rrd_format, start, window); err != nil {
+					Warning.Println(err)
+				}
+			}
+			if updates != nil {
+				updates <- WindowEvent{start, window}
+			}
+		})
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		closeRejects()
+		checkErrorRate()
+
+		// the report stays up with the last window once the replay is done
+		if *serve != "" {
+			select {}
+		}
+		return
+	}
+
+	if *freq != "" {
+		settings := runSettings()
+		settings.Need = parse.NeedAddrs | parse.NeedSegment
+		ctx, cancel := withTimeout(context.Background())
+		counts, err := CountValues(ctx, settings, filenames, WithWorkers(Workers), WithBlockSize(*bsize), WithOverlap(*overlap))
+		cancel()
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		closeRejects()
+		checkErrorRate()
+		PrintFrequencies(os.Stdout, *freq, counts)
+		return
+	}
+
+	// a worker runs the pipeline over each file the coordinator hands it
+	// and leaves the reporting to the coordinator
+	if *worker_of != "" {
+		hostname, _ := os.Hostname()
+		name := fmt.Sprintf("%v-%d", hostname, os.Getpid())
+		err := RunWorker(strings.TrimSuffix(*worker_of, "/"), name, filenames, func(ctx context.Context, assignment Assignment) (Result, error) {
+			inputs := []string{assignment.File}
+			settings := runSettings()
+			if assignment.Partition != "" {
+				var err error
+				if settings.Partition, err = ParsePartition(assignment.Partition); err != nil {
+					return Result{}, err
+				}
+				inputs = filenames
+			}
+			ctx, cancel := withTimeout(ctx)
+			defer cancel()
+			return New(WithWorkers(Workers), WithBlockSize(*bsize), WithOverlap(*overlap), WithSettings(settings)).Source(inputs...).Run(ctx)
+		})
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		closeRejects()
+		checkErrorRate()
+		return
+	}
+
+	pipeline := New(WithWorkers(Workers), WithBlockSize(*bsize), WithOverlap(*overlap)).Source(filenames...)
+	var records *RecordWriter
+	var records_file string
+	if *duckdb_raw {
+		staged, err := ioutil.TempFile("", "qreader-records")
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		staged.Close()
+		records_file = staged.Name()
+		defer os.Remove(records_file)
+
+		if records, err = NewRecordWriter(records_file, anon); err != nil {
+			Error.Fatalln(err)
+		}
+		pipeline.Tap(records.inq)
+
+		// the exported records carry every field of the log
+		ParseNeed = parse.NeedAll
+		go records.Start()
+	}
+	var sampled *RecordWriter
+	if *records_dir != "" {
+		if sampled, err = NewSampleWriter(*records_dir, records_sample, anon); err != nil {
+			Error.Fatalln(err)
+		}
+		pipeline.Tap(sampled.inq)
+		ParseNeed = parse.NeedAll
+		go sampled.Start()
+	}
+	var profile *ColumnProfile
+	if *stats_columns != "" {
+		var need parse.Need
+		if profile, need, err = NewColumnProfile(strings.Split(*stats_columns, ",")); err != nil {
+			Error.Fatalf("Invalid statistics columns given: %v", err)
+		}
+		pipeline.Tap(profile.inq)
+		ParseNeed |= need
+		go profile.Start()
+	}
+
+	// monitor status of workers
+	fmtstring := "\rReader -> (%d) -> Parser -> (%d) -> Batcher -> (%d) -> Reducer -> (%d) -> Combiner -> (%d done)"
+	fmtstring = fmt.Sprintf("%85s", fmtstring)
+	pipeline.Progress(func(st Status) {
+		fmt.Printf(fmtstring, st.Read, st.Parsed, st.Batched, st.Reduced, st.Done)
+	})
+
+	// a cached result can't feed the records to the taps
+	var cache *ResultCache
+	var cache_key string
+	if *cache_dir != "" && *coordinate == "" && records == nil && sampled == nil && profile == nil {
+		options := make(map[string]string)
+		flag.Visit(func(f *flag.Flag) { options[f.Name] = f.Value.String() })
+		if cache, err = OpenResultCache(*cache_dir); err == nil {
+			cache_key, err = CacheKey(filenames, options)
+		}
+		if err != nil {
+			Warning.Printf("not using the result cache: %v", err)
+			cache = nil
+		}
+	}
+
+	// the settings are taken once the taps have added the fields they need
+	settings := runSettings()
+	WithSettings(settings)(pipeline)
+
+	var final Result
+	cached := false
+	if cache != nil {
+		final, cached = cache.Get(cache_key)
+	}
+	switch {
+	case cached:
+		Info.Printf("using the result cached in %v", *cache_dir)
+	case *coordinate != "":
+		final, err = Coordinate(*coordinate, filenames, *partitions, *lease)
+	default:
+		ctx, cancel := withTimeout(context.Background())
+		began := time.Now()
+		final, err = pipeline.Run(ctx)
+		cancel()
+		if err == nil && ThroughputLog != "" {
+			record := NewThroughputRecord(filenames, &settings, time.Since(began))
+			if err := AppendThroughput(ThroughputLog, record); err != nil {
+				Warning.Printf("could not log the throughput of the run: %v", err)
+			}
+		}
+	}
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	if cache != nil && !cached {
+		if err := cache.Put(cache_key, final); err != nil {
+			Warning.Printf("could not cache the result: %v", err)
+		}
+	}
+	closeRejects()
+	checkErrorRate()
+
+	// present the final results
+	Run = NewRunMetadata(filenames, final)
+	if *save_state != "" {
+		if err := SaveState(*save_state, final); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	var anomalies []Anomaly
+	if baseline != nil {
+		anomalies = baseline.Anomalies(final, *sigma)
+	}
+	if *history != "" {
+		if err := AppendHistory(*history, final); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	for _, lock := range locks {
+		lock.Release()
+	}
+	if *chargeback {
+		// departments are resolved before anonymizing since the mapping
+		// refers to the real addresses, and the hosts anonymized after
+		fmt.Println()
+		ChargebackSection{anon}.Render(os.Stdout, final)
+	}
+	if Quotas != nil {
+		fmt.Println()
+		QuotaSection{anon}.Render(os.Stdout, final)
+	}
+	if profile != nil {
+		profile.Close()
+	}
+	if records != nil {
+		if err := records.Close(); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if sampled != nil {
+		if err := sampled.Close(); err != nil {
+			Error.Fatalln(err)
+		}
+		if *records_retention > 0 {
+			if err := PruneSamples(*records_dir, *records_retention); err != nil {
+				Warning.Println(err)
+			}
+		}
+	}
+	if Geo != nil && final.Remotes != nil {
+		final.Countries = Geo.Totals(final.Remotes)
+	}
+	if Tenants != nil {
+		final.Tenants = Tenants.Split(final.Hosts)
+	}
+	if anon != nil {
+		final = anon.Result(final)
+		if Previous != nil {
+			anonymized := anon.Result(*Previous)
+			Previous = &anonymized
+		}
+		for i := range anomalies {
+			anomalies[i].Key = anon.Key(anomalies[i].Key)
+		}
+
+		// the mapping refers to real addresses, so it must not be used
+		// to label anonymized ones
+		Labels, settings.Labels = nil, nil
+	}
+
+	if *dump_all != "" {
+		if err := DumpAll(*dump_all, final); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *duckdb != "" {
+		if err := ExportDuckDB(*duckdb, final, records_file); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *mqtt != "" {
+		if err := PublishWindows(*mqtt, *mqtt_topic, final); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *rrd_dir != "" {
+		if err := UpdateRRD(*rrd_dir, *rrd_format, final); err != nil {
+			Error.Fatalln(err)
+		}
+		noteOutput(*rrd_dir)
+	}
+	if *intel_out != "" {
+		if err := WriteIntel(*intel_out, final, *intel_top); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *chart_top != "" {
+		if err := WriteChart(*chart_top, TopChart(final)); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *chart_time != "" {
+		if err := WriteChart(*chart_time, TimeChart(final)); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+	if *manifest != "" {
+		run_manifest, err := NewRunManifest(Run, &settings, final, cached)
+		if err != nil {
+			Error.Fatalln(err)
+		}
+		if err := WriteManifest(*manifest, run_manifest); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	if *tui {
+		if err := Browse(final, &settings); err != nil {
+			Error.Fatalln(err)
+		}
+	} else {
+		var out io.WriteCloser = nopWriteCloser{os.Stdout}
+		if !*no_pager {
+			if out, err = OpenPager(os.Stdout, TopN); err != nil {
+				Error.Fatalln(err)
+			}
+		}
+		if sections != nil {
+			fmt.Fprintln(out)
+			PrintSections(out, sections, final)
+		}
+		if baseline != nil {
+			fmt.Fprintln(out)
+			AnomalyReport(out, anomalies, *baseline)
+		}
+		if profile != nil {
+			fmt.Fprintln(out)
+			profile.Report(out)
+		}
+		out.Close()
+	}
+
+	if *serve != "" {
+		// the inputs have all been summed, so of the reloaded files
+		// only the labels change the report
+		reload := func() error {
+			apply, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			apply()
+			return nil
+		}
+		if err := ServeReport(*serve, final, reload, store, nil); err != nil {
+			Error.Fatalln(err)
+		}
 	}
 }
@@ -0,0 +1,3340 @@
+package qreader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+func collectChunks(t *testing.T, r io.Reader, size int) []string {
+	var chunks []string
+	err := SplitChunks(r, size, func(chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("SplitChunks: %v", err)
+	}
+	return chunks
+}
+
+func TestSplitChunks(t *testing.T) {
+	var data bytes.Buffer
+	for i := 0; i < 500; i++ {
+		data.WriteString(strings.Repeat("x", i%37))
+		data.WriteString("\tline\n")
+	}
+	input := data.String()
+	want := strings.TrimRight(input, "\n")
+
+	readers := map[string]func(string) io.Reader{
+		"plain":    func(s string) io.Reader { return strings.NewReader(s) },
+		"onebyte":  func(s string) io.Reader { return iotest.OneByteReader(strings.NewReader(s)) },
+		"halfread": func(s string) io.Reader { return iotest.HalfReader(strings.NewReader(s)) },
+	}
+	for name, reader := range readers {
+		for _, size := range []int{16, 17, 100, 4096, 1 << 20} {
+			for _, text := range []string{input, want} {
+				chunks := collectChunks(t, reader(text), size)
+				for _, chunk := range chunks {
+					if strings.HasSuffix(chunk, "\n") || strings.HasPrefix(chunk, "\n") {
+						t.Errorf("%v/%d: chunk not cut at a line boundary: %q", name, size, chunk)
+					}
+				}
+				if got := strings.Join(chunks, "\n"); got != want {
+					t.Errorf("%v/%d: chunks don't add back up to the input (%d of %d bytes)", name, size, len(got), len(want))
+				}
+			}
+		}
+	}
+}
+
+func TestSplitChunksLongLine(t *testing.T) {
+	long := strings.Repeat("y", 1000)
+	chunks := collectChunks(t, strings.NewReader("a\n"+long+"\nb"), 16)
+	if got := strings.Join(chunks, "\n"); got != "a\n"+long+"\nb" {
+		t.Errorf("long line was split or lost: got %d bytes", len(got))
+	}
+}
+
+func TestSplitChunksMaxLine(t *testing.T) {
+	LogInit(false)
+	for _, test := range []struct {
+		input string
+		size  int
+		line  int
+	}{
+		{"a\nb\n", 16, 0},
+		{"a\n" + strings.Repeat("y", 100) + "\nb", 16, 0},
+		{"a\n" + strings.Repeat("y", 101) + "\nb", 16, 2},
+		{"a\nb\n" + strings.Repeat("y", 101) + "\nb", 1024, 3},
+		{strings.Repeat("\x00", 1<<20), 4096, 1},
+	} {
+		err := splitChunks(strings.NewReader(test.input), test.size, 100, func(chunk []byte, line int) error {
+			return nil
+		})
+		var long *LineTooLongError
+		switch {
+		case test.line == 0 && err != nil:
+			t.Errorf("%d bytes: %v", len(test.input), err)
+		case test.line != 0 && (!errors.As(err, &long) || long.Line != test.line):
+			t.Errorf("%d bytes: expected line %d to be too long, got %v", len(test.input), test.line, err)
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	if err := os.WriteFile(filename, bytes.Repeat([]byte{0xff}, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings := Defaults()
+	settings.MaxLineLength = 1024
+	_, err := New(WithSettings(settings), WithBlockSize(256)).Source(filename).Run(context.Background())
+	var long *LineTooLongError
+	if !errors.As(err, &long) || long.File != filename {
+		t.Errorf("expected the binary input to stop the run, got %v", err)
+	}
+}
+
+func TestSplitChunksEmpty(t *testing.T) {
+	if chunks := collectChunks(t, strings.NewReader(""), 16); len(chunks) != 0 {
+		t.Errorf("expected no chunks, got %q", chunks)
+	}
+	if chunks := collectChunks(t, strings.NewReader("\n\n"), 16); len(chunks) != 0 {
+		t.Errorf("expected no chunks for blank input, got %q", chunks)
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	const size = 7
+
+	inq := make(chan []Conn, 10)
+	outq := make(chan []Conn, 10)
+	total := 0
+	for _, n := range []int{3, 0, 12, 1, 5} {
+		inq <- make([]Conn, n)
+		total += n
+	}
+	close(inq)
+	Batcher{size, inq, outq}.Start()
+
+	var sizes []int
+	seen := 0
+	for batch := range outq {
+		sizes = append(sizes, len(batch))
+		seen += len(batch)
+	}
+	if seen != total {
+		t.Fatalf("batches hold %d records, expected %d", seen, total)
+	}
+	for i, got := range sizes[:len(sizes)-1] {
+		if got != size {
+			t.Errorf("batch %d holds %d records, expected %d", i, got, size)
+		}
+	}
+	if last := sizes[len(sizes)-1]; last < 1 || last > size {
+		t.Errorf("the last batch holds %d records, expected 1 to %d", last, size)
+	}
+}
+
+func TestNextLine(t *testing.T) {
+	block := []byte("one\ntwo\n\nthree")
+	var lines []string
+	for len(block) > 0 {
+		var line []byte
+		line, block = NextLine(block)
+		lines = append(lines, string(line))
+	}
+	if got := strings.Join(lines, "|"); got != "one|two||three" {
+		t.Errorf("unexpected lines %q", got)
+	}
+}
+
+func writeConnLog(t *testing.T, records int) string {
+	var data bytes.Buffer
+	data.WriteString("#fields\tts\tuid\tid.orig_h\tid.orig_p\tid.resp_h\tid.resp_p\n")
+	for i := 0; i < records; i++ {
+		fields := []string{"1600000000.5", "C1", "128.252.0.1", "1234", "8.8.8.8", "443"}
+		for len(fields) < 16 {
+			fields = append(fields, "-")
+		}
+		fields = append(fields, "100", "-", "50", "-")
+		data.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+	filename := t.TempDir() + "/conn.log"
+	if err := os.WriteFile(filename, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestForEachConn(t *testing.T) {
+	LogInit(false)
+	filename := writeConnLog(t, 5000)
+
+	count, total := 0, 0
+	err := ForEachConn(context.Background(), filename, func(c Conn) error {
+		count++
+		total += c.Bytes
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5000 || total != 5000*150 {
+		t.Errorf("got %d records totalling %d bytes", count, total)
+	}
+
+	stop := errors.New("stop")
+	err = ForEachConn(context.Background(), filename, func(c Conn) error {
+		return stop
+	})
+	if err != stop {
+		t.Errorf("expected the callback's error, got %v", err)
+	}
+}
+
+func TestSample(t *testing.T) {
+	sample, err := ParseSample("1/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for i := 0; i < 16000; i++ {
+		uid := "C" + strings.Repeat("x", i%7) + string(rune('a'+i%26)) + strings.Repeat("y", i/26)
+		if sample.Keep(uid) != sample.Keep(uid) {
+			t.Fatalf("sampling of %v is not consistent", uid)
+		}
+		if sample.Keep(uid) {
+			kept++
+		}
+	}
+	if kept < 800 || kept > 1200 {
+		t.Errorf("kept %d of 16000 connections, expected about 1000", kept)
+	}
+
+	for _, bad := range []string{"", "1", "0/16", "17/16", "a/b", "1/0"} {
+		if _, err := ParseSample(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestRejects(t *testing.T) {
+	LogInit(false)
+	filename := t.TempDir() + "/errors.log"
+	rejects, err := NewRejectLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := Defaults()
+	settings.Need = parse.NeedTs | parse.NeedAddrs
+	settings.Lines, settings.Rejects = &LineCounts{}, rejects
+
+	// the small chunk size spreads the lines over several blocks
+	input := "#fields\tts\n1\tC1\t10.0.0.1\t1\t10.0.0.2\t53\nbad\n\n2\tC2\t10.0.0.1\t1\tnot-an-ip\t53\n"
+	err = splitChunks(strings.NewReader(input), 8, 0, func(chunk []byte, line int) error {
+		settings.ParseBlock(Block{Filename: "conn.log", Line: line, Data: chunk, warn: settings.Warn})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rejects.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := openOutput(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{"conn.log:3: ", "conn.log:5: invalid responder \"not-an-ip\""} {
+		if !strings.Contains(got, want) {
+			t.Errorf("reject log %q is missing %q", got, want)
+		}
+	}
+	if rejects.Count != 2 {
+		t.Errorf("recorded %d rejects, expected 2", rejects.Count)
+	}
+	lines := settings.Lines
+	if lines.Parsed != 1 || lines.Rejected != 2 || lines.ErrorRate() < 0.66 || lines.ErrorRate() > 0.67 {
+		t.Errorf("counted %d parsed and %d rejected lines", lines.Parsed, lines.Rejected)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	LogInit(false)
+	filename := t.TempDir() + "/dropped.log"
+	dead, err := NewRejectLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := Defaults()
+	settings.Need = parse.NeedTs | parse.NeedAddrs
+	settings.FilterNeed = parse.NeedAddrs
+	settings.Filter = func(c Conn) bool { return c.Orig != netip.MustParseAddr("10.0.0.9") }
+	settings.DeadLetters = dead
+
+	input := "#fields\tts\n1\tC1\t10.0.0.1\t1\t10.0.0.2\t53\n2\tC2\t10.0.0.9\t1\t10.0.0.2\t53\nbad\n"
+	kept := settings.ParseBlock(Block{Filename: "conn.log", Line: 1, Data: []byte(input), warn: func(InputWarning) {}})
+	if len(kept) != 1 {
+		t.Errorf("kept %d records, expected 1", len(kept))
+	}
+	if err := dead.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := openOutput(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{"conn.log:3: filtered out: 2\tC2\t10.0.0.9", "conn.log:4: "} {
+		if !strings.Contains(got, want) {
+			t.Errorf("dead letters %q are missing %q", got, want)
+		}
+	}
+	if strings.Contains(got, "C1") || strings.Contains(got, "#fields") || dead.Count != 2 {
+		t.Errorf("got %d dead letters %q, expected 2", dead.Count, got)
+	}
+}
+
+func TestCreateOutput(t *testing.T) {
+	dir := t.TempDir()
+	filename := dir + "/out.csv"
+
+	// nothing appears under the name until the file is committed
+	file, err := CreateOutput(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("partial")
+	if _, err := os.Stat(filename); err == nil {
+		t.Errorf("output visible before it was committed")
+	}
+	file.Abort()
+
+	if err := WriteOutput(filename, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteOutput(filename, []byte("second")); err == nil {
+		t.Errorf("existing output replaced without -force")
+	}
+	Force = true
+	defer func() { Force = false }()
+	if err := WriteOutput(filename, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(filename); string(data) != "second" {
+		t.Errorf("output holds %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestLock(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state.json")
+	lock, err := AcquireLock(state, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second run fails at once, or once it has waited, while the
+	// first one holds the lock
+	defer func(poll time.Duration) { LockPoll = poll }(LockPoll)
+	LockPoll = 10 * time.Millisecond
+	for _, wait := range []time.Duration{0, 50 * time.Millisecond} {
+		began := time.Now()
+		if _, err := AcquireLock(state, wait); err == nil || !strings.Contains(err.Error(), "in use") {
+			t.Errorf("waiting %v: got %v while the lock was held", wait, err)
+		}
+		if waited := time.Since(began); waited < wait {
+			t.Errorf("gave up after %v instead of %v", waited, wait)
+		}
+	}
+
+	// it gets the lock once the first one lets go of it
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		lock.Release()
+	}()
+	second, err := AcquireLock(state, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Release()
+}
+
+func TestExportDuckDB(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "out.duckdb")
+	result := Result{Hosts: map[string]int64{"10.0.0.1": 100}}
+	defer func(duckdb string) { DuckDB = duckdb }(DuckDB)
+
+	// a failed export leaves nothing behind, not even a partial database
+	DuckDB = "false"
+	if err := ExportDuckDB(filename, result, ""); err == nil {
+		t.Errorf("a failed export succeeded")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("failed export left %v", entries)
+	}
+
+	// a stand-in for duckdb that keeps the statements it was given
+	DuckDB = filepath.Join(t.TempDir(), "duckdb")
+	if err := os.WriteFile(DuckDB, []byte("#!/bin/sh\ncat > \"$1\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExportDuckDB(filename, result, ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filename); !strings.Contains(string(data), "CREATE OR REPLACE TABLE hosts") {
+		t.Errorf("database holds %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+	if err := ExportDuckDB(filename, result, ""); err == nil {
+		t.Errorf("existing database replaced without -force")
+	}
+
+	if err := CheckOutputDirs(dir, filepath.Join(dir, "new")); err != nil {
+		t.Error(err)
+	}
+	if err := CheckOutputDirs(filename); err == nil {
+		t.Errorf("a file was accepted as an output directory")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	for _, test := range []struct {
+		speed string
+		want  float64
+	}{
+		{"1x", 1}, {"10x", 10}, {"0.5", 0.5}, {"0x", 0}, {"fast", 0},
+	} {
+		speed, err := ParseSpeed(test.speed)
+		if speed != test.want || (err == nil) != (test.want > 0) {
+			t.Errorf("%v: got %v, %v", test.speed, speed, err)
+		}
+	}
+
+	LogInit(false)
+	settings := Defaults()
+	settings.BucketSize, settings.Lines = time.Minute, &LineCounts{}
+	line := func(ts int, bytes int) string {
+		return fmt.Sprintf("%d\tC1\t10.0.0.1\t1\t128.252.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t%d\t1\t0\n", ts, bytes)
+	}
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	input := line(1599999960, 1) + line(1600000019, 2) + line(1600000020, 4) + line(1600000145, 8)
+	if err := os.WriteFile(filename, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// each bucket with records is a window of its own, the empty one
+	// between them is skipped
+	got := make(map[int64]int64)
+	var starts []int64
+	err := Replay(settings, []string{filename}, 1e6, func(start int64, window Result) {
+		starts = append(starts, start)
+		got[start] = window.Hosts["128.252.0.1"]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]int64{1599999960: 3, 1600000020: 4, 1600000140: 8}
+	if !reflect.DeepEqual(got, want) || len(starts) != 3 || starts[0] > starts[1] || starts[1] > starts[2] {
+		t.Errorf("got windows %v in the order %v, expected %v", got, starts, want)
+	}
+	if parsed, rejected := settings.Lines.Load(); parsed != 4 || rejected != 0 {
+		t.Errorf("counted %d parsed and %d rejected lines", parsed, rejected)
+	}
+}
+
+func TestReplayPace(t *testing.T) {
+	LogInit(false)
+	settings := Defaults()
+	settings.BucketSize, settings.Lines = time.Minute, &LineCounts{}
+	line := func(ts int, bytes int) string {
+		return fmt.Sprintf("%d\tC1\t10.0.0.1\t1\t128.252.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t%d\t1\t0\n", ts, bytes)
+	}
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	input := line(1599999960, 1) + "not a record\n" + line(1600000050, 2)
+	if err := os.WriteFile(filename, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// at 600x the 90 seconds between the records take 150ms, and the
+	// first window closes at its end, 100ms in
+	began := time.Now()
+	var closed []time.Duration
+	err := Replay(settings, []string{filename}, 600, func(start int64, window Result) {
+		closed = append(closed, time.Since(began))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closed) != 2 || closed[0] < 95*time.Millisecond || closed[1] < 145*time.Millisecond {
+		t.Errorf("got windows closing at %v", closed)
+	}
+	if parsed, rejected := settings.Lines.Load(); parsed != 2 || rejected != 1 {
+		t.Errorf("counted %d parsed and %d rejected lines", parsed, rejected)
+	}
+}
+
+func TestWindowStore(t *testing.T) {
+	store, err := OpenWindowStore(t.TempDir(), 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, start := range []int64{3600, 7200, 10800, 14400} {
+		result := Result{Hosts: map[string]int64{"10.0.0.1": start, "10.0.0.2": 1}}
+		if err := store.Put(start, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// windows more than two hours older than the newest are dropped
+	windows, err := store.List(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 3 || windows[0].Start != 7200 || windows[2].Bytes != 14401 || windows[2].Hosts != 2 {
+		t.Errorf("unexpected windows %+v", windows)
+	}
+	if windows, _ := store.List(7200, 14400); len(windows) != 2 {
+		t.Errorf("expected 2 windows in range, got %+v", windows)
+	}
+
+	if result, err := store.Get(10800); err != nil || result.Hosts["10.0.0.1"] != 10800 {
+		t.Errorf("got %+v, %v", result, err)
+	}
+	if _, err := store.Get(3600); err == nil {
+		t.Errorf("expired window still returned")
+	}
+}
+
+func TestRatio(t *testing.T) {
+	cases := []struct {
+		sent, total int64
+		want        string
+	}{
+		{100, 150, "up/down 2.00 (outbound heavy)"},
+		{50, 150, "up/down 0.50"},
+		{10, 10, "up/down inf (outbound heavy)"},
+		{0, 0, "up/down 0.00"},
+	}
+	RatioFlag = 2
+	defer func() { RatioFlag = 0 }()
+	for _, c := range cases {
+		if got := RatioColumn(c.sent, c.total); got != c.want {
+			t.Errorf("%d of %d: got %q, expected %q", c.sent, c.total, got, c.want)
+		}
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	filename := t.TempDir() + "/exclude.csv"
+	rules := "# expected bulk traffic\nbackups,port,873\nbackups,hours,22-02\nmirror,cidr,10.9.0.0/16\nrsync,service,rsync\n"
+	if err := os.WriteFile(filename, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := LoadExclusions(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noon := float64(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Unix())
+	midnight := float64(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC).Unix())
+	addr := netip.MustParseAddr
+	cases := []struct {
+		c    Conn
+		want string
+	}{
+		{Conn{Ts: noon, Port: 873}, "backups"},
+		{Conn{Ts: midnight, Port: 443}, "backups"},
+		{Conn{Ts: noon, Port: 443, Orig: addr("10.1.0.1"), Resp: addr("10.9.3.4")}, "mirror"},
+		{Conn{Ts: noon, Port: 10000, Service: "ssh,rsync"}, "rsync"},
+		{Conn{Ts: noon, Port: 443, Orig: addr("10.1.0.1"), Resp: addr("10.2.0.1")}, ""},
+	}
+	for _, c := range cases {
+		if name, _ := excludes.Match(c.c); name != c.want {
+			t.Errorf("%+v matched %q, expected %q", c.c, name, c.want)
+		}
+	}
+
+	for _, bad := range []string{"x,port,http\n", "x,hours,3\n", "x,proto,tcp\n", "x,cidr\n"} {
+		os.WriteFile(filename, []byte(bad), 0644)
+		if _, err := LoadExclusions(filename); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	filename := t.TempDir() + "/geoip.csv"
+	table := "network,country\n8.0.0.0/8,us\n8.8.8.0/24,NL\n2001:db8::/32,DE\n"
+	if err := os.WriteFile(filename, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadGeoIP(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	totals := db.Totals(map[string]int64{"8.8.8.8": 1, "8.1.1.1": 2, "::ffff:8.8.4.4": 4, "2001:db8::1": 8, "9.9.9.9": 16})
+	want := map[string]int64{"NL": 1, "US": 6, "DE": 8, UnknownCountry: 16}
+	if len(totals) != len(want) {
+		t.Errorf("got %v, expected %v", totals, want)
+	}
+	for country, bytecount := range want {
+		if totals[country] != bytecount {
+			t.Errorf("%v: got %d bytes, expected %d", country, totals[country], bytecount)
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	filename := t.TempDir() + "/users.csv"
+	sessions := "ip,user,start,end\n" +
+		"10.0.0.1,alice,100,200\n" +
+		"10.0.0.1,bob,2020-01-01T00:00:00Z,\n" +
+		"10.0.0.2,carol,150,300\n" +
+		"10.0.0.2,dave,250,400\n"
+	if err := os.WriteFile(filename, []byte(sessions), 0644); err != nil {
+		t.Fatal(err)
+	}
+	users, err := LoadUsers(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		ts   float64
+		user string
+	}{
+		{"10.0.0.1", 99, ""},
+		{"10.0.0.1", 100, "alice"},
+		{"10.0.0.1", 200, ""},
+		{"10.0.0.1", 1700000000, "bob"},
+		{"::ffff:10.0.0.2", 200, "carol"},
+		{"10.0.0.2", 260, "dave"},
+		{"10.0.0.3", 150, ""},
+	}
+	for _, test := range tests {
+		user, _ := users.Lookup(netip.MustParseAddr(test.ip), test.ts)
+		if user != test.user {
+			t.Errorf("%v at %v: got %q, expected %q", test.ip, test.ts, user, test.user)
+		}
+	}
+
+	if err := os.WriteFile(filename, []byte("10.0.0.1,alice,200,100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadUsers(filename); err == nil {
+		t.Errorf("expected an error for a session ending before it starts")
+	}
+}
+
+func TestDNSNames(t *testing.T) {
+	dir := t.TempDir()
+	tsv := filepath.Join(dir, "dns.log")
+	text := "#separator \\x09\n" +
+		"#fields\tts\tuid\tid.orig_h\tid.orig_p\tid.resp_h\tid.resp_p\tquery\tanswers\n" +
+		"100\tC1\t10.0.0.1\t5353\t10.0.0.53\t53\tcdn.example.com\twww.cdn.net,192.0.2.1\n" +
+		"200\tC2\t10.0.0.1\t5353\t10.0.0.53\t53\tshop.example.com\t192.0.2.1\n" +
+		"150\tC3\t10.0.0.2\t5353\t10.0.0.53\t53\tmail.example.org\t192.0.2.1,192.0.2.2\n" +
+		"160\tC4\t10.0.0.2\t5353\t10.0.0.53\t53\tnx.example.org\t-\n"
+	ndjson := filepath.Join(dir, "dns.json")
+	lines := `{"ts":"1970-01-01T00:05:00Z","id.orig_h":"10.0.0.3","query":"api.example.net","answers":["192.0.2.3"]}` + "\n"
+	if err := os.WriteFile(tsv, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ndjson, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dns, err := LoadDNS([]string{tsv, ndjson})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		client, address string
+		ts              float64
+		name            string
+	}{
+		{"10.0.0.1", "192.0.2.1", 50, ""},
+		{"10.0.0.1", "192.0.2.1", 100, "cdn.example.com"},
+		{"10.0.0.1", "192.0.2.1", 250, "shop.example.com"},
+		{"10.0.0.2", "192.0.2.1", 250, "mail.example.org"},
+		{"10.0.0.1", "192.0.2.2", 250, ""},
+		{"10.0.0.3", "192.0.2.3", 300, "api.example.net"},
+	} {
+		name, _, _ := dns.Lookup(netip.MustParseAddr(test.client), netip.MustParseAddr(test.address), test.ts)
+		if name != test.name {
+			t.Errorf("%v for %v at %v: got %q, expected %q", test.address, test.client, test.ts, name, test.name)
+		}
+	}
+
+	// a remote host is named after the last name a local peer resolved
+	settings := Defaults()
+	settings.Local = netip.MustParsePrefix("10.0.0.0/8")
+	settings.TrackRemote = true
+	settings.DNS = dns
+	conn := func(orig, resp string, ts float64) Conn {
+		return Conn{Ts: ts, Orig: netip.MustParseAddr(orig), Resp: netip.MustParseAddr(resp), Bytes: 1}
+	}
+	result := settings.ReduceBatch([]Conn{
+		conn("10.0.0.1", "192.0.2.1", 120),
+		conn("192.0.2.1", "10.0.0.2", 170),
+		conn("10.0.0.1", "192.0.2.2", 170),
+	}).Result()
+	if len(result.RemoteNames) != 1 || result.RemoteNames["192.0.2.1"] != "mail.example.org" {
+		t.Errorf("named the remotes %v", result.RemoteNames)
+	}
+
+	if err := os.WriteFile(tsv, []byte("100\t10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDNS([]string{tsv}); err == nil {
+		t.Errorf("expected an error for a log without a header")
+	}
+}
+
+func TestHostNames(t *testing.T) {
+	dir := t.TempDir()
+	http_log := filepath.Join(dir, "http.log")
+	text := "#separator \\x09\n" +
+		"#fields\tts\tuid\tid.orig_h\tid.orig_p\tid.resp_h\tid.resp_p\ttrans_depth\tmethod\thost\turi\n" +
+		"100\tC1\t10.0.0.1\t5000\t192.0.2.1\t80\t1\tGET\tshop.example.com\t/\n" +
+		"101\tC1\t10.0.0.1\t5000\t192.0.2.1\t80\t2\tGET\tcdn.example.net\t/a.js\n" +
+		"102\tC2\t10.0.0.1\t5001\t192.0.2.1\t80\t1\tGET\t-\t/\n"
+	ssl_log := filepath.Join(dir, "ssl.log")
+	lines := `{"ts":103,"uid":"C3","id.orig_h":"10.0.0.2","server_name":"mail.example.org"}` + "\n"
+	if err := os.WriteFile(http_log, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ssl_log, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := LoadHostNames([]string{http_log, ssl_log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uid, expected := range map[string]string{"C1": "shop.example.com", "C2": "", "C3": "mail.example.org"} {
+		if name, _ := hosts.Lookup(uid); name != expected {
+			t.Errorf("%v: got %q, expected %q", uid, name, expected)
+		}
+	}
+
+	// the traffic of the connections whose names aren't known is
+	// totalled by the external host
+	settings := Defaults()
+	settings.Local = netip.MustParsePrefix("10.0.0.0/8")
+	settings.TrackDestinations = true
+	settings.HostNames = hosts
+	conn := func(uid, orig, resp string, bytes int) Conn {
+		return Conn{UID: uid, Orig: netip.MustParseAddr(orig), Resp: netip.MustParseAddr(resp), Bytes: bytes}
+	}
+	result := settings.ReduceBatch([]Conn{
+		conn("C1", "10.0.0.1", "192.0.2.1", 1),
+		conn("C2", "10.0.0.1", "192.0.2.1", 10),
+		conn("C3", "192.0.2.1", "10.0.0.2", 100),
+		conn("C4", "10.0.0.1", "10.0.0.2", 1000),
+	}).Result()
+	expected := map[string]int64{"shop.example.com": 1, "192.0.2.1": 10, "mail.example.org": 100}
+	if len(result.Destinations) != len(expected) {
+		t.Errorf("got destinations %v", result.Destinations)
+	}
+	for key, bytes := range expected {
+		if result.Destinations[key] != bytes {
+			t.Errorf("%v: got %d bytes, expected %d", key, result.Destinations[key], bytes)
+		}
+	}
+
+	if err := os.WriteFile(http_log, []byte("#fields\tts\tuid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadHostNames([]string{http_log}); err == nil {
+		t.Errorf("expected an error for a log without a host column")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	filename := t.TempDir() + "/tenants.csv"
+	table := "name,network\nacme,10.1.0.0/16,10.3.0.0/16\nglobex,10.2.0.0/16\nacme-lab,10.1.5.0/24\n"
+	if err := os.WriteFile(filename, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tenancy, err := LoadTenants(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	split := tenancy.Split(map[string]int64{"10.1.0.1": 1, "10.3.0.1": 2, "10.1.5.1": 4, "10.2.0.1": 8, "10.9.0.1": 16})
+	want := map[string]map[string]int64{
+		"acme":     {"10.1.0.1": 1, "10.3.0.1": 2},
+		"acme-lab": {"10.1.5.1": 4},
+		"globex":   {"10.2.0.1": 8},
+		Unassigned: {"10.9.0.1": 16},
+	}
+	if len(split) != len(want) {
+		t.Errorf("got %v, expected %v", split, want)
+	}
+	for name, hosts := range want {
+		for ip, bytecount := range hosts {
+			if split[name][ip] != bytecount {
+				t.Errorf("%v %v: got %d bytes, expected %d", name, ip, split[name][ip], bytecount)
+			}
+		}
+	}
+}
+
+func TestRollup(t *testing.T) {
+	dir := t.TempDir()
+	states := []Result{
+		{Hosts: map[string]int64{"10.0.0.1": 1}, Services: map[int]int64{443: 1}, First: 1600000000, Last: 1600003600},
+		{Hosts: map[string]int64{"10.0.0.1": 2, "10.0.0.2": 4}, Services: map[int]int64{443: 2}, First: 1600100000, Last: 1600103600},
+		{Hosts: map[string]int64{"10.0.0.2": 8}, First: 1602000000, Last: 1602003600},
+	}
+	var filenames []string
+	for i, state := range states {
+		filename := dir + "/" + strconv.Itoa(i) + ".json"
+		if err := writeState(filename, state); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	weeks, err := Rollup(filenames, "week")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(weeks) != 3 || weeks[0].String() != "week of 2020-09-07" || weeks[1].String() != "week of 2020-09-14" {
+		t.Errorf("got weeks %v", weeks)
+	}
+
+	months, err := Rollup(filenames, "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(months) != 2 || months[0].String() != "month of 2020-09" || months[0].Runs != 2 {
+		t.Fatalf("got months %v", months)
+	}
+	total, err := Rollup(filenames, "total")
+	if err != nil || len(total) != 1 || total[0].String() != "total" || total[0].Result.Hosts["10.0.0.2"] != 12 {
+		t.Errorf("got total %v, %v", total, err)
+	}
+
+	september := months[0].Result
+	if september.Hosts["10.0.0.1"] != 3 || september.Hosts["10.0.0.2"] != 4 || september.Services[443] != 3 {
+		t.Errorf("got %v, %v", september.Hosts, september.Services)
+	}
+	if september.First != 1600000000 || september.Last != 1600103600 {
+		t.Errorf("got range %v-%v", september.First, september.Last)
+	}
+}
+
+func TestSampleWriter(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewSampleWriter(dir, Sample{1, 4}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Start()
+	var batch []Conn
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		c := Conn{Ts: float64(i), UID: "C" + strconv.Itoa(i), Orig: netip.MustParseAddr("10.0.0.1"), Resp: netip.MustParseAddr("8.8.8.8")}
+		if w.keep(c) {
+			kept++
+		}
+		batch = append(batch, c)
+	}
+	w.inq <- batch
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if kept < 200 || kept > 300 {
+		t.Errorf("kept %d of 1000 records at 1/4", kept)
+	}
+
+	files, _ := filepath.Glob(dir + "/*.csv.gz")
+	if len(files) != 1 {
+		t.Fatalf("got sample files %v", files)
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(zr).ReadAll()
+	if err != nil || len(rows) != kept+1 {
+		t.Errorf("got %d rows, expected %d: %v", len(rows), kept+1, err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(files[0], old, old)
+	if err := PruneSamples(dir, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(dir + "/*.csv.gz"); len(files) != 0 {
+		t.Errorf("expected %v to be pruned", files)
+	}
+}
+
+func TestBenchmarkUnzippers(t *testing.T) {
+	filename := t.TempDir() + "/conn.log.gz"
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for i := 0; i < 10000; i++ {
+		zw.Write([]byte("1600000000.000000\tC" + strconv.Itoa(i) + "\t10.0.0.1\t1234\t8.8.8.8\t53\n"))
+	}
+	zw.Close()
+	data := buf.Bytes()
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// cut short like a large input would be
+	defer func(n int64) { UnzipBenchBytes = n }(UnzipBenchBytes)
+	UnzipBenchBytes = int64(len(data) / 2)
+
+	best, timings, err := BenchmarkUnzippers(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, timing := range timings {
+		if timing.Unzipper == InternalUnzipper && timing.Err != nil {
+			t.Errorf("internal: %v", timing.Err)
+		}
+		found = found || timing.Unzipper == best
+	}
+	if !found {
+		t.Errorf("picked %v, which wasn't timed", best)
+	}
+
+	defer func(u string) { Unzipper = u }(Unzipper)
+	Unzipper = InternalUnzipper
+	r := Reader{}.GetReader(filename)
+	lines, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || bytes.Count(lines, []byte("\n")) != 10000 {
+		t.Errorf("read %d lines, %v", bytes.Count(lines, []byte("\n")), err)
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	coordinator, err := NewCoordinator([]string{"a.log", "b.log"}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := coordinator.Claim("w1")
+	second, _ := coordinator.Claim("w2")
+	if first.File != "a.log" || second.File != "b.log" {
+		t.Fatalf("got %v and %v", first, second)
+	}
+	if _, ok := coordinator.Claim("w3"); ok {
+		t.Fatalf("handed out a file with a live lease")
+	}
+
+	// w1 goes silent and its file is handed out again, after which its
+	// result must not be counted
+	time.Sleep(60 * time.Millisecond)
+	coordinator.Renew(second.Lease)
+	again, ok := coordinator.Claim("w3")
+	if !ok || again.File != "a.log" || again.Lease == first.Lease {
+		t.Fatalf("got %v, expected a.log under a new lease", again)
+	}
+	if coordinator.Renew(first.Lease) || coordinator.Complete(first.Lease, Result{Hosts: map[string]int64{"10.0.0.1": 100}}) {
+		t.Errorf("accepted the expired lease of a file handed out again")
+	}
+	if !coordinator.Complete(again.Lease, Result{Hosts: map[string]int64{"10.0.0.1": 1}}) ||
+		!coordinator.Complete(second.Lease, Result{Hosts: map[string]int64{"10.0.0.2": 2}}) {
+		t.Fatalf("rejected a current lease")
+	}
+	if coordinator.Complete(second.Lease, Result{Hosts: map[string]int64{"10.0.0.2": 2}}) {
+		t.Errorf("accepted a file twice")
+	}
+
+	select {
+	case <-coordinator.done:
+	default:
+		t.Fatalf("not done after every file completed")
+	}
+	if coordinator.result.Hosts["10.0.0.1"] != 1 || coordinator.result.Hosts["10.0.0.2"] != 2 {
+		t.Errorf("got %v", coordinator.result.Hosts)
+	}
+}
+
+func TestRunWorker(t *testing.T) {
+	files := []string{"a.log", "b.log", "c.log"}
+	coordinator, err := NewCoordinator(files, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(coordinator.Handler())
+	defer server.Close()
+
+	failed := false
+	err = RunWorker(server.URL, "w1", files, func(ctx context.Context, assignment Assignment) (Result, error) {
+		if assignment.File == "b.log" && !failed {
+			failed = true
+			return Result{}, errors.New("disk error")
+		}
+		return Result{Hosts: map[string]int64{assignment.File: 1}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coordinator.result.Hosts) != 3 || coordinator.result.Hosts["b.log"] != 1 {
+		t.Errorf("got %v", coordinator.result.Hosts)
+	}
+}
+
+func TestK8sPlan(t *testing.T) {
+	files := []string{"/data/1.gz", "/data/2.gz", "/data/3.gz", "/data/4.gz", "/data/5.gz"}
+	plan := NewK8sPlan("backfill", "qreader:test", "logs", files, 2)
+	if len(plan.Shards) != 2 || len(plan.Shards[0]) != 2 || len(plan.Shards[1]) != 3 || plan.Shards[1][0] != "/data/3.gz" {
+		t.Errorf("got shards %v", plan.Shards)
+	}
+	if plan := NewK8sPlan("backfill", "qreader:test", "logs", files[:1], 4); len(plan.Shards) != 1 {
+		t.Errorf("got %d shards for one input", len(plan.Shards))
+	}
+
+	var buf bytes.Buffer
+	if err := plan.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`name: "backfill-shards"`, "completions: 2", `claimName: "logs"`,
+		`1) set -- '/data/3.gz' '/data/4.gz' '/data/5.gz' ;;`,
+		`- "/data/qreader-plan/backfill/part-1.json"`,
+		"- \"rollup\"\n        - \"-period=total\"",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("manifests lack %q:\n%v", want, buf.String())
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	if _, err := ParsePartition("4/4"); err == nil {
+		t.Errorf("accepted an index past the count")
+	}
+
+	var conns []Conn
+	for i := 0; i < 1000; i++ {
+		conns = append(conns, Conn{
+			Ts:    float64(1600000000 + i),
+			Orig:  netip.AddrFrom4([4]byte{128, 252, byte(i / 256), byte(i)}),
+			Resp:  netip.AddrFrom4([4]byte{8, 8, byte(i % 7), 8}),
+			Port:  i % 13,
+			Bytes: i,
+		})
+	}
+	defer func() { KeyPartition, TrackRemote, TrackConvs = nil, false, false }()
+	TrackRemote, TrackConvs = true, true
+	KeyPartition = nil
+	whole := ReduceBatch(conns).Result()
+
+	merged := Result{Hosts: make(map[string]int64)}
+	for i := 0; i < 4; i++ {
+		KeyPartition = &Partition{i, 4}
+		part := ReduceBatch(conns).Result()
+		for host := range part.Hosts {
+			if _, ok := merged.Hosts[host]; ok {
+				t.Fatalf("%v is in more than one partition", host)
+			}
+		}
+		merged.Merge(part)
+	}
+	for name, pair := range map[string][2]map[string]int64{
+		"hosts": {whole.Hosts, merged.Hosts}, "remotes": {whole.Remotes, merged.Remotes}, "convs": {whole.Convs, merged.Convs},
+	} {
+		if len(pair[0]) != len(pair[1]) {
+			t.Errorf("%v: got %d keys, expected %d", name, len(pair[1]), len(pair[0]))
+		}
+		for key, bytecount := range pair[0] {
+			if pair[1][key] != bytecount {
+				t.Errorf("%v %v: got %d bytes, expected %d", name, key, pair[1][key], bytecount)
+			}
+		}
+	}
+
+	// growing from 4 to 5 partitions only moves keys to the new one
+	for i := uint64(0); i < 1000; i++ {
+		if before, after := jumpHash(i, 4), jumpHash(i, 5); before != after && after != 4 {
+			t.Fatalf("key %d moved from %d to %d", i, before, after)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	defer func(numbers NumberLocale, si bool) { Numbers, SIUnits = numbers, si }(Numbers, SIUnits)
+
+	tests := []struct {
+		locale string
+		value  float64
+		want   string
+	}{
+		{"C", 1234567.891, "1234567.89"},
+		{"en_US.UTF-8", 1234567.891, "1,234,567.89"},
+		{"de", 1234567.891, "1.234.567,89"},
+		{"fr_FR", -1234.5, "-1 234,50"},
+		{"de_CH", 123.456, "123.46"},
+		{"de-CH", 1234, "1'234.00"},
+	}
+	for _, test := range tests {
+		var err error
+		if Numbers, err = ParseNumberLocale(test.locale); err != nil {
+			t.Fatal(err)
+		}
+		if got := FormatNumber(test.value, 2); got != test.want {
+			t.Errorf("%v: got %q, expected %q", test.locale, got, test.want)
+		}
+	}
+	if _, err := ParseNumberLocale("xx"); err == nil {
+		t.Errorf("accepted an unknown locale")
+	}
+
+	Numbers, _ = ParseNumberLocale("de")
+	if got := HumanBytes(1536); got != "1,5 KiB" {
+		t.Errorf("got %q", got)
+	}
+	SIUnits = true
+	if got := HumanBytes(1500000); got != "1,5 MB" {
+		t.Errorf("got %q", got)
+	}
+	if got := Percent(1, 3); got != "33,3333%" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestShareBar(t *testing.T) {
+	defer func(styled bool) { Styled = styled }(Styled)
+
+	Styled = false
+	if got := ShareBar(1, 4); got != "#####" {
+		t.Errorf("got %q", got)
+	}
+	if got := keyWidth(4, []Talker{{"10.0.0.1", 1}}); got != 4 {
+		t.Errorf("widened a plain report to %d", got)
+	}
+
+	Styled = true
+	if got := ShareBar(1, 4); got != ansiYellow+"█████"+ansiReset {
+		t.Errorf("got %q", got)
+	}
+	if got := ShareBar(1, 160); got != ansiGreen+"▏"+ansiReset {
+		t.Errorf("got %q", got)
+	}
+	if got := keyWidth(4, []Talker{{"10.0.0.1", 1}}); got != 8 {
+		t.Errorf("got width %d", got)
+	}
+}
+
+func TestOpenPager(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// output that isn't a terminal is never paged
+	out, err := OpenPager(w, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := out.(nopWriteCloser); !ok {
+		t.Errorf("paged output to a pipe")
+	}
+	io.WriteString(out, "report\n")
+	out.Close()
+	w.Close()
+	if got, _ := io.ReadAll(r); string(got) != "report\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	LogInit(false)
+	defer func(unzipper string, need parse.Need) { Unzipper, ParseNeed = unzipper, need }(Unzipper, ParseNeed)
+	Unzipper, ParseNeed = InternalUnzipper, parse.NeedTs|parse.NeedAddrs
+
+	// a gzip input cut off halfway through, after a line that can't be
+	// parsed
+	var data bytes.Buffer
+	zw := gzip.NewWriter(&data)
+	io.WriteString(zw, "bad\n")
+	for i := 0; i < 1000; i++ {
+		io.WriteString(zw, "1\tC1\t10.0.0.1\t1\t10.0.0.2\t53\ttcp\t-\t1\t"+strconv.Itoa(i)+"\t0\n")
+	}
+	zw.Close()
+	filename := filepath.Join(t.TempDir(), "conn.log.gz")
+	if err := os.WriteFile(filename, data.Bytes()[:data.Len()/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := make(chan InputWarning)
+	var got []InputWarning
+	done := make(chan struct{})
+	go func() {
+		for warning := range warnings {
+			got = append(got, warning)
+		}
+		close(done)
+	}()
+	_, err := New(WithBlockSize(4096)).Source(filename).Warnings(warnings).Run(context.Background())
+	close(warnings)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reader and the parsers report concurrently
+	truncated, malformed := false, false
+	for _, warning := range got {
+		truncated = truncated || warning.Kind == TruncatedInput
+		malformed = malformed || (warning.Kind == MalformedLine && warning.Line == 1 && warning.Text == "bad")
+	}
+	if !truncated || !malformed {
+		t.Errorf("got warnings %v", got)
+	}
+}
+
+func TestFromReader(t *testing.T) {
+	LogInit(false)
+	input := "#fields\tts\n1\tC1\t10.0.0.1\t1\t128.252.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t100\t1\t200\n"
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	io.WriteString(zw, input)
+	zw.Close()
+
+	for _, test := range []struct {
+		r           io.Reader
+		compression Compression
+	}{
+		{strings.NewReader(input), NoCompression},
+		{strings.NewReader(input), DetectCompression},
+		{bytes.NewReader(zipped.Bytes()), DetectCompression},
+		{bytes.NewReader(zipped.Bytes()), GzipCompression},
+	} {
+		result, err := FromReader("fixture", test.r, test.compression).Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Hosts["128.252.0.1"] != 300 {
+			t.Errorf("compression %d: got hosts %v", test.compression, result.Hosts)
+		}
+	}
+}
+
+func TestPipelineSettings(t *testing.T) {
+	LogInit(false)
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	input := "1\tC1\t10.0.0.1\t1\t192.168.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t100\t1\t200\n"
+	if err := os.WriteFile(filename, []byte(strings.Repeat(input, 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ten, private := Defaults(), Defaults()
+	ten.Local = netip.MustParsePrefix("10.0.0.0/8")
+	private.Local = netip.MustParsePrefix("192.168.0.0/16")
+	private.TrackRemote = true
+	ten.Lines, private.Lines = &LineCounts{}, &LineCounts{}
+	pipelines := map[string]*Pipeline{
+		"10.0.0.1":    New(WithSettings(ten)).Source(filename),
+		"192.168.0.1": New(WithSettings(private)).Source(filename),
+	}
+
+	// each pipeline runs twice, all four runs at once
+	var wg sync.WaitGroup
+	for host, pipeline := range pipelines {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(host string, pipeline *Pipeline) {
+				defer wg.Done()
+				result, err := pipeline.Run(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(result.Hosts) != 1 || result.Hosts[host] != 30000 {
+					t.Errorf("expected only %v, got %v", host, result.Hosts)
+				}
+				if (result.Remotes != nil) != (host == "192.168.0.1") {
+					t.Errorf("%v: got remotes %v", host, result.Remotes)
+				}
+			}(host, pipeline)
+		}
+	}
+	wg.Wait()
+
+	// each pipeline counts its lines apart from the other
+	for _, lines := range []*LineCounts{ten.Lines, private.Lines} {
+		if parsed, rejected := lines.Load(); parsed != 200 || rejected != 0 {
+			t.Errorf("counted %d parsed and %d rejected lines, expected 200 and 0", parsed, rejected)
+		}
+	}
+}
+
+func TestPipelineMissingInput(t *testing.T) {
+	LogInit(false)
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "conn.log")
+	input := "1\tC1\t10.0.0.1\t1\t192.168.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t100\t1\t200\n"
+	if err := os.WriteFile(filename, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a missing input fails the run rather than the program, whether
+	// or not the inputs are ordered first
+	missing := filepath.Join(dir, "missing.log")
+	for _, inputs := range [][]string{{missing}, {filename, missing}} {
+		if _, err := New().Source(inputs...).Run(context.Background()); err == nil {
+			t.Errorf("%v: expected an error for the missing input", inputs)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	LogInit(false)
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	input := "1\tC1\t10.0.0.1\t1\t128.252.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t100\t1\t200\n"
+	if err := os.WriteFile(filename, []byte(strings.Repeat(input, 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		lines, bytes int64
+		limit        string
+	}{
+		{0, 0, ""},
+		{1000, 0, ""},
+		{999, 0, "lines"},
+		{0, int64(len(input)) * 10, "bytes"},
+	} {
+		settings := Defaults()
+		settings.MaxLines, settings.MaxInputBytes = test.lines, test.bytes
+		_, err := New(WithSettings(settings), WithBlockSize(len(input))).Source(filename).Run(context.Background())
+		var limit *LimitError
+		switch {
+		case test.limit == "" && err != nil:
+			t.Errorf("%d lines, %d bytes: %v", test.lines, test.bytes, err)
+		case test.limit != "" && (!errors.As(err, &limit) || limit.Limit != test.limit):
+			t.Errorf("%d lines, %d bytes: expected the %v limit, got %v", test.lines, test.bytes, test.limit, err)
+		}
+	}
+}
+
+func TestDirections(t *testing.T) {
+	settings := Defaults()
+	settings.Local = netip.MustParsePrefix("10.0.0.0/8")
+	settings.TrackDirections = true
+	conn := func(orig, resp string, bytes int) Conn {
+		return Conn{Orig: netip.MustParseAddr(orig), Resp: netip.MustParseAddr(resp), Bytes: bytes}
+	}
+	result := settings.ReduceBatch([]Conn{
+		conn("10.0.0.1", "10.0.0.2", 1),
+		conn("10.0.0.1", "8.8.8.8", 10),
+		conn("8.8.8.8", "10.0.0.1", 100),
+		conn("8.8.8.8", "10.0.0.2", 100),
+		conn("8.8.8.8", "1.1.1.1", 1000),
+	}).Result()
+
+	want := map[string]int64{Internal: 1, Outbound: 10, Inbound: 200, External: 1000}
+	for _, direction := range Directions {
+		if result.Directions[direction] != want[direction] {
+			t.Errorf("%v: got %d bytes, expected %d", direction, result.Directions[direction], want[direction])
+		}
+	}
+
+	var out bytes.Buffer
+	DirectionReport(&out, Result{})
+	if !strings.Contains(out.String(), " inbound") || !strings.Contains(out.String(), "-\n") {
+		t.Errorf("got %q for no traffic", out.String())
+	}
+}
+
+func TestParseBitRate(t *testing.T) {
+	cases := map[string]float64{"10Gbps": 10e9, "100 Mbit/s": 100e6, "1.5g": 1.5e9, "64kb/s": 64e3, "9600": 9600}
+	for s, want := range cases {
+		if got, err := ParseBitRate(s); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, expected %v", s, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "fast", "0Gbps", "-1M", "10Xbps"} {
+		if _, err := ParseBitRate(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	defer func(capacity float64) { LinkCapacity = capacity }(LinkCapacity)
+	LinkCapacity = 1e6
+	if got := Utilization(125000*60, time.Minute); got != 100 {
+		t.Errorf("got %v%% for a full link", got)
+	}
+}
+
+func TestCostRates(t *testing.T) {
+	rates, err := ParseCostRates("0.09, 10GB:0.05, 20GB:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[int64]float64{0: 0, 5e9: 0.45, 10e9: 0.9, 15e9: 1.15, 30e9: 1.4}
+	for bytes, want := range cases {
+		if got := rates.Cost(bytes); math.Abs(got-want) > 1e-9 {
+			t.Errorf("%d bytes: got %v, expected %v", bytes, got, want)
+		}
+	}
+	for _, bad := range []string{"", "cheap", "0.09,10GB", "0.09,20GB:0.05,10GB:0.01", "-1"} {
+		if _, err := ParseCostRates(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	settings := Defaults()
+	settings.TrackDetail = true
+	settings.Normalize = SubnetKeys(&settings)
+	conns := []Conn{
+		{Orig: netip.MustParseAddr("128.252.1.10"), Resp: netip.MustParseAddr("8.8.8.8"), Port: 53, Bytes: 100},
+		{Orig: netip.MustParseAddr("128.252.1.20"), Resp: netip.MustParseAddr("8.8.8.8"), Port: 53, Bytes: 50},
+		{Orig: netip.MustParseAddr("128.252.2.10"), Resp: netip.MustParseAddr("8.8.8.8"), Port: 443, Bytes: 7},
+	}
+	result := settings.ReduceBatch(conns).Result()
+	if len(result.Hosts) != 2 || result.Hosts["128.252.1.0/24"] != 150 || result.Hosts["128.252.2.0/24"] != 7 {
+		t.Errorf("got %v", result.Hosts)
+	}
+	if result.Conns["128.252.1.0/24"] != 2 || result.Ports["128.252.1.0/24"][53] != 150 {
+		t.Errorf("got %v and %v", result.Conns, result.Ports)
+	}
+
+	settings.Normalize = func(netip.Addr) string { return "all" }
+	if result := settings.ReduceBatch(conns).Result(); result.Hosts["all"] != 157 {
+		t.Errorf("got %v", result.Hosts)
+	}
+}
+
+func TestStream(t *testing.T) {
+	stream := NewStream()
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %q", ct)
+	}
+
+	if err := stream.Publish(WindowEvent{1600000000, Result{Hosts: map[string]int64{"128.252.1.1": 42}}}); err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	for _, want := range []string{"event: window", `data: {"start":1600000000,"result":{"hosts":{"128.252.1.1":42}}}`, ""} {
+		if !lines.Scan() || lines.Text() != want {
+			t.Fatalf("got %q, expected %q", lines.Text(), want)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewTLSServer(RequireToken("s3cret", ok))
+	defer server.Close()
+
+	certs := filepath.Join(t.TempDir(), "ca.pem")
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certs, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		token string
+		query string
+		want  int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"wrong", "", http.StatusUnauthorized},
+		{"s3cret", "", http.StatusOK},
+		{"", "?token=s3cret", http.StatusOK},
+	}
+	for _, c := range cases {
+		client, err := NewClient(c.token, certs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(server.URL + c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("token %q%v: got %v, expected %v", c.token, c.query, resp.StatusCode, c.want)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	limit := &throttle{rate: 1, burst: 2, clients: make(map[string]*bucket)}
+	now := time.Unix(1600000000, 0)
+	for i, want := range []bool{true, true, false} {
+		if got := limit.allow("10.0.0.1", now); got != want {
+			t.Errorf("request %d: got %v", i, got)
+		}
+	}
+	if !limit.allow("10.0.0.2", now) {
+		t.Errorf("one client used up the tokens of another")
+	}
+	if !limit.allow("10.0.0.1", now.Add(time.Second)) {
+		t.Errorf("the bucket didn't refill")
+	}
+
+	defer func(upload int64) { MaxUploadBytes = upload }(MaxUploadBytes)
+	MaxUploadBytes = 16
+	server := httptest.NewServer(Throttle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	})))
+	defer server.Close()
+	for body, want := range map[string]int{"small": http.StatusOK, strings.Repeat("x", 17): http.StatusRequestEntityTooLarge} {
+		resp, err := http.Post(server.URL, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%d bytes: got %v", len(body), resp.StatusCode)
+		}
+	}
+}
+
+func TestColumnProfile(t *testing.T) {
+	if _, _, err := NewColumnProfile([]string{"bytes", "colour"}); err == nil {
+		t.Errorf("accepted an unknown column")
+	}
+	profile, need, err := NewColumnProfile([]string{"bytes", "duration"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if need != parse.NeedBytes|parse.NeedDuration {
+		t.Errorf("got need %b", need)
+	}
+	go profile.Start()
+	profile.inq <- []Conn{{Bytes: 0}, {Bytes: 3, Duration: 0.5}, {Bytes: 100, Duration: 2}}
+	profile.Close()
+
+	sizes := profile.Stats[0]
+	if sizes.Count != 3 || sizes.Min != 0 || sizes.Max != 100 || sizes.Zeros != 1 || sizes.Bins[2] != 1 || sizes.Bins[7] != 1 {
+		t.Errorf("got %+v", sizes)
+	}
+	if mean := profile.Stats[1].Mean(); math.Abs(mean-2.5/3) > 1e-9 {
+		t.Errorf("got a mean duration of %v", mean)
+	}
+}
+
+func TestTopShare(t *testing.T) {
+	ranked := Rank(map[string]int64{"a": 50, "b": 30, "c": 15, "d": 5})
+	defer func(n int, share float64) { TopN, TopShare = n, share }(TopN, TopShare)
+	TopN = 0
+	for share, want := range map[float64]int{50: 1, 80: 2, 81: 3, 95: 3, 100: 4} {
+		TopShare = share
+		if got := topRows(ranked); len(got) != want {
+			t.Errorf("%v%%: got %d rows, expected %d", share, len(got), want)
+		}
+	}
+}
+
+func TestSaveBaseline(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "baseline.json")
+	periods := []Result{
+		{Hosts: map[string]int64{"128.252.1.1": 100}},
+		{Hosts: map[string]int64{"128.252.1.1": 300}},
+	}
+	if err := SaveBaseline(filename, BuildBaseline(periods)); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveBaseline(filename, BuildBaseline(periods)); err == nil {
+		t.Errorf("replaced an existing baseline without -force")
+	}
+
+	baseline, err := LoadBaseline(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.Periods != 2 || baseline.Subnets["128.252.1.0/24"] != (Stat{200, 20000}) {
+		t.Errorf("got %+v", baseline)
+	}
+}
+
+func TestAnomalies(t *testing.T) {
+	var periods []Result
+	for _, bytes := range []int64{100, 300, 200} {
+		periods = append(periods, Result{Hosts: map[string]int64{"128.252.1.1": bytes, "128.252.2.1": 0, "128.252.3.1": 500}})
+	}
+	baseline := BuildBaseline(periods)
+
+	// a varying host is flagged past sigma, a flat one past the square
+	// root of its level, and one without traffic in the baseline once it
+	// reaches the minimum
+	for _, test := range []struct {
+		key   string
+		bytes int64
+		sigma float64
+	}{
+		{"128.252.1.1", 250, 0},
+		{"128.252.1.1", 1000, 8},
+		{"128.252.3.1", 500, 0},
+		{"128.252.3.1", 520, 0},
+		{"128.252.3.1", 600, 4.47},
+		{"128.252.2.1", 1 << 30, math.Inf(1)},
+		{"128.252.2.1", 1000, 0},
+		{"128.252.4.1", 1 << 20, math.Inf(1)},
+		{"128.252.4.1", 1<<20 - 1, 0},
+	} {
+		anomalies := baseline.Anomalies(Result{Hosts: map[string]int64{test.key: test.bytes}}, 3)
+		var got float64
+		for _, a := range anomalies {
+			if a.Key == test.key {
+				got = a.Sigma
+			}
+		}
+		if math.Abs(got-test.sigma) > 0.01 && !(math.IsInf(got, 1) && math.IsInf(test.sigma, 1)) {
+			t.Errorf("%v at %d bytes: got sigma %v, expected %v", test.key, test.bytes, got, test.sigma)
+		}
+	}
+
+	// the subnet of a new host is new too
+	anomalies := baseline.Anomalies(Result{Hosts: map[string]int64{"128.252.4.1": 1 << 30, "128.252.3.1": 600}}, 3)
+	flagged := make(map[string]Anomaly)
+	for _, a := range anomalies {
+		flagged[a.Key] = a
+	}
+	if a, ok := flagged["128.252.4.0/24"]; !ok || !math.IsInf(a.Sigma, 1) {
+		t.Errorf("the subnet of the new host wasn't flagged: %+v", a)
+	}
+
+	var out bytes.Buffer
+	AnomalyReport(&out, anomalies, baseline)
+	if !strings.Contains(out.String(), "new") || !strings.Contains(out.String(), "+4.5") || strings.Contains(out.String(), "Inf") {
+		t.Errorf("got report:\n%v", out.String())
+	}
+}
+
+func TestQueries(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "queries")
+	text := "# team queries\n[top-https]\nreport = hosts,ports\n-top = 20\n\n[all]\nall = true\n"
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	queries, err := LoadQueries(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 || queries["top-https"]["top"] != "20" {
+		t.Fatalf("got %v", queries)
+	}
+
+	flags := flag.NewFlagSet("qreader", flag.ContinueOnError)
+	report := flags.String("report", "", "")
+	top := flags.Int("top", 10, "")
+	flags.String("query", "", "")
+	if err := flags.Parse([]string{"-top", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queries["top-https"].Apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *report != "hosts,ports" || *top != 5 {
+		t.Errorf("got -report %v -top %v", *report, *top)
+	}
+	if err := (Query{"colour": "red"}).Apply(flags); err == nil {
+		t.Errorf("accepted an unknown option")
+	}
+	if err := (Query{"query": "all"}).Apply(flags); err == nil {
+		t.Errorf("accepted a query running a query")
+	}
+}
+
+func TestFileList(t *testing.T) {
+	flags := flag.NewFlagSet("qreader", flag.ContinueOnError)
+	var inputs fileList
+	flags.Var(&inputs, "f", "")
+	if err := flags.Parse([]string{"-f", "a.log", "-f", "b.log.gz", "c.log"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 2 || inputs[0] != "a.log" || inputs[1] != "b.log.gz" || inputs.String() != "a.log,b.log.gz" {
+		t.Errorf("got -f %v", inputs)
+	}
+	if args := flags.Args(); len(args) != 1 || args[0] != "c.log" {
+		t.Errorf("got arguments %v", args)
+	}
+	if err := flags.Parse([]string{"-f", ""}); err == nil {
+		t.Errorf("accepted an empty file name")
+	}
+}
+
+func TestExpandInputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"conn.00.log.gz", "conn.01.log.gz", "dns.00.log.gz", "conn[1].log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ExpandInputs([]string{filepath.Join(dir, "conn.*.log.gz"), filepath.Join(dir, "conn[1].log"), "other.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "conn.00.log.gz"), filepath.Join(dir, "conn.01.log.gz"), filepath.Join(dir, "conn[1].log"), "other.log"}
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("expanded to %v, expected %v", got, expected)
+	}
+	if _, err := ExpandInputs([]string{filepath.Join(dir, "http.*.log")}); err == nil {
+		t.Errorf("expected an error for a pattern matching nothing")
+	}
+}
+
+func TestWalkInputs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "2024-05-01", "sensor1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"2024-05-01/conn.00.log.gz", "2024-05-01/sensor1/conn.log", "2024-05-01/sensor1/notes.txt", "README"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := WalkInputs(dir, []string{".gz", ".log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "2024-05-01", "conn.00.log.gz"), filepath.Join(dir, "2024-05-01", "sensor1", "conn.log")}
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("walked to %v, expected %v", got, expected)
+	}
+	if got, err := WalkInputs(dir, nil); err != nil || len(got) != 4 {
+		t.Errorf("walked to %v, %v, expected all 4 files", got, err)
+	}
+	if _, err := WalkInputs(dir, []string{".bro"}); err == nil {
+		t.Errorf("expected an error for a tree without matching files")
+	}
+	if _, err := WalkInputs(filepath.Join(dir, "missing"), nil); err == nil {
+		t.Errorf("expected an error for a missing directory")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	if err := os.WriteFile(filename, []byte("1\tC1\t128.252.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := func(options map[string]string) string {
+		k, err := CacheKey([]string{filename}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	base := key(map[string]string{"report": "hosts"})
+	if key(map[string]string{"report": "hosts", "top": "50", "bars": "true"}) != base {
+		t.Errorf("presentation options changed the key")
+	}
+	if key(map[string]string{"report": "hosts,ports"}) == base {
+		t.Errorf("the sections didn't change the key")
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("2\tC2\t128.252.1.2\n")
+	file.Close()
+	if key(map[string]string{"report": "hosts"}) == base {
+		t.Errorf("appending to the input didn't change the key")
+	}
+
+	// editing a file the result is summed with changes the key too
+	exclude := filepath.Join(t.TempDir(), "exclude")
+	if err := os.WriteFile(exclude, []byte("backup 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := key(map[string]string{"exclude": exclude})
+	if err := os.WriteFile(exclude, []byte("backup 10.0.0.1,10.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key(map[string]string{"exclude": exclude}) == before {
+		t.Errorf("editing the exclusions didn't change the key")
+	}
+	if _, err := CacheKey([]string{filename}, map[string]string{"users": exclude + ".missing"}); err == nil {
+		t.Errorf("expected an error for a missing users file")
+	}
+}
+
+func TestCompressedState(t *testing.T) {
+	if !ZstdInstalled() {
+		t.Skip("zstd is not installed")
+	}
+	defer func(compress bool) { CompressOutputs = compress }(CompressOutputs)
+	result := Result{Hosts: map[string]int64{"128.252.1.1": 42}}
+	for _, compress := range []bool{true, false} {
+		CompressOutputs = compress
+		filename := filepath.Join(t.TempDir(), "state.json")
+		if err := SaveState(filename, result); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(data, zstdMagic) != compress {
+			t.Errorf("compress %v: got %q", compress, data)
+		}
+		loaded, err := LoadState(filename)
+		if err != nil || loaded.Hosts["128.252.1.1"] != 42 {
+			t.Errorf("compress %v: got %v, %v", compress, loaded.Hosts, err)
+		}
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	LogInit(false)
+	defer func(policy string, settle time.Duration) { InProgress, SettleTime = policy, settle }(InProgress, SettleTime)
+	line := "1\tC1\t10.0.0.1\t1\t128.252.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t100\t1\t200\n"
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	if err := os.WriteFile(filename, []byte(line+line+line[:20]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		policy string
+		settle time.Duration
+		bytes  int64
+		warned bool
+	}{
+		{"complete", time.Hour, 600, true},
+		{"skip", time.Hour, 0, true},
+		{"wait", 50 * time.Millisecond, 600, true},
+		{"skip", 0, 600, false},
+	} {
+		InProgress, SettleTime = test.policy, test.settle
+		warnings := make(chan InputWarning, 10)
+		result, err := New().Source(filename).Warnings(warnings).Run(context.Background())
+		close(warnings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		warned := false
+		for warning := range warnings {
+			warned = warned || warning.Kind == InProgressInput
+		}
+		if result.Hosts["128.252.0.1"] != test.bytes || warned != test.warned {
+			t.Errorf("%v %v: got %v bytes, warned %v", test.policy, test.settle, result.Hosts["128.252.0.1"], warned)
+		}
+	}
+}
+
+func TestBackfillPlan(t *testing.T) {
+	LogInit(false)
+	dir := t.TempDir()
+	line := "1\tC1\t10.0.0.1\t1\t128.252.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t100\t1\t200\n"
+	for _, day := range []string{"2024-01-01", "2024-01-02", "2024-01-03"} {
+		if err := os.MkdirAll(filepath.Join(dir, day), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := "#open\t" + day + "-00-00-00\n" + strings.Repeat(line, 100)
+		for _, name := range []string{"conn.00:00:00-01:00:00.log", "dns.00:00:00-01:00:00.log"} {
+			if err := os.WriteFile(filepath.Join(dir, day, name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	since := time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)
+	plan, err := MakePlan(dir, "conn*", since, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Entries) != 2 || !strings.Contains(plan.Entries[0].Filename, "2024-01-02") {
+		t.Fatalf("got %v", plan.Entries)
+	}
+	if err := plan.EstimateAt(0, float64(len(line))); err != nil {
+		t.Fatal(err)
+	}
+	if plan.Bytes != plan.Entries[0].Size*2 || plan.Estimate < 200*time.Second || plan.Estimate > 201*time.Second {
+		t.Errorf("got %v bytes, estimated %v", plan.Bytes, plan.Estimate)
+	}
+
+	// the rate is measured when it isn't given
+	if err := plan.EstimateAt(0, 0); err != nil || plan.PlainRate <= 0 {
+		t.Errorf("measured %v, %v", plan.PlainRate, err)
+	}
+}
+
+func TestThroughputLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "qreader", "throughput.jsonl")
+	for _, run := range []struct {
+		bytes, gzip int64
+		elapsed     float64
+	}{
+		{100, 100, 1}, {300, 300, 1}, {200, 200, 1}, {1000, 0, 2}, {500, 250, 1},
+	} {
+		record := ThroughputRecord{Bytes: run.bytes, GzipBytes: run.gzip, Elapsed: run.elapsed}
+		if err := AppendThroughput(filename, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := LoadThroughput(filename)
+	if err != nil || len(records) != 5 {
+		t.Fatalf("got %v, %v", records, err)
+	}
+	if gzip, plain := ThroughputRates(records); gzip != 200 || plain != 500 {
+		t.Errorf("got rates %v and %v", gzip, plain)
+	}
+
+	// the third gzip run is compared to the median of the two before it
+	var out strings.Builder
+	PrintThroughput(&out, records, 3)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasSuffix(lines[1], "-33%") || !strings.HasSuffix(lines[3], "-") {
+		t.Errorf("got\n%v", out.String())
+	}
+
+	if records, err := LoadThroughput(filepath.Join(t.TempDir(), "missing")); records != nil || err != nil {
+		t.Errorf("got %v, %v", records, err)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	LogInit(false)
+	defer func(unzipper string) { Unzipper = unzipper }(Unzipper)
+	Unzipper = InternalUnzipper
+	for _, check := range SelfTest(1000) {
+		if check.Err != nil && !check.Optional {
+			t.Errorf("%v: %v", check.Name, check.Err)
+		}
+	}
+
+	// a missing decompressor fails the test
+	Unzipper = "qreader-no-such-unzipper"
+	for _, check := range SelfTest(10) {
+		if check.Name == "decompressor" && check.Status() != "FAIL" {
+			t.Errorf("got %v for a missing decompressor", check.Status())
+		}
+	}
+}
+
+func TestCountInputs(t *testing.T) {
+	LogInit(false)
+	data, expected := syntheticLog(500)
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings := Defaults()
+	settings.Schema = parse.TSV
+	settings.SettleTime = 0
+	inventory, err := CountInputs(context.Background(), settings, []string{filename}, WithBlockSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for _, bytes := range expected {
+		total += bytes
+	}
+	if inventory.Records != 500 || inventory.Bytes != total || inventory.Size != int64(len(data)) {
+		t.Errorf("counted %d records of %d bytes in %d, expected 500 of %d in %d",
+			inventory.Records, inventory.Bytes, inventory.Size, total, len(data))
+	}
+	if inventory.First < 1700000000 || inventory.Last < 1700000499 || inventory.Last >= 1700000500 {
+		t.Errorf("counted a span of %v to %v", inventory.First, inventory.Last)
+	}
+}
+
+func TestCountValues(t *testing.T) {
+	LogInit(false)
+	data, _ := syntheticLog(100)
+	data = append(data, "1700000100.000000\tC100\t10.0.0.1\t1024\t192.0.2.1\t53\tudp\t-\t1.5\t10\t10\tSF\t-\t0\tDd\t1\t38\t1\t54\n"...)
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := DetectSchema([]string{filename}, "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := Defaults()
+	settings.Schema = schema
+	settings.Need = parse.NeedAddrs | parse.NeedSegment
+	settings.SettleTime = 0
+	counts, err := CountValues(context.Background(), settings, []string{filename}, WithBlockSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts["ssl"] != 100 || counts["-"] != 1 {
+		t.Errorf("counted %v", counts)
+	}
+
+	var out bytes.Buffer
+	PrintFrequencies(&out, "service", counts)
+	if lines := strings.Split(out.String(), "\n"); !strings.HasPrefix(lines[1], "ssl") || !strings.HasPrefix(lines[2], "-") {
+		t.Errorf("frequencies not ranked:\n%v", out.String())
+	}
+}
+
+func TestRunManifest(t *testing.T) {
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "conn.log"), filepath.Join(dir, "top.csv")
+	if err := os.WriteFile(input, []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteOutput(output, []byte("host,bytes\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := &RunMetadata{Version: Version, Inputs: []string{input}}
+	settings := Defaults()
+	settings.Lines = &LineCounts{Parsed: 3, Rejected: 1}
+	manifest, err := NewRunManifest(metadata, &settings, Result{Hosts: map[string]int64{"128.252.1.1": 1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("data\n"))
+	if len(manifest.InputFiles) != 1 || manifest.InputFiles[0].SHA256 != hex.EncodeToString(sum[:]) || manifest.InputFiles[0].Size != 5 {
+		t.Errorf("got inputs %v", manifest.InputFiles)
+	}
+	found := false
+	for _, entry := range manifest.Outputs {
+		found = found || (entry.Path == output && entry.Size == int64(len("host,bytes\n")))
+	}
+	if !found || manifest.Counts.Hosts != 1 || manifest.Counts.Lines != 3 || manifest.Counts.Rejected != 1 {
+		t.Errorf("got outputs %v, counts %v", manifest.Outputs, manifest.Counts)
+	}
+
+	// the metadata is inlined into the manifest
+	filename := filepath.Join(dir, "manifest.json")
+	if err := WriteManifest(filename, manifest); err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	data, _ := os.ReadFile(filename)
+	if err := json.Unmarshal(data, &fields); err != nil || fields["version"] != Version || fields["input_files"] == nil {
+		t.Errorf("got %s, %v", data, err)
+	}
+}
+
+func TestTopPerGroup(t *testing.T) {
+	defer func(n int) { TopPerGroup = n }(TopPerGroup)
+	result := Result{Hosts: map[string]int64{
+		"128.252.1.1": 100, "128.252.1.2": 300, "128.252.1.3": 200,
+		"128.252.2.1": 50,
+	}}
+	var out strings.Builder
+	SubnetReport(&out, result)
+	if strings.Contains(out.String(), "128.252.1.2") {
+		t.Errorf("listed hosts without -top-per-group:\n%v", out.String())
+	}
+
+	TopPerGroup = 2
+	out.Reset()
+	SubnetReport(&out, result)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || !strings.Contains(lines[0], "128.252.1.0/24") ||
+		!strings.Contains(lines[1], "128.252.1.2") || !strings.Contains(lines[1], "50.0000%") ||
+		!strings.Contains(lines[2], "128.252.1.3") || !strings.Contains(lines[4], "128.252.2.1") {
+		t.Errorf("got\n%v", out.String())
+	}
+}
+
+func TestDomains(t *testing.T) {
+	cases := map[string]string{
+		"rr3.sn-4g5e6nsz.googlevideo.com": "googlevideo.com",
+		"www.bbc.co.uk":                   "bbc.co.uk",
+		"Shop.Example.com.":               "example.com",
+		"shop.example.com:8443":           "example.com",
+		"example.com":                     "example.com",
+		"co.uk":                           "co.uk",
+		"localhost":                       "localhost",
+		"192.0.2.1":                       "192.0.2.1",
+		"2001:db8::1":                     "2001:db8::1",
+		"bucket.s3.amazonaws.com":         "s3.amazonaws.com",
+	}
+	for name, expected := range cases {
+		if got := PublicSuffixes.Domain(name); got != expected {
+			t.Errorf("%v: got %v, expected %v", name, got, expected)
+		}
+	}
+
+	// wildcards make every label below them a suffix, except the names
+	// excepted with !
+	list := ParsePublicSuffixes(strings.NewReader("// comment\n*.ck\n!www.ck\n"))
+	cases = map[string]string{
+		"a.b.ck":     "a.b.ck",
+		"x.a.b.ck":   "a.b.ck",
+		"www.ck":     "www.ck",
+		"web.www.ck": "www.ck",
+	}
+	for name, expected := range cases {
+		if got := list.Domain(name); got != expected {
+			t.Errorf("%v: got %v, expected %v", name, got, expected)
+		}
+	}
+
+	domains := PublicSuffixes.Rollup(map[string]int64{
+		"a.googlevideo.com": 1,
+		"b.googlevideo.com": 10,
+		"www.bbc.co.uk":     100,
+		"192.0.2.1":         1000,
+	})
+	expected := map[string]int64{"googlevideo.com": 11, "bbc.co.uk": 100, "192.0.2.1": 1000}
+	if len(domains) != len(expected) {
+		t.Errorf("got domains %v", domains)
+	}
+	for key, bytes := range expected {
+		if domains[key] != bytes {
+			t.Errorf("%v: got %d bytes, expected %d", key, domains[key], bytes)
+		}
+	}
+}
+
+func TestStdin(t *testing.T) {
+	saved := stdin
+	defer func() { stdin = saved }()
+	data := strings.Repeat("1700000000.000000\tC1\t10.0.0.1\n", 5000)
+	stdin = bufio.NewReaderSize(strings.NewReader(data), ProbeSize)
+
+	// the head is peeked at, and read again with the rest
+	head, err := Reader{}.readHead(StdinName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(head) != ProbeSize || !strings.HasPrefix(data, string(head)) {
+		t.Errorf("got a head of %d bytes, expected the first %d", len(head), ProbeSize)
+	}
+	reader, err := Reader{}.OpenFile(StdinName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != data {
+		t.Errorf("read %d bytes, expected %d", len(read), len(data))
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	LogInit(false)
+	dir := t.TempDir()
+	data, hosts := syntheticLog(200)
+	filename := filepath.Join(dir, "conn.log")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hosts of two of the subnets are tagged from a file, and the
+	// rest by a function added to the pipeline
+	var rows strings.Builder
+	rows.WriteString("address,tag\n# a comment\n")
+	expected := make(map[string]int64)
+	for ip, bytes := range hosts {
+		if strings.HasPrefix(ip, "10.0.0.") || strings.HasPrefix(ip, "10.0.1.") {
+			tag := "asset-" + strings.Split(ip, ".")[2]
+			fmt.Fprintf(&rows, "%v,%v\n", ip, tag)
+			expected[tag] += bytes
+		} else {
+			expected["other"] += bytes
+		}
+	}
+	tags_file := filepath.Join(dir, "tags.csv")
+	if err := os.WriteFile(tags_file, []byte(rows.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := LoadTags(tags_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := EnricherFunc(func(batch []Conn) {
+		for i := range batch {
+			if batch[i].OrigTag == "" {
+				batch[i].OrigTag = "other"
+			}
+			if batch[i].RespTag == "" {
+				batch[i].RespTag = "other"
+			}
+		}
+	})
+
+	settings := Defaults()
+	settings.Local = netip.MustParsePrefix("10.0.0.0/8")
+	settings.TrackTags = true
+	settings.Enrichers = []Enricher{tags}
+	settings.SettleTime = 0
+	result, err := New(WithSettings(settings), WithBlockSize(1024)).Source(filename).Enrich(other).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Tags) != len(expected) {
+		t.Errorf("got tags %v", result.Tags)
+	}
+	for tag, bytes := range expected {
+		if result.Tags[tag] != bytes {
+			t.Errorf("%v: got %d bytes, expected %d", tag, result.Tags[tag], bytes)
+		}
+	}
+
+	if err := os.WriteFile(tags_file, []byte("10.0.0.1,a\nnot an address,b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTags(tags_file); err == nil {
+		t.Errorf("expected an error for an invalid address")
+	}
+}
+
+func TestAnonymizeResult(t *testing.T) {
+	anon, err := NewAnonymizer(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string]int64{"10.0.0.1": 100}
+	totals := map[string]int64{"x": 1}
+	result := Result{
+		Hosts:         hosts,
+		Conns:         map[string]int64{"10.0.0.1": 2},
+		Ports:         map[string]map[int]int64{"10.0.0.1": {443: 100}},
+		Buckets:       map[int64]int64{0: 100},
+		Remotes:       map[string]int64{"192.0.2.1": 100},
+		SubnetBuckets: map[string]map[int64]int64{"10.0.0.0/24": {0: 100}},
+		Services:      map[int]int64{443: 100},
+		Convs:         map[string]int64{ConvKey("10.0.0.1", "192.0.2.1"): 100},
+		Sent:          map[string]int64{"10.0.0.1": 40},
+		Excluded:      totals,
+		Countries:     totals,
+		Tenants:       map[string]map[string]int64{"acme": hosts},
+		Segments:      totals,
+		MACs:          map[string]int64{"00:11:22:33:44:55": 100},
+		Users:         totals,
+		Tags:          totals,
+		Directions:    totals,
+		RemoteNames:   map[string]string{"192.0.2.1": "example.com"},
+		Destinations:  map[string]int64{"shop.example.com": 60, "192.0.2.1": 40},
+		First:         1,
+		Last:          2,
+	}
+
+	// every field must be set here, so that one Result gains can't be
+	// left out of the anonymized copy unnoticed
+	in, out := reflect.ValueOf(result), reflect.ValueOf(anon.Result(result))
+	for i := 0; i < in.NumField(); i++ {
+		name := in.Type().Field(i).Name
+		if in.Field(i).IsZero() {
+			t.Errorf("%v isn't set in the test result", name)
+		}
+		if out.Field(i).IsZero() {
+			t.Errorf("%v is left out of the anonymized result", name)
+		}
+	}
+
+	anonymized := anon.Result(result)
+	ip := anon.IP("192.0.2.1")
+	if ip == "192.0.2.1" || anonymized.Hosts["10.0.0.1"] != 0 {
+		t.Errorf("addresses weren't anonymized: %v", anonymized.Hosts)
+	}
+	if anonymized.RemoteNames[ip] != "example.com" {
+		t.Errorf("got remote names %v", anonymized.RemoteNames)
+	}
+	if anonymized.Destinations["shop.example.com"] != 60 || anonymized.Destinations[ip] != 40 {
+		t.Errorf("got destinations %v", anonymized.Destinations)
+	}
+
+	// hosts normalized to their networks are anonymized as networks
+	normalized := anon.Result(Result{Hosts: map[string]int64{"10.0.0.0/24": 100}, Tenants: map[string]map[string]int64{"acme": {"10.0.0.0/24": 100}}})
+	key := anon.Key("10.0.0.0/24")
+	if !strings.HasSuffix(key, "/24") || key == "10.0.0.0/24" || normalized.Hosts[key] != 100 || normalized.Tenants["acme"][key] != 100 {
+		t.Errorf("got hosts %v and tenants %v, expected them under %v", normalized.Hosts, normalized.Tenants, key)
+	}
+}
+
+func TestChartNoData(t *testing.T) {
+	for _, chart := range []Chart{
+		TopChart(Result{Hosts: map[string]int64{"10.0.0.1": 0}}),
+		TimeChart(Result{Buckets: map[int64]int64{1600000000: 0}}),
+	} {
+		canvas := newSVGCanvas(ChartWidth, ChartHeight)
+		chart(canvas)
+		data, err := canvas.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "no data") || strings.Contains(string(data), "NaN") {
+			t.Errorf("got chart %s", data)
+		}
+	}
+}
+
+func TestChargeback(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "map.csv")
+	text := "network,hostname,owner,department\n128.252.0.0/16,,,research\n128.252.9.0/24,,,finance\n"
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	labels, err := LoadMapping(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(labels *Mapping, top int) { Labels, TopPerGroup = labels, top }(Labels, TopPerGroup)
+	Labels, TopPerGroup = labels, 1
+
+	// the most specific network decides the department
+	result := Result{Hosts: map[string]int64{"128.252.1.1": 600, "128.252.9.1": 300, "10.0.0.1": 100}}
+	for _, test := range []struct {
+		department string
+		bytes      int64
+	}{
+		{"research", 600}, {"finance", 300}, {Unassigned, 100},
+	} {
+		if got := Departments(result)[test.department]; got != test.bytes {
+			t.Errorf("%v: got %d bytes, expected %d", test.department, got, test.bytes)
+		}
+	}
+
+	// the section lists the hosts of each department, anonymized when
+	// it is given an anonymizer
+	anon, err := NewAnonymizer(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ChargebackSection{anon}.Render(&out, result)
+	got := out.String()
+	if !strings.Contains(got, "research") || !strings.Contains(got, "600") || !strings.Contains(got, anon.IP("128.252.1.1")) || strings.Contains(got, "128.252.1.1") {
+		t.Errorf("got report:\n%v", got)
+	}
+	if _, ok := Sections["chargeback"]; !ok {
+		t.Errorf("the chargeback section isn't registered")
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "quota.csv")
+	text := "network,budget\n128.252.0.0/16,1KB\n128.252.9.0/24,100\n2001:db8::/32,1MiB\n"
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	quotas, err := LoadQuotas(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotas) != 3 || quotas[1].Network != netip.MustParsePrefix("128.252.9.0/24") || quotas[1].Budget != 100 {
+		t.Fatalf("got quotas %v", quotas)
+	}
+
+	// nested subnets are each held to their own budget
+	result := Result{Hosts: map[string]int64{"128.252.1.1": 600, "128.252.9.1": 300, "2001:db8::1": 10, "::ffff:128.252.1.2": 1}}
+	var out bytes.Buffer
+	QuotaReport(&out, result, quotas, nil)
+	for _, test := range []struct {
+		network, used, status string
+	}{
+		{"128.252.0.0/16", "901 B", "ok"},
+		{"128.252.9.0/24", "300 B", "OVER BUDGET"},
+		{"2001:db8::/32", "10 B", "ok"},
+	} {
+		found := false
+		for _, line := range strings.Split(out.String(), "\n") {
+			found = found || strings.HasPrefix(line, test.network) && strings.Contains(line, test.used) && strings.HasSuffix(line, test.status)
+		}
+		if !found {
+			t.Errorf("%v: expected %v used and %v in\n%v", test.network, test.used, test.status, out.String())
+		}
+	}
+	for _, bad := range []string{"network,budget\n128.252.0.0/16,1KB\n10.0.0.0/33,1KB\n", "10.0.0.1,lots\n"} {
+		if err := os.WriteFile(filename, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadQuotas(filename); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	pool := NewPool(2)
+	gate := make(chan struct{})
+	started := make(chan struct{}, 2)
+	var ran int64
+	blocked := func() {
+		started <- struct{}{}
+		<-gate
+		atomic.AddInt64(&ran, 1)
+	}
+
+	// with both workers held up, the tasks of the blocked one's deque
+	// are only run once they are free
+	pool.Submit(blocked)
+	pool.Submit(blocked)
+	<-started
+	<-started
+
+	// the queue holds twice as many tasks as there are workers, and the
+	// next task is run by the caller
+	for i := 0; i < 4; i++ {
+		pool.Submit(func() { atomic.AddInt64(&ran, 1) })
+	}
+	inline := false
+	pool.Submit(func() { inline = true })
+	if !inline || atomic.LoadInt64(&ran) != 0 {
+		t.Errorf("a task submitted to a full queue wasn't run by the caller")
+	}
+	close(gate)
+	pool.Close()
+	if ran != 6 {
+		t.Errorf("ran %d tasks, expected 6", ran)
+	}
+
+	// a worker that is held up has its deque emptied by the other
+	pool = NewPool(2)
+	gate = make(chan struct{})
+	pool.Submit(blocked)
+	<-started
+	var done sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		done.Add(1)
+		pool.Submit(done.Done)
+	}
+	stolen := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(stolen)
+	}()
+	select {
+	case <-stolen:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the tasks of a busy worker weren't stolen")
+	}
+	close(gate)
+	pool.Close()
+}
+
+func TestDumpAll(t *testing.T) {
+	defer func(run *RunMetadata, min int64, compress bool) { Run, MinBytes, CompressOutputs = run, min, compress }(Run, MinBytes, CompressOutputs)
+	Run = &RunMetadata{Version: Version, Created: "2020-09-13T12:26:40Z", Inputs: []string{"conn.log"}}
+	MinBytes = 10
+
+	// a plain name gains .zst only when the dump will be zstd compressed
+	CompressOutputs = false
+	for _, test := range []struct{ name, want string }{
+		{"dump.csv", "dump.csv"}, {"dump.csv.gz", "dump.csv.gz"}, {"dump.csv.zst", "dump.csv.zst"},
+	} {
+		if got := DumpName(test.name); got != test.want {
+			t.Errorf("%v: got %v, expected %v", test.name, got, test.want)
+		}
+	}
+	CompressOutputs = true
+	if ZstdInstalled() && DumpName("dump.csv") != "dump.csv.zst" {
+		t.Errorf("got %v for a zstd compressed dump", DumpName("dump.csv"))
+	}
+
+	filename := filepath.Join(t.TempDir(), "dump.csv.gz")
+	result := Result{
+		Hosts:   map[string]int64{"128.252.1.1": 100, "128.252.1.2": 5},
+		Conns:   map[string]int64{"128.252.1.1": 3, "128.252.1.2": 1},
+		Buckets: map[int64]int64{1600000000: 5},
+	}
+	if err := DumpAll(filename, result); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "#qreader version: "+Version+"\n") || !strings.Contains(string(data), "#qreader inputs: conn.log\n") {
+		t.Errorf("the dump doesn't start with the run metadata:\n%s", data)
+	}
+
+	// the keys below MinBytes are left out, but not the buckets
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"kind", "key", "bytes", "conns"},
+		{"host", "128.252.1.1", "100", "3"},
+		{"subnet", "128.252.1.0/24", "105", ""},
+		{"bucket", "1600000000", "5", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v, expected %v", rows, want)
+	}
+}
+
+func TestBrowser(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "map.csv")
+	if err := os.WriteFile(filename, []byte("128.252.1.2,printer\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	labels, err := LoadMapping(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := Result{
+		Hosts: map[string]int64{"128.252.1.3": 10, "128.252.1.1": 10, "128.252.1.2": 20, "128.252.1.4": 10},
+		Conns: map[string]int64{"128.252.1.3": 1, "128.252.1.1": 1, "128.252.1.2": 1, "128.252.1.4": 2},
+	}
+
+	// the rows that tie on the sort column are ordered by their keys
+	for _, test := range []struct {
+		sortcol int
+		reverse bool
+		want    []string
+	}{
+		{1, false, []string{"128.252.1.2", "128.252.1.1", "128.252.1.3", "128.252.1.4"}},
+		{2, false, []string{"128.252.1.4", "128.252.1.1", "128.252.1.2", "128.252.1.3"}},
+		{0, true, []string{"128.252.1.4", "128.252.1.3", "128.252.1.2", "128.252.1.1"}},
+	} {
+		b := &Browser{result: result, sortcol: test.sortcol, reverse: test.reverse}
+		for i := 0; i < 3; i++ {
+			b.Refresh()
+			var got []string
+			for _, row := range b.rows {
+				got = append(got, row.key)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sorted by %d: got %v, expected %v", test.sortcol, got, test.want)
+			}
+		}
+	}
+
+	// the labels come from the settings the browser is given
+	tty, err := os.Create(filepath.Join(t.TempDir(), "tty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	defer func(labels *Mapping) { Labels = labels }(Labels)
+	Labels = nil
+	b := &Browser{result: result, labels: labels, tty: tty, host: "128.252.1.2", sortcol: 1}
+	b.Refresh()
+	b.Draw()
+	screen, err := os.ReadFile(tty.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(screen), "ports of 128.252.1.2 (printer)") {
+		t.Errorf("the label of the host isn't shown:\n%q", screen)
+	}
+}
+
+func TestOrderInputs(t *testing.T) {
+	LogInit(false)
+	line := func(ts int, bytes int) string {
+		return fmt.Sprintf("%d\tC1\t10.0.0.1\t1\t128.252.0.1\t53\ttcp\t-\t1\t10\t0\t-\t-\t0\t-\t1\t%d\t1\t0\n", ts, bytes)
+	}
+	dir := t.TempDir()
+	inputs := map[string]string{
+		"b.log": line(2000, 1) + line(2100, 1),
+		"a.log": line(1000, 10) + line(1100, 10),
+		"c.log": line(1050, 100) + line(1200, 100),
+		"d.log": "#separator \\x09\n",
+	}
+	var filenames []string
+	for _, name := range []string{"d.log", "c.log", "b.log", "a.log"} {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(inputs[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	// the inputs are read in the order of their data, those without any
+	// last
+	spans, err := Reader{}.OrderInputs(filenames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, span := range spans {
+		order = append(order, filepath.Base(span.Filename))
+	}
+	if want := []string{"a.log", "c.log", "b.log", "d.log"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got the order %v, expected %v", order, want)
+	}
+
+	// c.log starts before a.log ends, so it is either counted with a
+	// warning or skipped
+	for _, test := range []struct {
+		policy string
+		bytes  int64
+	}{
+		{"warn", 222}, {"skip", 22},
+	} {
+		warnings := make(chan InputWarning, 10)
+		result, err := New(WithOverlap(test.policy)).Source(filenames...).Warnings(warnings).Run(context.Background())
+		close(warnings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		overlapping := 0
+		for warning := range warnings {
+			if warning.Kind == OverlappingInput && filepath.Base(warning.File) == "c.log" {
+				overlapping++
+			}
+		}
+		if result.Hosts["128.252.0.1"] != test.bytes || overlapping != 1 {
+			t.Errorf("%v: got %d bytes and %d overlap warnings", test.policy, result.Hosts["128.252.0.1"], overlapping)
+		}
+	}
+}
+
+func TestDashboardPage(t *testing.T) {
+	defer func(rows, bars int, labels *Mapping) { DashboardRows, DashboardBars, Labels = rows, bars, labels }(DashboardRows, DashboardBars, Labels)
+	DashboardRows, DashboardBars, Labels = 2, 1, nil
+	result := Result{
+		Hosts: map[string]int64{"128.252.1.1": 600, "128.252.1.2": 300, "128.252.1.3": 100},
+		Conns: map[string]int64{"128.252.1.1": 6},
+	}
+
+	// the rows are cut to DashboardRows, the bars to DashboardBars, and
+	// the widths are relative to the largest host
+	page := newDashboardPage(result)
+	if page.Total != 1000 || page.Hosts != 3 || !page.Detail || page.Labels {
+		t.Errorf("got page %+v", page)
+	}
+	want := []dashboardRow{
+		{Rank: 1, Host: "128.252.1.1", Bytes: 600, Share: 60, Conns: 6, Width: 100},
+		{Rank: 2, Host: "128.252.1.2", Bytes: 300, Share: 30, Width: 50},
+	}
+	if !reflect.DeepEqual(page.Rows, want) || !reflect.DeepEqual(page.Bars, want[:1]) {
+		t.Errorf("got rows %+v and bars %+v", page.Rows, page.Bars)
+	}
+
+	// the labels are escaped in the page
+	filename := filepath.Join(t.TempDir(), "map.csv")
+	if err := os.WriteFile(filename, []byte("128.252.1.1,<script>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if Labels, err = LoadMapping(filename); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := dashboardTemplate.Execute(&out, newDashboardPage(result)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "&lt;script&gt;") || !strings.Contains(out.String(), "3 hosts") {
+		t.Errorf("got page:\n%v", out.String())
+	}
+}
+
+func TestWriteChart(t *testing.T) {
+	dir := t.TempDir()
+	result := Result{
+		Hosts:   map[string]int64{"128.252.1.1": 600, "128.252.1.2": 300},
+		Buckets: map[int64]int64{1600000000: 100, 1600000060: 400},
+	}
+
+	// the format follows the extension of the file
+	for _, test := range []struct {
+		name  string
+		chart Chart
+		err   bool
+	}{
+		{"top.svg", TopChart(result), false},
+		{"top.png", TopChart(result), false},
+		{"time.PNG", TimeChart(result), false},
+		{"top.jpg", TopChart(result), true},
+	} {
+		filename := filepath.Join(dir, test.name)
+		err := WriteChart(filename, test.chart)
+		if (err != nil) != test.err {
+			t.Errorf("%v: got %v", test.name, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "top.svg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "128.252.1.1") || !strings.Contains(string(data), "66.67%") {
+		t.Errorf("got chart %s", data)
+	}
+	for _, name := range []string{"top.png", "time.PNG"} {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := png.DecodeConfig(file)
+		file.Close()
+		if err != nil || config.Width != ChartWidth || config.Height != ChartHeight {
+			t.Errorf("%v: got %+v, %v", name, config, err)
+		}
+	}
+}
+
+func TestMapping(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "map.csv")
+	text := "network,hostname,owner,department\n" +
+		"# the campus and some of its hosts\n" +
+		"128.252.0.0/16,,,research\n" +
+		"128.252.9.1,printer,alice\n" +
+		"128.252.9.0/24,,bob,finance\n" +
+		"2001:db8::/32,v6-lab\n"
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	labels, err := LoadMapping(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the most specific network wins, whatever the order of the file
+	for _, test := range []struct {
+		ip    string
+		label string
+		ok    bool
+	}{
+		{"128.252.9.1", "printer [alice]", true},
+		{"128.252.9.2", "[bob, finance]", true},
+		{"128.252.1.1", "[research]", true},
+		{"2001:db8::1", "v6-lab", true},
+		{"10.0.0.1", "", false},
+		{"128.252.0.0/16", "", false},
+	} {
+		label, ok := labels.Lookup(test.ip)
+		if label.String() != test.label || ok != test.ok {
+			t.Errorf("%v: got %q, %v", test.ip, label, ok)
+		}
+	}
+
+	// the report labels its rows from the mapping of its settings
+	settings := Defaults()
+	settings.Labels = labels
+	var out bytes.Buffer
+	Combiner{settings: &settings}.Report(&out, Result{Hosts: map[string]int64{"128.252.9.1": 10}})
+	if !strings.Contains(out.String(), "printer [alice]") {
+		t.Errorf("got report:\n%v", out.String())
+	}
+
+	if err := os.WriteFile(filename, []byte("network,hostname\n10.0.0.1,a\nnot-a-network,b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMapping(filename); err == nil || !strings.Contains(err.Error(), ":3:") {
+		t.Errorf("got %v, expected an error on line 3", err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	previous := &Result{Hosts: map[string]int64{"128.252.1.1": 1000, "128.252.1.2": 0, "128.252.1.3": 2000}}
+	for _, test := range []struct {
+		key   string
+		bytes int64
+		want  []string
+	}{
+		{"128.252.1.1", 1500, []string{"+500", "B", "+50.0%"}},
+		{"128.252.1.3", 1000, []string{"-1000", "B", "-50.0%"}},
+		{"128.252.1.2", 10, []string{"+10", "B"}},
+		{"128.252.1.4", 10, []string{"new"}},
+	} {
+		got := strings.Fields(Compare(previous, test.key, test.bytes))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %q, expected %q", test.key, got, test.want)
+		}
+	}
+
+	// the previous period is read back from a state file, with the
+	// metadata of the run that saved it alongside the result
+	defer func(run *RunMetadata, compress bool) { Run, CompressOutputs = run, compress }(Run, CompressOutputs)
+	Run, CompressOutputs = &RunMetadata{Version: Version}, false
+	filename := filepath.Join(t.TempDir(), "state.json")
+	if err := SaveState(filename, *previous); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadState(filename)
+	if err != nil || !reflect.DeepEqual(loaded.Hosts, previous.Hosts) {
+		t.Errorf("got %v, %v", loaded.Hosts, err)
+	}
+
+	settings := Defaults()
+	settings.Previous = &loaded
+	var out bytes.Buffer
+	Combiner{settings: &settings}.Report(&out, Result{Hosts: map[string]int64{"128.252.1.1": 1500, "128.252.1.4": 10}})
+	if !strings.Contains(out.String(), "+50.0%") || !strings.Contains(out.String(), "new") {
+		t.Errorf("got report:\n%v", out.String())
+	}
+}
+
+func TestWriteIntel(t *testing.T) {
+	defer func(run *RunMetadata) { Run = run }(Run)
+	Run = &RunMetadata{Version: Version, Inputs: []string{"conn.log"}}
+	result := Result{Remotes: map[string]int64{"192.0.2.1": 300, "192.0.2.2": 200, "example.com": 250, "192.0.2.3": 100}}
+	filename := filepath.Join(t.TempDir(), "intel.dat")
+	if err := WriteIntel(filename, result, 3); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata is in comments zeek skips, and keys that aren't
+	// addresses take up a place in the top n but aren't exported
+	var indicators []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			if !strings.HasPrefix(line, "#qreader ") && !strings.HasPrefix(line, "#fields\tindicator\tindicator_type\tmeta.source\tmeta.desc") {
+				t.Errorf("unexpected comment %q", line)
+			}
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 || fields[1] != "Intel::ADDR" || fields[2] != IntelSource {
+			t.Errorf("invalid intel line %q", line)
+		}
+		indicators = append(indicators, fields[0])
+	}
+	if want := []string{"192.0.2.1", "192.0.2.2"}; !reflect.DeepEqual(indicators, want) {
+		t.Errorf("got indicators %v, expected %v", indicators, want)
+	}
+	if !strings.Contains(string(data), "#qreader version: "+Version+"\n") {
+		t.Errorf("the metadata is missing from\n%s", data)
+	}
+}
+
+func TestPublishWindows(t *testing.T) {
+	defer func(pub string, size time.Duration) { MosquittoPub, BucketSize = pub, size }(MosquittoPub, BucketSize)
+	BucketSize = time.Minute
+	result := Result{Buckets: map[int64]int64{1600000060: 20, 1600000000: 10}}
+
+	// a stand-in for mosquitto_pub that keeps its arguments and messages
+	MosquittoPub = filepath.Join(t.TempDir(), "mosquitto_pub")
+	script := "#!/bin/sh\necho \"$@\" > \"$0.args\"\ncat > \"$0.in\"\n"
+	if err := os.WriteFile(MosquittoPub, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ broker, args string }{
+		{"broker", "-h broker -p 1883 -t qreader/windows -l\n"},
+		{"broker:8883", "-h broker -p 8883 -t qreader/windows -l\n"},
+	} {
+		if err := PublishWindows(test.broker, "qreader/windows", result); err != nil {
+			t.Fatal(err)
+		}
+		if args, _ := os.ReadFile(MosquittoPub + ".args"); string(args) != test.args {
+			t.Errorf("%v: got arguments %q, expected %q", test.broker, args, test.args)
+		}
+	}
+
+	// one message per bucket, oldest first
+	messages, _ := os.ReadFile(MosquittoPub + ".in")
+	want := "{\"start\":1600000000,\"end\":1600000060,\"bytes\":10}\n{\"start\":1600000060,\"end\":1600000120,\"bytes\":20}\n"
+	if string(messages) != want {
+		t.Errorf("got messages %q, expected %q", messages, want)
+	}
+
+	MosquittoPub = "false"
+	if err := PublishWindows("broker", "qreader/windows", result); err == nil {
+		t.Errorf("a failed publish succeeded")
+	}
+	if err := PublishWindows("broker", "qreader/windows", Result{}); err != nil {
+		t.Errorf("publishing no windows failed: %v", err)
+	}
+}
+
+func TestUpdateRRD(t *testing.T) {
+	defer func(rrd, create, update string, size time.Duration) {
+		RRDTool, WhisperCreate, WhisperUpdate, BucketSize = rrd, create, update, size
+	}(RRDTool, WhisperCreate, WhisperUpdate, BucketSize)
+	BucketSize = time.Minute
+
+	// stand-ins for the tools that log their calls, create the files
+	// they are asked to, and claim the last update of an rrd file was
+	// at the end of the second bucket
+	tools := t.TempDir()
+	stub := func(name string, create string) string {
+		filename := filepath.Join(tools, name)
+		script := "#!/bin/sh\necho \"$@\" >> \"$0.log\"\ncase \"$1\" in\n" + create +
+			"last) echo 1600000120 ;;\nesac\n"
+		if err := os.WriteFile(filename, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	RRDTool = stub("rrdtool", "create) touch \"$2\" ;;\n")
+	WhisperCreate = stub("whisper-create", "*.wsp) touch \"$1\" ;;\n")
+	WhisperUpdate = stub("whisper-update", "")
+
+	dir := t.TempDir()
+	rrd := filepath.Join(dir, "128.252.0.0_24.rrd")
+	for _, test := range []struct {
+		name    string
+		buckets map[int64]int64
+		calls   string
+	}{
+		{"new file", map[int64]int64{1600000000: 6000, 1600000060: 12000},
+			"create " + rrd + " --start 1599999999 --step 60 DS:bytes:GAUGE:120:0:U RRA:AVERAGE:0.5:1:8640\n" +
+				"update " + rrd + " 1600000060:100.000 1600000120:200.000\n"},
+		{"stored buckets", map[int64]int64{1600000060: 12000, 1600000120: 600},
+			"last " + rrd + "\nupdate " + rrd + " 1600000180:10.000\n"},
+		{"nothing new", map[int64]int64{1600000000: 6000},
+			"last " + rrd + "\n"},
+	} {
+		os.Remove(RRDTool + ".log")
+		result := Result{SubnetBuckets: map[string]map[int64]int64{"128.252.0.0/24": test.buckets}}
+		if err := UpdateRRD(dir, "rrd", result); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if calls, _ := os.ReadFile(RRDTool + ".log"); string(calls) != test.calls {
+			t.Errorf("%v: got calls\n%sexpected\n%s", test.name, calls, test.calls)
+		}
+	}
+
+	// a replayed window is stamped with its start, at the rate of the
+	// whole window
+	window := Result{SubnetBuckets: map[string]map[int64]int64{"128.252.0.0/24": {1600000000: 60, 1600000030: 60}}}
+	if err := UpdateRRDWindow(dir, "wsp", 1600000000, window); err != nil {
+		t.Fatal(err)
+	}
+	wsp := filepath.Join(dir, "128.252.0.0_24.wsp")
+	if calls, _ := os.ReadFile(WhisperCreate + ".log"); string(calls) != wsp+" 60:8640\n" {
+		t.Errorf("got whisper-create calls %q", calls)
+	}
+	if calls, _ := os.ReadFile(WhisperUpdate + ".log"); string(calls) != wsp+" 1600000000:2.000\n" {
+		t.Errorf("got whisper-update calls %q", calls)
+	}
+
+	RRDTool = "false"
+	if err := UpdateRRD(t.TempDir(), "rrd", Result{SubnetBuckets: window.SubnetBuckets}); err == nil {
+		t.Errorf("a failed rrdtool create succeeded")
+	}
+}
+
+func TestRunMetadata(t *testing.T) {
+	defer func(run *RunMetadata, compress bool) { Run, CompressOutputs = run, compress }(Run, CompressOutputs)
+	CompressOutputs = false
+	Run = &RunMetadata{
+		Version:       Version,
+		Created:       "2020-09-13T12:26:40Z",
+		Inputs:        []string{"a.log", "b.log"},
+		Start:         epochString(1600000000),
+		Options:       map[string]string{"top": "5", "bucket": "1m0s"},
+		LocalNetworks: []string{"128.252.0.0/16"},
+	}
+
+	// the options come last, in name order, and missing times are empty
+	want := [][]string{
+		{"version", Version},
+		{"created", "2020-09-13T12:26:40Z"},
+		{"inputs", "a.log b.log"},
+		{"start", "2020-09-13T12:26:40Z"},
+		{"end", ""},
+		{"local_networks", "128.252.0.0/16"},
+		{"option.bucket", "1m0s"},
+		{"option.top", "5"},
+	}
+	if rows := Run.Rows(); !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v, expected %v", rows, want)
+	}
+
+	// a state file carries the metadata alongside the result, and still
+	// loads as a plain result
+	filename := filepath.Join(t.TempDir(), "state.json")
+	if err := SaveState(filename, Result{Hosts: map[string]int64{"128.252.1.1": 42}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved stateFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Metadata, Run) {
+		t.Errorf("got metadata %+v, expected %+v", saved.Metadata, Run)
+	}
+	loaded, err := LoadState(filename)
+	if err != nil || loaded.Hosts["128.252.1.1"] != 42 {
+		t.Errorf("got %v, %v", loaded.Hosts, err)
+	}
+}
+
+func TestParseSections(t *testing.T) {
+	for _, test := range []struct {
+		s     string
+		names []string
+		fail  bool
+	}{
+		{"hosts", []string{"hosts"}, false},
+		// sections print in the order they were registered, once each
+		{"ports,hosts", []string{"hosts", "ports"}, false},
+		{" remotes , directions,remotes", []string{"directions", "remotes"}, false},
+		{"hosts,nonsense", nil, true},
+		{"", nil, true},
+	} {
+		names, err := ParseSections(test.s)
+		if (err != nil) != test.fail {
+			t.Errorf("%q: got error %v", test.s, err)
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%q: got %v, expected %v", test.s, names, test.names)
+		}
+	}
+}
+
+// a site specific section, as registered from an init function
+type testSection struct{}
+
+func (testSection) Name() string { return "test" }
+
+func (testSection) Render(w io.Writer, result Result) {
+	fmt.Fprintf(w, "%v hosts\n", len(result.Hosts))
+}
+
+func TestRegisterSection(t *testing.T) {
+	defer func(sections map[string]ReportSection, names []string, styled bool) {
+		Sections, SectionNames, Styled = sections, names, styled
+	}(Sections, SectionNames, Styled)
+	Sections = map[string]ReportSection{"directions": Sections["directions"]}
+	SectionNames = []string{"directions"}
+	Styled = false
+
+	RegisterSection(testSection{})
+	names, err := ParseSections("test,directions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	PrintSections(&out, names, Result{Hosts: map[string]int64{"128.252.1.1": 1}})
+	if !strings.HasSuffix(out.String(), "\n\ntop test:\n1 hosts\n") || !strings.HasPrefix(out.String(), "top directions:\n") {
+		t.Errorf("got report\n%s", out.String())
+	}
+
+	// a single section prints without a title
+	out.Reset()
+	PrintSections(&out, []string{"test"}, Result{})
+	if out.String() != "0 hosts\n" {
+		t.Errorf("got report %q", out.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a section twice didn't panic")
+		}
+	}()
+	RegisterSection(testSection{})
+}
+
+func TestCgroupCPUs(t *testing.T) {
+	defer func(root string) { CgroupRoot = root }(CgroupRoot)
+	for _, test := range []struct {
+		name  string
+		files map[string]string
+		cpus  float64
+	}{
+		{"v2 quota", map[string]string{"cpu.max": "150000 100000\n"}, 1.5},
+		{"v2 no quota", map[string]string{"cpu.max": "max 100000\n"}, 0},
+		{"v2 invalid", map[string]string{"cpu.max": "150000\n"}, 0},
+		// cgroup v2 wins over the v1 files
+		{"v2 and v1", map[string]string{"cpu.max": "max 100000", "cpu/cpu.cfs_quota_us": "200000", "cpu/cpu.cfs_period_us": "100000"}, 0},
+		{"v1 quota", map[string]string{"cpu/cpu.cfs_quota_us": "50000\n", "cpu/cpu.cfs_period_us": "100000\n"}, 0.5},
+		{"v1 no quota", map[string]string{"cpu/cpu.cfs_quota_us": "-1", "cpu/cpu.cfs_period_us": "100000"}, 0},
+		{"v1 no period", map[string]string{"cpu/cpu.cfs_quota_us": "50000"}, 0},
+		{"no cgroup", nil, 0},
+	} {
+		CgroupRoot = t.TempDir()
+		for name, content := range test.files {
+			filename := filepath.Join(CgroupRoot, name)
+			os.MkdirAll(filepath.Dir(filename), 0755)
+			if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cpus := CgroupCPUs(); cpus != test.cpus {
+			t.Errorf("%v: got %v cpus, expected %v", test.name, cpus, test.cpus)
+		}
+	}
+
+	// the quota is rounded up and capped by the machine, and an explicit
+	// number of cpus always wins
+	CgroupRoot = t.TempDir()
+	os.WriteFile(filepath.Join(CgroupRoot, "cpu.max"), []byte("1 100000"), 0644)
+	if cpus := UsableCPUs(0); cpus != 1 {
+		t.Errorf("got %v usable cpus, expected 1", cpus)
+	}
+	if cpus := UsableCPUs(3); cpus != 3 {
+		t.Errorf("got %v usable cpus, expected 3", cpus)
+	}
+	os.WriteFile(filepath.Join(CgroupRoot, "cpu.max"), []byte("100000000 1000"), 0644)
+	if cpus := UsableCPUs(0); cpus != runtime.NumCPU() {
+		t.Errorf("got %v usable cpus, expected %v", cpus, runtime.NumCPU())
+	}
+}
+
+func TestPartial(t *testing.T) {
+	a, b := netip.MustParseAddr("128.252.1.1"), netip.MustParseAddr("128.252.1.2")
+	for _, test := range []struct {
+		name      string
+		normalize KeyNormalizer
+		hosts     map[string]int64
+		ports     map[string]map[int]int64
+	}{
+		{"addresses", nil,
+			map[string]int64{"128.252.1.1": 350, "128.252.1.2": 20},
+			map[string]map[int]int64{"128.252.1.1": {53: 300, 443: 50}, "128.252.1.2": {53: 20}}},
+		// the keys are only normalized when the result is built, summing
+		// the addresses that share one
+		{"normalized", func(netip.Addr) string { return "site" },
+			map[string]int64{"site": 370},
+			map[string]map[int]int64{"site": {53: 320, 443: 50}}},
+	} {
+		settings := Defaults()
+		settings.TrackDetail = true
+		settings.Normalize = test.normalize
+
+		// two reducers' worth of records, summed by the combiner
+		first, second := settings.NewPartial(), settings.NewPartial()
+		first.Add(a, 53, 100)
+		first.Add(b, 53, 20)
+		first.AddTime(1600000060)
+		second.Add(a, 53, 200)
+		second.Add(a, 443, 50)
+		second.AddTime(1600000000)
+		second.AddTime(0)
+		final := settings.NewPartial()
+		final.Merge(first)
+		final.Merge(second)
+
+		result := final.Result()
+		if !reflect.DeepEqual(result.Hosts, test.hosts) {
+			t.Errorf("%v: got hosts %v, expected %v", test.name, result.Hosts, test.hosts)
+		}
+		if !reflect.DeepEqual(result.Ports, test.ports) {
+			t.Errorf("%v: got ports %v, expected %v", test.name, result.Ports, test.ports)
+		}
+		if result.First != 1600000000 || result.Last != 1600000060 {
+			t.Errorf("%v: got time range %v-%v", test.name, result.First, result.Last)
+		}
+	}
+}
+
+func TestOpenInput(t *testing.T) {
+	LogInit(false)
+	defer func(direct, drop bool, every int64) { DirectIO, DropCache, DropCacheEvery = direct, drop, every }(DirectIO, DropCache, DropCacheEvery)
+	DropCacheEvery = 4096
+
+	// more than one buffer of direct io, ending off a block boundary
+	data := bytes.Repeat([]byte("0123456789abcdef\n"), 150000)
+	filename := filepath.Join(t.TempDir(), "conn.log")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ direct, drop bool }{
+		{false, false},
+		{false, true},
+		// falls back to a plain open where the filesystem refuses O_DIRECT
+		{true, false},
+	} {
+		DirectIO, DropCache = test.direct, test.drop
+		r, err := OpenInput(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("direct %v, drop %v: read %v bytes of %v, %v", test.direct, test.drop, len(read), len(data), err)
+		}
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if buf := alignedBuffer(1 << 16); len(buf) != 1<<16 || addressOf(buf)%directAlign != 0 {
+		t.Errorf("got a buffer of %v bytes at %x", len(buf), addressOf(buf))
+	}
+}
+
+func TestParseIOClass(t *testing.T) {
+	for _, test := range []struct {
+		s            string
+		class, level int
+		fail         bool
+	}{
+		{"idle", ioprioClassIdle, 0, false},
+		{"best-effort", ioprioClassBestEffort, 4, false},
+		{"best-effort:0", ioprioClassBestEffort, 0, false},
+		{"best-effort:7", ioprioClassBestEffort, 7, false},
+		{"best-effort:8", 0, 0, true},
+		{"best-effort:low", 0, 0, true},
+		{"idle:3", 0, 0, true},
+		{"realtime", 0, 0, true},
+	} {
+		class, level, err := parseIOClass(test.s)
+		if (err != nil) != test.fail || class != test.class || level != test.level {
+			t.Errorf("%q: got %v, %v, %v", test.s, class, level, err)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, 10000)
+	start := time.Now()
+	r := NewRateLimiter(io.NopCloser(bytes.NewReader(data)), 40000)
+	read, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("read %v bytes of %v, %v", len(read), len(data), err)
+	}
+	if elapsed := time.Since(start); elapsed < 240*time.Millisecond {
+		t.Errorf("read 10000 bytes at 40000 per second in %v", elapsed)
+	}
+}
+
+func TestRemoteReport(t *testing.T) {
+	defer func(styled, bars bool) { Styled, Bars = styled, bars }(Styled, Bars)
+	Styled, Bars = false, false
+
+	// the external side of each connection is counted, whichever end
+	// started it, and traffic between local hosts isn't
+	settings := Defaults()
+	settings.Local = netip.MustParsePrefix("10.0.0.0/8")
+	settings.TrackRemote = true
+	conn := func(orig, resp string, bytes int) Conn {
+		return Conn{Ts: 100, Orig: netip.MustParseAddr(orig), Resp: netip.MustParseAddr(resp), Bytes: bytes}
+	}
+	result := settings.ReduceBatch([]Conn{
+		conn("10.0.0.1", "192.0.2.1", 100),
+		conn("192.0.2.1", "10.0.0.2", 50),
+		conn("10.0.0.1", "192.0.2.2", 300),
+		conn("10.0.0.1", "10.0.0.2", 1000),
+	}).Result()
+	if want := map[string]int64{"192.0.2.1": 150, "192.0.2.2": 300}; !reflect.DeepEqual(result.Remotes, want) {
+		t.Errorf("got remotes %v, expected %v", result.Remotes, want)
+	}
+
+	for _, test := range []struct {
+		names map[string]string
+		want  []string
+	}{
+		{nil, []string{"192.0.2.2", "192.0.2.1"}},
+		{map[string]string{"192.0.2.1": "mail.example.org"}, []string{"192.0.2.2", "192.0.2.1 mail.example.org"}},
+	} {
+		result.RemoteNames = test.names
+		var out bytes.Buffer
+		RemoteReport(&out, result)
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			fields := strings.Fields(line)
+			got = append(got, strings.Join(append(fields[:1], fields[2:]...), " "))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("names %v: got report\n%s", test.names, out.String())
+		}
+	}
+}
+
+func TestExportMinBytes(t *testing.T) {
+	defer func(duckdb string, min int64, run *RunMetadata) { DuckDB, MinBytes, Run = duckdb, min, run }(DuckDB, MinBytes, Run)
+	Run = nil
+
+	// a stand-in for duckdb that keeps the staged tables it was given
+	DuckDB = filepath.Join(t.TempDir(), "duckdb")
+	script := "#!/bin/sh\ncat > \"$1.sql\"\nfor f in $(grep -o \"'[^']*[.]csv'\" \"$1.sql\" | tr -d \"'\"); do cat \"$f\"; done > \"$1\"\n"
+	if err := os.WriteFile(DuckDB, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	result := Result{
+		Hosts:   map[string]int64{"10.0.0.1": 500, "10.0.0.2": 50},
+		Ports:   map[string]map[int]int64{"10.0.0.2": {53: 50}},
+		Remotes: map[string]int64{"192.0.2.1": 400, "192.0.2.2": 99},
+		Buckets: map[int64]int64{1600000000: 1},
+	}
+	for _, test := range []struct {
+		min  int64
+		want string
+	}{
+		{0, "host,bytes,conns\n10.0.0.1,500,\n10.0.0.2,50,\n" +
+			"host,port,bytes\n10.0.0.2,53,50\n" +
+			"host,bytes\n192.0.2.1,400\n192.0.2.2,99\n" +
+			"start,bytes\n1600000000,1\n"},
+		// the time buckets are kept whatever their size
+		{100, "host,bytes,conns\n10.0.0.1,500,\n" +
+			"host,port,bytes\n" +
+			"host,bytes\n192.0.2.1,400\n" +
+			"start,bytes\n1600000000,1\n"},
+	} {
+		MinBytes = test.min
+		filename := filepath.Join(t.TempDir(), "out.duckdb")
+		if err := ExportDuckDB(filename, result, ""); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(filename); string(data) != test.want {
+			t.Errorf("min %v: got tables\n%sexpected\n%s", test.min, data, test.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+	Description:
+		Saved queries, named sets of options stored in a file so that a
+		common analysis can be run again, or by someone else, by its name
+		alone. The file holds a section per query with an option per
+		line:
+			[top-https-uploads]
+			report = hosts,ports
+			top = 20
+		and a query is run with -query or as qreader run <name>
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the options of a saved query by flag name, without the leading -
+type Query map[string]string
+
+/*
+	function to find the default queries file, queries in the user's
+	configuration directory
+*/
+func DefaultQueriesFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "qreader", "queries")
+}
+
+/*
+	function to load the saved queries from a file. Blank lines and
+	lines starting with # are ignored
+*/
+func LoadQueries(filename string) (map[string]Query, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	queries := make(map[string]Query)
+	var current Query
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if name == "" {
+				return nil, fmt.Errorf("%v:%d: query without a name", filename, lineno)
+			}
+			if _, ok := queries[name]; ok {
+				return nil, fmt.Errorf("%v:%d: query %v is defined twice", filename, lineno, name)
+			}
+			current = make(Query)
+			queries[name] = current
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%v:%d: option outside of a [query] section", filename, lineno)
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%v:%d: expected option = value", filename, lineno)
+		}
+		current[strings.TrimLeft(strings.TrimSpace(name), "-")] = strings.TrimSpace(value)
+	}
+	return queries, scanner.Err()
+}
+
+/*
+	function to set the options of a query on a set of flags, leaving the
+	ones given on the command line as they are so that they can adjust
+	the query
+*/
+func (self Query) Apply(flags *flag.FlagSet) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for name, value := range self {
+		if name == "query" || name == "queries" {
+			return fmt.Errorf("a query can't run another query")
+		}
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown option -%v", name)
+		}
+		if given[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for -%v: %v", value, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+	Description:
+		Compares the traffic of each subnet against a byte budget from a
+		quota file and flags the subnets that are over budget
+*/
+
+package qreader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+)
+
+//--------------------------------------------------------------------------------
+//	Quota describes the monthly byte budget of a subnet
+//--------------------------------------------------------------------------------
+
+type Quota struct {
+	Network netip.Prefix
+	Budget  int64
+}
+
+// the loaded quotas, nil when -quota isn't given
+var Quotas []Quota
+
+/*
+	function to load a quota file with the columns
+		network,budget
+	where the budget is a byte quantity such as 500GB or 2TiB. Lines
+	starting with # and a header row are ignored
+*/
+func LoadQuotas(filename string) ([]Quota, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	var quotas []Quota
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != 2 {
+			return nil, fmt.Errorf("%v:%d: expected network,budget", filename, line)
+		}
+
+		network, err := parseNetwork(record[0])
+		if err != nil {
+			if row == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		budget, err := ParseBytes(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		quotas = append(quotas, Quota{network, budget})
+	}
+	return quotas, nil
+}
+
+// the report of the Quotas as a section, measured on the real addresses
+// of the result, see QuotaReport
+type QuotaSection struct {
+	Anon *Anonymizer
+}
+
+func (self QuotaSection) Name() string { return "quotas" }
+
+func (self QuotaSection) Render(w io.Writer, result Result) {
+	QuotaReport(w, result, Quotas, self.Anon)
+}
+
+/*
+	function to print the usage of every subnet in the quota file against
+	its budget. Nested subnets are each measured against their own
+	budget, so a host can count towards several of them. The usage is
+	measured on the real addresses of the result, and the subnets are
+	printed anonymized, without their labels, when anon isn't nil
+*/
+func QuotaReport(w io.Writer, result Result, quotas []Quota, anon *Anonymizer) {
+	used := make([]int64, len(quotas))
+	for ip, bytecount := range result.Hosts {
+		addr, err := parseHost(ip)
+		if err != nil {
+			continue
+		}
+		for i, q := range quotas {
+			if q.Network.Contains(addr) {
+				used[i] += bytecount
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%-20v %18v %18v %9v  %v\n", "subnet", "used", "budget", "used%", "status")
+	for i, q := range quotas {
+		var pct float64
+		if q.Budget > 0 {
+			pct = float64(used[i]) / float64(q.Budget) * 100
+		}
+		status := "ok"
+		if used[i] > q.Budget {
+			status = "OVER BUDGET"
+		}
+		network := q.Network.String()
+		if anon != nil {
+			network = anon.Key(network)
+		}
+		line := fmt.Sprintf("%-20v %18v %18v %9v  %v", network, HumanBytes(used[i]), HumanBytes(q.Budget), FormatNumber(pct, 2)+"%", status)
+		if label, ok := Labels.Lookup(q.Network.Addr().String()); ok && anon == nil {
+			line += "  " + label.String()
+		}
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+	Description:
+		Records the lines that could not be parsed, with where they came
+		from and why, so that problems with the upstream logs can be
+		looked into instead of being skipped silently. The lines the
+		record filters drop can be kept the same way, as dead letters, to
+		check that the filters don't drop something that matters
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// numbers of data lines parsed and rejected, updated atomically
+type LineCounts struct {
+	Parsed   int64
+	Rejected int64
+}
+
+type RejectLog struct {
+	mu    sync.Mutex
+	file  *OutputFile
+	zw    io.WriteCloser
+	w     *bufio.Writer
+	Count int
+}
+
+/*
+	function to create a reject log writing to the given file, zstd
+	compressed unless CompressOutputs is off
+*/
+func NewRejectLog(filename string) (*RejectLog, error) {
+	file, err := CreateOutput(filename)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := compressOutput(file)
+	if err != nil {
+		file.Abort()
+		return nil, err
+	}
+	return &RejectLog{file: file, zw: zw, w: bufio.NewWriter(zw)}, nil
+}
+
+/*
+	function to record a rejected line as "file:line: reason: text". It
+	is called by the parsers concurrently, so the lines of the log are in
+	no particular order
+*/
+func (self *RejectLog) Add(filename string, line int, text []byte, reason error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	fmt.Fprintf(self.w, "%v:%d: %v: %s\n", filename, line, reason, text)
+	self.Count++
+}
+
+/*
+	function to finish the log and move it into place
+*/
+func (self *RejectLog) Close() error {
+	err := self.w.Flush()
+	if zerr := self.zw.Close(); err == nil {
+		err = zerr
+	}
+	if err != nil {
+		self.file.Abort()
+		return err
+	}
+	return self.file.Commit()
+}
+
+/*
+	function to count the lines of a block, once it has been parsed
+*/
+func (self *LineCounts) Add(parsed, rejected int) {
+	if self == nil {
+		return
+	}
+	atomic.AddInt64(&self.Parsed, int64(parsed))
+	atomic.AddInt64(&self.Rejected, int64(rejected))
+}
+
+/*
+	function to read the numbers of lines parsed and rejected so far
+*/
+func (self *LineCounts) Load() (int64, int64) {
+	if self == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&self.Parsed), atomic.LoadInt64(&self.Rejected)
+}
+
+/*
+	function to work out the fraction of the data lines read so far that
+	could not be parsed
+*/
+func (self *LineCounts) ErrorRate() float64 {
+	parsed, rejected := self.Load()
+	if parsed+rejected == 0 {
+		return 0
+	}
+	return float64(rejected) / float64(parsed+rejected)
+}
@@ -0,0 +1,116 @@
+/*
+	Description:
+		Terminal-aware touches for the text report: colored bars showing
+		each row's share, bold section headings and columns widened to
+		the longest key. Output that isn't going to a terminal stays
+		plain text, so scripts reading it see no escape codes
+*/
+
+package qreader
+
+import (
+	"os"
+	"strings"
+)
+
+// whether the report is written with color escapes
+var Styled bool = false
+
+// whether the report rows get a bar showing their share of the total
+var Bars bool = false
+
+// the width of a full share bar, in characters
+var BarWidth int = 20
+
+/*
+	function to tell whether a file is a terminal
+*/
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+/*
+	function to decide whether to use color from the -color setting
+	(auto, always or never). In auto mode color is only used on a
+	terminal that supports it, and not when NO_COLOR is set
+*/
+func UseColor(setting string, out *os.File) bool {
+	switch setting {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return IsTerminal(out)
+}
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+func colorize(s string, code string) string {
+	if !Styled {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+/*
+	function to format a section heading
+*/
+func Heading(s string) string {
+	return colorize(s, ansiBold)
+}
+
+/*
+	function to draw a bar as long as a row's share of the total, in
+	eighths of a character on a color terminal and in whole # characters
+	otherwise. On a color terminal the bar goes from green to red as the
+	share grows
+*/
+func ShareBar(part, total int64) string {
+	if total <= 0 {
+		return ""
+	}
+	share := float64(part) / float64(total)
+	if !Styled {
+		return strings.Repeat("#", int(share*float64(BarWidth)+0.5))
+	}
+
+	eighths := int(share*float64(BarWidth*8) + 0.5)
+	bar := strings.Repeat("█", eighths/8)
+	if eighths%8 > 0 {
+		bar += string([]rune(" ▏▎▍▌▋▊▉")[eighths%8])
+	}
+	switch {
+	case share >= 0.3:
+		return colorize(bar, ansiRed)
+	case share >= 0.1:
+		return colorize(bar, ansiYellow)
+	}
+	return colorize(bar, ansiGreen)
+}
+
+/*
+	function to find the width of the key column: the given width, or on
+	a terminal the width of the longest key if that is wider
+*/
+func keyWidth(width int, keys []Talker) int {
+	if !Styled {
+		return width
+	}
+	for _, t := range keys {
+		if len(t.Key) > width {
+			width = len(t.Key)
+		}
+	}
+	return width
+}
@@ -0,0 +1,106 @@
+/*
+	Description:
+		Replays historical logs at their original pace, or a multiple of
+		it, reporting each time bucket as it closes as if the traffic
+		were live. Useful for exercising whatever consumes the reports
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+/*
+	function to parse a replay speed such as "1x", "10x" or "0.5"
+*/
+func ParseSpeed(s string) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid replay speed %q", s)
+	}
+	return speed, nil
+}
+
+/*
+	function to replay the given files in order, sleeping between records
+	so that the gaps between their timestamps pass speed times faster
+	than they originally did. Each time bucket is passed to emit once the
+	replay has reached its end. The files are read line by line in a
+	single goroutine, since the records must be seen in order, with the
+	given settings counting and recording their lines
+*/
+func Replay(settings Settings, filenames []string, speed float64, emit func(start int64, result Result)) error {
+	size := int64(settings.BucketSize / time.Second)
+
+	var began time.Time
+	var first float64
+	due := func(ts float64) time.Time {
+		return began.Add(time.Duration((ts - first) / speed * float64(time.Second)))
+	}
+
+	var window []Conn
+	var start int64
+	flush := func() {
+		if len(window) > 0 {
+			emit(start, settings.ReduceBatch(window).Result())
+		}
+		window = nil
+	}
+
+	for _, filename := range filenames {
+		reader := Reader{settings: &settings}.GetReader(filename)
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+		for lineno := 1; scanner.Scan(); lineno++ {
+			c, err := settings.Schema.LineWhere(scanner.Bytes(), settings.Need, settings.FilterNeed, settings.Filter)
+			if err == parse.ErrComment {
+				continue
+			}
+			if err != nil && settings.DeadLetters != nil {
+				settings.DeadLetters.Add(filename, lineno, scanner.Bytes(), err)
+			}
+			if err == parse.ErrFiltered {
+				settings.Lines.Add(1, 0)
+				continue
+			}
+			if err != nil {
+				settings.Lines.Add(0, 1)
+				settings.Warn(InputWarning{Kind: MalformedLine, File: filename, Line: lineno, Text: scanner.Text(), Err: err})
+				continue
+			}
+			settings.Lines.Add(1, 0)
+			if began.IsZero() {
+				began, first = time.Now(), c.Ts
+				start = settings.BucketOf(c.Ts)
+			}
+
+			// a record past the current bucket closes it once the replay
+			// reaches the bucket's end
+			if bucket := settings.BucketOf(c.Ts); bucket > start {
+				time.Sleep(time.Until(due(float64(start + size))))
+				flush()
+				start = bucket
+			}
+
+			time.Sleep(time.Until(due(c.Ts)))
+			window = append(window, c)
+		}
+
+		err := scanner.Err()
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", filename, err)
+		}
+	}
+
+	flush()
+	return nil
+}
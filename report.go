@@ -0,0 +1,434 @@
+/*
+	Description:
+		Sections of the printed report, so that several top-N breakdowns
+		and any site specific sections can be printed from a single pass
+		over the data
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//--------------------------------------------------------------------------------
+//	ReportSection interface implemented by every section of the printed
+//	report. Site specific sections are added by registering them from an
+//	init function in their own file, e.g.
+//
+//		func init() { RegisterSection(partnerSection{}) }
+//--------------------------------------------------------------------------------
+
+type ReportSection interface {
+	// name used to request the section with -report
+	Name() string
+	Render(w io.Writer, result Result)
+}
+
+// how many rows the top-N sections show, 0 for all of them
+var TopN int = 10
+
+// the percentage of its total the rows of a top-N section make up
+// together, instead of a number of rows. 0 when TopN applies
+var TopShare float64 = 0
+
+// how many of the top hosts of each group the subnets section and the
+// chargeback report list under the group, 0 for none
+var TopPerGroup int = 0
+
+// the registered sections by name, and their names in print order
+var Sections = map[string]ReportSection{}
+var SectionNames []string
+
+/*
+	function to make a section available to -report. Sections print in
+	the order they were registered
+*/
+func RegisterSection(section ReportSection) {
+	name := section.Name()
+	if _, ok := Sections[name]; ok {
+		panic("report section registered twice: " + name)
+	}
+	Sections[name] = section
+	SectionNames = append(SectionNames, name)
+}
+
+// adapts a plain function to the ReportSection interface
+type sectionFunc struct {
+	name   string
+	render func(io.Writer, Result)
+}
+
+func (self sectionFunc) Name() string { return self.name }
+
+func (self sectionFunc) Render(w io.Writer, result Result) { self.render(w, result) }
+
+func init() {
+	// the summary by direction comes before any of the top talkers
+	RegisterSection(sectionFunc{"directions", DirectionReport})
+	RegisterSection(sectionFunc{"hosts", Combiner{}.Report})
+	RegisterSection(sectionFunc{"ports", PortReport})
+	RegisterSection(sectionFunc{"subnets", SubnetReport})
+	RegisterSection(sectionFunc{"convs", ConvReport})
+	RegisterSection(sectionFunc{"remotes", RemoteReport})
+	RegisterSection(sectionFunc{"destinations", DestinationReport})
+	RegisterSection(sectionFunc{"domains", DomainReport})
+	RegisterSection(sectionFunc{"excluded", ExcludedReport})
+	RegisterSection(sectionFunc{"countries", CountryReport})
+	RegisterSection(sectionFunc{"segments", SegmentReport})
+	RegisterSection(sectionFunc{"macs", MACReport})
+	RegisterSection(sectionFunc{"tags", TagReport})
+	RegisterSection(sectionFunc{"users", UserReport})
+	RegisterSection(sectionFunc{"tenants", TenantReport})
+	RegisterSection(sectionFunc{"utilization", UtilizationReport})
+	RegisterSection(ChargebackSection{})
+	RegisterSection(QuotaSection{})
+}
+
+/*
+	function to parse a comma separated list of report sections, returning
+	them in print order
+*/
+func ParseSections(s string) ([]string, error) {
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := Sections[name]; !ok {
+			return nil, fmt.Errorf("unknown report section %q, expected one of %v", name, strings.Join(SectionNames, ","))
+		}
+		wanted[name] = true
+	}
+
+	var names []string
+	for _, name := range SectionNames {
+		if wanted[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+/*
+	function to render the named sections, with a title above each one
+	when there is more than one
+*/
+func PrintSections(w io.Writer, names []string, result Result) {
+	for i, name := range names {
+		if len(names) > 1 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintln(w, Heading(fmt.Sprintf("top %v:", name)))
+		}
+		Sections[name].Render(w, result)
+	}
+}
+
+/*
+	function to build the key of a conversation between two hosts, which
+	is the same whichever of them started it
+*/
+func ConvKey(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return a + " <-> " + b
+}
+
+/*
+	function to split a conversation key back into its two hosts
+*/
+func SplitConvKey(key string) (string, string) {
+	pair := strings.SplitN(key, " <-> ", 2)
+	if len(pair) != 2 {
+		return key, ""
+	}
+	return pair[0], pair[1]
+}
+
+/*
+	function to cut a ranking down to the rows a section shows: the
+	largest ones that reach TopShare of the total between them, or else
+	the first TopN
+*/
+func topRows(ranked []Talker) []Talker {
+	if TopShare > 0 {
+		var tbytes, sum int64
+		for _, t := range ranked {
+			tbytes += t.Bytes
+		}
+		for i, t := range ranked {
+			sum += t.Bytes
+			if float64(sum) >= float64(tbytes)*TopShare/100 {
+				return ranked[:i+1]
+			}
+		}
+		return ranked
+	}
+	if TopN > 0 && len(ranked) > TopN {
+		return ranked[:TopN]
+	}
+	return ranked
+}
+
+/*
+	function to print the TopN largest entries of an aggregation with
+	their share of the total
+*/
+func printTop(w io.Writer, tt map[string]int64, width int) {
+	printRanked(w, tt, width, false, nil, nil)
+}
+
+/*
+	function to print the top entries like printTop, with the estimated
+	cost of each one and of all of them when Rates are set. The hosts of
+	each entry are listed under it when groups is given, see TopPerGroup
+*/
+func printTopCost(w io.Writer, tt map[string]int64, width int, groups map[string]map[string]int64) {
+	var below func(string)
+	if groups != nil && TopPerGroup > 0 {
+		below = func(key string) { printGroupTop(w, groups[key], max(width-len(key), 0)+2) }
+	}
+	printRanked(w, tt, width, Rates != nil, nil, below)
+	if Rates == nil {
+		return
+	}
+	var cost float64
+	for _, v := range tt {
+		cost += Rates.Cost(v)
+	}
+	fmt.Fprintf(w, "%*v %9v %12v\n", width, "total", "", FormatCost(cost))
+}
+
+/*
+	function to print the top entries of an aggregation, each followed by
+	its label when label gives one, and then by what below prints
+*/
+func printRanked(w io.Writer, tt map[string]int64, width int, cost bool, label func(string) string, below func(string)) {
+	var tbytes int64
+	for _, v := range tt {
+		tbytes += v
+	}
+
+	ranked := topRows(Rank(tt))
+	width = keyWidth(width, ranked)
+	for _, t := range ranked {
+		line := fmt.Sprintf("%*v %v", width, t.Key, Percent(t.Bytes, tbytes))
+		if cost || Bars {
+			line = fmt.Sprintf("%*v %9v", width, t.Key, Percent(t.Bytes, tbytes))
+		}
+		if cost {
+			line += fmt.Sprintf(" %12v", FormatCost(Rates.Cost(t.Bytes)))
+		}
+		if bar := ShareBar(t.Bytes, tbytes); Bars && bar != "" {
+			line += " " + bar
+		}
+		if label != nil {
+			if text := label(t.Key); text != "" {
+				line += "  " + text
+			}
+		}
+		fmt.Fprintln(w, line)
+		if below != nil {
+			below(t.Key)
+		}
+	}
+}
+
+/*
+	function to split the host totals into groups by the given function
+*/
+func GroupHosts(hosts map[string]int64, group func(string) string) map[string]map[string]int64 {
+	groups := make(map[string]map[string]int64)
+	for ip, bytecount := range hosts {
+		name := group(ip)
+		if groups[name] == nil {
+			groups[name] = make(map[string]int64)
+		}
+		groups[name][ip] = bytecount
+	}
+	return groups
+}
+
+/*
+	function to print the TopPerGroup largest hosts of a group, indented
+	by the given number of spaces under the group's row, with their bytes
+	and share of the group
+*/
+func printGroupTop(w io.Writer, hosts map[string]int64, indent int) {
+	var tbytes int64
+	for _, v := range hosts {
+		tbytes += v
+	}
+	ranked := Rank(hosts)
+	if len(ranked) > TopPerGroup {
+		ranked = ranked[:TopPerGroup]
+	}
+	width := keyWidth(15, ranked)
+	for _, t := range ranked {
+		fmt.Fprintf(w, "%*v%-*v %10v %9v\n", indent, "", width, t.Key, HumanBytes(t.Bytes), Percent(t.Bytes, tbytes))
+	}
+}
+
+func PortReport(w io.Writer, result Result) {
+	ports := make(map[string]int64, len(result.Services))
+	for port, bytecount := range result.Services {
+		ports[strconv.Itoa(port)] = bytecount
+	}
+	printTop(w, ports, 15)
+}
+
+func SubnetReport(w io.Writer, result Result) {
+	var groups map[string]map[string]int64
+	if TopPerGroup > 0 {
+		groups = GroupHosts(result.Hosts, Subnet)
+	}
+	printTopCost(w, SubnetTotals(result.Hosts), 18, groups)
+}
+
+func ConvReport(w io.Writer, result Result) {
+	printTop(w, result.Convs, 35)
+}
+
+/*
+	function to print the external hosts that exchanged the most bytes
+	with the local network, the mirror image of the hosts section, each
+	with the domain it was resolved from when dns logs were given
+*/
+func RemoteReport(w io.Writer, result Result) {
+	if result.RemoteNames == nil {
+		printTop(w, result.Remotes, 15)
+		return
+	}
+	printRanked(w, result.Remotes, 15, false, func(key string) string { return result.RemoteNames[key] }, nil)
+}
+
+/*
+	function to print the services the local network exchanged the most
+	bytes with, by the name of each one, or the address of the external
+	host where the name isn't known
+*/
+func DestinationReport(w io.Writer, result Result) {
+	width := 15
+	for _, t := range topRows(Rank(result.Destinations)) {
+		width = max(width, len(t.Key))
+	}
+	printTop(w, result.Destinations, width)
+}
+
+/*
+	function to print the destinations rolled up to their registered
+	domains, see PublicSuffixes
+*/
+func DomainReport(w io.Writer, result Result) {
+	DestinationReport(w, Result{Destinations: PublicSuffixes.Rollup(result.Destinations)})
+}
+
+/*
+	function to print the traffic matched by each exclusion rule
+*/
+func ExcludedReport(w io.Writer, result Result) {
+	for _, t := range Rank(result.Excluded) {
+		fmt.Fprintf(w, "%15v %v\n", t.Key, HumanBytes(t.Bytes))
+	}
+}
+
+/*
+	function to print the bytes exchanged with each country, all of them
+	rather than the top ten since the list is short and reviewed whole
+*/
+func CountryReport(w io.Writer, result Result) {
+	var tbytes int64
+	for _, v := range result.Countries {
+		tbytes += v
+	}
+	for _, t := range Rank(result.Countries) {
+		fmt.Fprintf(w, "%7v %10v %v\n", t.Key, HumanBytes(t.Bytes), Percent(t.Bytes, tbytes))
+	}
+}
+
+/*
+	function to print the bytes of local traffic in each network segment
+*/
+func SegmentReport(w io.Writer, result Result) {
+	var tbytes int64
+	for _, v := range result.Segments {
+		tbytes += v
+	}
+	for _, t := range Rank(result.Segments) {
+		fmt.Fprintf(w, "%15v %10v %v\n", t.Key, HumanBytes(t.Bytes), Percent(t.Bytes, tbytes))
+	}
+}
+
+func MACReport(w io.Writer, result Result) {
+	printTop(w, result.MACs, 17)
+}
+
+func UserReport(w io.Writer, result Result) {
+	printTop(w, result.Users, 15)
+}
+
+func TagReport(w io.Writer, result Result) {
+	printTop(w, result.Tags, 15)
+}
+
+/*
+	function to print the total of each tenant with its top talkers
+	underneath
+*/
+func TenantReport(w io.Writer, result Result) {
+	totals := make(map[string]int64, len(result.Tenants))
+	var tbytes int64
+	for name, hosts := range result.Tenants {
+		for _, v := range hosts {
+			totals[name] += v
+		}
+		tbytes += totals[name]
+	}
+	for i, t := range Rank(totals) {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if Rates != nil {
+			fmt.Fprintf(w, "%v %v %v cost %v\n", t.Key, HumanBytes(t.Bytes), Percent(t.Bytes, tbytes), FormatCost(Rates.Cost(t.Bytes)))
+		} else {
+			fmt.Fprintf(w, "%v %v %v\n", t.Key, HumanBytes(t.Bytes), Percent(t.Bytes, tbytes))
+		}
+		printTop(w, result.Tenants[t.Key], 17)
+	}
+}
+
+/*
+	function to compute the upload/download ratio of a host from the
+	bytes it sent and its total
+*/
+func Ratio(sent, total int64) float64 {
+	received := total - sent
+	if received <= 0 {
+		if sent > 0 {
+			return math.Inf(1)
+		}
+		return 0
+	}
+	return float64(sent) / float64(received)
+}
+
+/*
+	function to format the ratio column of the hosts report, marking the
+	hosts whose uploads dwarf their downloads
+*/
+func RatioColumn(sent, total int64) string {
+	ratio := Ratio(sent, total)
+	column := "up/down " + FormatNumber(ratio, 2)
+	if math.IsInf(ratio, 1) {
+		column = "up/down inf"
+	}
+	if RatioFlag > 0 && ratio >= RatioFlag {
+		column += " (outbound heavy)"
+	}
+	return column
+}
@@ -0,0 +1,234 @@
+/*
+	Description:
+		Rolls the state files of many runs up into weekly or monthly
+		totals, so that long-horizon reports can be made without going
+		back to the raw logs
+*/
+
+package qreader
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// the results of the runs that began in one week or month
+type RollupPeriod struct {
+	Unit   string
+	Start  time.Time
+	Runs   int
+	Result Result
+}
+
+/*
+	function to find the start of the week (starting monday) or month a
+	time falls in, in utc. Everything falls in the one period of the
+	"total" unit
+*/
+func periodOf(ts float64, unit string) time.Time {
+	if unit == "total" {
+		return time.Time{}
+	}
+	t := time.Unix(int64(ts), 0).UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if unit == "month" {
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+/*
+	function to name a period in the report, e.g. "week of 2021-03-01",
+	"month of 2021-03" or "total"
+*/
+func (self RollupPeriod) String() string {
+	if self.Unit == "total" {
+		return "total"
+	}
+	if self.Unit == "month" {
+		return "month of " + self.Start.Format("2006-01")
+	}
+	return "week of " + self.Start.Format("2006-01-02")
+}
+
+/*
+	function to load the given state files and merge them into the week
+	or month in which the data of each began, oldest period first. A run
+	whose data crosses into the next period is counted whole in the one
+	it began in
+*/
+func Rollup(filenames []string, unit string) ([]RollupPeriod, error) {
+	periods := make(map[time.Time]*RollupPeriod)
+	for _, filename := range filenames {
+		result, err := LoadState(filename)
+		if err != nil {
+			return nil, err
+		}
+		if result.First == 0 && unit != "total" {
+			return nil, fmt.Errorf("%v: state has no time range to roll up by", filename)
+		}
+		start := periodOf(result.First, unit)
+		period, ok := periods[start]
+		if !ok {
+			period = &RollupPeriod{Unit: unit, Start: start, Result: Result{Hosts: make(map[string]int64)}}
+			periods[start] = period
+		}
+		period.Result.Merge(result)
+		period.Runs++
+	}
+
+	rolled := make([]RollupPeriod, 0, len(periods))
+	for _, period := range periods {
+		rolled = append(rolled, *period)
+	}
+	sort.Slice(rolled, func(i, j int) bool { return rolled[i].Start.Before(rolled[j].Start) })
+	return rolled, nil
+}
+
+/*
+	function to run the rollup command with its own options, the
+	arguments following qreader rollup. Only the state of earlier runs is
+	merged, so none of the options for reading logs apply
+*/
+func RollupMain(args []string) {
+	flags := flag.NewFlagSet("qreader rollup", flag.ExitOnError)
+	var state_files fileList
+	flags.Var(&state_files, "f", "a <-save-state> file of a run, or a glob pattern, repeated for more files (which may also follow as arguments)")
+	var unit = flags.String("period", "week", "what the runs are totalled by: week, month, or total to merge them all into one")
+	var report = flags.String("report", "hosts", "comma separated report sections to print for each period")
+	var top = flags.Int("top", TopN, "number of rows in each section of the report, 0 for all")
+	var anonymize = flags.Bool("anonymize", false, "anonymize all ip addresses in the output (prefix-preserving)")
+	var anon_key = flags.String("anonymize-key", "", "file holding the 32 byte anonymization key (default: random per run)")
+	var debugging = flags.Bool("d", false, "enable debug messages")
+	flags.Parse(args)
+
+	LogInit(*debugging)
+	if len(state_files) == 0 {
+		Error.Fatalln("qreader rollup requires -f")
+	}
+	if *unit != "week" && *unit != "month" && *unit != "total" {
+		Error.Fatalf("Invalid roll-up period given: %v", *unit)
+	}
+	if *top < 0 {
+		Error.Fatalf("Invalid number of rows given: %v", *top)
+	}
+	TopN = *top
+	sections, err := ParseSections(*report)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	filenames, err := ExpandInputs(append([]string(state_files), flags.Args()...))
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	var anon *Anonymizer
+	if *anonymize {
+		if anon, err = LoadAnonymizer(*anon_key); err != nil {
+			Error.Fatalln(err)
+		}
+	}
+
+	periods, err := Rollup(filenames, *unit)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	for _, period := range periods {
+		result := period.Result
+		if anon != nil {
+			result = anon.Result(result)
+		}
+		fmt.Printf("\n%v (%d runs):\n", period, period.Runs)
+		PrintSections(os.Stdout, sections, result)
+	}
+}
+
+func mergeTotals(dst *map[string]int64, src map[string]int64) {
+	if src == nil {
+		return
+	}
+	if *dst == nil {
+		*dst = make(map[string]int64, len(src))
+	}
+	for key, bytecount := range src {
+		(*dst)[key] += bytecount
+	}
+}
+
+/*
+	function to add the totals of another result to this one
+*/
+func (self *Result) Merge(other Result) {
+	for _, pair := range []struct {
+		dst *map[string]int64
+		src map[string]int64
+	}{
+		{&self.Hosts, other.Hosts}, {&self.Conns, other.Conns}, {&self.Remotes, other.Remotes},
+		{&self.Convs, other.Convs}, {&self.Sent, other.Sent}, {&self.Excluded, other.Excluded},
+		{&self.Countries, other.Countries}, {&self.Segments, other.Segments},
+		{&self.MACs, other.MACs}, {&self.Users, other.Users}, {&self.Directions, other.Directions},
+		{&self.Destinations, other.Destinations}, {&self.Tags, other.Tags},
+	} {
+		mergeTotals(pair.dst, pair.src)
+	}
+
+	if other.Ports != nil && self.Ports == nil {
+		self.Ports = make(map[string]map[int]int64)
+	}
+	for host, ports := range other.Ports {
+		if self.Ports[host] == nil {
+			self.Ports[host] = make(map[int]int64)
+		}
+		for port, bytecount := range ports {
+			self.Ports[host][port] += bytecount
+		}
+	}
+	if other.Buckets != nil && self.Buckets == nil {
+		self.Buckets = make(map[int64]int64)
+	}
+	for start, bytecount := range other.Buckets {
+		self.Buckets[start] += bytecount
+	}
+	if other.SubnetBuckets != nil && self.SubnetBuckets == nil {
+		self.SubnetBuckets = make(map[string]map[int64]int64)
+	}
+	for subnet, buckets := range other.SubnetBuckets {
+		if self.SubnetBuckets[subnet] == nil {
+			self.SubnetBuckets[subnet] = make(map[int64]int64)
+		}
+		for start, bytecount := range buckets {
+			self.SubnetBuckets[subnet][start] += bytecount
+		}
+	}
+	if other.Services != nil && self.Services == nil {
+		self.Services = make(map[int]int64)
+	}
+	for port, bytecount := range other.Services {
+		self.Services[port] += bytecount
+	}
+	if other.Tenants != nil && self.Tenants == nil {
+		self.Tenants = make(map[string]map[string]int64)
+	}
+	for name, hosts := range other.Tenants {
+		tenant := self.Tenants[name]
+		mergeTotals(&tenant, hosts)
+		self.Tenants[name] = tenant
+	}
+
+	// the names of the result merged last, usually the later one, win
+	if other.RemoteNames != nil && self.RemoteNames == nil {
+		self.RemoteNames = make(map[string]string)
+	}
+	for ip, name := range other.RemoteNames {
+		self.RemoteNames[ip] = name
+	}
+
+	if self.First == 0 || (other.First != 0 && other.First < self.First) {
+		self.First = other.First
+	}
+	if other.Last > self.Last {
+		self.Last = other.Last
+	}
+}
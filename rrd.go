@@ -0,0 +1,158 @@
+/*
+	Description:
+		Updates a round robin database per local subnet with its byte
+		rate in each time bucket, for graphing tools built on rrdtool or
+		graphite's whisper files
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// which commands to use for maintaining rrd and whisper files
+var RRDTool string = "rrdtool"
+var WhisperCreate string = "whisper-create.py"
+var WhisperUpdate string = "whisper-update.py"
+
+// number of buckets kept by newly created databases
+var RRDRows int = 8640
+
+func runTool(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v failed: %v: %v", name, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+/*
+	function to name the database file of a subnet, since the slash of
+	the cidr notation can't be part of a file name
+*/
+func rrdFile(dir string, subnet string, format string) string {
+	return filepath.Join(dir, strings.Replace(subnet, "/", "_", -1)+"."+format)
+}
+
+/*
+	function to update an rrd file with the given bucket rates, creating
+	it first if needed. rrdtool refuses updates at or before the last one
+	it has stored, so buckets that were already written by an earlier run
+	are left out
+*/
+func updateRRD(filename string, starts []int64, rates []float64, size int64) error {
+	var last int64
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		last = starts[0] - 1
+		_, err := runTool(RRDTool, "create", filename,
+			"--start", strconv.FormatInt(last, 10),
+			"--step", strconv.FormatInt(size, 10),
+			fmt.Sprintf("DS:bytes:GAUGE:%d:0:U", 2*size),
+			fmt.Sprintf("RRA:AVERAGE:0.5:1:%d", RRDRows))
+		if err != nil {
+			return err
+		}
+	} else {
+		out, err := runTool(RRDTool, "last", filename)
+		if err != nil {
+			return err
+		}
+		if last, err = strconv.ParseInt(out, 10, 64); err != nil {
+			return fmt.Errorf("unexpected output from %v last: %q", RRDTool, out)
+		}
+	}
+
+	// rates are stored at the end of their bucket
+	args := []string{"update", filename}
+	for i, start := range starts {
+		if start+size > last {
+			args = append(args, fmt.Sprintf("%d:%.3f", start+size, rates[i]))
+		}
+	}
+	if len(args) == 2 {
+		return nil
+	}
+	_, err := runTool(RRDTool, args...)
+	return err
+}
+
+/*
+	function to update a whisper file with the given bucket rates,
+	creating it first if needed. Whisper overwrites points that already
+	exist, so buckets are simply written again
+*/
+func updateWhisper(filename string, starts []int64, rates []float64, size int64) error {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if _, err := runTool(WhisperCreate, filename, fmt.Sprintf("%d:%d", size, RRDRows)); err != nil {
+			return err
+		}
+	}
+
+	args := []string{filename}
+	for i, start := range starts {
+		args = append(args, fmt.Sprintf("%d:%.3f", start, rates[i]))
+	}
+	_, err := runTool(WhisperUpdate, args...)
+	return err
+}
+
+/*
+	function to write the byte rate of every subnet in each time bucket
+	to one database file per subnet in the given directory, where the
+	format is either rrd or wsp
+*/
+func UpdateRRD(dir string, format string, result Result) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	size := int64(BucketSize / time.Second)
+
+	for subnet, buckets := range result.SubnetBuckets {
+		starts := make([]int64, 0, len(buckets))
+		for start := range buckets {
+			starts = append(starts, start)
+		}
+		sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+		rates := make([]float64, len(starts))
+		for i, start := range starts {
+			rates[i] = float64(buckets[start]) / float64(size)
+		}
+
+		filename := rrdFile(dir, subnet, format)
+		var err error
+		if format == "wsp" {
+			err = updateWhisper(filename, starts, rates, size)
+		} else {
+			err = updateRRD(filename, starts, rates, size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	function to update the databases with the byte rate of each subnet
+	in one window of a replay, stamped with the start of the window
+*/
+func UpdateRRDWindow(dir string, format string, start int64, window Result) error {
+	buckets := make(map[string]map[int64]int64, len(window.SubnetBuckets))
+	for subnet, counts := range window.SubnetBuckets {
+		var bytecount int64
+		for _, count := range counts {
+			bytecount += count
+		}
+		buckets[subnet] = map[int64]int64{start: bytecount}
+	}
+	return UpdateRRD(dir, format, Result{SubnetBuckets: buckets})
+}
@@ -0,0 +1,123 @@
+/*
+	Description:
+		Consistent sampling of connections by a hash of their uid, so the
+		same connections are kept on every run and in every log type
+		that carries the uid. The same sampling picks the raw records
+		kept in the sample directory for later drill-down
+*/
+
+package qreader
+
+import (
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a sampling rate of N out of every D connections
+type Sample struct {
+	N uint64
+	D uint64
+}
+
+/*
+	function to parse a sampling rate such as "1/16"
+*/
+func ParseSample(s string) (Sample, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	if len(parts) != 2 {
+		return Sample{}, fmt.Errorf("invalid sampling rate %q, expected N/D", s)
+	}
+	n, err1 := strconv.ParseUint(parts[0], 10, 64)
+	d, err2 := strconv.ParseUint(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || n == 0 || d == 0 || n > d {
+		return Sample{}, fmt.Errorf("invalid sampling rate %q, expected N/D with 0 < N <= D", s)
+	}
+	return Sample{n, d}, nil
+}
+
+/*
+	function to decide whether a connection with the given key is in the
+	sample. The decision only depends on the key, using the 64 bit fnv-1a
+	hash since it is stable across platforms and versions
+*/
+func (self Sample) Keep(key string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()%self.D < self.N
+}
+
+/*
+	function to decide whether a connection is in the sample, by its uid
+	or, for logs without one, by its time and endpoints
+*/
+func (self Sample) KeepConn(c Conn) bool {
+	if c.UID != "" {
+		return self.Keep(c.UID)
+	}
+	return self.Keep(fmt.Sprintf("%f %v:%d %v:%d", c.Ts, c.Orig, c.OrigPort, c.Resp, c.Port))
+}
+
+// a gzipped csv file in the sample directory, only put in place once
+// it has been completely written
+type sampleFile struct {
+	*gzip.Writer
+	file *OutputFile
+}
+
+func (self sampleFile) Close() error {
+	if err := self.Writer.Close(); err != nil {
+		self.file.Abort()
+		return err
+	}
+	return self.file.Commit()
+}
+
+/*
+	function to start writing the sampled records of this run to a new
+	gzipped csv file in the given directory, named by the time of the run
+*/
+func NewSampleWriter(dir string, sample Sample, anon *Anonymizer) (*RecordWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + ".csv.gz"
+	file, err := CreateOutput(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &RecordWriter{
+		inq:  make(chan []Conn, 100),
+		done: make(chan error, 1),
+		file: sampleFile{gzip.NewWriter(file), file},
+		anon: anon,
+		keep: sample.KeepConn,
+	}, nil
+}
+
+/*
+	function to remove the sample files last written longer than retain
+	ago from the sample directory
+*/
+func PruneSamples(dir string, retain time.Duration) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retain)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".csv.gz") || !entry.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+/*
+	Description:
+		Scanning of line boundaries in the read blocks. The scan is built
+		on bytes.IndexByte, which the go runtime implements with vector
+		instructions, and it slices the block in place instead of copying
+		every line into a new string. Fields are scanned the same way by
+		parse.Fields
+*/
+
+package qreader
+
+import (
+	"bytes"
+)
+
+/*
+	function to cut the next line off the front of a block, returning the
+	line without its newline and the rest of the block
+*/
+func NextLine(block []byte) ([]byte, []byte) {
+	if i := bytes.IndexByte(block, '\n'); i >= 0 {
+		return block[:i], block[i+1:]
+	}
+	return block, nil
+}
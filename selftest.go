@@ -0,0 +1,240 @@
+/*
+	Description:
+		A self-test of a deployment, run as
+			qreader selftest
+		It sums a log generated in memory through the whole pipeline and
+		checks the totals against those known from generating it, then
+		checks what the runs depend on outside of qreader: the
+		decompressor, zstd and the directories written to
+*/
+
+package qreader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+// the network the hosts of the generated log are local to
+var selfTestNetwork = netip.MustParsePrefix("10.0.0.0/8")
+
+// the outcome of one check of the self-test. An optional check failing
+// only disables a feature, see Check.Status
+type Check struct {
+	Name     string
+	Detail   string
+	Err      error
+	Optional bool
+}
+
+func (self Check) Status() string {
+	switch {
+	case self.Err == nil:
+		return "ok"
+	case self.Optional:
+		return "warn"
+	}
+	return "FAIL"
+}
+
+/*
+	function to generate a zeek conn log of n connections between local
+	and external hosts, returning it with the totals each local host must
+	be summed to
+*/
+func syntheticLog(n int) ([]byte, map[string]int64) {
+	rng := rand.New(rand.NewSource(1))
+	var data bytes.Buffer
+	data.WriteString("#separator \\x09\n")
+	data.WriteString("#fields\tts\tuid\tid.orig_h\tid.orig_p\tid.resp_h\tid.resp_p\tproto\tservice\tduration\torig_bytes\tresp_bytes\tconn_state\tlocal_orig\tmissed_bytes\thistory\torig_pkts\torig_ip_bytes\tresp_pkts\tresp_ip_bytes\n")
+
+	hosts := make(map[string]int64)
+	for i := 0; i < n; i++ {
+		local := fmt.Sprintf("10.0.%d.%d", rng.Intn(4), 1+rng.Intn(50))
+		remote := fmt.Sprintf("192.0.2.%d", 1+rng.Intn(254))
+		orig, resp := local, remote
+		if rng.Intn(2) == 0 {
+			orig, resp = remote, local
+		}
+		sent, received := rng.Int63n(1<<20), rng.Int63n(1<<20)
+		fmt.Fprintf(&data, "%d.%06d\tC%d\t%v\t%d\t%v\t443\ttcp\tssl\t1.5\t%d\t%d\tSF\t-\t0\tShADadFf\t10\t%d\t10\t%d\n",
+			1700000000+i, rng.Intn(1000000), i, orig, 1024+rng.Intn(60000), resp, sent, received, sent, received)
+		hosts[local] += sent + received
+	}
+	return data.Bytes(), hosts
+}
+
+/*
+	function to sum a generated log through the pipeline and compare the
+	result with the known totals
+*/
+func checkPipeline(data []byte, expected map[string]int64, compression Compression) error {
+	settings := Defaults()
+	settings.Schema = parse.TSV
+	settings.Local = selfTestNetwork
+	result, err := FromReader("selftest", bytes.NewReader(data), compression, WithSettings(settings), WithBlockSize(64*1024)).Run(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(result.Hosts) != len(expected) {
+		return fmt.Errorf("summed %d hosts, expected %d", len(result.Hosts), len(expected))
+	}
+	for host, total := range expected {
+		if result.Hosts[host] != total {
+			return fmt.Errorf("summed %v to %d bytes, expected %d", host, result.Hosts[host], total)
+		}
+	}
+	return nil
+}
+
+/*
+	function to check that a file can be created in a directory
+*/
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".qreader-selftest-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+/*
+	function to run the checks of the self-test over a log of the given
+	number of generated connections
+*/
+func SelfTest(n int) []Check {
+	var checks []Check
+	data, expected := syntheticLog(n)
+
+	cpus := fmt.Sprintf("%v/%v, %d of %d cpus usable", runtime.GOOS, runtime.GOARCH, UsableCPUs(0), runtime.NumCPU())
+	checks = append(checks, Check{Name: "pipeline", Detail: cpus, Err: checkPipeline(data, expected, NoCompression)})
+
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(data)
+	zw.Close()
+	checks = append(checks, Check{Name: "gzip", Detail: "internal", Err: checkPipeline(zipped.Bytes(), expected, GzipCompression)})
+
+	unzip := Check{Name: "decompressor", Detail: Unzipper}
+	if Unzipper != InternalUnzipper {
+		if _, err := exec.LookPath(Unzipper); err != nil {
+			unzip.Err = fmt.Errorf("%v, install it or run with -unzip-bench", err)
+		} else if r, err := openUnzipper(Unzipper, bytes.NewReader(zipped.Bytes())); err != nil {
+			unzip.Err = err
+		} else {
+			got, err := io.ReadAll(r)
+			if closed := r.Close(); err == nil {
+				err = closed
+			}
+			if err == nil && !bytes.Equal(got, data) {
+				err = fmt.Errorf("decompressed the log wrong")
+			}
+			unzip.Err = err
+		}
+	}
+	checks = append(checks, unzip)
+
+	zstd := Check{Name: "zstd", Detail: Zstd, Optional: true}
+	switch {
+	case !CompressOutputs:
+		zstd.Detail = "not used, see -no-compress"
+	case !ZstdInstalled():
+		zstd.Err = fmt.Errorf("not installed, state files, dumps and error logs are written uncompressed")
+	default:
+		zstd.Err = checkZstd(data)
+	}
+	checks = append(checks, zstd)
+
+	checks = append(checks, Check{Name: "temporary directory", Detail: os.TempDir(), Err: checkWritable(os.TempDir())})
+	if ThroughputLog != "" {
+		dir := filepath.Dir(ThroughputLog)
+		checks = append(checks, Check{Name: "throughput log", Detail: dir, Err: checkWritable(dir), Optional: true})
+	}
+	return checks
+}
+
+/*
+	function to compress data the way outputs are and read it back
+*/
+func checkZstd(data []byte) error {
+	file, err := os.CreateTemp("", "qreader-selftest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	zw, err := compressOutput(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	r, err := openOutput(file.Name())
+	if err != nil {
+		return err
+	}
+	got, err := io.ReadAll(r)
+	if closed := r.Close(); err == nil {
+		err = closed
+	}
+	if err == nil && !bytes.Equal(got, data) {
+		err = fmt.Errorf("decompressed the data wrong")
+	}
+	return err
+}
+
+/*
+	function to run the selftest command with its own options, the
+	arguments following qreader selftest. It exits with a status of 1
+	when a check that isn't optional failed
+*/
+func SelfTestMain(args []string) {
+	flags := flag.NewFlagSet("qreader selftest", flag.ExitOnError)
+	var n = flags.Int("n", 100000, "number of connections in the generated log")
+	var debugging = flags.Bool("d", false, "enable debug messages")
+	flags.Parse(args)
+
+	LogInit(*debugging)
+	if *n <= 0 {
+		Error.Fatalf("Invalid number of connections given: %d", *n)
+	}
+
+	failed := false
+	for _, check := range SelfTest(*n) {
+		line := fmt.Sprintf("%-4v %v", check.Status(), check.Name)
+		if check.Detail != "" {
+			line += " (" + check.Detail + ")"
+		}
+		if check.Err != nil {
+			line += ": " + check.Err.Error()
+		}
+		fmt.Println(line)
+		failed = failed || (check.Err != nil && !check.Optional)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
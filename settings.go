@@ -0,0 +1,156 @@
+/*
+	Description:
+		The settings a pipeline reads and sums its inputs with. The
+		command line sets them through the package level variables, and a
+		run takes a copy of those unless it was given its own with
+		WithSettings, so that a server can go through several requests at
+		once, each with settings of its own
+*/
+
+package qreader
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+type Settings struct {
+	// how the inputs are read, see Unzipper and ReadRate
+	Unzipper string
+	ReadRate int64
+
+	// what is done with inputs still being written, see InProgress
+	InProgress string
+	SettleTime time.Duration
+
+	// how the lines are parsed and which records are kept
+	Schema parse.Schema
+	Need   parse.Need
+	Filter func(Conn) bool
+
+	// the fields Filter looks at, see FilterNeed
+	FilterNeed parse.Need
+
+	// the most lines and bytes of data a run reads, see MaxLines
+	MaxLines      int64
+	MaxInputBytes int64
+
+	// the longest line an input may have, see MaxLineLength
+	MaxLineLength int
+
+	// how many records each reducer sums at a time
+	BatchSize int
+
+	// which addresses are local, and how they are grouped into subnets
+	Local       netip.Prefix
+	SubnetBits4 int
+	SubnetBits6 int
+
+	// what is summed besides the host totals, see the Track variables
+	BucketSize         time.Duration
+	TrackDetail        bool
+	TrackRemote        bool
+	TrackSubnetBuckets bool
+	TrackPorts         bool
+	TrackConvs         bool
+	TrackSent          bool
+	TrackSegments      bool
+	TrackMACs          bool
+	TrackUsers         bool
+	TrackDirections    bool
+	TrackExcluded      bool
+	TrackDestinations  bool
+	TrackTags          bool
+
+	// the key each host is totalled under, see KeyNormalizer
+	Normalize KeyNormalizer
+
+	Excludes  Exclusions
+	Users     *UserMap
+	DNS       *DNSMap
+	HostNames *HostNameMap
+	Partition *Partition
+	Enrichers []Enricher
+
+	// where the dropped lines are kept, or nil to drop them
+	DeadLetters *RejectLog
+
+	// where the lines are counted, and where the rejected ones are
+	// recorded when the pipeline isn't given a warnings channel. They
+	// belong to a run, so the Defaults leave them nil
+	Lines   *LineCounts
+	Rejects *RejectLog
+
+	// how the hosts report is presented, see Labels, Bars and Previous
+	Labels   *Mapping
+	Bars     bool
+	Previous *Result
+}
+
+/*
+	function to collect the settings from the package level variables
+*/
+func Defaults() Settings {
+	return Settings{
+		Unzipper:           Unzipper,
+		ReadRate:           ReadRate,
+		InProgress:         InProgress,
+		SettleTime:         SettleTime,
+		Schema:             InputSchema,
+		Need:               ParseNeed,
+		Filter:             RecordFilter,
+		FilterNeed:         FilterNeed,
+		MaxLines:           MaxLines,
+		MaxInputBytes:      MaxInputBytes,
+		MaxLineLength:      MaxLineLength,
+		BatchSize:          BatchSize,
+		Local:              LocalNetwork,
+		SubnetBits4:        SubnetBits4,
+		SubnetBits6:        SubnetBits6,
+		BucketSize:         BucketSize,
+		TrackDetail:        TrackDetail,
+		TrackRemote:        TrackRemote,
+		TrackSubnetBuckets: TrackSubnetBuckets,
+		TrackPorts:         TrackPorts,
+		TrackConvs:         TrackConvs,
+		TrackSent:          TrackSent,
+		TrackSegments:      TrackSegments,
+		TrackMACs:          TrackMACs,
+		TrackUsers:         TrackUsers,
+		TrackDirections:    TrackDirections,
+		TrackExcluded:      TrackExcluded,
+		TrackDestinations:  TrackDestinations,
+		TrackTags:          TrackTags,
+		Normalize:          NormalizeKeys,
+		Excludes:           Excludes,
+		Users:              Users,
+		DNS:                DNSNames,
+		HostNames:          HostNames,
+		Partition:          KeyPartition,
+		Enrichers:          Enrichers,
+		Labels:             Labels,
+		Bars:               Bars,
+		Previous:           Previous,
+	}
+}
+
+func (self *Settings) IsLocal(ip netip.Addr) bool {
+	return self.Local.Contains(ip)
+}
+
+func (self *Settings) SubnetOf(ip netip.Addr) netip.Prefix {
+	if ip.Is4() {
+		return netip.PrefixFrom(ip, self.SubnetBits4).Masked()
+	}
+	return netip.PrefixFrom(ip, self.SubnetBits6).Masked()
+}
+
+/*
+	function to find the start of the time bucket a timestamp falls in
+*/
+func (self *Settings) BucketOf(ts float64) int64 {
+	size := int64(self.BucketSize / time.Second)
+	return int64(ts) / size * size
+}
@@ -0,0 +1,76 @@
+/*
+	Description:
+		Inputs that aren't files, such as in-memory buffers or network
+		streams, so that programs embedding the pipeline can feed it
+		without going through the filesystem
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+)
+
+// how the data of a stream is compressed
+type Compression int
+
+const (
+	// gzip streams are told apart by their first bytes
+	DetectCompression Compression = iota
+	NoCompression
+	GzipCompression
+)
+
+// a stream input of a pipeline, read once and never closed by it
+type streamSource struct {
+	name        string
+	r           io.Reader
+	compression Compression
+}
+
+/*
+	function to open a stream for reading, decompressing it if needed
+*/
+func (self streamSource) Open() (io.ReadCloser, error) {
+	r := self.r
+	compression := self.compression
+	if compression == DetectCompression {
+		br := bufio.NewReader(r)
+		magic, _ := br.Peek(2)
+		compression = NoCompression
+		if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			compression = GzipCompression
+		}
+		r = br
+	}
+	if compression != GzipCompression {
+		return ioutil.NopCloser(r), nil
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return gzipReader{zr, ioutil.NopCloser(nil)}, nil
+}
+
+/*
+	function to add an input read from r rather than from a file, named
+	name in warnings and rejected lines. Streams are read after the files
+	and in the order they were added, since their time range can't be
+	probed without consuming them
+*/
+func (self *Pipeline) SourceReader(name string, r io.Reader, compression Compression) *Pipeline {
+	self.streams = append(self.streams, streamSource{name, r, compression})
+	return self
+}
+
+/*
+	function to create a pipeline over a single stream, for callers that
+	hold the data in memory or receive it over the network
+*/
+func FromReader(name string, r io.Reader, compression Compression, opts ...Option) *Pipeline {
+	return New(opts...).SourceReader(name, r, compression)
+}
@@ -0,0 +1,168 @@
+/*
+	Description:
+		Determines the time range covered by each input file so that
+		rotated logs can be processed in order and overlapping inputs
+		can be detected before they inflate the totals
+*/
+
+package qreader
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+// how many bytes from the head of a file are inspected when probing
+var ProbeSize int = 64 * 1024
+
+// layout of the timestamps in the zeek #open and #close headers
+const zeekHeaderTime = "2006-01-02-15-04-05"
+
+//--------------------------------------------------------------------------------
+//	FileSpan describes an input file and the range of time its data covers,
+//	stored as unix epoch seconds (0 when unknown)
+//--------------------------------------------------------------------------------
+
+type FileSpan struct {
+	Filename string
+	Start    float64
+	End      float64
+}
+
+/*
+	function to parse the value of a zeek #open / #close header line
+*/
+func headerTime(line []byte) (float64, bool) {
+	fields := bytes.SplitN(line, []byte("\t"), 2)
+	if len(fields) != 2 {
+		return 0, false
+	}
+	t, err := time.ParseInLocation(zeekHeaderTime, string(bytes.TrimSpace(fields[1])), time.Local)
+	if err != nil {
+		return 0, false
+	}
+	return float64(t.UnixNano()) / 1e9, true
+}
+
+/*
+	function to parse the ts of a data line
+*/
+func recordTime(line []byte, schema parse.Schema) (float64, bool) {
+	c, err := schema.LineWith(line, parse.NeedTs)
+	if err != nil {
+		return 0, false
+	}
+	return c.Ts, true
+}
+
+/*
+	function to find the start time of the data in a block read from the
+	head of a file. The #open header is preferred since zeek writes conn
+	records when connections end, which means the ts column is not
+	monotonic; the first record is used when no header is present
+*/
+func SpanStart(block []byte, schema parse.Schema) float64 {
+	var first float64
+	for _, line := range bytes.Split(block, []byte("\n")) {
+		if schema.Syslog() {
+			line, _ = parse.Unframe(line)
+		}
+		if bytes.HasPrefix(line, []byte("#open")) {
+			if ts, ok := headerTime(line); ok {
+				return ts
+			}
+		}
+		if first == 0 {
+			if ts, ok := recordTime(line, schema); ok {
+				first = ts
+			}
+		}
+	}
+	return first
+}
+
+/*
+	function to find the end time of the data from the final block of a
+	file, using the #close header if present or the last record otherwise
+*/
+func SpanEnd(block []byte, schema parse.Schema) float64 {
+	lines := bytes.Split(block, []byte("\n"))
+	if schema.Syslog() {
+		for i := range lines {
+			lines[i], _ = parse.Unframe(lines[i])
+		}
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		if bytes.HasPrefix(lines[i], []byte("#close")) {
+			if ts, ok := headerTime(lines[i]); ok {
+				return ts
+			}
+		}
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		if ts, ok := recordTime(lines[i], schema); ok {
+			return ts
+		}
+	}
+	return 0
+}
+
+/*
+	function to read the first ProbeSize bytes of an input. Those of the
+	standard input are peeked at, so that they are still read with the
+	rest of it
+*/
+func (self Reader) readHead(filename string) ([]byte, error) {
+	if filename == StdinName {
+		head, err := stdin.Peek(ProbeSize)
+		if err == io.EOF {
+			err = nil
+		}
+		return head, err
+	}
+	reader, err := self.OpenFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	block := make([]byte, ProbeSize)
+	length, err := io.ReadFull(reader, block)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return block[:length], err
+}
+
+/*
+	function to read the head of each input and sort the inputs by the
+	start of their data. Files whose start cannot be determined are kept
+	in their given order after all the others
+*/
+func (self Reader) OrderInputs(filenames []string) ([]FileSpan, error) {
+	spans := make([]FileSpan, 0, len(filenames))
+	for _, filename := range filenames {
+		head, err := self.readHead(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		span := FileSpan{Filename: filename, Start: SpanStart(head, self.config().Schema)}
+		if span.Start == 0 {
+			Warning.Printf("could not determine the start time of %v", filename)
+		}
+		Debug.Printf("\t%v starts at %.6f", filename, span.Start)
+		spans = append(spans, span)
+	}
+
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].Start == 0 || spans[j].Start == 0 {
+			return spans[j].Start == 0 && spans[i].Start != 0
+		}
+		return spans[i].Start < spans[j].Start
+	})
+	return spans, nil
+}
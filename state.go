@@ -0,0 +1,91 @@
+/*
+	Description:
+		Saving and loading of the aggregation state, so that a later run
+		can compare its results against a previous period
+*/
+
+package qreader
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// the results of the previous period when comparing, nil otherwise
+var Previous *Result
+
+// layout of a state file, the result with the metadata of the run that
+// produced it alongside
+type stateFile struct {
+	Metadata *RunMetadata `json:"metadata,omitempty"`
+	Result
+}
+
+/*
+	function to write a result to a state file
+*/
+func SaveState(filename string, result Result) error {
+	if err := CheckOutputs(filename); err != nil {
+		return err
+	}
+	return writeState(filename, result)
+}
+
+func writeState(filename string, result Result) error {
+	file, err := replaceOutput(filename)
+	if err != nil {
+		return err
+	}
+	w, err := compressOutput(file)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	err = json.NewEncoder(w).Encode(stateFile{Run, result})
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
+
+/*
+	function to read a result back from a state file
+*/
+func LoadState(filename string) (Result, error) {
+	var result Result
+	file, err := openOutput(filename)
+	if err != nil {
+		return result, err
+	}
+	err = json.NewDecoder(file).Decode(&result)
+	if cerr := file.Close(); err == nil && cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		return result, fmt.Errorf("invalid state file %v: %v", filename, err)
+	}
+	if result.Hosts == nil {
+		result.Hosts = make(map[string]int64)
+	}
+	return result, nil
+}
+
+/*
+	function to describe how a talker's traffic changed since the previous
+	period, or mark it as new if it wasn't seen then
+*/
+func Compare(previous *Result, key string, bytes int64) string {
+	before, ok := previous.Hosts[key]
+	if !ok {
+		return fmt.Sprintf("%12v %9v", "new", "")
+	}
+	delta := HumanDelta(bytes - before)
+	if before == 0 {
+		return fmt.Sprintf("%12v %9v", delta, "")
+	}
+	return fmt.Sprintf("%12v %+8.1f%%", delta, float64(bytes-before)/float64(before)*100)
+}
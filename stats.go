@@ -0,0 +1,203 @@
+/*
+	Description:
+		Statistics of numeric columns of the records, such as the
+		duration, bytes and packets of the connections: their range,
+		mean and a histogram in powers of two, for a quick profile of the
+		traffic beyond who the top talkers are
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/kings-gambit/qreader/parse"
+)
+
+// a numeric column statistics can be gathered on
+type statsColumn struct {
+	need   parse.Need
+	value  func(Conn) float64
+	format func(float64) string
+}
+
+func formatSeconds(v float64) string { return FormatNumber(v, 3) + "s" }
+func formatBytes(v float64) string   { return HumanBytes(int64(v)) }
+func formatCount(v float64) string   { return FormatCount(int64(v)) }
+
+var statsColumns = map[string]statsColumn{
+	"duration":   {parse.NeedDuration, func(c Conn) float64 { return c.Duration }, formatSeconds},
+	"bytes":      {parse.NeedBytes, func(c Conn) float64 { return float64(c.Bytes) }, formatBytes},
+	"orig_bytes": {parse.NeedDirBytes, func(c Conn) float64 { return float64(c.OrigBytes) }, formatBytes},
+	"resp_bytes": {parse.NeedDirBytes, func(c Conn) float64 { return float64(c.RespBytes) }, formatBytes},
+	"pkts":       {parse.NeedPackets, func(c Conn) float64 { return float64(c.OrigPkts + c.RespPkts) }, formatCount},
+	"orig_pkts":  {parse.NeedPackets, func(c Conn) float64 { return float64(c.OrigPkts) }, formatCount},
+	"resp_pkts":  {parse.NeedPackets, func(c Conn) float64 { return float64(c.RespPkts) }, formatCount},
+}
+
+/*
+	function to list the names of the columns statistics can be gathered
+	on, for the help text
+*/
+func StatsColumnNames() []string {
+	var names []string
+	for name := range statsColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the statistics of one column
+type ColumnStats struct {
+	Name  string
+	Count int64
+	Min   float64
+	Max   float64
+	Sum   float64
+
+	// counts of the values by the power of two they are below, see bin,
+	// and of the zeros which have none
+	Zeros int64
+	Bins  map[int]int64
+}
+
+/*
+	function to find the histogram bin of a positive value, the exponent
+	e for which 2^(e-1) <= v < 2^e
+*/
+func bin(v float64) int {
+	_, exp := math.Frexp(v)
+	return exp
+}
+
+func (self *ColumnStats) Add(v float64) {
+	if self.Count == 0 || v < self.Min {
+		self.Min = v
+	}
+	if self.Count == 0 || v > self.Max {
+		self.Max = v
+	}
+	self.Count++
+	self.Sum += v
+	if v <= 0 {
+		self.Zeros++
+		return
+	}
+	self.Bins[bin(v)]++
+}
+
+func (self *ColumnStats) Mean() float64 {
+	if self.Count == 0 {
+		return 0
+	}
+	return self.Sum / float64(self.Count)
+}
+
+//--------------------------------------------------------------------------------
+//	ColumnProfile gathers the statistics from the records passing a tap
+//	of the pipeline
+//--------------------------------------------------------------------------------
+
+type ColumnProfile struct {
+	inq     chan []Conn
+	done    chan struct{}
+	columns []statsColumn
+	Stats   []*ColumnStats
+}
+
+/*
+	function to make a profile of the named columns, returning the record
+	fields they need parsed
+*/
+func NewColumnProfile(names []string) (*ColumnProfile, parse.Need, error) {
+	profile := &ColumnProfile{inq: make(chan []Conn, 100), done: make(chan struct{})}
+	var need parse.Need
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		column, ok := statsColumns[name]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown column %q, expected one of %v", name, strings.Join(StatsColumnNames(), ", "))
+		}
+		profile.columns = append(profile.columns, column)
+		profile.Stats = append(profile.Stats, &ColumnStats{Name: name, Bins: make(map[int]int64)})
+		need |= column.need
+	}
+	return profile, need, nil
+}
+
+func (self *ColumnProfile) Start() {
+	for data_slice := range self.inq {
+		for _, c := range data_slice {
+			for i, column := range self.columns {
+				self.Stats[i].Add(column.value(c))
+			}
+		}
+	}
+	close(self.done)
+}
+
+/*
+	function to wait for the tap to be drained once the pipeline is done
+*/
+func (self *ColumnProfile) Close() {
+	close(self.inq)
+	<-self.done
+}
+
+/*
+	function to print the statistics of each column, with a histogram of
+	the bins from the smallest to the largest value
+*/
+func (self *ColumnProfile) Report(w io.Writer) {
+	for i, stats := range self.Stats {
+		format := self.columns[i].format
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, Heading(stats.Name))
+		if stats.Count == 0 {
+			fmt.Fprintln(w, "no records")
+			continue
+		}
+		fmt.Fprintf(w, "count %v, min %v, max %v, mean %v\n", FormatCount(stats.Count),
+			format(stats.Min), format(stats.Max), format(stats.Mean()))
+
+		type row struct {
+			label string
+			count int64
+		}
+		var rows []row
+		if stats.Zeros > 0 {
+			rows = append(rows, row{"0", stats.Zeros})
+		}
+		if len(stats.Bins) > 0 {
+			lo, hi := math.MaxInt, math.MinInt
+			for exp := range stats.Bins {
+				lo, hi = min(lo, exp), max(hi, exp)
+			}
+			for exp := lo; exp <= hi; exp++ {
+				label := fmt.Sprintf("%v - %v", format(math.Ldexp(1, exp-1)), format(math.Ldexp(1, exp)))
+				rows = append(rows, row{label, stats.Bins[exp]})
+			}
+		}
+
+		width := 0
+		for _, r := range rows {
+			width = max(width, len(r.label))
+		}
+		for _, r := range rows {
+			line := fmt.Sprintf("%*v %12v %v", width, r.label, FormatCount(r.count), Percent(r.count, stats.Count))
+			if Bars {
+				if bar := ShareBar(r.count, stats.Count); bar != "" {
+					line += " " + bar
+				}
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
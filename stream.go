@@ -0,0 +1,118 @@
+/*
+	Description:
+		Pushes the result of each window to the clients of the report
+		server as server-sent events while replaying, so a wallboard
+		can follow the traffic live instead of polling results.json
+*/
+
+package qreader
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how often an idle stream is sent a comment, so that proxies between
+// the server and the clients don't time it out
+var StreamHeartbeat = 30 * time.Second
+
+// how many events a client may fall behind before it is disconnected,
+// to come back through the reconnect of its EventSource
+const streamBacklog = 16
+
+// the event sent for each window that closes
+type WindowEvent struct {
+	Start  int64  `json:"start"`
+	Result Result `json:"result"`
+}
+
+type Stream struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+func NewStream() *Stream {
+	return &Stream{clients: make(map[chan []byte]struct{})}
+}
+
+/*
+	function to send an event to every connected client, disconnecting
+	the ones that have fallen too far behind
+*/
+func (self *Stream) Publish(event WindowEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for client := range self.clients {
+		select {
+		case client <- data:
+		default:
+			delete(self.clients, client)
+			close(client)
+		}
+	}
+	return nil
+}
+
+func (self *Stream) subscribe() chan []byte {
+	client := make(chan []byte, streamBacklog)
+	self.mu.Lock()
+	self.clients[client] = struct{}{}
+	self.mu.Unlock()
+	return client
+}
+
+func (self *Stream) unsubscribe(client chan []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.clients[client]; ok {
+		delete(self.clients, client)
+		close(client)
+	}
+}
+
+/*
+	handler streaming the events to a client until it goes away, each
+	as a "window" event with the json of a WindowEvent as its data
+*/
+func (self *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client := self.subscribe()
+	defer self.unsubscribe(client)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case data, ok := <-client:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: window\ndata: %s\n\n", data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
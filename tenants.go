@@ -0,0 +1,119 @@
+/*
+	Description:
+		Splits the local hosts between the customers of a shared sensor
+		by the networks each of them was handed, so that one pass yields
+		the totals and the top talkers of every tenant
+*/
+
+package qreader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// the loaded tenant networks, nil when -tenants isn't given
+var Tenants *Tenancy
+
+type tenantEntry struct {
+	network netip.Prefix
+	name    string
+}
+
+type Tenancy struct {
+	entries []tenantEntry
+}
+
+/*
+	function to load a tenants file with the columns
+		name,network[,network...]
+	where the networks are addresses or cidrs. A tenant may be spread
+	over several rows. Lines starting with # and a header row are ignored
+*/
+func LoadTenants(filename string) (*Tenancy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	tenancy := &Tenancy{}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		name := strings.TrimSpace(record[0])
+		if len(record) < 2 || name == "" {
+			return nil, fmt.Errorf("%v:%d: expected name,network", filename, line)
+		}
+
+		for i, s := range record[1:] {
+			network, err := parseNetwork(s)
+			if err != nil {
+				if row == 1 && i == 0 {
+					break
+				}
+				return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+			}
+			tenancy.entries = append(tenancy.entries, tenantEntry{network, name})
+		}
+	}
+
+	// most specific networks first so that a customer sub-allocated out
+	// of another's block is found first
+	sort.SliceStable(tenancy.entries, func(i, j int) bool {
+		return tenancy.entries[i].network.Bits() > tenancy.entries[j].network.Bits()
+	})
+	return tenancy, nil
+}
+
+/*
+	function to find the tenant of the most specific network containing
+	the given address
+*/
+func (self *Tenancy) Lookup(s string) (string, bool) {
+	ip, err := parseHost(s)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range self.entries {
+		if entry.network.Contains(ip) {
+			return entry.name, true
+		}
+	}
+	return "", false
+}
+
+/*
+	function to split the host totals of a result by tenant, with the
+	hosts no tenant owns under Unassigned
+*/
+func (self *Tenancy) Split(hosts map[string]int64) map[string]map[string]int64 {
+	tenants := make(map[string]map[string]int64)
+	for ip, bytecount := range hosts {
+		name, ok := self.Lookup(ip)
+		if !ok {
+			name = Unassigned
+		}
+		if tenants[name] == nil {
+			tenants[name] = make(map[string]int64)
+		}
+		tenants[name][ip] += bytecount
+	}
+	return tenants
+}
@@ -0,0 +1,119 @@
+/*
+	Description:
+		Limits on what clients of the report server and the coordinator
+		can ask of the host: how often each may send a request, how much
+		it may upload and how many requests are worked on at once, so a
+		misbehaving client can't exhaust it
+*/
+
+package qreader
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the requests per second each client address may send, and how many
+// it may send at once after being idle. 0 for no limit
+var RequestRate float64 = 0
+var RequestBurst int = 20
+
+// the largest request body accepted, such as a worker's result
+var MaxUploadBytes int64 = 1 << 30
+
+// the most requests worked on at once, 0 for no limit. A client
+// following the result stream holds one for as long as it is connected
+var MaxConcurrent int = 0
+
+// the token bucket of one client address
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type throttle struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*bucket
+	swept   time.Time
+}
+
+/*
+	function to take a token from the bucket of a client, telling whether
+	there was one
+*/
+func (self *throttle) allow(client string, now time.Time) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// buckets that have filled up again are the same as new ones
+	if now.Sub(self.swept) > time.Minute {
+		for name, b := range self.clients {
+			if b.tokens+now.Sub(b.last).Seconds()*self.rate >= self.burst {
+				delete(self.clients, name)
+			}
+		}
+		self.swept = now
+	}
+
+	b, ok := self.clients[client]
+	if !ok {
+		b = &bucket{self.burst, now}
+		self.clients[client] = b
+	}
+	b.tokens = min(self.burst, b.tokens+now.Sub(b.last).Seconds()*self.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+/*
+	handler wrapper applying RequestRate, MaxUploadBytes and MaxConcurrent
+	to the requests of the given handler
+*/
+func Throttle(next http.Handler) http.Handler {
+	limit := &throttle{rate: RequestRate, burst: float64(max(RequestBurst, 1)), clients: make(map[string]*bucket)}
+	var slots chan struct{}
+	if MaxConcurrent > 0 {
+		slots = make(chan struct{}, MaxConcurrent)
+	}
+	upload := MaxUploadBytes
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit.rate > 0 {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			if !limit.allow(client, time.Now()) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "too many requests in progress", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if upload > 0 {
+			if r.ContentLength > upload {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, upload)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,234 @@
+/*
+	Description:
+		A local log of how fast each run read its inputs and what those
+		inputs were like, so that a slowdown after an upgrade or a move
+		to other storage shows up against the runs before it. The log is
+		viewed with
+			qreader history
+		and gives qreader plan the rates it estimates back-fills at
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the file the throughput of each run is appended to, "" to keep none
+var ThroughputLog string = DefaultThroughputLog()
+
+// how many of the latest runs of a kind the rates of plans and the
+// trend of qreader history are taken from
+var ThroughputWindow int = 10
+
+/*
+	function to find the default throughput log, throughput.jsonl in the
+	user's cache directory
+*/
+func DefaultThroughputLog() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "qreader", "throughput.jsonl")
+}
+
+// the throughput of one run. Bytes are of the inputs as they are on
+// disk, GzipBytes of those that are compressed
+type ThroughputRecord struct {
+	Time      string  `json:"time"`
+	Version   string  `json:"version"`
+	Inputs    int     `json:"inputs"`
+	Bytes     int64   `json:"bytes"`
+	GzipBytes int64   `json:"gzip_bytes"`
+	Lines     int64   `json:"lines"`
+	Format    string  `json:"format"`
+	Workers   int     `json:"workers"`
+	Unzipper  string  `json:"unzipper"`
+	Elapsed   float64 `json:"elapsed"`
+}
+
+/*
+	function to describe a run with the settings over the given inputs
+	that took elapsed
+*/
+func NewThroughputRecord(filenames []string, settings *Settings, elapsed time.Duration) ThroughputRecord {
+	lines, _ := settings.Lines.Load()
+	record := ThroughputRecord{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Version:  Version,
+		Inputs:   len(filenames),
+		Lines:    lines,
+		Format:   settings.Schema.Format.String(),
+		Workers:  Workers,
+		Unzipper: settings.Unzipper,
+		Elapsed:  elapsed.Seconds(),
+	}
+	for _, filename := range filenames {
+		if info, err := os.Stat(filename); err == nil {
+			record.Bytes += info.Size()
+			if strings.HasSuffix(filename, ".gz") {
+				record.GzipBytes += info.Size()
+			}
+		}
+	}
+	return record
+}
+
+/*
+	function to get the bytes per second a run read, 0 if it took no time
+*/
+func (self ThroughputRecord) Rate() float64 {
+	if self.Elapsed <= 0 {
+		return 0
+	}
+	return float64(self.Bytes) / self.Elapsed
+}
+
+/*
+	function to tell the kind of inputs a run read: gzip, plain or mixed
+*/
+func (self ThroughputRecord) Kind() string {
+	switch self.GzipBytes {
+	case 0:
+		return "plain"
+	case self.Bytes:
+		return "gzip"
+	}
+	return "mixed"
+}
+
+/*
+	function to append the throughput of a run to a log, creating it if
+	needed
+*/
+func AppendThroughput(filename string, record ThroughputRecord) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+	function to load the runs of a throughput log, oldest first. A missing
+	log has no runs
+*/
+func LoadThroughput(filename string) ([]ThroughputRecord, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []ThroughputRecord
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		var record ThroughputRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", filename, lineno, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+/*
+	function to find the median rate of the latest ThroughputWindow runs
+	of a kind among the given ones, 0 when there are none
+*/
+func medianRate(records []ThroughputRecord, kind string) float64 {
+	var rates []float64
+	for i := len(records) - 1; i >= 0 && len(rates) < ThroughputWindow; i-- {
+		if records[i].Kind() == kind && records[i].Rate() > 0 {
+			rates = append(rates, records[i].Rate())
+		}
+	}
+	if len(rates) == 0 {
+		return 0
+	}
+	sort.Float64s(rates)
+	return rates[len(rates)/2]
+}
+
+/*
+	function to find the rates of compressed and plain inputs from the
+	latest runs that read only one kind of them
+*/
+func ThroughputRates(records []ThroughputRecord) (float64, float64) {
+	return medianRate(records, "gzip"), medianRate(records, "plain")
+}
+
+/*
+	function to print the latest runs of a throughput log, 0 for all, each
+	with how its rate compares to the median of the runs of its kind
+	before it
+*/
+func PrintThroughput(w io.Writer, records []ThroughputRecord, last int) {
+	fmt.Fprintln(w, Heading(fmt.Sprintf("%-20v %-10v %5v %6v %10v %12v %9v %11v %8v",
+		"time", "version", "kind", "inputs", "size", "lines", "elapsed", "rate", "trend")))
+	first := 0
+	if last > 0 && len(records) > last {
+		first = len(records) - last
+	}
+	for i := first; i < len(records); i++ {
+		record := records[i]
+		trend := "-"
+		if median := medianRate(records[:i], record.Kind()); median > 0 && record.Rate() > 0 {
+			trend = fmt.Sprintf("%+.0f%%", (record.Rate()/median-1)*100)
+		}
+		elapsed := time.Duration(record.Elapsed * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%-20v %-10v %5v %6v %10v %12v %9v %9v/s %8v\n", record.Time, record.Version, record.Kind(),
+			record.Inputs, HumanBytes(record.Bytes), FormatCount(record.Lines), elapsed,
+			HumanBytes(int64(record.Rate())), trend)
+	}
+}
+
+/*
+	function to run the history command with its own options, the
+	arguments following qreader history
+*/
+func HistoryMain(args []string) {
+	flags := flag.NewFlagSet("qreader history", flag.ExitOnError)
+	var log = flags.String("throughput-log", ThroughputLog, "the log of the runs to show")
+	var last = flags.Int("n", 20, "number of the latest runs to show, 0 for all")
+	flags.Parse(args)
+
+	LogInit(false)
+	if *last < 0 {
+		Error.Fatalf("Invalid number of runs given: %d", *last)
+	}
+	records, err := LoadThroughput(*log)
+	if err != nil {
+		Error.Fatalln(err)
+	}
+	if len(records) == 0 {
+		Info.Printf("no runs have been logged to %v", *log)
+		return
+	}
+	PrintThroughput(os.Stdout, records, *last)
+}
@@ -0,0 +1,357 @@
+/*
+	Description:
+		Interactive terminal browser for the aggregation results, with
+		sortable columns, searching and a per-port drill-down for each
+		host
+*/
+
+package qreader
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//--------------------------------------------------------------------------------
+//	terminal helpers, done through stty so that no terminal library is
+//	required
+//--------------------------------------------------------------------------------
+
+func stty(tty *os.File, args ...string) (string, error) {
+	c := exec.Command("stty", args...)
+	c.Stdin = tty
+	out, err := c.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func termSize(tty *os.File) (int, int) {
+	out, err := stty(tty, "size")
+	if err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(out, &rows, &cols); err == nil && rows > 0 && cols > 0 {
+			return rows, cols
+		}
+	}
+	return 24, 80
+}
+
+//--------------------------------------------------------------------------------
+//	Browser class which holds the state of the interactive ui
+//--------------------------------------------------------------------------------
+
+type browserRow struct {
+	key   string
+	bytes int64
+	conns int64
+	ports int
+}
+
+type Browser struct {
+	result Result
+	labels *Mapping
+	tty    *os.File
+
+	// the host being drilled into, or "" for the host list
+	host   string
+	rows   []browserRow
+	total  int64
+	search string
+
+	sortcol int
+	reverse bool
+	cursor  int
+	offset  int
+
+	// state of the host list, restored when leaving a drill-down
+	saved_cursor int
+	saved_offset int
+}
+
+/*
+	function to run the browser on the controlling terminal until the
+	user quits, with the hosts labelled from the settings
+*/
+func Browse(result Result, settings *Settings) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("the tui requires a terminal: %v", err)
+	}
+	defer tty.Close()
+
+	saved, err := stty(tty, "-g")
+	if err != nil {
+		return fmt.Errorf("could not read terminal settings: %v", err)
+	}
+	if _, err := stty(tty, "raw", "-echo"); err != nil {
+		return fmt.Errorf("could not set terminal to raw mode: %v", err)
+	}
+	defer stty(tty, saved)
+
+	// switch to the alternate screen and hide the cursor
+	fmt.Fprint(tty, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(tty, "\x1b[?25h\x1b[?1049l")
+
+	b := &Browser{result: result, labels: settings.Labels, tty: tty, sortcol: 1}
+	b.Refresh()
+
+	key := make([]byte, 8)
+	for {
+		b.Draw()
+		length, err := tty.Read(key)
+		if err != nil {
+			return err
+		}
+		if !b.HandleKey(key[:length]) {
+			return nil
+		}
+	}
+}
+
+/*
+	function to rebuild the visible rows from the results using the
+	current view, search term and sort order
+*/
+func (self *Browser) Refresh() {
+	self.rows = self.rows[:0]
+	self.total = 0
+
+	if self.host == "" {
+		for ip, bytecount := range self.result.Hosts {
+			self.total += bytecount
+			if self.search != "" && !strings.Contains(ip, self.search) {
+				continue
+			}
+			self.rows = append(self.rows, browserRow{ip, bytecount, self.result.Conns[ip], len(self.result.Ports[ip])})
+		}
+	} else {
+		for port, bytecount := range self.result.Ports[self.host] {
+			self.total += bytecount
+			key := strconv.Itoa(port)
+			if self.search != "" && !strings.Contains(key, self.search) {
+				continue
+			}
+			self.rows = append(self.rows, browserRow{key: key, bytes: bytecount})
+		}
+	}
+
+	numeric := self.host != ""
+	byKey := func(a, b browserRow) bool {
+		if numeric {
+			x, _ := strconv.Atoi(a.key)
+			y, _ := strconv.Atoi(b.key)
+			return x < y
+		}
+		return a.key < b.key
+	}
+
+	// rows that tie on the sort column are in the order of their keys,
+	// so that they don't swap places between refreshes
+	less := func(i, j int) bool {
+		a, b := self.rows[i], self.rows[j]
+		switch {
+		case self.sortcol == 2 && a.conns != b.conns:
+			return a.conns > b.conns
+		case self.sortcol == 3 && a.ports != b.ports:
+			return a.ports > b.ports
+		case self.sortcol == 1 && a.bytes != b.bytes:
+			return a.bytes > b.bytes
+		}
+		return byKey(a, b)
+	}
+	sort.Slice(self.rows, func(i, j int) bool {
+		if self.reverse {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+
+	if self.cursor >= len(self.rows) {
+		self.cursor = len(self.rows) - 1
+	}
+	if self.cursor < 0 {
+		self.cursor = 0
+	}
+}
+
+func (self *Browser) columns() []string {
+	if self.host == "" {
+		return []string{"host", "bytes", "conns", "ports"}
+	}
+	return []string{"port", "bytes"}
+}
+
+/*
+	function to draw the current view to the terminal
+*/
+func (self *Browser) Draw() {
+	height, width := termSize(self.tty)
+	visible := height - 3
+	if visible < 1 {
+		visible = 1
+	}
+	if self.cursor < self.offset {
+		self.offset = self.cursor
+	}
+	if self.cursor >= self.offset+visible {
+		self.offset = self.cursor - visible + 1
+	}
+
+	var out bytes.Buffer
+	out.WriteString("\x1b[H\x1b[2J")
+
+	// title line
+	title := "qreader - all hosts"
+	if self.host != "" {
+		title = "qreader - ports of " + self.host
+		if label, ok := self.labels.Lookup(self.host); ok {
+			title += " (" + label.String() + ")"
+		}
+	}
+	if self.search != "" {
+		title += fmt.Sprintf("  [search: %v]", self.search)
+	}
+	writeLine(&out, fmt.Sprintf("%v  (%d rows)", title, len(self.rows)), width, false)
+
+	// column headers, with the sort column marked
+	var header string
+	for i, name := range self.columns() {
+		if i == self.sortcol {
+			if self.reverse {
+				name += "^"
+			} else {
+				name += "v"
+			}
+		}
+		if i == 0 {
+			header += fmt.Sprintf("%-20v", name)
+		} else {
+			header += fmt.Sprintf("%16v", name)
+		}
+	}
+	header += fmt.Sprintf("%10v", "share")
+	writeLine(&out, header, width, true)
+
+	for i := self.offset; i < len(self.rows) && i < self.offset+visible; i++ {
+		row := self.rows[i]
+		line := fmt.Sprintf("%-20v%16d", row.key, row.bytes)
+		if self.host == "" {
+			line += fmt.Sprintf("%16d%16d", row.conns, row.ports)
+		}
+		var share float64
+		if self.total > 0 {
+			share = float64(row.bytes) / float64(self.total) * 100
+		}
+		line += fmt.Sprintf("%9.4f%%", share)
+		if label, ok := self.labels.Lookup(row.key); ok && self.host == "" {
+			line += "  " + label.String()
+		}
+		writeLine(&out, line, width, i == self.cursor)
+	}
+
+	// key help on the last line
+	fmt.Fprintf(&out, "\x1b[%d;1H", height)
+	help := "q quit  j/k move  enter drill down  esc back  / search  s sort  r reverse"
+	writeLine(&out, help, width, true)
+
+	self.tty.Write(out.Bytes())
+}
+
+func writeLine(out *bytes.Buffer, line string, width int, highlight bool) {
+	if len(line) > width {
+		line = line[:width]
+	}
+	if highlight {
+		out.WriteString("\x1b[7m" + line + strings.Repeat(" ", width-len(line)) + "\x1b[0m")
+	} else {
+		out.WriteString(line)
+	}
+	out.WriteString("\r\n")
+}
+
+/*
+	function to prompt for a search term on the bottom line of the
+	screen, returning false if the prompt was cancelled
+*/
+func (self *Browser) Prompt() (string, bool) {
+	height, _ := termSize(self.tty)
+	term := ""
+	key := make([]byte, 8)
+	for {
+		fmt.Fprintf(self.tty, "\x1b[%d;1H\x1b[2K/%v", height, term)
+		length, err := self.tty.Read(key)
+		if err != nil {
+			return "", false
+		}
+		switch k := key[:length]; {
+		case k[0] == '\r' || k[0] == '\n':
+			return term, true
+		case k[0] == 0x1b || k[0] == 0x03:
+			return "", false
+		case k[0] == 0x7f || k[0] == 0x08:
+			if len(term) > 0 {
+				term = term[:len(term)-1]
+			}
+		case k[0] >= ' ' && k[0] < 0x7f:
+			term += string(k)
+		}
+	}
+}
+
+/*
+	function to apply a key press, returning false when the browser
+	should exit
+*/
+func (self *Browser) HandleKey(key []byte) bool {
+	height, _ := termSize(self.tty)
+	page := height - 3
+
+	switch string(key) {
+	case "q", "\x03":
+		return false
+	case "j", "\x1b[B":
+		self.cursor++
+	case "k", "\x1b[A":
+		self.cursor--
+	case " ", "\x1b[6~":
+		self.cursor += page
+	case "b", "\x1b[5~":
+		self.cursor -= page
+	case "g", "\x1b[H":
+		self.cursor = 0
+	case "G", "\x1b[F":
+		self.cursor = len(self.rows) - 1
+	case "s":
+		self.sortcol = (self.sortcol + 1) % len(self.columns())
+	case "r":
+		self.reverse = !self.reverse
+	case "/":
+		if term, ok := self.Prompt(); ok {
+			self.search = term
+			self.cursor = 0
+		}
+	case "\r", "\n", "l", "\x1b[C":
+		if self.host == "" && len(self.rows) > 0 {
+			self.saved_cursor, self.saved_offset = self.cursor, self.offset
+			self.host = self.rows[self.cursor].key
+			self.search, self.sortcol, self.reverse = "", 1, false
+			self.cursor, self.offset = 0, 0
+		}
+	case "\x1b", "h", "\x7f", "\x1b[D":
+		if self.host != "" {
+			self.host, self.search = "", ""
+			self.sortcol, self.reverse = 1, false
+			self.Refresh()
+			self.cursor, self.offset = self.saved_cursor, self.saved_offset
+		} else if self.search != "" {
+			self.search = ""
+		}
+	}
+
+	self.Refresh()
+	return true
+}
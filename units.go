@@ -0,0 +1,206 @@
+/*
+	Description:
+		Parsing and formatting of byte quantities
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// multipliers for the unit suffixes accepted by ParseBytes
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"pb":  1000 * 1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+}
+
+/*
+	function to parse a byte quantity such as "1500", "1.5GB" or "2 TiB",
+	where the decimal units are powers of 1000 and the binary units are
+	powers of 1024
+*/
+func ParseBytes(s string) (int64, error) {
+	text := strings.ToLower(strings.TrimSpace(s))
+	split := len(text)
+	for split > 0 && (text[split-1] < '0' || text[split-1] > '9') && text[split-1] != '.' {
+		split--
+	}
+
+	number := strings.TrimSpace(text[:split])
+	unit, ok := byteUnits[strings.TrimSpace(text[split:])]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("invalid byte quantity %q", s)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid byte quantity %q", s)
+	}
+	return int64(value * float64(unit)), nil
+}
+
+// whether HumanBytes uses the decimal units (powers of 1000) rather
+// than the binary ones (powers of 1024)
+var SIUnits bool = false
+
+/*
+	function to format a byte count with a binary unit suffix, or a
+	decimal one with SIUnits
+*/
+func HumanBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	base := 1024.0
+	if SIUnits {
+		units = []string{"B", "kB", "MB", "GB", "TB", "PB"}
+		base = 1000
+	}
+	value := float64(n)
+	unit := 0
+	for value >= base && unit < len(units)-1 {
+		value /= base
+		unit++
+	}
+	if unit == 0 {
+		return FormatNumber(float64(n), 0) + " B"
+	}
+	return FormatNumber(value, 1) + " " + units[unit]
+}
+
+//--------------------------------------------------------------------------------
+//	number formatting for the text reports
+//--------------------------------------------------------------------------------
+
+// the separators a locale writes numbers with
+type NumberLocale struct {
+	Decimal string
+	Group   string
+}
+
+// the locale the reports are written in. The default groups nothing and
+// uses a decimal point, as the reports always have
+var Numbers = NumberLocale{Decimal: "."}
+
+// separators by language, or by language and country where the
+// countries of a language differ
+var numberLocales = map[string]NumberLocale{
+	"c":     {".", ""},
+	"posix": {".", ""},
+	"en":    {".", ","},
+	"ja":    {".", ","},
+	"zh":    {".", ","},
+	"de":    {",", "."},
+	"nl":    {",", "."},
+	"it":    {",", "."},
+	"es":    {",", "."},
+	"pt":    {",", "."},
+	"da":    {",", "."},
+	"tr":    {",", "."},
+	"id":    {",", "."},
+	"fr":    {",", " "},
+	"sv":    {",", " "},
+	"nb":    {",", " "},
+	"fi":    {",", " "},
+	"pl":    {",", " "},
+	"cs":    {",", " "},
+	"ru":    {",", " "},
+	"uk":    {",", " "},
+	"de_ch": {".", "'"},
+	"it_ch": {".", "'"},
+	"fr_ch": {",", " "},
+}
+
+/*
+	function to find the number locale of a name such as "de", "de_CH"
+	or "de_CH.UTF-8"
+*/
+func ParseNumberLocale(name string) (NumberLocale, error) {
+	key := strings.ToLower(strings.Replace(name, "-", "_", -1))
+	if i := strings.IndexAny(key, ".@"); i >= 0 {
+		key = key[:i]
+	}
+	if locale, ok := numberLocales[key]; ok {
+		return locale, nil
+	}
+	if i := strings.Index(key, "_"); i >= 0 {
+		if locale, ok := numberLocales[key[:i]]; ok {
+			return locale, nil
+		}
+	}
+	return NumberLocale{}, fmt.Errorf("unknown locale %q", name)
+}
+
+/*
+	function to format a number with the given number of decimals in the
+	locale of the reports
+*/
+func FormatNumber(value float64, decimals int) string {
+	return localize(strconv.FormatFloat(value, 'f', decimals, 64))
+}
+
+/*
+	function to format a count, such as a number of bytes, in the locale
+	of the reports
+*/
+func FormatCount(n int64) string {
+	return localize(strconv.FormatInt(n, 10))
+}
+
+/*
+	function to rewrite a number formatted by strconv with the separators
+	of the report locale
+*/
+func localize(text string) string {
+	sign := ""
+	if strings.HasPrefix(text, "-") {
+		sign, text = "-", text[1:]
+	}
+	whole, fraction := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, fraction = text[:i], text[i+1:]
+	}
+
+	if Numbers.Group != "" && len(whole) > 3 {
+		var grouped strings.Builder
+		for i, digit := range whole {
+			if i > 0 && (len(whole)-i)%3 == 0 {
+				grouped.WriteString(Numbers.Group)
+			}
+			grouped.WriteRune(digit)
+		}
+		whole = grouped.String()
+	}
+	if fraction == "" {
+		return sign + whole
+	}
+	return sign + whole + Numbers.Decimal + fraction
+}
+
+/*
+	function to format a share of a total as a percentage with four
+	decimals, the way the reports show them
+*/
+func Percent(part, total int64) string {
+	return FormatNumber(float64(part)/float64(total)*100, 4) + "%"
+}
+
+/*
+	function to format a change in a byte count with an explicit sign
+*/
+func HumanDelta(n int64) string {
+	if n < 0 {
+		return "-" + HumanBytes(-n)
+	}
+	return "+" + HumanBytes(n)
+}
@@ -0,0 +1,118 @@
+/*
+	Description:
+		Times the gzip decompressors available on the machine on the
+		start of an input, so that the fastest of them can be used for
+		the rest of the run
+*/
+
+package qreader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// the Unzipper value that decompresses in process rather than through
+// an external command
+const InternalUnzipper = "internal"
+
+// the decompressors tried by the benchmark, the external ones only if
+// they are installed
+var UnzipCandidates = []string{"pigz", "gzcat", "gzip", InternalUnzipper}
+
+// how much of the compressed input each decompressor is timed on
+var UnzipBenchBytes int64 = 8 << 20
+
+// the time a decompressor took on the benchmark input
+type UnzipTiming struct {
+	Unzipper string
+	Elapsed  time.Duration
+	Err      error
+}
+
+/*
+	function to open a gzip stream with the given decompressor
+*/
+func openUnzipper(unzipper string, input io.Reader) (io.ReadCloser, error) {
+	if unzipper == InternalUnzipper {
+		zr, err := gzip.NewReader(input)
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}
+	c := exec.Command(unzipper, "-c", "-d")
+	c.Stdin = input
+	pipe, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return cmdReader{pipe, c, nil}, nil
+}
+
+/*
+	function to time how long a decompressor takes to inflate the given
+	start of a gzip file. Since the data is cut short, the decompressor
+	failing at the end of it isn't an error
+*/
+func timeUnzipper(unzipper string, head []byte) UnzipTiming {
+	timing := UnzipTiming{Unzipper: unzipper}
+	began := time.Now()
+	r, err := openUnzipper(unzipper, bytes.NewReader(head))
+	if err != nil {
+		timing.Err = err
+		return timing
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	r.Close()
+	timing.Elapsed = time.Since(began)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		timing.Err = err
+	} else if n == 0 {
+		timing.Err = fmt.Errorf("%v produced no output", unzipper)
+	}
+	return timing
+}
+
+/*
+	function to time the installed decompressors on the first
+	UnzipBenchBytes of the given gzip file, returning the fastest along
+	with all the timings
+*/
+func BenchmarkUnzippers(filename string) (string, []UnzipTiming, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(file, UnzipBenchBytes))
+	file.Close()
+	if err != nil {
+		return "", nil, err
+	}
+
+	best := InternalUnzipper
+	var timings []UnzipTiming
+	var fastest time.Duration
+	for _, unzipper := range UnzipCandidates {
+		if unzipper != InternalUnzipper {
+			if _, err := exec.LookPath(unzipper); err != nil {
+				continue
+			}
+		}
+		timing := timeUnzipper(unzipper, head)
+		timings = append(timings, timing)
+		if timing.Err == nil && (fastest == 0 || timing.Elapsed < fastest) {
+			best, fastest = unzipper, timing.Elapsed
+		}
+	}
+	return best, timings, nil
+}
@@ -0,0 +1,134 @@
+/*
+	Description:
+		Attributes local traffic to the users that held an address at the
+		time, from a session file exported from RADIUS or VPN accounting
+		logs, so that the top talkers can be reported by user rather than
+		by an address that changes hands
+*/
+
+package qreader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// key of the local traffic no session covers
+const UnknownUser = "-"
+
+// the loaded sessions, nil when -users isn't given
+var Users *UserMap
+
+// a user holding an address from start up to but not including end
+type userSession struct {
+	user  string
+	start float64
+	end   float64
+}
+
+type UserMap struct {
+	// the sessions of each address, sorted by start
+	sessions map[netip.Addr][]userSession
+}
+
+/*
+	function to parse a session time, either in unix seconds or in
+	RFC3339. An empty end stands for a session that is still open
+*/
+func parseSessionTime(s string, open float64) (float64, error) {
+	if s == "" {
+		return open, nil
+	}
+	if ts, err := strconv.ParseFloat(s, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected unix seconds or RFC3339", s)
+	}
+	return float64(t.Unix()) + float64(t.Nanosecond())/1e9, nil
+}
+
+/*
+	function to load a session file with the columns
+		ip,user,start,end
+	where the times are unix seconds or RFC3339 and an empty end leaves
+	the session open. Lines starting with # and a header row are ignored
+*/
+func LoadUsers(filename string) (*UserMap, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	users := &UserMap{sessions: make(map[netip.Addr][]userSession)}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != 4 {
+			return nil, fmt.Errorf("%v:%d: expected ip,user,start,end", filename, line)
+		}
+
+		ip, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			if row == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		session := userSession{user: strings.TrimSpace(record[1])}
+		if session.user == "" {
+			return nil, fmt.Errorf("%v:%d: empty user", filename, line)
+		}
+		if session.start, err = parseSessionTime(strings.TrimSpace(record[2]), math.Inf(-1)); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		if session.end, err = parseSessionTime(strings.TrimSpace(record[3]), math.Inf(1)); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", filename, line, err)
+		}
+		if session.end < session.start {
+			return nil, fmt.Errorf("%v:%d: session ends before it starts", filename, line)
+		}
+		ip = ip.Unmap()
+		users.sessions[ip] = append(users.sessions[ip], session)
+	}
+	for _, sessions := range users.sessions {
+		sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].start < sessions[j].start })
+	}
+	return users, nil
+}
+
+/*
+	function to find the user holding an address at the given time. When
+	sessions overlap the one that started last wins, since accounting
+	logs often miss the stop of a session
+*/
+func (self *UserMap) Lookup(ip netip.Addr, ts float64) (string, bool) {
+	sessions := self.sessions[ip.Unmap()]
+	i := sort.Search(len(sessions), func(i int) bool { return sessions[i].start > ts })
+	for i--; i >= 0; i-- {
+		if ts < sessions[i].end {
+			return sessions[i].user, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,123 @@
+/*
+	Description:
+		Problems with the inputs that don't stop a run, such as lines that
+		can't be parsed or a compressed input that ends early. They are
+		passed around as values, so that a program running a Pipeline can
+		handle them itself instead of having them logged
+*/
+
+package qreader
+
+import (
+	"fmt"
+)
+
+// what went wrong with an input
+type WarningKind int
+
+const (
+	// a line that could not be parsed and was skipped
+	MalformedLine WarningKind = iota
+
+	// an input that ended before its compressed stream did
+	TruncatedInput
+
+	// a column of the inputs that isn't known and is ignored
+	UnknownField
+
+	// an input whose data overlaps an input read before it
+	OverlappingInput
+
+	// an input that was still being written when it was read
+	InProgressInput
+)
+
+func (self WarningKind) String() string {
+	switch self {
+	case MalformedLine:
+		return "malformed line"
+	case TruncatedInput:
+		return "truncated input"
+	case UnknownField:
+		return "unknown field"
+	case OverlappingInput:
+		return "overlapping input"
+	case InProgressInput:
+		return "input still being written"
+	}
+	return fmt.Sprintf("warning %d", int(self))
+}
+
+// a problem with an input. Line is 0 for problems with the input as a
+// whole, and Text holds the line or the name of the field it is about
+type InputWarning struct {
+	Kind WarningKind
+	File string
+	Line int
+	Text string
+	Err  error
+}
+
+func (self InputWarning) String() string {
+	s := self.Kind.String()
+	if self.Line > 0 {
+		s = fmt.Sprintf("%v:%d: %v", self.File, self.Line, s)
+	} else if self.File != "" {
+		s = fmt.Sprintf("%v: %v", self.File, s)
+	}
+	if self.Err != nil {
+		s += ": " + self.Err.Error()
+	}
+	if self.Text != "" {
+		s += ": " + self.Text
+	}
+	return s
+}
+
+/*
+	function to handle a warning when no one asked for them: malformed
+	lines are skipped, since there is no reject log to record them in,
+	and the rest go to the Warning log
+*/
+func LogWarning(warning InputWarning) {
+	logWarning(warning, nil)
+}
+
+/*
+	function to handle a warning of a run with the settings: malformed
+	lines go to their Rejects if it is set, and the rest to the Warning
+	log
+*/
+func (self *Settings) Warn(warning InputWarning) {
+	logWarning(warning, self.Rejects)
+}
+
+/*
+	function to handle a warning with malformed lines going to the given
+	reject log, if there is one
+*/
+func logWarning(warning InputWarning, rejects *RejectLog) {
+	switch warning.Kind {
+	case MalformedLine:
+		if rejects != nil {
+			rejects.Add(warning.File, warning.Line, []byte(warning.Text), warning.Err)
+		}
+	case UnknownField:
+		Debug.Println(warning)
+	default:
+		Warning.Println(warning)
+	}
+}
+
+/*
+	function to report a problem with the block's input, to the pipeline
+	that read it or else to LogWarning. Parse functions passed to
+	Pipeline.Parser report the lines they skip through it
+*/
+func (self Block) Warn(warning InputWarning) {
+	if self.warn != nil {
+		self.warn(warning)
+		return
+	}
+	LogWarning(warning)
+}
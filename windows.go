@@ -0,0 +1,149 @@
+/*
+	Description:
+		Keeps the result of every time window reported while replaying,
+		in a directory of state files named by the start of the window,
+		so that past windows can still be queried through the report
+		server once the replay has moved on
+*/
+
+package qreader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WindowStore struct {
+	mu  sync.Mutex
+	dir string
+
+	// how long windows are kept, counted back from the newest window
+	// since replayed data is usually older than the clock. 0 keeps them
+	// all
+	retain time.Duration
+}
+
+// a stored window with its totals
+type WindowInfo struct {
+	Start int64 `json:"start"`
+	Bytes int64 `json:"bytes"`
+	Hosts int   `json:"hosts"`
+}
+
+/*
+	function to open a window store in the given directory, creating it
+	if needed
+*/
+func OpenWindowStore(dir string, retain time.Duration) (*WindowStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &WindowStore{dir: dir, retain: retain}, nil
+}
+
+func (self *WindowStore) path(start int64) string {
+	return filepath.Join(self.dir, strconv.FormatInt(start, 10)+".json")
+}
+
+/*
+	function to list the starts of the stored windows, oldest first
+*/
+func (self *WindowStore) starts() ([]int64, error) {
+	entries, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return nil, err
+	}
+	var starts []int64
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || name == entry.Name() {
+			continue
+		}
+		if start, err := strconv.ParseInt(name, 10, 64); err == nil {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts, nil
+}
+
+/*
+	function to store the result of a window, replacing any earlier copy
+	of it, and drop the windows that have fallen out of the retention
+*/
+func (self *WindowStore) Put(start int64, result Result) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if err := writeState(self.path(start), result); err != nil {
+		return err
+	}
+	if self.retain <= 0 {
+		return nil
+	}
+
+	starts, err := self.starts()
+	if err != nil {
+		return err
+	}
+	oldest := starts[len(starts)-1] - int64(self.retain/time.Second)
+	for _, s := range starts {
+		if s >= oldest {
+			break
+		}
+		if err := os.Remove(self.path(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	function to read back the result of the window starting at start
+*/
+func (self *WindowStore) Get(start int64) (Result, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, err := os.Stat(self.path(start)); err != nil {
+		return Result{}, fmt.Errorf("no window starts at %d", start)
+	}
+	return LoadState(self.path(start))
+}
+
+/*
+	function to list the stored windows starting from "from" up to but
+	not including "to", where a "to" of 0 has no upper bound
+*/
+func (self *WindowStore) List(from, to int64) ([]WindowInfo, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	starts, err := self.starts()
+	if err != nil {
+		return nil, err
+	}
+	windows := []WindowInfo{}
+	for _, start := range starts {
+		if start < from || (to != 0 && start >= to) {
+			continue
+		}
+		result, err := LoadState(self.path(start))
+		if err != nil {
+			return nil, err
+		}
+		info := WindowInfo{Start: start, Hosts: len(result.Hosts)}
+		for _, v := range result.Hosts {
+			info.Bytes += v
+		}
+		windows = append(windows, info)
+	}
+	return windows, nil
+}
@@ -0,0 +1,131 @@
+/*
+	Description:
+		Reading of the zeek logs other than conn.log that runs are joined
+		with, such as dns.log and http.log, in either of the layouts zeek
+		writes: tab separated with a #fields header, or json
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	function to parse the time of a zeek log line, unix seconds or the
+	ISO 8601 zeek writes with its json timestamps option
+*/
+func zeekTime(s string) (float64, error) {
+	if ts, err := strconv.ParseFloat(s, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ts %q", s)
+	}
+	return float64(t.UnixNano()) / 1e9, nil
+}
+
+/*
+	function to convert a json value of a zeek log to the text it has in
+	the tab separated layout, with the items of arrays joined by commas
+*/
+func zeekValue(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err == nil {
+		values := make([]string, len(items))
+		for i, item := range items {
+			values[i] = zeekValue(item)
+		}
+		return strings.Join(values, ",")
+	}
+	return string(raw)
+}
+
+/*
+	function to read the lines of a zeek log, passing record the values
+	of the given columns of each one. A column may be given as
+	alternatives, such as host|server_name, of which the first the log
+	has is read. Unset values are passed as ""
+*/
+func readZeekLog(r *bufio.Reader, names []string, record func(values []string) error) error {
+	var columns []int
+	values := make([]string, len(names))
+	for lineno := 1; ; lineno++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '{':
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal(line, &object); err != nil {
+				return fmt.Errorf("line %d: %v", lineno, err)
+			}
+			for i, name := range names {
+				values[i] = ""
+				for _, key := range strings.Split(name, "|") {
+					if raw, ok := object[key]; ok {
+						values[i] = zeekValue(raw)
+						break
+					}
+				}
+			}
+		case bytes.HasPrefix(line, []byte("#fields\t")):
+			fields := strings.Split(string(line), "\t")[1:]
+			columns = make([]int, len(names))
+			for i, name := range names {
+				columns[i] = -1
+				for _, key := range strings.Split(name, "|") {
+					for j, field := range fields {
+						if field == key && columns[i] < 0 {
+							columns[i] = j
+						}
+					}
+				}
+				if columns[i] < 0 {
+					return fmt.Errorf("line %d: the log has no %v column", lineno, name)
+				}
+			}
+			continue
+		case line[0] == '#':
+			continue
+		case columns == nil:
+			return fmt.Errorf("line %d: expected json or a #fields header", lineno)
+		default:
+			fields := strings.Split(string(line), "\t")
+			for i, column := range columns {
+				if column >= len(fields) {
+					return fmt.Errorf("line %d: expected at least %d fields, got %d", lineno, column+1, len(fields))
+				}
+				values[i] = fields[column]
+			}
+		}
+
+		for i, value := range values {
+			if value == "-" || value == "(empty)" {
+				values[i] = ""
+			}
+		}
+		if err := record(values); err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+}
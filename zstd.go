@@ -0,0 +1,120 @@
+/*
+	Description:
+		Zstd compression of the files qreader writes for itself and for
+		later runs, state files, full dumps and error logs, which grow
+		large for aggregations with many keys. The compression is done
+		by the zstd command when it is installed, and the files are
+		recognized by their magic number when read back, so uncompressed
+		ones keep working
+*/
+
+package qreader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// whether state files, dumps and error logs are compressed
+var CompressOutputs bool = true
+
+// the command the outputs are compressed and decompressed with
+var Zstd string = "zstd"
+
+// whether the zstd command is installed, see ZstdInstalled
+var zstdFound struct {
+	once sync.Once
+	ok   bool
+}
+
+/*
+	function to check whether the zstd command is installed, without
+	which the outputs are written uncompressed
+*/
+func ZstdInstalled() bool {
+	zstdFound.once.Do(func() {
+		_, err := exec.LookPath(Zstd)
+		zstdFound.ok = err == nil
+	})
+	return zstdFound.ok
+}
+
+// the leading bytes of a zstd frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// an output being compressed by the zstd command on its way to w
+type zstdWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (self zstdWriter) Close() error {
+	self.WriteCloser.Close()
+	if err := self.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v failed: %v: %v", Zstd, err, strings.TrimSpace(self.stderr.String()))
+	}
+	return nil
+}
+
+/*
+	function to start compressing what is written to an output, unless
+	CompressOutputs is off or zstd isn't installed. Closing the writer
+	finishes the compressed data but leaves w open
+*/
+func compressOutput(w io.Writer) (io.WriteCloser, error) {
+	if !CompressOutputs || !ZstdInstalled() {
+		return nopWriteCloser{w}, nil
+	}
+	c := exec.Command(Zstd, "-q", "-c")
+	c.Stdout = w
+	stderr := &bytes.Buffer{}
+	c.Stderr = stderr
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return zstdWriter{stdin, c, stderr}, nil
+}
+
+type fileReader struct {
+	io.Reader
+	io.Closer
+}
+
+/*
+	function to open a file written by qreader, decompressing it if it
+	was compressed
+*/
+func openOutput(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(file)
+	if head, _ := br.Peek(len(zstdMagic)); !bytes.Equal(head, zstdMagic) {
+		return fileReader{br, file}, nil
+	}
+
+	c := exec.Command(Zstd, "-d", "-q", "-c")
+	c.Stdin = br
+	pipe, err := c.StdoutPipe()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%v is zstd compressed: %v", filename, err)
+	}
+	return cmdReader{pipe, c, file}, nil
+}